@@ -1,99 +1,34 @@
+// Command CentralServer runs the central server of the cluster with the
+// settings of the FDS_* environment variables, see package server.
 package main
 
 import (
-	"fmt"
-	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/redis/go-redis/v9"
+	"FDS/cluster/server"
+	"context"
 	"go.uber.org/zap"
-	"log"
-	"net/http"
-	"sync"
-	"time"
+	"os/signal"
+	"syscall"
 )
 
-const serverPort = 8000
-
-const maxNodeSize = 128 * MB
-
-const MB = 1024 * 1024
-
-var httpRequestsTotal = prometheus.NewCounterVec(
-	prometheus.CounterOpts{
-		Name: "http_requests_total",
-		Help: "Total number of HTTP requests received, labeled by method and path.",
-	},
-	[]string{"method", "path"},
-)
-
-type FileBlock struct {
-	bytes    []byte
-	position int
-}
-
-type NodeRegistrationRequest struct {
-	Url string `json:"Url"`
-}
-
-type clients struct {
-	httpClient  http.Client
-	redisClient *redis.Client
-	mutex       *sync.Mutex
-	nodeManager *nodeManager
-	fileManager *fileManager
-}
-
-func newHttpClient() http.Client {
-	return http.Client{Timeout: time.Duration(5) * time.Second}
-}
-
-func newRedisClient() *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-		Protocol: 2,
-	})
-}
-
-var logger *zap.Logger
-
 func main() {
-	logger, _ = zap.NewProduction()
-	httpClient := newHttpClient()
-	redisClient := newRedisClient()
-	mutex := &sync.Mutex{}
-
-	prometheus.MustRegister(httpRequestsTotal)
-	prometheus.MustRegister(blockTransmissedByNode)
-
-	nodeManagerClient := &nodeManager{httpClient: &httpClient, mutex: mutex, redisClient: redisClient}
-	redisManagerClient := &RedisManager{redisClient: redisClient}
-	fileManagerClient := &fileManager{nodeManager: nodeManagerClient, redisManager: redisManagerClient, httpClient: &httpClient, mutex: mutex}
-	clients := &clients{httpClient: httpClient, redisClient: redisClient, mutex: mutex, nodeManager: nodeManagerClient, fileManager: fileManagerClient}
-
-	routerHttp := clients.SetupRouter()
-
-	err := http.ListenAndServe(fmt.Sprintf(":%d", serverPort), routerHttp)
+	logger, _ := zap.NewProduction()
 
+	cfg, err := server.LoadConfig()
 	if err != nil {
-		log.Fatalf(err.Error())
+		logger.Fatal("Invalid configuration", zap.Error(err))
 	}
-}
-
-func (c *clients) SetupRouter() *mux.Router {
-	routerHttp := mux.NewRouter()
 
-	routerHttp.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
-		httpRequestsTotal.WithLabelValues(request.Method, request.URL.Path).Inc()
-		w.Write([]byte("Hello, Prometheus!"))
-	})
-	routerHttp.Handle("/metrics", promhttp.Handler())
-	routerHttp.HandleFunc("/sendFile", c.fileManager.UploadFileAndDistributeBlocks).Methods("POST")
-	routerHttp.HandleFunc("/nodesUsage", c.nodeManager.GetNodeUsage).Methods("GET")
-	routerHttp.HandleFunc("/retrieveFile", c.fileManager.DownloadFile).Methods("GET")
-	routerHttp.HandleFunc("/addNode", c.nodeManager.VerifyAndRegisterNode).Methods("POST")
+	s, err := server.New(cfg)
+	if err != nil {
+		logger.Fatal("Failed to start the central server", zap.Error(err))
+	}
 
-	return routerHttp
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := s.Start(ctx); err != nil {
+		logger.Fatal("Failed to start the central server", zap.Error(err))
+	}
+	if err := s.Wait(); err != nil {
+		logger.Fatal("Central server stopped", zap.Error(err))
+	}
 }
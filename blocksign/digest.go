@@ -0,0 +1,116 @@
+package blocksign
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// Standard digest headers describing the content of a block, for peers that
+// do not know X-Block-SHA256: Content-Digest (RFC 9530) and Content-MD5
+// (RFC 1864). They describe the block itself, not the framing it travels in:
+// on /receiveFile they are headers of the file part, over gRPC they are
+// request metadata.
+const (
+	ContentDigestHeader = "Content-Digest"
+	ContentMD5Header    = "Content-MD5"
+)
+
+var (
+	ErrMalformedDigest = errors.New("malformed block digest")
+	ErrDigestMismatch  = errors.New("block content does not match its digest")
+)
+
+// digestAlgorithms are the Content-Digest algorithms a node checks. Others
+// are ignored, as RFC 9530 allows.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// SetDigests describes data in header with Content-Digest and Content-MD5.
+// sum is the SHA-256 of data, which the caller has already computed.
+func SetDigests(header http.Header, sum []byte, data []byte) {
+	header.Set(ContentDigestHeader, "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	md5Sum := md5.Sum(data)
+	header.Set(ContentMD5Header, base64.StdEncoding.EncodeToString(md5Sum[:]))
+}
+
+// Digests checks the content written to it against the digests of a
+// header.
+type Digests struct {
+	expected map[string][]byte
+	hashes   map[string]hash.Hash
+}
+
+// ParseDigests reads the Content-Digest and Content-MD5 of header. A header
+// without either gives Digests that accept any content.
+func ParseDigests(header http.Header) (*Digests, error) {
+	d := &Digests{expected: map[string][]byte{}, hashes: map[string]hash.Hash{}}
+
+	if value := header.Get(ContentMD5Header); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(sum) != md5.Size {
+			return nil, ErrMalformedDigest
+		}
+		d.add("md5", md5.New(), sum)
+	}
+
+	for _, value := range header.Values(ContentDigestHeader) {
+		for _, member := range strings.Split(value, ",") {
+			algorithm, encoded, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if !ok {
+				return nil, ErrMalformedDigest
+			}
+			// Parameters, which RFC 9530 defines none of, are ignored.
+			encoded, _, _ = strings.Cut(encoded, ";")
+			if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+				return nil, ErrMalformedDigest
+			}
+			sum, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+			if err != nil {
+				return nil, ErrMalformedDigest
+			}
+			newHash, known := digestAlgorithms[strings.ToLower(algorithm)]
+			if !known {
+				continue
+			}
+			h := newHash()
+			if len(sum) != h.Size() {
+				return nil, ErrMalformedDigest
+			}
+			d.add(strings.ToLower(algorithm), h, sum)
+		}
+	}
+	return d, nil
+}
+
+func (d *Digests) add(algorithm string, h hash.Hash, sum []byte) {
+	d.expected[algorithm] = sum
+	d.hashes[algorithm] = h
+}
+
+// Write hashes p with every algorithm given.
+func (d *Digests) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Check returns ErrDigestMismatch when the content written does not match
+// one of the digests.
+func (d *Digests) Check() error {
+	for algorithm, h := range d.hashes {
+		if !bytes.Equal(h.Sum(nil), d.expected[algorithm]) {
+			return ErrDigestMismatch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Package client is a Go client for the central server's HTTP API.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+// FileInfo mirrors the metadata the central server keeps for every file.
+type FileInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Blocks    int       `json:"blocks"`
+	BlockSize int       `json:"block_size"`
+	CreatedAt time.Time `json:"created_at"`
+	// Version goes up with every write of the file.
+	Version int64 `json:"version"`
+	// ReadCount and LastAccessed are only set by Stat and List.
+	ReadCount    int64      `json:"read_count"`
+	LastAccessed *time.Time `json:"last_accessed"`
+}
+
+// apiVersion is the version of the central server API the client speaks.
+const apiVersion = "/v1"
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// New returns a client for the central server at baseURL, e.g.
+// "http://localhost:8000". Idempotent requests are retried with
+// DefaultRetryPolicy.
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + apiVersion,
+		httpClient: &http.Client{},
+		retry:      DefaultRetryPolicy,
+	}
+}
+
+// send sends the request newRequest builds, again for each retry, and
+// returns the response when its status is one of ok. The caller closes its
+// body.
+func (c *Client) send(ctx context.Context, newRequest func() (*http.Request, error), ok ...int) (*http.Response, error) {
+	var response *http.Response
+	err := c.retry.do(ctx, func() error {
+		var err error
+		response, err = c.sendOnce(ctx, newRequest, ok...)
+		return err
+	})
+	return response, err
+}
+
+// sendOnce sends the request newRequest builds without retrying, for the
+// callers that retry more than the request, such as reading its answer.
+func (c *Client) sendOnce(ctx context.Context, newRequest func() (*http.Request, error), ok ...int) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, finalError{err}
+	}
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(ok, res.StatusCode) {
+		defer res.Body.Close()
+		return nil, responseError(res)
+	}
+	return res, nil
+}
+
+// getJSON decodes the answer of a GET of path into out. The request and the
+// reading of its answer are retried together.
+func (c *Client) getJSON(ctx context.Context, path string, out any) error {
+	return c.retry.do(ctx, func() error {
+		res, err := c.sendOnce(ctx, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+		}, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return json.NewDecoder(res.Body).Decode(out)
+	})
+}
+
+func (c *Client) List() ([]FileInfo, error) {
+	var files []FileInfo
+	err := c.getJSON(context.Background(), "/files", &files)
+	return files, err
+}
+
+func (c *Client) Stat(name string) (FileInfo, error) {
+	var info FileInfo
+	err := c.getJSON(context.Background(), "/files/"+url.PathEscape(name), &info)
+	return info, err
+}
+
+// ErrFileChanged is returned by Download when the file is overwritten while
+// a download interrupted by an error is resumed.
+var ErrFileChanged = errors.New("file changed during the download")
+
+// Download writes the file to w as it streams from the server, without
+// buffering it. A download interrupted by a network error is resumed where
+// it stopped, as long as the file did not change meanwhile.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) error {
+	var written int64
+	var etag string
+	return c.retry.do(ctx, func() error {
+		res, err := c.sendOnce(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodGet, c.baseURL+"/retrieveFile?fileName="+url.QueryEscape(name), nil)
+			if err == nil && written > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			}
+			return req, err
+		}, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			if written > 0 {
+				// The previous attempt got the whole file.
+				return nil
+			}
+			return finalError{responseError(res)}
+		}
+		if etag == "" {
+			etag = res.Header.Get("ETag")
+		} else if res.Header.Get("ETag") != etag {
+			return finalError{ErrFileChanged}
+		}
+		if res.StatusCode == http.StatusOK && written > 0 {
+			return finalError{fmt.Errorf("server cannot resume the download at byte %d", written)}
+		}
+
+		n, err := io.Copy(writerFunc(func(p []byte) (int, error) {
+			n, err := w.Write(p)
+			if err != nil {
+				err = finalError{err}
+			}
+			return n, err
+		}), res.Body)
+		written += n
+		return err
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// DownloadFrom streams the file starting at offset. Reading past the end of
+// the file yields an empty stream. The caller must close the returned reader.
+func (c *Client) DownloadFrom(name string, offset int64) (io.ReadCloser, error) {
+	res, err := c.send(context.Background(), func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, c.baseURL+"/retrieveFile?fileName="+url.QueryEscape(name), nil)
+		if err == nil && offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		return req, err
+	}, http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		res.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return res.Body, nil
+}
+
+// Upload stores content under name, replacing any existing file. The body is
+// streamed to the server without being buffered on the client side. Content
+// that is an io.Seeker is sent again from where it started when the upload
+// fails with an error worth retrying; other content is sent once.
+func (c *Client) Upload(ctx context.Context, name string, content io.Reader) error {
+	seeker, rewindable := content.(io.Seeker)
+	var start int64
+	if rewindable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			rewindable = false
+		}
+	}
+
+	policy := c.retry
+	if !rewindable {
+		policy.Attempts = 1
+	}
+	attempt := 0
+	return policy.do(ctx, func() error {
+		if attempt++; attempt > 1 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return finalError{err}
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.baseURL+"/files/"+url.PathEscape(name), io.NopCloser(content))
+		if err != nil {
+			return finalError{err}
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+
+		res, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+			return responseError(res)
+		}
+		return nil
+	})
+}
+
+func (c *Client) Delete(name string) error {
+	res, err := c.send(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, c.baseURL+"/files/"+url.PathEscape(name), nil)
+	}, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
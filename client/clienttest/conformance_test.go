@@ -0,0 +1,170 @@
+package clienttest_test
+
+import (
+	"FDS/client"
+	"FDS/client/clienttest"
+	"FDS/cluster/clustertest"
+	"FDS/cluster/server"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+)
+
+// outcome is what a sequence of client calls saw, compared between the fake
+// and a real cluster.
+type outcome struct {
+	Names       []string
+	Sizes       map[string]int64
+	Contents    map[string][]byte
+	Tail        []byte
+	PastEnd     []byte
+	Parallel    []byte
+	Synced      []byte
+	SyncedSize  int64
+	MissingStat string
+	MissingGet  string
+	Deleted     []string
+}
+
+// errorCode returns the code of a central server error, or the error text
+// for other errors.
+func errorCode(err error) string {
+	var serverErr *client.Error
+	if errors.As(err, &serverErr) {
+		return serverErr.Code
+	}
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func exercise(t *testing.T, c *client.Client) outcome {
+	t.Helper()
+	ctx := context.Background()
+	rng := rand.NewChaCha8([32]byte{})
+	small := []byte("hello, world\n")
+	large := make([]byte, 200<<10)
+	_, _ = rng.Read(large)
+
+	out := outcome{Sizes: map[string]int64{}, Contents: map[string][]byte{}}
+	for name, content := range map[string][]byte{"small.txt": small, "large.bin": large} {
+		if err := c.Upload(ctx, name, bytes.NewReader(content)); err != nil {
+			t.Fatalf("Upload %s: %v", name, err)
+		}
+	}
+	if err := c.UploadParts(ctx, "parts.bin", bytes.NewReader(large), int64(len(large)), 64<<10); err != nil {
+		t.Fatalf("UploadParts: %v", err)
+	}
+
+	files, err := c.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	for _, file := range files {
+		out.Names = append(out.Names, file.Name)
+		info, err := c.Stat(file.Name)
+		if err != nil {
+			t.Fatalf("Stat %s: %v", file.Name, err)
+		}
+		out.Sizes[file.Name] = info.Size
+
+		var content bytes.Buffer
+		if err := c.Download(ctx, file.Name, &content); err != nil {
+			t.Fatalf("Download %s: %v", file.Name, err)
+		}
+		out.Contents[file.Name] = content.Bytes()
+	}
+
+	for offset, dst := range map[int64]*[]byte{100000: &out.Tail, 1 << 30: &out.PastEnd} {
+		body, err := c.DownloadFrom("large.bin", offset)
+		if err != nil {
+			t.Fatalf("DownloadFrom %d: %v", offset, err)
+		}
+		*dst, err = io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("DownloadFrom %d: %v", offset, err)
+		}
+	}
+
+	var parallel bytes.Buffer
+	if err := c.DownloadParallel(ctx, "large.bin", &parallel, 3); err != nil {
+		t.Fatalf("DownloadParallel: %v", err)
+	}
+	out.Parallel = parallel.Bytes()
+
+	changed := bytes.Clone(large)
+	copy(changed[150000:], "changed")
+	info, err := c.Sync("large.bin", changed)
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	out.SyncedSize = info.Size
+	var synced bytes.Buffer
+	if err := c.Download(ctx, "large.bin", &synced); err != nil {
+		t.Fatalf("Download after Sync: %v", err)
+	}
+	out.Synced = synced.Bytes()
+
+	_, err = c.Stat("missing.bin")
+	out.MissingStat = errorCode(err)
+	err = c.Download(ctx, "missing.bin", io.Discard)
+	out.MissingGet = errorCode(err)
+
+	if err := c.Delete("small.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	files, err = c.List()
+	if err != nil {
+		t.Fatalf("List after Delete: %v", err)
+	}
+	for _, file := range files {
+		out.Deleted = append(out.Deleted, file.Name)
+	}
+	return out
+}
+
+// TestConformance runs the same client calls against the fake and against
+// a real cluster, so the fake keeps answering like the central server.
+func TestConformance(t *testing.T) {
+	fake := clienttest.NewServer()
+	defer fake.Close()
+	want := exercise(t, fake.Client())
+
+	cluster := clustertest.Start(t, clustertest.Options{
+		Server: func(cfg *server.Config) {
+			cfg.DirectDownloads = "plan"
+		},
+	})
+	got := exercise(t, cluster.Client())
+
+	gotValue, wantValue := reflect.ValueOf(got), reflect.ValueOf(want)
+	for i := range gotValue.NumField() {
+		if !reflect.DeepEqual(gotValue.Field(i).Interface(), wantValue.Field(i).Interface()) {
+			t.Errorf("%s: the cluster gave %v, the fake %v", gotValue.Type().Field(i).Name, summarize(gotValue.Field(i).Interface()), summarize(wantValue.Field(i).Interface()))
+		}
+	}
+}
+
+// summarize shortens contents in failure messages.
+func summarize(v any) any {
+	switch v := v.(type) {
+	case []byte:
+		if len(v) > 32 {
+			return len(v)
+		}
+		return string(v)
+	case map[string][]byte:
+		sizes := make(map[string]int, len(v))
+		for name, content := range v {
+			sizes[name] = len(content)
+		}
+		return sizes
+	}
+	return v
+}
@@ -0,0 +1,117 @@
+package clienttest
+
+import (
+	"FDS/client"
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// upload is a multipart upload in progress: its parts, by number.
+type upload struct {
+	name  string
+	parts map[int][]byte
+}
+
+// lookupUpload returns the upload of the request, answering 404 when there
+// is none for its file. The caller holds s.mutex.
+func (s *Server) lookupUpload(w http.ResponseWriter, r *http.Request) (*upload, bool) {
+	vars := mux.Vars(r)
+	u, ok := s.uploads[vars["id"]]
+	if !ok || u.name != vars["name"] {
+		respondError(w, http.StatusNotFound, client.CodeUploadNotFound, "Multipart upload not found", map[string]any{"upload_id": vars["id"]})
+		return nil, false
+	}
+	return u, true
+}
+
+func (s *Server) initiateUpload(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	s.mutex.Lock()
+	s.nextUpload++
+	id := strconv.Itoa(s.nextUpload)
+	s.uploads[id] = &upload{name: name, parts: make(map[int][]byte)}
+	s.mutex.Unlock()
+
+	respondJSON(w, http.StatusCreated, map[string]any{"upload_id": id, "file": name})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.Atoi(mux.Vars(r)["part"])
+	if err != nil || number < 1 {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "part must be a positive number", nil)
+		return
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "Failed to read part content", nil)
+		return
+	}
+	s.mutex.Lock()
+	u, ok := s.lookupUpload(w, r)
+	if ok {
+		u.parts[number] = content
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		respondJSON(w, http.StatusOK, map[string]any{"part": number, "size": len(content)})
+	}
+}
+
+// completeUpload stores the parts, in the order of their numbers, as the
+// file.
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	u, ok := s.lookupUpload(w, r)
+	if !ok {
+		s.mutex.Unlock()
+		return
+	}
+	if len(u.parts) == 0 {
+		s.mutex.Unlock()
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "No part was uploaded", nil)
+		return
+	}
+	numbers := make([]int, 0, len(u.parts))
+	for number := range u.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	var content bytes.Buffer
+	for _, number := range numbers {
+		content.Write(u.parts[number])
+	}
+	delete(s.uploads, mux.Vars(r)["id"])
+	f := s.store(u.name, content.Bytes())
+	info := s.info(u.name, f)
+	s.mutex.Unlock()
+
+	w.Header().Set("ETag", etag(f.version))
+	respondJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) abortUpload(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	_, ok := s.lookupUpload(w, r)
+	if ok {
+		delete(s.uploads, mux.Vars(r)["id"])
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Uploads returns the number of multipart uploads started and neither
+// completed nor aborted.
+func (s *Server) Uploads() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.uploads)
+}
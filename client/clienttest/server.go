@@ -0,0 +1,508 @@
+// Package clienttest runs an in-memory stand-in for the central server, for
+// unit tests of code using package client without Redis, nodes or a central
+// server.
+//
+//	server := clienttest.NewServer()
+//	defer server.Close()
+//	c := server.Client()
+//
+// The fake serves the endpoints the client uses, with the answers and error
+// codes of the real server: listing, stats, uploads (PUT, /sendFile and
+// multipart), downloads with ranges, deletes, signatures and deltas, and
+// manifests whose blocks it serves itself. Fail injects errors to exercise
+// retries and error handling.
+package clienttest
+
+import (
+	"FDS/client"
+	"FDS/rollsum"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// BlockSize is the size of the pieces manifests cut files into.
+const BlockSize = 64 << 10
+
+// deltaChunkSize is the chunk size of signatures when the client asks for
+// none, as on the real server.
+const deltaChunkSize = 64 << 10
+
+type file struct {
+	content   []byte
+	createdAt time.Time
+	version   int64
+	reads     int64
+	accessed  *time.Time
+}
+
+type failure struct {
+	status     int
+	code       string
+	retryAfter time.Duration
+}
+
+// Server is a fake central server keeping its files in memory. It is safe
+// for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	files    map[string]*file
+	versions map[string]int64
+	failures []failure
+	requests int
+
+	uploads    map[string]*upload
+	nextUpload int
+}
+
+// NewServer starts a fake central server with no files. Close it when done.
+func NewServer() *Server {
+	s := &Server{files: make(map[string]*file), versions: make(map[string]int64), uploads: make(map[string]*upload)}
+
+	router := mux.NewRouter()
+	api := router.PathPrefix("/v1").Subrouter()
+	api.HandleFunc("/files", s.list).Methods("GET")
+	api.HandleFunc("/sendFile", s.sendFile).Methods("POST")
+	api.HandleFunc("/retrieveFile", s.retrieve).Methods("GET", "HEAD")
+	api.HandleFunc("/files/{name}", s.stat).Methods("GET")
+	api.HandleFunc("/files/{name}", s.put).Methods("PUT")
+	api.HandleFunc("/files/{name}", s.delete).Methods("DELETE")
+	api.HandleFunc("/files/{name}/manifest", s.manifest).Methods("GET")
+	api.HandleFunc("/files/{name}/signature", s.signature).Methods("GET")
+	api.HandleFunc("/files/{name}/delta", s.delta).Methods("POST")
+	api.HandleFunc("/files/{name}/uploads", s.initiateUpload).Methods("POST")
+	api.HandleFunc("/files/{name}/uploads/{id}", s.abortUpload).Methods("DELETE")
+	api.HandleFunc("/files/{name}/uploads/{id}/parts/{part}", s.uploadPart).Methods("PUT")
+	api.HandleFunc("/files/{name}/uploads/{id}/complete", s.completeUpload).Methods("POST")
+	router.HandleFunc("/blocks/{name}/{version}/{position}", s.block).Methods("GET")
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondError(w, http.StatusNotFound, client.CodeNotFound, "Not found", nil)
+	})
+
+	s.Server = httptest.NewServer(s.injectFailures(router))
+	return s
+}
+
+// Client returns a client of the server. Its retries do not wait, so tests
+// of failures run fast.
+func (s *Server) Client() *client.Client {
+	c := client.New(s.URL)
+	policy := client.DefaultRetryPolicy
+	policy.InitialBackoff, policy.MaxBackoff = 0, 0
+	c.SetRetryPolicy(policy)
+	return c
+}
+
+// Put stores a file as an upload would.
+func (s *Server) Put(name string, content []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.store(name, content)
+}
+
+// File returns the content of a file and whether it exists.
+func (s *Server) File(name string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(f.content), true
+}
+
+// Names returns the names of the files, sorted.
+func (s *Server) Names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Fail answers the next times requests with status and code, and
+// Retry-After when retryAfter is not 0, instead of serving them.
+func (s *Server) Fail(times int, status int, code string, retryAfter time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for range times {
+		s.failures = append(s.failures, failure{status: status, code: code, retryAfter: retryAfter})
+	}
+}
+
+// Requests returns the number of requests the server received, failed ones
+// included.
+func (s *Server) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *Server) injectFailures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests++
+		var injected *failure
+		if len(s.failures) > 0 {
+			injected = &s.failures[0]
+			s.failures = s.failures[1:]
+		}
+		s.mutex.Unlock()
+
+		if injected == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if injected.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(injected.retryAfter.Seconds())))
+		}
+		respondError(w, injected.status, injected.code, "Injected failure", nil)
+	})
+}
+
+// store records content under name with the next version of the name. The
+// caller holds s.mutex.
+func (s *Server) store(name string, content []byte) *file {
+	s.versions[name]++
+	f := &file{content: bytes.Clone(content), createdAt: time.Now().UTC(), version: s.versions[name]}
+	s.files[name] = f
+	return f
+}
+
+func (s *Server) info(name string, f *file) client.FileInfo {
+	blocks := (len(f.content) + BlockSize - 1) / BlockSize
+	return client.FileInfo{
+		Name:         name,
+		Size:         int64(len(f.content)),
+		Blocks:       blocks,
+		BlockSize:    BlockSize,
+		CreatedAt:    f.createdAt,
+		Version:      f.version,
+		ReadCount:    f.reads,
+		LastAccessed: f.accessed,
+	}
+}
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// matches reports whether the If-Match of r, if any, lets the write of a
+// file at f (nil if it does not exist) go through.
+func matches(r *http.Request, f *file) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return true
+	}
+	if strings.TrimSpace(ifMatch) == "*" {
+		return f != nil
+	}
+	return f != nil && slices.Contains(strings.Split(strings.ReplaceAll(ifMatch, " ", ""), ","), etag(f.version))
+}
+
+func respondJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func respondError(w http.ResponseWriter, status int, code string, message string, details map[string]any) {
+	respondJSON(w, status, map[string]any{
+		"code":    code,
+		"message": message,
+		"details": details,
+		"error":   message,
+	})
+}
+
+func respondFileNotFound(w http.ResponseWriter, name string) {
+	respondError(w, http.StatusNotFound, client.CodeFileNotFound, "File not found", map[string]any{"file": name})
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	files := make([]client.FileInfo, 0, len(s.files))
+	for name, f := range s.files {
+		files = append(files, s.info(name, f))
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	respondJSON(w, http.StatusOK, files)
+}
+
+func (s *Server) stat(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	s.mutex.Lock()
+	f, ok := s.files[name]
+	var info client.FileInfo
+	if ok {
+		info = s.info(name, f)
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		respondFileNotFound(w, name)
+		return
+	}
+	w.Header().Set("ETag", etag(info.Version))
+	respondJSON(w, http.StatusOK, info)
+}
+
+// write stores the body of an upload, answering 412 when its If-Match does
+// not hold.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, name string, content []byte, status int) {
+	if name == "" {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidFileName, "File name is required", nil)
+		return
+	}
+	s.mutex.Lock()
+	if !matches(r, s.files[name]) {
+		s.mutex.Unlock()
+		respondError(w, http.StatusPreconditionFailed, client.CodePreconditionFailed, "File is not at the version expected", map[string]any{"file": name})
+		return
+	}
+	f := s.store(name, content)
+	s.mutex.Unlock()
+
+	w.Header().Set("ETag", etag(f.version))
+	w.WriteHeader(status)
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request) {
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "Failed to read file content", nil)
+		return
+	}
+	s.write(w, r, mux.Vars(r)["name"], content, http.StatusCreated)
+}
+
+func (s *Server) sendFile(w http.ResponseWriter, r *http.Request) {
+	part, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "Failed to read file from request", nil)
+		return
+	}
+	defer part.Close()
+	content, err := io.ReadAll(part)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "Failed to read file content", nil)
+		return
+	}
+	s.write(w, r, header.Filename, content, http.StatusOK)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	s.mutex.Lock()
+	f, ok := s.files[name]
+	if ok && !matches(r, f) {
+		s.mutex.Unlock()
+		respondError(w, http.StatusPreconditionFailed, client.CodePreconditionFailed, "File is not at the version expected", map[string]any{"file": name})
+		return
+	}
+	delete(s.files, name)
+	s.mutex.Unlock()
+
+	if !ok {
+		respondFileNotFound(w, name)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// read returns the content of a file and counts the read. ok is false when
+// it does not exist.
+func (s *Server) read(name string) (content []byte, version int64, createdAt time.Time, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, 0, time.Time{}, false
+	}
+	now := time.Now().UTC()
+	f.reads++
+	f.accessed = &now
+	return f.content, f.version, f.createdAt, true
+}
+
+func (s *Server) retrieve(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("fileName")
+	content, version, createdAt, ok := s.read(name)
+	if !ok {
+		respondFileNotFound(w, name)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", createdAt, bytes.NewReader(content))
+}
+
+// blocks cuts content into BlockSize pieces, each compressed as a gzip member
+// of its own, as the real server stores files.
+func blocks(content []byte) [][]byte {
+	var compressed [][]byte
+	for offset := 0; offset < len(content); offset += BlockSize {
+		var block bytes.Buffer
+		writer := gzip.NewWriter(&block)
+		_, _ = writer.Write(content[offset:min(offset+BlockSize, len(content))])
+		_ = writer.Close()
+		compressed = append(compressed, block.Bytes())
+	}
+	return compressed
+}
+
+func (s *Server) manifest(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	content, version, _, ok := s.read(name)
+	if !ok {
+		respondFileNotFound(w, name)
+		return
+	}
+
+	manifest := client.Manifest{
+		Name:        name,
+		Size:        int64(len(content)),
+		Version:     version,
+		Compression: "gzip",
+		ExpiresAt:   time.Now().Add(5 * time.Minute).UTC().Truncate(time.Second),
+		Blocks:      []client.ManifestBlock{},
+	}
+	for i, block := range blocks(content) {
+		sum := sha256.Sum256(block)
+		manifest.Blocks = append(manifest.Blocks, client.ManifestBlock{
+			Position: i + 1,
+			URL:      fmt.Sprintf("%s/blocks/%s/%d/%d", s.URL, url.PathEscape(name), version, i+1),
+			Size:     int64(len(block)),
+			SHA256:   fmt.Sprintf("%x", sum),
+		})
+	}
+	w.Header().Set("ETag", etag(version))
+	respondJSON(w, http.StatusOK, manifest)
+}
+
+// block serves a block of a manifest, as a node would. Blocks of a version
+// since overwritten are gone.
+func (s *Server) block(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.mutex.Lock()
+	f, ok := s.files[vars["name"]]
+	var content []byte
+	if ok && strconv.FormatInt(f.version, 10) == vars["version"] {
+		content = f.content
+	}
+	s.mutex.Unlock()
+
+	position, _ := strconv.Atoi(vars["position"])
+	stored := blocks(content)
+	if position < 1 || position > len(stored) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(stored[position-1])
+}
+
+func (s *Server) signature(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	chunkSize := deltaChunkSize
+	if value := r.URL.Query().Get("chunkSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "chunkSize must be a positive number of bytes", nil)
+			return
+		}
+		chunkSize = size
+	}
+
+	s.mutex.Lock()
+	f, ok := s.files[name]
+	var content []byte
+	if ok {
+		content = f.content
+	}
+	s.mutex.Unlock()
+	if !ok {
+		respondFileNotFound(w, name)
+		return
+	}
+
+	signature := client.Signature{
+		Name:      name,
+		Size:      int64(len(content)),
+		ChunkSize: chunkSize,
+		Base:      fmt.Sprintf("%x", sha256.Sum256(content)),
+	}
+	for offset := 0; offset < len(content); offset += chunkSize {
+		chunk := content[offset:min(offset+chunkSize, len(content))]
+		signature.Chunks = append(signature.Chunks, struct {
+			Weak   uint32 `json:"weak"`
+			Strong string `json:"strong"`
+		}{Weak: rollsum.Sum(chunk), Strong: fmt.Sprintf("%x", sha256.Sum256(chunk))})
+	}
+	respondJSON(w, http.StatusOK, signature)
+}
+
+func (s *Server) delta(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var req struct {
+		Base      string           `json:"base"`
+		ChunkSize int              `json:"chunk_size"`
+		Ops       []client.DeltaOp `json:"ops"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChunkSize <= 0 {
+		respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, "Invalid delta", nil)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		respondFileNotFound(w, name)
+		return
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(f.content)) != req.Base {
+		respondError(w, http.StatusConflict, client.CodeStaleDeltaBase, "the file changed since its signature was taken", map[string]any{"file": name})
+		return
+	}
+
+	var content []byte
+	for _, op := range req.Ops {
+		if len(op.Data) > 0 {
+			content = append(content, op.Data...)
+			continue
+		}
+		start := op.Chunk * req.ChunkSize
+		end := min(start+max(op.Count, 1)*req.ChunkSize, len(f.content))
+		if op.Chunk < 0 || op.Count < 0 || start >= len(f.content) {
+			respondError(w, http.StatusBadRequest, client.CodeInvalidRequest, fmt.Sprintf("chunk %d does not exist", op.Chunk), nil)
+			return
+		}
+		content = append(content, f.content[start:end]...)
+	}
+
+	stored := s.store(name, content)
+	w.Header().Set("ETag", etag(stored.version))
+	respondJSON(w, http.StatusOK, s.info(name, stored))
+}
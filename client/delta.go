@@ -0,0 +1,192 @@
+package client
+
+import (
+	"FDS/rollsum"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrStaleSignature is returned by Sync when the file changed on the server
+// between reading its signature and sending the delta.
+var ErrStaleSignature = errors.New("file changed on the server during sync")
+
+// Signature mirrors the chunk signature the central server returns for a
+// file.
+type Signature struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+	Base      string `json:"base"`
+	Chunks    []struct {
+		Weak   uint32 `json:"weak"`
+		Strong string `json:"strong"`
+	} `json:"chunks"`
+}
+
+// DeltaOp is one instruction of a delta: literal Data, or Count chunks of the
+// version on the server starting at Chunk.
+type DeltaOp struct {
+	Chunk int    `json:"chunk,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type deltaRequest struct {
+	Base      string    `json:"base"`
+	ChunkSize int       `json:"chunk_size"`
+	Ops       []DeltaOp `json:"ops"`
+}
+
+// Signature returns the chunk signature of a file. chunkSize 0 lets the
+// server choose.
+func (c *Client) Signature(name string, chunkSize int) (Signature, error) {
+	var signature Signature
+
+	u := c.baseURL + "/files/" + url.PathEscape(name) + "/signature"
+	if chunkSize > 0 {
+		u += fmt.Sprintf("?chunkSize=%d", chunkSize)
+	}
+	res, err := c.httpClient.Get(u)
+	if err != nil {
+		return signature, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return signature, responseError(res)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&signature)
+	return signature, err
+}
+
+// Delta describes content against a signature, in the manner of rsync: the
+// rolling checksum finds the chunks of the signed version at any offset of
+// content, SHA-256 confirms each match, and whatever is left is sent as
+// literal data.
+func Delta(signature Signature, content []byte) []DeltaOp {
+	chunkSize := signature.ChunkSize
+	byWeak := make(map[uint32][]int)
+	for i, chunk := range signature.Chunks {
+		byWeak[chunk.Weak] = append(byWeak[chunk.Weak], i)
+	}
+
+	// The last chunk is shorter unless the size is a multiple of the chunk
+	// size; it can only match at the end of content.
+	lastSize := int(signature.Size) - (len(signature.Chunks)-1)*chunkSize
+
+	var ops []DeltaOp
+	literalStart := 0
+	emit := func(literalEnd int, chunk int) {
+		if literalEnd > literalStart {
+			ops = append(ops, DeltaOp{Data: content[literalStart:literalEnd]})
+		}
+		if last := len(ops) - 1; last >= 0 && ops[last].Data == nil && ops[last].Chunk+ops[last].Count == chunk {
+			ops[last].Count++
+		} else {
+			ops = append(ops, DeltaOp{Chunk: chunk, Count: 1})
+		}
+	}
+	match := func(window []byte, weak uint32) int {
+		var strong string
+		for _, i := range byWeak[weak] {
+			size := chunkSize
+			if i == len(signature.Chunks)-1 {
+				size = lastSize
+			}
+			if size != len(window) {
+				continue
+			}
+			if strong == "" {
+				sum := sha256.Sum256(window)
+				strong = hex.EncodeToString(sum[:])
+			}
+			if signature.Chunks[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	offset := 0
+	var rolling *rollsum.Rolling
+	for offset+chunkSize <= len(content) {
+		window := content[offset : offset+chunkSize]
+		if rolling == nil {
+			rolling = rollsum.New(window)
+		}
+		if i := match(window, rolling.Sum()); i >= 0 {
+			emit(offset, i)
+			offset += chunkSize
+			literalStart = offset
+			rolling = nil
+			continue
+		}
+		if offset+chunkSize < len(content) {
+			rolling.Roll(content[offset], content[offset+chunkSize])
+		}
+		offset++
+	}
+
+	if len(signature.Chunks) > 0 && lastSize < chunkSize && len(content)-literalStart >= lastSize {
+		tail := content[len(content)-lastSize:]
+		if i := match(tail, rollsum.Sum(tail)); i >= 0 {
+			emit(len(content)-lastSize, i)
+			literalStart = len(content)
+		}
+	}
+	if literalStart < len(content) {
+		ops = append(ops, DeltaOp{Data: content[literalStart:]})
+	}
+	return ops
+}
+
+// Sync stores content under name, sending only what differs from the
+// version already on the server. A file that does not exist yet is uploaded
+// in full.
+func (c *Client) Sync(name string, content []byte) (FileInfo, error) {
+	var info FileInfo
+
+	signature, err := c.Signature(name, 0)
+	if errors.Is(err, ErrNotFound) {
+		if err := c.Upload(context.Background(), name, bytes.NewReader(content)); err != nil {
+			return info, err
+		}
+		return c.Stat(name)
+	}
+	if err != nil {
+		return info, err
+	}
+
+	body, err := json.Marshal(deltaRequest{
+		Base:      signature.Base,
+		ChunkSize: signature.ChunkSize,
+		Ops:       Delta(signature, content),
+	})
+	if err != nil {
+		return info, err
+	}
+
+	res, err := c.httpClient.Post(c.baseURL+"/files/"+url.PathEscape(name)+"/delta", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return info, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return info, ErrStaleSignature
+	}
+	if res.StatusCode != http.StatusOK {
+		return info, responseError(res)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&info)
+	return info, err
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Codes of the errors the central server answers, see Error.
+const (
+	CodeInvalidRequest      = "invalid_request"
+	CodeInvalidFileName     = "invalid_file_name"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeInvalidAPIKey       = "invalid_api_key"
+	CodeInvalidSignature    = "invalid_signature"
+	CodeSignatureExpired    = "signature_expired"
+	CodeNotFound            = "not_found"
+	CodeFileNotFound        = "file_not_found"
+	CodeUploadNotFound      = "upload_not_found"
+	CodeConflict            = "conflict"
+	CodeStaleDeltaBase      = "stale_delta_base"
+	CodeFileLocked          = "file_locked"
+	CodePreconditionFailed  = "precondition_failed"
+	CodeUploadTooLarge      = "upload_too_large"
+	CodeUnsupportedType     = "unsupported_media_type"
+	CodeUploadRejected      = "upload_rejected"
+	CodeRangeNotSatisfiable = "range_not_satisfiable"
+	CodeInternal            = "internal"
+	CodeUnavailable         = "unavailable"
+	CodeMaintenance         = "maintenance"
+	CodeUploadsSaturated    = "uploads_saturated"
+	CodeNoNodesAvailable    = "no_nodes_available"
+	CodeNodesFull           = "nodes_full"
+	CodeWriteUnverified     = "write_unverified"
+)
+
+// Errors the *Error of the matching codes are, for errors.Is.
+var (
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrPreconditionFailed = errors.New("file is not at the version expected")
+	ErrFileLocked         = errors.New("file is locked")
+	ErrUploadTooLarge     = errors.New("upload too large")
+	ErrMaintenance        = errors.New("central server in maintenance")
+	ErrUnavailable        = errors.New("central server unavailable")
+	ErrNodesFull          = errors.New("nodes are full")
+)
+
+var codeErrors = map[string]error{
+	CodeFileNotFound:       ErrNotFound,
+	CodeNotFound:           ErrNotFound,
+	CodeUnauthorized:       ErrUnauthorized,
+	CodeInvalidAPIKey:      ErrUnauthorized,
+	CodePreconditionFailed: ErrPreconditionFailed,
+	CodeFileLocked:         ErrFileLocked,
+	CodeUploadTooLarge:     ErrUploadTooLarge,
+	CodeMaintenance:        ErrMaintenance,
+	CodeUnavailable:        ErrUnavailable,
+	CodeUploadsSaturated:   ErrUnavailable,
+	CodeNoNodesAvailable:   ErrUnavailable,
+	CodeNodesFull:          ErrNodesFull,
+}
+
+// Error is an error answered by the central server.
+type Error struct {
+	StatusCode int
+	// Code is one of the Code constants, stable across versions.
+	Code      string
+	Message   string
+	Details   map[string]any
+	RequestID string
+	// RetryAfter is how long the server asked to wait before trying again,
+	// 0 if it did not say.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server responded %d", e.StatusCode)
+	}
+	return fmt.Sprintf("server responded %d (%s): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is matches the Err variable of the code of e, and ErrNotFound for any 404.
+func (e *Error) Is(target error) bool {
+	if target == ErrNotFound && e.StatusCode == http.StatusNotFound {
+		return true
+	}
+	return codeErrors[e.Code] == target
+}
+
+// Temporary reports whether the request may succeed if sent again.
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func responseError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	var body struct {
+		Code      string         `json:"code"`
+		Message   string         `json:"message"`
+		Details   map[string]any `json:"details"`
+		RequestID string         `json:"requestId"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err == nil {
+		e.Code, e.Message, e.Details, e.RequestID = body.Code, body.Message, body.Details, body.RequestID
+	}
+	return e
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// DefaultPartSize is the size of the parts UploadParts sends when it is
+// given none.
+const DefaultPartSize = 8 << 20
+
+// maxParts is the number of parts a multipart upload takes at most.
+const maxParts = 10000
+
+// ErrMultipartUnavailable is returned by UploadParts when the central server
+// refuses multipart uploads, as it does while upload hooks are configured.
+var ErrMultipartUnavailable = errors.New("multipart uploads are not available")
+
+// UploadParts stores the size bytes of content under name, replacing any
+// existing file, as a multipart upload: parts of partSize bytes
+// (DefaultPartSize if 0) are sent one after the other, each retried on its
+// own, so an error only sends the part it interrupted again. The file is
+// only replaced once every part is stored; an upload that fails is dropped.
+func (c *Client) UploadParts(ctx context.Context, name string, content io.ReaderAt, size int64, partSize int64) error {
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	// The central server takes up to maxParts parts.
+	partSize = max(partSize, (size+maxParts-1)/maxParts)
+	uploads := c.baseURL + "/files/" + url.PathEscape(name) + "/uploads"
+
+	// Starting an upload is not idempotent: a retry would leave the first
+	// one behind, to expire.
+	res, err := c.sendOnce(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, uploads+"?size="+strconv.FormatInt(size, 10), nil)
+		if err == nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		return req, err
+	}, http.StatusCreated)
+	var serverErr *Error
+	if errors.As(err, &serverErr) && serverErr.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w: %w", ErrMultipartUnavailable, err)
+	}
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		ID string `json:"upload_id"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&upload)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	uploadURL := uploads + "/" + url.PathEscape(upload.ID)
+
+	if err := c.sendParts(ctx, uploadURL, content, size, partSize); err != nil {
+		c.abortUpload(uploadURL)
+		return err
+	}
+	res, err = c.send(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, uploadURL+"/complete", nil)
+	}, http.StatusCreated)
+	if err != nil {
+		c.abortUpload(uploadURL)
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// sendParts sends content as the parts of the upload at uploadURL. A part
+// sent again replaces the previous one, so each is retried on its own.
+func (c *Client) sendParts(ctx context.Context, uploadURL string, content io.ReaderAt, size int64, partSize int64) error {
+	for number, offset := 1, int64(0); number == 1 || offset < size; number, offset = number+1, offset+partSize {
+		length := min(partSize, size-offset)
+		res, err := c.send(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPut, uploadURL+"/parts/"+strconv.Itoa(number), io.NewSectionReader(content, offset, length))
+			if err == nil {
+				req.ContentLength = length
+			}
+			return req, err
+		}, http.StatusOK)
+		if err != nil {
+			return fmt.Errorf("part %d: %w", number, err)
+		}
+		res.Body.Close()
+	}
+	return nil
+}
+
+// abortUpload drops an upload that failed, leaving it to expire on the
+// central server if it cannot.
+func (c *Client) abortUpload(uploadURL string) {
+	res, err := c.sendOnce(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, uploadURL, nil)
+	}, http.StatusNoContent)
+	if err == nil {
+		res.Body.Close()
+	}
+}
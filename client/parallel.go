@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultConnections is the number of blocks DownloadParallel fetches at
+// once when it is given none.
+const DefaultConnections = 4
+
+// ErrNoManifest is returned by Manifest for files the central server only
+// serves itself: packed files, files in the cold tier, or all of them when
+// direct downloads are disabled.
+var ErrNoManifest = errors.New("file has no manifest")
+
+// Manifest mirrors the block plan the central server returns for a file:
+// where to fetch each of its blocks from the nodes. The blocks, concatenated
+// in order, are a gzip stream of the file.
+type Manifest struct {
+	Name        string          `json:"name"`
+	Size        int64           `json:"size"`
+	Version     int64           `json:"version"`
+	Compression string          `json:"compression"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	Blocks      []ManifestBlock `json:"blocks"`
+}
+
+// ManifestBlock is a block of a Manifest: URL and Replicas serve it, and
+// SHA256 is that of the block as stored, compressed.
+type ManifestBlock struct {
+	Position int      `json:"position"`
+	URL      string   `json:"url"`
+	Replicas []string `json:"replicas,omitempty"`
+	Size     int64    `json:"size"`
+	SHA256   string   `json:"sha256"`
+}
+
+// Manifest returns the block plan of a file.
+func (c *Client) Manifest(ctx context.Context, name string) (Manifest, error) {
+	var manifest Manifest
+	err := c.getJSON(ctx, "/files/"+url.PathEscape(name)+"/manifest", &manifest)
+	var serverErr *Error
+	if errors.As(err, &serverErr) && (serverErr.StatusCode == http.StatusForbidden || serverErr.StatusCode == http.StatusConflict) {
+		return manifest, fmt.Errorf("%w: %w", ErrNoManifest, err)
+	}
+	return manifest, err
+}
+
+// DownloadParallel writes the file to w, fetching its blocks straight from
+// the nodes over up to connections requests at once (DefaultConnections if
+// 0). Each block is checked against its SHA-256, and fetched from its other
+// replicas when it does not match or its node fails. At most connections
+// blocks are held in memory. Files without a manifest are downloaded through
+// the central server instead.
+func (c *Client) DownloadParallel(ctx context.Context, name string, w io.Writer, connections int) error {
+	if connections <= 0 {
+		connections = DefaultConnections
+	}
+
+	manifest, err := c.Manifest(ctx, name)
+	if errors.Is(err, ErrNoManifest) {
+		return c.Download(ctx, name, w)
+	}
+	if err != nil {
+		return err
+	}
+	if len(manifest.Blocks) == 0 {
+		return nil
+	}
+
+	type fetched struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan fetched, len(manifest.Blocks))
+	for i := range results {
+		results[i] = make(chan fetched, 1)
+	}
+	// slots bounds the blocks fetched or waiting to be written; the writer
+	// frees one as it writes each block.
+	slots := make(chan struct{}, connections)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, block := range manifest.Blocks {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, block ManifestBlock) {
+				data, err := c.fetchManifestBlock(ctx, block, i)
+				results[i] <- fetched{data, err}
+			}(i, block)
+		}
+	}()
+
+	compressed, writer := io.Pipe()
+	decompressed := make(chan error, 1)
+	go func() {
+		decompressed <- decompress(w, compressed, manifest.Size)
+		// Unblock the writer if decompression stopped early.
+		compressed.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	for i := range manifest.Blocks {
+		result := <-results[i]
+		<-slots
+		if result.err != nil {
+			writer.CloseWithError(result.err)
+			<-decompressed
+			return result.err
+		}
+		if _, err := writer.Write(result.data); err != nil {
+			break
+		}
+	}
+	writer.Close()
+	return <-decompressed
+}
+
+// fetchManifestBlock fetches a block from its replicas in turn, starting
+// with a different one for each block so the fetches spread over them, and
+// returns the first copy matching its SHA-256.
+func (c *Client) fetchManifestBlock(ctx context.Context, block ManifestBlock, i int) ([]byte, error) {
+	urls := append([]string{block.URL}, block.Replicas...)
+	var errs []error
+	for attempt := range urls {
+		u := urls[(i+attempt)%len(urls)]
+		data, err := c.fetchURL(ctx, u)
+		if err == nil {
+			sum := sha256.Sum256(data)
+			if hex.EncodeToString(sum[:]) == block.SHA256 {
+				return data, nil
+			}
+			err = fmt.Errorf("block %d does not match its SHA-256", block.Position)
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("failed to fetch block %d: %w", block.Position, errors.Join(errs...))
+}
+
+func (c *Client) fetchURL(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("node responded %d", res.StatusCode)
+	}
+	var data bytes.Buffer
+	_, err = io.Copy(&data, res.Body)
+	return data.Bytes(), err
+}
+
+// decompress writes the file the gzip stream from r holds to w, and checks
+// it is size bytes long unless size is negative.
+func decompress(w io.Writer, r io.Reader, size int64) error {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(w, reader)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("downloaded %d bytes, the file has %d", written, size)
+	}
+	return nil
+}
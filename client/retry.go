@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy decides how often an idempotent request that failed is sent
+// again.
+type RetryPolicy struct {
+	// Attempts counts the first request; 1 never retries.
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter spreads each backoff randomly by up to this fraction, so
+	// clients do not retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the retry policy of the clients New returns.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       4,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Jitter:         0.5,
+}
+
+// SetRetryPolicy replaces the retry policy of the client.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
+}
+
+// finalError wraps errors that sending the request again cannot fix, such as
+// a failure to write what was downloaded.
+type finalError struct{ err error }
+
+func (e finalError) Error() string { return e.err.Error() }
+func (e finalError) Unwrap() error { return e.err }
+
+// do calls op until it succeeds, fails with an error that is not worth
+// retrying, ctx is done or the attempts are used up. A server asking to wait
+// with Retry-After is waited for instead of the backoff, within MaxBackoff.
+// It returns the last error.
+func (p RetryPolicy) do(ctx context.Context, op func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.Attempts || ctx.Err() != nil || !retryable(err) {
+			var final finalError
+			if errors.As(err, &final) {
+				return final.err
+			}
+			return err
+		}
+
+		delay := p.jittered(backoff)
+		var serverErr *Error
+		if errors.As(err, &serverErr) && serverErr.RetryAfter > 0 {
+			delay = min(serverErr.RetryAfter, p.MaxBackoff)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, p.MaxBackoff)
+	}
+}
+
+func (p RetryPolicy) jittered(backoff time.Duration) time.Duration {
+	if p.Jitter <= 0 || backoff <= 0 {
+		return backoff
+	}
+	spread := p.Jitter * float64(backoff)
+	return time.Duration(float64(backoff) - spread + 2*spread*rand.Float64())
+}
+
+// retryable reports whether err may be transient: a network error or a
+// temporary error of the server. Cancellation and final errors are not.
+func retryable(err error) bool {
+	var final finalError
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &final) {
+		return false
+	}
+
+	var serverErr *Error
+	if errors.As(err, &serverErr) {
+		return serverErr.Temporary()
+	}
+	return true
+}
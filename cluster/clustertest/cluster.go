@@ -0,0 +1,165 @@
+// Package clustertest runs a whole cluster inside the test process, for
+// end-to-end tests that need no Redis, nodes or central server started
+// beside them:
+//
+//	c := clustertest.Start(t, clustertest.Options{Nodes: 3})
+//	err := c.Client().Upload(ctx, "report.pdf", file)
+//
+// The cluster is a central server on an in-memory Redis (miniredis) and
+// storage nodes, each with a temporary storage directory, all on free ports
+// of localhost. It stops when the test ends. The central server keeps its
+// state in package variables, so a process runs one cluster at a time:
+// tests using clustertest must not call t.Parallel.
+package clustertest
+
+import (
+	"FDS/client"
+	"FDS/cluster/node"
+	"FDS/cluster/server"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// DefaultNodes is the number of nodes of a cluster given none.
+const DefaultNodes = 3
+
+// readyTimeout bounds how long Start waits for the nodes to register.
+const readyTimeout = 10 * time.Second
+
+// Options describes a cluster.
+type Options struct {
+	Nodes int // DefaultNodes if 0
+
+	// Server and Node, when set, adjust the settings of the central server
+	// and of the i-th node before they start.
+	Server func(cfg *server.Config)
+	Node   func(i int, cfg *node.Config)
+}
+
+// Cluster is a running cluster.
+type Cluster struct {
+	Redis  *miniredis.Miniredis
+	Server *server.Server
+	Nodes  []*node.Node
+
+	cancel context.CancelFunc
+}
+
+// Start starts a cluster and waits until all its nodes have registered with
+// the central server. It fails tb if the cluster does not come up, and stops
+// the cluster when tb ends.
+func Start(tb testing.TB, opts Options) *Cluster {
+	tb.Helper()
+	if opts.Nodes <= 0 {
+		opts.Nodes = DefaultNodes
+	}
+
+	redis := miniredis.RunT(tb)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Cluster{Redis: redis, cancel: cancel}
+	tb.Cleanup(c.Close)
+
+	cfg := server.DefaultConfig()
+	cfg.HTTPAddr = "localhost:0"
+	cfg.GRPCAddr = "localhost:0"
+	cfg.RedisAddr = redis.Addr()
+	cfg.NodeHeartbeatInterval = time.Second
+	cfg.Log.Level = "warn"
+	if opts.Server != nil {
+		opts.Server(&cfg)
+	}
+	s, err := server.New(cfg)
+	if err != nil {
+		tb.Fatalf("clustertest: %v", err)
+	}
+	if err := s.Start(ctx); err != nil {
+		tb.Fatalf("clustertest: %v", err)
+	}
+	c.Server = s
+
+	for i := range opts.Nodes {
+		cfg := node.DefaultConfig()
+		cfg.StorageDir = tb.TempDir()
+		cfg.CentralURL = s.URL()
+		cfg.ReportInterval = time.Second
+		if opts.Node != nil {
+			opts.Node(i, &cfg)
+		}
+		n, err := node.New(cfg)
+		if err != nil {
+			tb.Fatalf("clustertest: node %d: %v", i, err)
+		}
+		if err := n.Start(ctx); err != nil {
+			tb.Fatalf("clustertest: node %d: %v", i, err)
+		}
+		c.Nodes = append(c.Nodes, n)
+	}
+
+	if err := c.waitForNodes(opts.Nodes); err != nil {
+		tb.Fatalf("clustertest: %v", err)
+	}
+	return c
+}
+
+// URL returns the base URL of the central server.
+func (c *Cluster) URL() string {
+	return c.Server.URL()
+}
+
+// Client returns a client of the central server.
+func (c *Cluster) Client() *client.Client {
+	return client.New(c.URL())
+}
+
+// Close stops the nodes and the central server, and waits for them. Start
+// has it called when the test ends.
+func (c *Cluster) Close() {
+	c.cancel()
+	for _, n := range c.Nodes {
+		n.Wait()
+	}
+	if c.Server != nil {
+		c.Server.Wait()
+	}
+	c.Nodes, c.Server = nil, nil
+}
+
+// waitForNodes polls the node registry until it lists want nodes.
+func (c *Cluster) waitForNodes(want int) error {
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		got, err := c.registeredNodes()
+		if err == nil && got >= want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("nodes did not register: %w", err)
+			}
+			return fmt.Errorf("%d of %d nodes registered after %s", got, want, readyTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (c *Cluster) registeredNodes() (int, error) {
+	res, err := http.Get(c.URL() + "/v1/nodes")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET /v1/nodes answered %s", res.Status)
+	}
+	var nodes []json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&nodes); err != nil {
+		return 0, err
+	}
+	return len(nodes), nil
+}
@@ -0,0 +1,55 @@
+package clustertest_test
+
+import (
+	"FDS/cluster/clustertest"
+	"FDS/cluster/server"
+	"bytes"
+	"context"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestUploadDownload(t *testing.T) {
+	c := clustertest.Start(t, clustertest.Options{
+		Server: func(cfg *server.Config) {
+			// Small blocks, so the file is spread over several of them.
+			cfg.AdaptiveBlockSize = false
+			cfg.BlockSize = 64 << 10
+		},
+	})
+	ctx := context.Background()
+
+	content := make([]byte, 300<<10)
+	rng := rand.NewChaCha8([32]byte{})
+	_, _ = rng.Read(content)
+
+	if err := c.Client().Upload(ctx, "report.bin", bytes.NewReader(content)); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	info, err := c.Client().Stat("report.bin")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("Stat: size %d, want %d", info.Size, len(content))
+	}
+	if info.Blocks < 2 {
+		t.Errorf("Stat: %d blocks, want several", info.Blocks)
+	}
+
+	var got bytes.Buffer
+	if err := c.Client().Download(ctx, "report.bin", &got); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Errorf("Download: got %d bytes that differ from the %d uploaded", got.Len(), len(content))
+	}
+
+	if err := c.Client().Delete("report.bin"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Client().Stat("report.bin"); err == nil {
+		t.Errorf("Stat after Delete: found the file")
+	}
+}
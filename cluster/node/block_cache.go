@@ -0,0 +1,103 @@
+package node
+
+import (
+	"container/list"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	blockCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "block_cache_requests_total",
+			Help: "Block reads by whether they were served from memory (hit) or disk (miss)",
+		},
+		[]string{"result"},
+	)
+	blockCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "block_cache_bytes",
+		Help: "Bytes of block data held in memory",
+	})
+)
+
+type cachedBlock struct {
+	name string
+	data []byte
+}
+
+// blockLRU keeps the most recently read blocks in memory, up to a byte
+// budget, so popular content is served without touching the disk. Blocks
+// are dropped as soon as they are rewritten or deleted.
+type blockLRU struct {
+	mutex   sync.Mutex
+	budget  int
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+}
+
+// newBlockCache returns a cache of budget bytes, disabled if 0.
+func newBlockCache(budget int) *blockLRU {
+	return &blockLRU{budget: budget, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *blockLRU) Get(name string) ([]byte, bool) {
+	if c.budget <= 0 {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[name]
+	if !ok {
+		blockCacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	blockCacheRequests.WithLabelValues("hit").Inc()
+	return element.Value.(*cachedBlock).data, true
+}
+
+// Admits reports whether a block of size bytes would be kept: blocks larger
+// than a quarter of the budget are not.
+func (c *blockLRU) Admits(size int64) bool {
+	return c.budget > 0 && size <= int64(c.budget/4)
+}
+
+// Put keeps data, which must not be modified afterwards, evicting the least
+// recently read blocks as needed.
+func (c *blockLRU) Put(name string, data []byte) {
+	if !c.Admits(int64(len(data))) {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeLocked(name)
+	c.entries[name] = c.order.PushFront(&cachedBlock{name: name, data: data})
+	c.size += len(data)
+	for c.size > c.budget {
+		c.removeLocked(c.order.Back().Value.(*cachedBlock).name)
+	}
+	blockCacheBytes.Set(float64(c.size))
+}
+
+func (c *blockLRU) Invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeLocked(name)
+	blockCacheBytes.Set(float64(c.size))
+}
+
+func (c *blockLRU) removeLocked(name string) {
+	element, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.order.Remove(element)
+	delete(c.entries, name)
+	c.size -= len(element.Value.(*cachedBlock).data)
+}
@@ -0,0 +1,239 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// BlockStore is where a node keeps its blocks. Missing blocks are reported
+// with errors wrapping os.ErrNotExist.
+type BlockStore interface {
+	// Create starts a new version of a block, which replaces the current one
+	// only once committed, so a failed write never leaves a partial block.
+	Create(name string) (BlockWriter, error)
+	Read(name string) ([]byte, error)
+	// Open returns the block for streaming; the local store returns the
+	// *os.File itself, so it can be sent with sendfile.
+	Open(name string) (io.ReadSeekCloser, error)
+	Exists(name string) (bool, error)
+	// List returns the names of the stored blocks.
+	List() ([]string, error)
+	Delete(name string) error
+	// Copy stores the content of from under to as well, as cheaply as the
+	// store allows.
+	Copy(from string, to string) error
+	// Used returns the bytes taken by the blocks.
+	Used() (int64, error)
+	// Free returns the bytes left for blocks, or errors.ErrUnsupported when
+	// the store has no fixed capacity.
+	Free() (int64, error)
+}
+
+// BlockWriter receives the content of a block being stored.
+type BlockWriter interface {
+	io.Writer
+	Commit() error
+	// Abort discards the block; it does nothing after Commit.
+	Abort()
+}
+
+// bytesBlock serves a block held in memory through Open.
+type bytesBlock struct{ *bytes.Reader }
+
+func (bytesBlock) Close() error { return nil }
+
+func openBytes(data []byte) io.ReadSeekCloser { return bytesBlock{bytes.NewReader(data)} }
+
+// openBlockStore parses FDS_NODE_STORE: "local" (the default) for the
+// storage directory, "kv" to keep the small blocks of the storage directory
+// in a single key-value file, "memory" for a store that is lost on exit, or
+// s3://bucket/prefix.
+func (n *Node) openBlockStore(spec string) (BlockStore, error) {
+	switch {
+	case spec == "" || spec == "local":
+		return localStore{dir: n.config.StorageDir, durable: n.durable}, nil
+	case spec == "kv":
+		return newKVStore(localStore{dir: n.config.StorageDir, durable: n.durable}, n.config.KVMaxBlock)
+	case spec == "memory":
+		return newMemoryStore(), nil
+	case strings.HasPrefix(spec, "s3://"):
+		return newS3Store(spec, n.config)
+	}
+	return nil, fmt.Errorf("FDS_NODE_STORE: %q is not local, kv, memory or s3://bucket/prefix", spec)
+}
+
+// localStore keeps each block in a file of dir.
+type localStore struct {
+	dir     string
+	durable *durability
+}
+
+func (l localStore) path(name string) string { return filepath.Join(l.dir, name) }
+
+// blockNamePattern is the shape of the names the central server gives
+// blocks: the name of a file, or what it stores blocks under, then the
+// position of the block.
+var blockNamePattern = regexp.MustCompile(`-block-[1-9][0-9]*\.bin$`)
+
+// validBlockName tells whether name can name a block: a single path element
+// of the shape of block names, so no request reaches outside the storage
+// directory, nor the checksums and other files kept beside the blocks.
+func validBlockName(name string) bool {
+	return name == filepath.Base(name) && blockNamePattern.MatchString(name)
+}
+
+// Create writes to a temporary file next to the block, renamed into place on
+// commit: blocks may be hard-linked by Copy, and writing through the existing
+// name would change the copies too.
+func (l localStore) Create(name string) (BlockWriter, error) {
+	tmp, err := os.CreateTemp(l.dir, name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: tmp, dest: l.path(name), durable: l.durable}, nil
+}
+
+type localWriter struct {
+	*os.File
+	dest    string
+	durable *durability
+	done    bool
+}
+
+func (w *localWriter) Commit() error {
+	w.done = true
+	err := w.durable.syncBeforeRename(w.File)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.dest)
+	}
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return w.durable.renamed(w.dest)
+}
+
+func (w *localWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.Close()
+	os.Remove(w.Name())
+}
+
+func (l localStore) Read(name string) ([]byte, error) {
+	return os.ReadFile(l.path(name))
+}
+
+func (l localStore) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l localStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(l.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List leaves out the state directory, the key-value store and blocks
+// being written.
+func (l localStore) List() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, kvStoreFile) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (l localStore) Delete(name string) error {
+	return os.Remove(l.path(name))
+}
+
+// Copy makes to a hard link to from when the file system supports it, so the
+// copy takes no space. Blocks are only ever replaced by renaming a new file
+// over them, never rewritten in place, so the two names stay independent.
+func (l localStore) Copy(from string, to string) error {
+	src, err := os.Open(l.path(from))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := l.link(from, to); err == nil {
+		return nil
+	}
+
+	w, err := l.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+func (l localStore) link(from string, to string) error {
+	// Renaming a link over another link to the same file does nothing, and
+	// would leave the temporary link behind.
+	if src, err := os.Stat(l.path(from)); err == nil {
+		if dst, err := os.Stat(l.path(to)); err == nil && os.SameFile(src, dst) {
+			return nil
+		}
+	}
+
+	tmp, err := os.CreateTemp(l.dir, to+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+
+	if err := os.Link(l.path(from), tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path(to)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return l.durable.renamed(l.path(to))
+}
+
+func (l localStore) Used() (int64, error) {
+	var size int64
+	err := filepath.Walk(l.dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+func (l localStore) Free() (int64, error) {
+	return freeDiskSpace(l.dir)
+}
@@ -0,0 +1,52 @@
+package node
+
+import (
+	"FDS/version"
+	"errors"
+	"log"
+)
+
+// nodeCodecs lists the encodings the node can serve blocks with.
+var nodeCodecs = []string{"identity", "gzip"}
+
+// nodeAuth lists the ways the node can authenticate the central server.
+var nodeAuth = []string{"cluster-token"}
+
+// nodeCapacity returns the space the node offers for blocks: Capacity if
+// set, and otherwise the space taken by the blocks plus the space left in
+// the store, as measured at startup. It is 0, for the central server to
+// decide, when the store has no fixed capacity.
+func (n *Node) nodeCapacity() int64 {
+	if n.config.Capacity > 0 {
+		return n.config.Capacity
+	}
+	used, err := n.store.Used()
+	if err != nil {
+		log.Printf("Failed to measure the capacity of the store: %v", err)
+		return 0
+	}
+	free, err := n.store.Free()
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			log.Printf("Failed to measure the capacity of the store: %v", err)
+		}
+		return 0
+	}
+	return used + free
+}
+
+// registrationPayload is what the node tells the central server when it
+// registers, so an incompatible central server can refuse it up front rather
+// than fail its transfers.
+func (n *Node) registrationPayload() map[string]any {
+	return map[string]any{
+		"Url":          n.url,
+		"ID":           n.id,
+		"Labels":       n.config.Labels,
+		"Version":      version.Get(n.features()...),
+		"MaxBlockSize": n.config.MaxBlockSize,
+		"Capacity":     n.nodeCapacity(),
+		"Codecs":       nodeCodecs,
+		"Auth":         nodeAuth,
+	}
+}
@@ -0,0 +1,50 @@
+package node
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// configureCentral loads the certificates trusted for the central server:
+// those of FDS_CENTRAL_CA_FILE, for a private CA, besides the system ones.
+func (n *Node) configureCentral() error {
+	caFile := n.config.CentralCAFile
+	if caFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("FDS_CENTRAL_CA_FILE: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("FDS_CENTRAL_CA_FILE: no certificate found in %s", caFile)
+	}
+	n.centralTLS = &tls.Config{RootCAs: pool}
+	return nil
+}
+
+// centralEndpoint returns the URL of an endpoint of the central server.
+func (n *Node) centralEndpoint(path string) string {
+	return strings.TrimSuffix(n.config.CentralURL, "/") + path
+}
+
+// newCentralClient returns the client the node calls the central server
+// with.
+func (n *Node) newCentralClient() http.Client {
+	client := http.Client{Timeout: 5 * time.Second}
+	if n.centralTLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = n.centralTLS
+		client.Transport = transport
+	}
+	return client
+}
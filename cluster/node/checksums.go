@@ -0,0 +1,149 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// checksumSuffix names the sidecar holding the SHA-256 of a block, kept in the
+// same store as the block.
+const checksumSuffix = ".sha256"
+
+// errBlockCorrupt is returned for a block whose content no longer matches the
+// checksum recorded when it was stored.
+var errBlockCorrupt = errors.New("block content does not match its checksum")
+
+// checksumStore records the SHA-256 of every block committed to the store it
+// wraps, so reads can tell a damaged block from a good one.
+type checksumStore struct{ BlockStore }
+
+func (c checksumStore) Create(name string) (BlockWriter, error) {
+	w, err := c.BlockStore.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumWriter{BlockWriter: w, store: c.BlockStore, name: name, hash: sha256.New()}, nil
+}
+
+type checksumWriter struct {
+	BlockWriter
+	store BlockStore
+	name  string
+	hash  hash.Hash
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.BlockWriter.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// Commit drops the checksum of the previous version before replacing the
+// block, so a crash in between leaves a block without a checksum rather than
+// one with the wrong checksum.
+func (w *checksumWriter) Commit() error {
+	if err := removeChecksum(w.store, w.name); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.BlockWriter.Commit(); err != nil {
+		return err
+	}
+	return writeChecksum(w.store, w.name, hex.EncodeToString(w.hash.Sum(nil)))
+}
+
+func (c checksumStore) Delete(name string) error {
+	if err := c.BlockStore.Delete(name); err != nil {
+		return err
+	}
+	return removeChecksum(c.BlockStore, name)
+}
+
+func (c checksumStore) Copy(from string, to string) error {
+	if err := removeChecksum(c.BlockStore, to); err != nil {
+		return err
+	}
+	if err := c.BlockStore.Copy(from, to); err != nil {
+		return err
+	}
+	sum, err := c.BlockStore.Read(from + checksumSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeChecksum(c.BlockStore, to, string(sum))
+}
+
+func writeChecksum(s BlockStore, name string, sum string) error {
+	w, err := s.Create(name + checksumSuffix)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, sum); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+func removeChecksum(s BlockStore, name string) error {
+	if err := s.Delete(name + checksumSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// verifyBlock checks content against the checksum of the block, and rewinds
+// it. Blocks stored before checksums were recorded have none, and pass.
+func (n *Node) verifyBlock(name string, content io.ReadSeeker) error {
+	sum, err := n.store.Read(name + checksumSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	digest := sha256.New()
+	_, err = io.Copy(digest, content)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	blockIODuration.WithLabelValues("verify").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != string(bytes.TrimSpace(sum)) {
+		return errBlockCorrupt
+	}
+	return nil
+}
+
+// storedHash reads a block back from the store and returns its SHA-256, so
+// the central server can check what was committed rather than what was
+// received.
+func (n *Node) storedHash(name string) (string, error) {
+	content, err := n.store.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	start := time.Now()
+	digest := sha256.New()
+	_, err = io.Copy(digest, content)
+	blockIODuration.WithLabelValues("verify").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
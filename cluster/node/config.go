@@ -0,0 +1,202 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of a node. LoadConfig reads them from the
+// environment variables named next to them; Addr and StorageDir come from
+// the command line.
+type Config struct {
+	Addr       string            // host:port the node listens on and registers with; port 0 picks a free one
+	StorageDir string            // holds the local blocks, and in .node the identity of the node and its cluster token
+	Store      string            // FDS_NODE_STORE, see openBlockStore
+	Labels     map[string]string // FDS_NODE_LABELS, e.g. "zone=eu-1,rack=r2"
+
+	// The central server
+	CentralURL      string        // FDS_CENTRAL_URL, https when it serves its API over TLS
+	CentralCAFile   string        // FDS_CENTRAL_CA_FILE, PEM of a private CA trusted for it besides the system ones
+	JoinSecret      string        // FDS_NODE_JOIN_SECRET it may require to register and report
+	BlockSigningKey string        // FDS_BLOCK_SIGNING_KEY, shared with it
+	SelfRegister    bool          // FDS_NODE_SELF_REGISTER, false leaves registration to its node discovery
+	ReregisterAfter time.Duration // FDS_NODE_REREGISTER_AFTER without heartbeat, 0 never registers again
+	ReportInterval  time.Duration // FDS_NODE_REPORT_INTERVAL of the usage reports, 0 turns them off
+
+	// Blocks, sizes in bytes
+	MaxBlockSize int64 // FDS_NODE_MAX_BLOCK_SIZE accepted, 0 for any size
+	Capacity     int64 // FDS_NODE_CAPACITY offered for blocks, 0 for what the store holds and has left
+	CacheSize    int   // FDS_NODE_CACHE_SIZE of recently read blocks kept in memory, 0 disables
+	KVMaxBlock   int   // FDS_NODE_KV_MAX_BLOCK up to which a block goes to the key-value store
+
+	// Durability, see durability
+	Fsync         string        // FDS_NODE_FSYNC: "block", "batch" or "async"
+	FsyncInterval time.Duration // FDS_NODE_FSYNC_INTERVAL between batches
+	FsyncDir      bool          // FDS_NODE_FSYNC_DIR also flushes the directory of a block renamed into place
+	ScrubInterval time.Duration // FDS_NODE_SCRUB_INTERVAL between checks of every block, 0 turns scrubbing off
+
+	// TLS, plain HTTP unless the node has certificate files or gets its
+	// certificate issued
+	TLSCertFile string // FDS_NODE_TLS_CERT_FILE, reloaded when it changes
+	TLSKeyFile  string // FDS_NODE_TLS_KEY_FILE
+	TLSIssued   bool   // FDS_NODE_TLS_ISSUED: the central server issues the certificate, renewed once two thirds of its lifetime are over
+
+	// S3, for FDS_NODE_STORE=s3://bucket/prefix
+	S3Endpoint  string // FDS_S3_ENDPOINT, AWS unless set
+	S3Region    string // FDS_S3_REGION
+	S3AccessKey string // FDS_S3_ACCESS_KEY
+	S3SecretKey string // FDS_S3_SECRET_KEY
+}
+
+// DefaultConfig returns the settings a node runs with when no variable is
+// set.
+func DefaultConfig() Config {
+	return Config{
+		Addr:            "localhost:0",
+		Store:           "local",
+		Labels:          map[string]string{},
+		CentralURL:      "http://localhost:8000",
+		SelfRegister:    true,
+		ReregisterAfter: 1 * time.Minute,
+		ReportInterval:  10 * time.Second,
+		KVMaxBlock:      defaultKVMaxBlock,
+		Fsync:           fsyncAsync,
+		FsyncInterval:   100 * time.Millisecond,
+		S3Region:        "us-east-1",
+	}
+}
+
+// LoadConfig returns the defaults overridden by the environment.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	if value := os.Getenv("FDS_NODE_STORE"); value != "" {
+		cfg.Store = value
+	}
+	cfg.Labels = parseLabels(os.Getenv("FDS_NODE_LABELS"))
+
+	if value := os.Getenv("FDS_CENTRAL_URL"); value != "" {
+		cfg.CentralURL = strings.TrimSuffix(value, "/")
+	}
+	cfg.CentralCAFile = os.Getenv("FDS_CENTRAL_CA_FILE")
+	cfg.JoinSecret = os.Getenv("FDS_NODE_JOIN_SECRET")
+	cfg.BlockSigningKey = os.Getenv("FDS_BLOCK_SIGNING_KEY")
+	if value := os.Getenv("FDS_NODE_SELF_REGISTER"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return cfg, fmt.Errorf("FDS_NODE_SELF_REGISTER: %q is not a boolean", value)
+		}
+		cfg.SelfRegister = b
+	}
+	if value := os.Getenv("FDS_NODE_REREGISTER_AFTER"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_REREGISTER_AFTER: %q is not a duration", value)
+		}
+		cfg.ReregisterAfter = d
+	}
+	if value := os.Getenv("FDS_NODE_REPORT_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_REPORT_INTERVAL: %q is not a duration", value)
+		}
+		cfg.ReportInterval = d
+	}
+
+	if value := os.Getenv("FDS_NODE_MAX_BLOCK_SIZE"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_MAX_BLOCK_SIZE: %q is not a number of bytes", value)
+		}
+		cfg.MaxBlockSize = n
+	}
+	if value := os.Getenv("FDS_NODE_CAPACITY"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_CAPACITY: %q is not a number of bytes", value)
+		}
+		cfg.Capacity = n
+	}
+	if value := os.Getenv("FDS_NODE_CACHE_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_CACHE_SIZE: %q is not a number of bytes", value)
+		}
+		cfg.CacheSize = n
+	}
+	if value := os.Getenv("FDS_NODE_KV_MAX_BLOCK"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_KV_MAX_BLOCK: %q is not a number of bytes", value)
+		}
+		cfg.KVMaxBlock = n
+	}
+
+	if mode := os.Getenv("FDS_NODE_FSYNC"); mode != "" {
+		if mode != fsyncBlock && mode != fsyncBatch && mode != fsyncAsync {
+			return cfg, fmt.Errorf("FDS_NODE_FSYNC: %q is not block, batch or async", mode)
+		}
+		cfg.Fsync = mode
+	}
+	if value := os.Getenv("FDS_NODE_FSYNC_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return cfg, fmt.Errorf("FDS_NODE_FSYNC_INTERVAL: %q is not a positive duration", value)
+		}
+		cfg.FsyncInterval = interval
+	}
+	if value := os.Getenv("FDS_NODE_FSYNC_DIR"); value != "" {
+		syncDir, err := strconv.ParseBool(value)
+		if err != nil {
+			return cfg, fmt.Errorf("FDS_NODE_FSYNC_DIR: %q is not a boolean", value)
+		}
+		cfg.FsyncDir = syncDir
+	}
+	if value := os.Getenv("FDS_NODE_SCRUB_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("FDS_NODE_SCRUB_INTERVAL: %q is not a duration", value)
+		}
+		cfg.ScrubInterval = d
+	}
+
+	cfg.TLSCertFile = os.Getenv("FDS_NODE_TLS_CERT_FILE")
+	cfg.TLSKeyFile = os.Getenv("FDS_NODE_TLS_KEY_FILE")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return cfg, errors.New("FDS_NODE_TLS_CERT_FILE, FDS_NODE_TLS_KEY_FILE: both or neither must be set")
+	}
+	if value := os.Getenv("FDS_NODE_TLS_ISSUED"); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return cfg, fmt.Errorf("FDS_NODE_TLS_ISSUED: %q is not a boolean", value)
+		}
+		cfg.TLSIssued = b
+	}
+	if cfg.TLSIssued && cfg.TLSCertFile != "" {
+		return cfg, errors.New("FDS_NODE_TLS_ISSUED: the certificate cannot be both issued and read from FDS_NODE_TLS_CERT_FILE")
+	}
+
+	cfg.S3Endpoint = os.Getenv("FDS_S3_ENDPOINT")
+	if value := os.Getenv("FDS_S3_REGION"); value != "" {
+		cfg.S3Region = value
+	}
+	cfg.S3AccessKey = os.Getenv("FDS_S3_ACCESS_KEY")
+	cfg.S3SecretKey = os.Getenv("FDS_S3_SECRET_KEY")
+	return cfg, nil
+}
+
+// parseLabels parses labels such as "zone=eu-1,rack=r2".
+func parseLabels(value string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && key != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
@@ -0,0 +1,142 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// corruptBlock is a block found damaged, and how it was found: "read" or
+// "scrub".
+type corruptBlock struct {
+	name   string
+	source string
+}
+
+// reportCorruption records a damaged block and queues it for the central
+// server; reports are dropped while the queue is full, the scrubber finds the
+// block again.
+func (n *Node) reportCorruption(name string, source string) {
+	blockCorruptions.WithLabelValues(source).Inc()
+	select {
+	case n.corruptBlocks <- corruptBlock{name: name, source: source}:
+	default:
+	}
+}
+
+// startCorruptionReports sends the damaged blocks to the central server, and
+// scrubs the store every FDS_NODE_SCRUB_INTERVAL to find those that are not
+// read; 0, the default, turns scrubbing off.
+func (n *Node) startCorruptionReports(ctx context.Context) {
+	n.run(func() {
+		for {
+			select {
+			case block := <-n.corruptBlocks:
+				if err := n.sendCorruption(block); err != nil {
+					log.Printf("Failed to report corrupted block %s: %v", block.name, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	if interval := n.config.ScrubInterval; interval > 0 {
+		n.run(func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				if err := n.scrub(); err != nil {
+					log.Printf("Scrub failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// scrub verifies every block with a checksum against it.
+func (n *Node) scrub() error {
+	names, err := n.store.List()
+	if err != nil {
+		return err
+	}
+
+	checked, corrupted := 0, 0
+	for _, name := range names {
+		block, ok := strings.CutSuffix(name, checksumSuffix)
+		if !ok {
+			continue
+		}
+		content, err := n.store.Open(block)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = n.verifyBlock(block, content)
+		content.Close()
+		checked++
+		if errors.Is(err, errBlockCorrupt) {
+			corrupted++
+			log.Printf("Block %s is corrupted", block)
+			n.reportCorruption(block, "scrub")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Scrub checked %d blocks, %d corrupted", checked, corrupted)
+	return nil
+}
+
+// sendCorruption reports a block along with the checksum it was stored with,
+// so the central server can ignore a report about a version it has since
+// replaced.
+func (n *Node) sendCorruption(block corruptBlock) error {
+	sum, err := n.store.Read(block.name + checksumSuffix)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"Url":    n.url,
+		"ID":     n.id,
+		"Block":  block.name,
+		"Hash":   string(bytes.TrimSpace(sum)),
+		"Source": block.source,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.centralEndpoint("/nodes/corruption"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	n.withJoinSecret(req)
+
+	res, err := n.registration.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("report answered %s", res.Status)
+	}
+	return nil
+}
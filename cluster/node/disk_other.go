@@ -0,0 +1,9 @@
+//go:build !unix
+
+package node
+
+import "errors"
+
+func freeDiskSpace(string) (int64, error) {
+	return 0, errors.New("free disk space is not available on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package node
+
+import "golang.org/x/sys/unix"
+
+// freeDiskSpace returns the bytes available to the node on the filesystem
+// holding dir.
+func freeDiskSpace(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,142 @@
+package node
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	fsyncBlock = "block"
+	fsyncBatch = "batch"
+	fsyncAsync = "async"
+)
+
+// syncer is anything whose writes can be flushed to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// durability decides when block writes reach stable storage. With "block",
+// every block is flushed before it is acknowledged; with "batch", blocks are
+// acknowledged at once and flushed together every interval, so a crash loses
+// at most that window; with "async", flushing is left to the operating
+// system. syncDir also flushes the directory after a block is renamed into
+// place, so the new name survives a crash too.
+type durability struct {
+	mode     string
+	syncDir  bool
+	interval time.Duration
+
+	mutex   sync.Mutex
+	files   map[string]bool
+	syncers map[syncer]bool
+}
+
+// newDurability returns the durability of the FDS_NODE_FSYNC settings of
+// cfg; in batch mode, run must flush the blocks.
+func newDurability(cfg Config) *durability {
+	d := &durability{mode: cfg.Fsync, syncDir: cfg.FsyncDir, interval: cfg.FsyncInterval}
+	if d.mode == fsyncBatch {
+		d.files = make(map[string]bool)
+		d.syncers = make(map[syncer]bool)
+	}
+	return d
+}
+
+// syncBeforeRename flushes a block file about to be renamed into place, in
+// block mode.
+func (d *durability) syncBeforeRename(file *os.File) error {
+	if d.mode != fsyncBlock {
+		return nil
+	}
+	return d.sync(file)
+}
+
+// renamed is called once a block file has been renamed to path.
+func (d *durability) renamed(path string) error {
+	if d.mode == fsyncBatch {
+		d.mutex.Lock()
+		d.files[path] = true
+		d.mutex.Unlock()
+		return nil
+	}
+	if d.syncDir {
+		return d.syncPath(filepath.Dir(path))
+	}
+	return nil
+}
+
+// written is called once a block has been written to s, such as the file of
+// the key-value store.
+func (d *durability) written(s syncer) error {
+	switch d.mode {
+	case fsyncBlock:
+		return d.sync(s)
+	case fsyncBatch:
+		d.mutex.Lock()
+		d.syncers[s] = true
+		d.mutex.Unlock()
+	}
+	return nil
+}
+
+func (d *durability) sync(s syncer) error {
+	start := time.Now()
+	err := s.Sync()
+	blockIODuration.WithLabelValues("fsync").Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (d *durability) syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return d.sync(file)
+}
+
+// run flushes the blocks written since the previous batch at each interval,
+// and once more when ctx is done.
+func (d *durability) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for stopped := false; !stopped; {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			stopped = true
+		}
+
+		d.mutex.Lock()
+		files, syncers := d.files, d.syncers
+		d.files, d.syncers = make(map[string]bool), make(map[syncer]bool)
+		d.mutex.Unlock()
+
+		dirs := make(map[string]bool)
+		for path := range files {
+			// A block deleted or replaced since needs no flush of its own.
+			if err := d.syncPath(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to flush block %s: %v", path, err)
+			}
+			dirs[filepath.Dir(path)] = true
+		}
+		for s := range syncers {
+			if err := d.sync(s); err != nil {
+				log.Printf("Failed to flush block store: %v", err)
+			}
+		}
+		if d.syncDir {
+			for dir := range dirs {
+				if err := d.syncPath(dir); err != nil {
+					log.Printf("Failed to flush directory %s: %v", dir, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package node
+
+import (
+	"FDS/blocksign"
+	"FDS/dfspb"
+	"FDS/grpcwire"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"time"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockService receives blocks streamed by the central server.
+type blockService struct {
+	node *Node
+}
+
+// StoreBlock writes the incoming chunks to a new version of the block and only
+// commits it once the last chunk has been verified, so a cancelled or
+// corrupted transfer never leaves a partial block behind.
+func (b *blockService) StoreBlock(stream dfspb.BlockService_StoreBlockServer) error {
+	start := time.Now()
+	err := b.storeBlock(stream)
+	blockStoreDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logf(stream.Context(), "Failed to store block: %v", err)
+	}
+	return err
+}
+
+func (b *blockService) storeBlock(stream dfspb.BlockService_StoreBlockServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	name := first.GetName()
+	if !validBlockName(name) {
+		return grpcwire.Errorf(grpcwire.InvalidArgument, "invalid block name %q", name)
+	}
+
+	var metadata http.Header
+	if s, ok := stream.(interface{ Header() http.Header }); ok {
+		metadata = s.Header()
+	}
+	n := b.node
+	expectedHash, err := blocksign.Verify(metadata, []byte(n.config.BlockSigningKey), name, time.Now())
+	if err != nil {
+		return grpcwire.Errorf(grpcwire.PermissionDenied, "block %s: %v", name, err)
+	}
+
+	digests, err := blocksign.ParseDigests(metadata)
+	if err != nil {
+		return grpcwire.Errorf(grpcwire.InvalidArgument, "block %s: %v", name, err)
+	}
+
+	tmp, err := n.store.Create(name)
+	if err != nil {
+		return grpcwire.Errorf(grpcwire.Internal, "failed to create block file: %v", err)
+	}
+	defer tmp.Abort()
+
+	hash := sha256.New()
+	checksum := crc32.New(castagnoliTable)
+	var received int64
+	// writeTime only counts the disk writes, not the time spent waiting for
+	// the next chunk.
+	var writeTime time.Duration
+
+	for msg := first; ; {
+		if msg.GetOffset() != received {
+			return grpcwire.Errorf(grpcwire.InvalidArgument, "chunk at offset %d, expected %d", msg.GetOffset(), received)
+		}
+
+		if n.config.MaxBlockSize > 0 && received+int64(len(msg.GetChunk())) > n.config.MaxBlockSize {
+			return grpcwire.Errorf(grpcwire.ResourceExhausted, "block larger than %d bytes", n.config.MaxBlockSize)
+		}
+
+		writeStart := time.Now()
+		if _, err := io.MultiWriter(tmp, checksum, hash, digests).Write(msg.GetChunk()); err != nil {
+			return grpcwire.Errorf(grpcwire.Internal, "failed to write block: %v", err)
+		}
+		writeTime += time.Since(writeStart)
+		received += int64(len(msg.GetChunk()))
+
+		if checksum.Sum32() != msg.GetChecksum() {
+			return grpcwire.Errorf(grpcwire.DataLoss, "checksum mismatch at offset %d", received)
+		}
+
+		if msg.GetLast() {
+			if expectedHash != "" && hex.EncodeToString(hash.Sum(nil)) != expectedHash {
+				return grpcwire.Errorf(grpcwire.DataLoss, "block %s: %v", name, blocksign.ErrHashMismatch)
+			}
+			if err := digests.Check(); err != nil {
+				return grpcwire.Errorf(grpcwire.DataLoss, "block %s: %v", name, err)
+			}
+
+			commitStart := time.Now()
+			if err := tmp.Commit(); err != nil {
+				return grpcwire.Errorf(grpcwire.Internal, "failed to commit block: %v", err)
+			}
+			n.cache.Invalidate(name)
+			blockIODuration.WithLabelValues("write").Observe((writeTime + time.Since(commitStart)).Seconds())
+
+			stored, err := n.storedHash(name)
+			if err != nil {
+				return grpcwire.Errorf(grpcwire.Internal, "failed to read back block: %v", err)
+			}
+
+			logf(stream.Context(), "Block %s stored (%d bytes)", name, received)
+			blockTransferSize.WithLabelValues("store").Observe(float64(received))
+
+			return stream.Send(&dfspb.StoreBlockResponse{Received: received, Checksum: checksum.Sum32(), Committed: true, Sha256: stored})
+		}
+
+		if err := stream.Send(&dfspb.StoreBlockResponse{Received: received, Checksum: checksum.Sum32()}); err != nil {
+			return err
+		}
+
+		msg, err = stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return grpcwire.Errorf(grpcwire.Aborted, "stream ended before the last chunk")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package node
+
+import (
+	"FDS/kvlog"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// kvStoreFile is the name of the key-value store in the storage directory;
+// block names end in .bin, so none can clash with it.
+const kvStoreFile = ".blocks.kv"
+
+const defaultKVMaxBlock = 1 * MB
+
+// kvStore keeps blocks up to maxBlock bytes in an embedded key-value store,
+// one record each in a single file, and larger blocks as files of their own.
+// Nodes holding many small blocks then use one inode for all of them and read
+// them with a single positioned read.
+type kvStore struct {
+	db       *kvlog.DB
+	files    localStore
+	maxBlock int
+}
+
+// newKVStore opens the store in the directory of files, which keeps the
+// blocks larger than maxBlock bytes.
+func newKVStore(files localStore, maxBlock int) (*kvStore, error) {
+	db, err := kvlog.Open(filepath.Join(files.dir, kvStoreFile))
+	if err != nil {
+		return nil, err
+	}
+	return &kvStore{db: db, files: files, maxBlock: maxBlock}, nil
+}
+
+// Create buffers the block until it outgrows maxBlock, at which point it is
+// written to a file instead.
+func (k *kvStore) Create(name string) (BlockWriter, error) {
+	return &kvWriter{store: k, name: name}, nil
+}
+
+type kvWriter struct {
+	store  *kvStore
+	name   string
+	buffer bytes.Buffer
+	file   BlockWriter
+}
+
+func (w *kvWriter) Write(p []byte) (int, error) {
+	if w.file == nil && w.buffer.Len()+len(p) > w.store.maxBlock {
+		file, err := w.store.files.Create(w.name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file.Write(w.buffer.Bytes()); err != nil {
+			file.Abort()
+			return 0, err
+		}
+		w.file = file
+		w.buffer = bytes.Buffer{}
+	}
+	if w.file != nil {
+		return w.file.Write(p)
+	}
+	return w.buffer.Write(p)
+}
+
+// Commit stores the new version and removes the previous one if it was kept
+// on the other side.
+func (w *kvWriter) Commit() error {
+	if w.file != nil {
+		if err := w.file.Commit(); err != nil {
+			return err
+		}
+		if err := w.store.db.Delete(w.name); err != nil && !errors.Is(err, kvlog.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+
+	if err := w.store.db.Put(w.name, w.buffer.Bytes()); err != nil {
+		return err
+	}
+	if err := w.store.files.durable.written(w.store.db); err != nil {
+		return err
+	}
+	if err := w.store.files.Delete(w.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (w *kvWriter) Abort() {
+	if w.file != nil {
+		w.file.Abort()
+	}
+}
+
+func (k *kvStore) Read(name string) ([]byte, error) {
+	data, err := k.db.Get(name)
+	if errors.Is(err, kvlog.ErrNotFound) {
+		return k.files.Read(name)
+	}
+	return data, err
+}
+
+func (k *kvStore) Open(name string) (io.ReadSeekCloser, error) {
+	data, err := k.db.Get(name)
+	if errors.Is(err, kvlog.ErrNotFound) {
+		return k.files.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return openBytes(data), nil
+}
+
+func (k *kvStore) Exists(name string) (bool, error) {
+	if k.db.Has(name) {
+		return true, nil
+	}
+	return k.files.Exists(name)
+}
+
+func (k *kvStore) List() ([]string, error) {
+	names, err := k.files.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range k.db.Keys() {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (k *kvStore) Delete(name string) error {
+	err := k.db.Delete(name)
+	if errors.Is(err, kvlog.ErrNotFound) {
+		return k.files.Delete(name)
+	}
+	return err
+}
+
+// Copy duplicates a small block as a new record; large blocks are copied by
+// the file side, as hard links when possible.
+func (k *kvStore) Copy(from string, to string) error {
+	data, err := k.db.Get(from)
+	if errors.Is(err, kvlog.ErrNotFound) {
+		if err := k.files.Copy(from, to); err != nil {
+			return err
+		}
+		if err := k.db.Delete(to); err != nil && !errors.Is(err, kvlog.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := k.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Used counts the file of the key-value store as it is on disk, including
+// the records compaction will reclaim.
+func (k *kvStore) Used() (int64, error) {
+	return k.files.Used()
+}
+
+func (k *kvStore) Free() (int64, error) {
+	return k.files.Free()
+}
+
+func (k *kvStore) Close() error {
+	return k.db.Close()
+}
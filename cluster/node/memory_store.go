@@ -0,0 +1,114 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// memoryStore keeps the blocks in memory, for tests and throwaway nodes.
+// Block contents are never modified once committed, so copies share them.
+type memoryStore struct {
+	mutex  sync.RWMutex
+	blocks map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blocks: make(map[string][]byte)}
+}
+
+func notExist(name string) error {
+	return fmt.Errorf("block %s: %w", name, os.ErrNotExist)
+}
+
+func (m *memoryStore) Create(name string) (BlockWriter, error) {
+	return &memoryWriter{store: m, name: name}, nil
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	store *memoryStore
+	name  string
+}
+
+func (w *memoryWriter) Commit() error {
+	w.store.mutex.Lock()
+	defer w.store.mutex.Unlock()
+	w.store.blocks[w.name] = w.Bytes()
+	return nil
+}
+
+func (w *memoryWriter) Abort() {}
+
+func (m *memoryStore) Read(name string) ([]byte, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	data, ok := m.blocks[name]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return data, nil
+}
+
+func (m *memoryStore) Open(name string) (io.ReadSeekCloser, error) {
+	data, err := m.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	return openBytes(data), nil
+}
+
+func (m *memoryStore) Exists(name string) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, ok := m.blocks[name]
+	return ok, nil
+}
+
+func (m *memoryStore) List() ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	names := make([]string, 0, len(m.blocks))
+	for name := range m.blocks {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (m *memoryStore) Delete(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.blocks[name]; !ok {
+		return notExist(name)
+	}
+	delete(m.blocks, name)
+	return nil
+}
+
+func (m *memoryStore) Copy(from string, to string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.blocks[from]
+	if !ok {
+		return notExist(from)
+	}
+	m.blocks[to] = data
+	return nil
+}
+
+func (m *memoryStore) Used() (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var size int64
+	for _, data := range m.blocks {
+		size += int64(len(data))
+	}
+	return size, nil
+}
+
+func (m *memoryStore) Free() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
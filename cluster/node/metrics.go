@@ -0,0 +1,191 @@
+package node
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var requestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"method", "route", "code"},
+)
+
+var activeRequests = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests being served",
+	},
+)
+
+var blockIODuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "block_io_duration_seconds",
+		Help:    "Disk time to read or write one block",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	},
+	[]string{"operation"},
+)
+
+var bytesServed = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "block_bytes_served_total",
+		Help: "Block bytes sent to clients",
+	},
+)
+
+var blockStoreDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "block_store_duration_seconds",
+		Help:    "Time to receive and commit one block",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	},
+	[]string{"result"},
+)
+
+var blockTransferSize = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "block_transfer_size_bytes",
+		Help:    "Size of stored and retrieved blocks",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 11),
+	},
+	[]string{"operation"},
+)
+
+var blockCorruptions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "block_corruptions_total",
+		Help: "Blocks found not to match their checksum, by read or scrub",
+	},
+	[]string{"source"},
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// ReadFrom hands streamed blocks to the underlying writer, which sends files
+// with sendfile.
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return io.Copy(r.ResponseWriter, src)
+}
+
+// withMetrics records the duration of every HTTP request by route.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		activeRequests.Inc()
+		defer activeRequests.Dec()
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsRegistry holds the metrics of the nodes apart from the default
+// registry, so nodes can run in the same process as the central server,
+// whose metrics share some of their names.
+var metricsRegistry = prometheus.NewRegistry()
+
+// registerMetrics registers the metrics shared by every node of the
+// process, once.
+var registerMetrics = sync.OnceFunc(func() {
+	metricsRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metricsRegistry.MustRegister(requestDuration, activeRequests, blockStoreDuration, blockTransferSize, blockIODuration, bytesServed)
+	metricsRegistry.MustRegister(blockCacheRequests, blockCacheBytes)
+	metricsRegistry.MustRegister(blockCorruptions)
+})
+
+// metricsHandler serves the metrics of the nodes of the process.
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(metricsRegistry, promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// registerSpaceMetrics exports the space used by the blocks and the space
+// left on the disk, both computed when scraped, and returns the function
+// that unregisters them.
+func (n *Node) registerSpaceMetrics() func() {
+	labels := prometheus.Labels{"node": strings.TrimPrefix(strings.TrimPrefix(n.url, "http://"), "https://")}
+
+	occupied := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "node_occupied_space_bytes",
+			Help:        "Bytes used by the stored blocks",
+			ConstLabels: labels,
+		},
+		func() float64 {
+			size, err := n.store.Used()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(size)
+		},
+	)
+	free := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "node_free_space_bytes",
+			Help:        "Bytes available on the disk holding the blocks",
+			ConstLabels: labels,
+		},
+		func() float64 {
+			free, err := n.store.Free()
+			if err != nil {
+				return math.NaN()
+			}
+			return float64(free)
+		},
+	)
+	metricsRegistry.MustRegister(occupied, free)
+	return func() {
+		metricsRegistry.Unregister(occupied)
+		metricsRegistry.Unregister(free)
+	}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
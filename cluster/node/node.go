@@ -0,0 +1,532 @@
+// Package node is a storage node of the cluster: it stores the blocks the
+// central server sends it and serves them back, registers with the central
+// server and reports its usage and damaged blocks to it.
+//
+//	n, err := node.New(cfg)
+//	...
+//	err = n.Start(ctx)
+//	...
+//	err = n.Wait()
+//
+// Several nodes can run in one process, each with its own storage directory.
+package node
+
+import (
+	"FDS/blocksign"
+	"FDS/dfspb"
+	"FDS/grpcwire"
+	"FDS/urlsign"
+	"FDS/version"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MB = 1024 * 1024
+
+// shutdownTimeout bounds how long a stopping Node waits for the requests in
+// flight.
+const shutdownTimeout = 30 * time.Second
+
+// baseFeatures lists the optional capabilities advertised on /version by
+// every node.
+var baseFeatures = []string{"block-stream", "signed-block-urls", "gzip-block-encoding", "labels", "block-copy", "verified-block-writes"}
+
+// Node is a storage node.
+type Node struct {
+	config     Config
+	id         string
+	stateDir   string
+	store      BlockStore
+	closer     io.Closer
+	cache      *blockLRU
+	durable    *durability
+	centralTLS *tls.Config
+	handler    http.Handler
+
+	clusterToken  atomic.Pointer[string]
+	serverCert    atomic.Pointer[tls.Certificate]
+	registration  *registrar
+	corruptBlocks chan corruptBlock
+
+	listener   net.Listener
+	url        string
+	background sync.WaitGroup
+	done       chan struct{}
+	err        error
+}
+
+// New sets up a node with cfg, typically from LoadConfig, creating its
+// storage directory and identity the first time. It serves nothing until
+// Start.
+func New(cfg Config) (*Node, error) {
+	if cfg.Labels == nil {
+		cfg.Labels = map[string]string{}
+	}
+	n := &Node{
+		config:        cfg,
+		cache:         newBlockCache(cfg.CacheSize),
+		durable:       newDurability(cfg),
+		corruptBlocks: make(chan corruptBlock, 64),
+		done:          make(chan struct{}),
+	}
+
+	stateDir, err := openStateDir(cfg.StorageDir)
+	if err != nil {
+		return nil, err
+	}
+	n.stateDir = stateDir
+	id, err := nodeID(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	n.id = id
+	if err := n.loadClusterToken(); err != nil {
+		return nil, err
+	}
+	if err := n.configureCentral(); err != nil {
+		return nil, err
+	}
+	store, err := n.openBlockStore(cfg.Store)
+	if err != nil {
+		return nil, err
+	}
+	n.closer, _ = store.(io.Closer)
+	n.store = checksumStore{store}
+
+	registerMetrics()
+	routerHttp := mux.NewRouter()
+	routerHttp.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		w.Write([]byte("Hello, Prometheus!"))
+	})
+	routerHttp.Handle("/metrics", metricsHandler())
+	routerHttp.HandleFunc("/health", currentHealth).Methods("GET")
+	routerHttp.HandleFunc("/version", version.Handler(n.features()...)).Methods("GET")
+	routerHttp.HandleFunc("/receiveFile", n.receiveFile).Methods("POST")
+	routerHttp.HandleFunc("/retrieveFile", n.retrieveFile).Methods("GET")
+	routerHttp.HandleFunc("/checkIfFileExists", n.checkIfFileExists).Methods("GET")
+	routerHttp.HandleFunc("/deleteFile", n.deleteFile).Methods("DELETE")
+	routerHttp.HandleFunc("/copyFile", n.copyFile).Methods("POST")
+	routerHttp.HandleFunc("/getCurrentNodeSpace", n.getCurrentNodeSpace).Methods("GET")
+	routerHttp.Use(withMetrics)
+
+	grpcServer := grpcwire.NewServer()
+	dfspb.RegisterBlockServiceServer(grpcServer, &blockService{node: n})
+
+	// Block transfers from the central server arrive as gRPC calls over
+	// HTTP/2 on the same port as the HTTP API.
+	n.handler = withRequestID(n.requireClusterToken(grpcServer.WithFallback(routerHttp)))
+	return n, nil
+}
+
+// features lists the optional capabilities advertised on /version.
+func (n *Node) features() []string {
+	features := baseFeatures
+	if n.tlsEnabled() {
+		features = append(features[:len(features):len(features)], "tls")
+	}
+	return features
+}
+
+// Start opens the listener of the node, gets its certificate when it is
+// issued, then serves blocks and keeps the node registered with the central
+// server until ctx is done. Wait returns once it has all stopped.
+func (n *Node) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", n.config.Addr)
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(n.config.Addr)
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	n.listener = listener
+	n.url = n.scheme() + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+
+	ctx, stop := context.WithCancel(ctx)
+	if err := n.startTLS(ctx); err != nil {
+		stop()
+		listener.Close()
+		return err
+	}
+	unregister := n.registerSpaceMetrics()
+	if n.durable.mode == fsyncBatch {
+		n.run(func() { n.durable.run(ctx) })
+	}
+	if err := n.startRegistration(ctx); err != nil {
+		stop()
+		listener.Close()
+		unregister()
+		return err
+	}
+	n.startReports(ctx)
+	n.startCorruptionReports(ctx)
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	protocols.SetHTTP2(true)
+
+	server := &http.Server{
+		Handler:   n.handler,
+		Protocols: &protocols,
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		if n.tlsEnabled() {
+			server.TLSConfig = n.serverTLS()
+			stopped <- server.ServeTLS(listener, "", "")
+		} else {
+			stopped <- server.Serve(listener)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case n.err = <-stopped:
+		}
+		stop()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut the node down: %v", err)
+		}
+		n.background.Wait()
+		unregister()
+		if n.closer != nil {
+			if err := n.closer.Close(); err != nil {
+				log.Printf("Failed to close the block store: %v", err)
+			}
+		}
+		close(n.done)
+	}()
+	return nil
+}
+
+// run runs fn in the background; the Node stops once fn has returned.
+func (n *Node) run(fn func()) {
+	n.background.Add(1)
+	go func() {
+		defer n.background.Done()
+		fn()
+	}()
+}
+
+// Wait waits for the Node to stop, and returns the error that stopped it,
+// nil if it stopped because the context of Start was done.
+func (n *Node) Wait() error {
+	<-n.done
+	return n.err
+}
+
+// URL returns the URL a started Node registers with.
+func (n *Node) URL() string {
+	return n.url
+}
+
+// ID returns the persistent identity of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+func currentHealth(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	return
+}
+
+func (n *Node) receiveFile(w http.ResponseWriter, r *http.Request) {
+
+	file, header, err := r.FormFile("file")
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if n.config.MaxBlockSize > 0 && header.Size > n.config.MaxBlockSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	name := filepath.Base(header.Filename)
+	if !validBlockName(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	expectedHash, err := blocksign.Verify(r.Header, []byte(n.config.BlockSigningKey), name, time.Now())
+	if err != nil {
+		logf(r.Context(), "Rejected block %s: %v", name, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	digests, err := blocksign.ParseDigests(http.Header(header.Header))
+	if err != nil {
+		logf(r.Context(), "Rejected block %s: %v", name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dest, err := n.store.Create(name)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	start := time.Now()
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dest, hash, digests), file)
+	if err == nil {
+		var mismatch error
+		if expectedHash != "" && hex.EncodeToString(hash.Sum(nil)) != expectedHash {
+			mismatch = blocksign.ErrHashMismatch
+		} else {
+			mismatch = digests.Check()
+		}
+		if mismatch != nil {
+			// The block was damaged on the way: keep the previous version.
+			dest.Abort()
+			logf(r.Context(), "Rejected block %s: %v", name, mismatch)
+			w.WriteHeader(blocksign.StatusCorrupt)
+			return
+		}
+	}
+	if err == nil {
+		err = dest.Commit()
+	}
+	blockIODuration.WithLabelValues("write").Observe(time.Since(start).Seconds())
+	n.cache.Invalidate(name)
+
+	if err != nil {
+		dest.Abort()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	stored, err := n.storedHash(name)
+	if err != nil {
+		logf(r.Context(), "Failed to read back block %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(blocksign.HashHeader, stored)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *Node) retrieveFile(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("filename")
+
+	if !validBlockName(fileName) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// With a signing key configured, blocks are only served to holders of a
+	// URL signed by the central server.
+	if key := n.config.BlockSigningKey; key != "" {
+		if err := urlsign.VerifyQuery([]byte(key), r.URL.Query(), http.MethodGet, fileName, time.Now()); err != nil {
+			logf(r.Context(), "Rejected request for block %s: %v", fileName, err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	var content io.ReadSeeker
+	if body, cached := n.cache.Get(fileName); cached {
+		content = bytes.NewReader(body)
+	} else {
+		block, err := n.store.Open(fileName)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer block.Close()
+		content = block
+
+		// Blocks the cache would keep are read whole; the others are streamed
+		// from the store, so a read never holds a large block in memory.
+		size, err := block.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = block.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var body []byte
+		if n.cache.Admits(size) {
+			start := time.Now()
+			body, err = io.ReadAll(block)
+			blockIODuration.WithLabelValues("read").Observe(time.Since(start).Seconds())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			content = bytes.NewReader(body)
+		}
+
+		// A damaged block gets its own status, so the central server can
+		// tell it from a failing node and have the block repaired.
+		if err := n.verifyBlock(fileName, content); errors.Is(err, errBlockCorrupt) {
+			logf(r.Context(), "Block %s is corrupted", fileName)
+			n.reportCorruption(fileName, "read")
+			w.WriteHeader(blocksign.StatusCorrupt)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if body != nil {
+			n.cache.Put(fileName, body)
+		}
+	}
+
+	// Blocks are pieces of a gzip stream, so a single-block file can be handed
+	// to the client as-is with the matching content encoding.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.URL.Query().Get("encoding") == "gzip" {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if downloadName := r.URL.Query().Get("download"); downloadName != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadName}))
+	}
+
+	// ServeContent answers Range requests, and copies files to the connection
+	// without going through user space.
+	counter := &servedBytes{ResponseWriter: w}
+	http.ServeContent(counter, r, "", time.Time{}, content)
+	bytesServed.Add(float64(counter.n))
+	blockTransferSize.WithLabelValues("retrieve").Observe(float64(counter.n))
+}
+
+// servedBytes counts the bytes of a response, keeping the ReadFrom of the
+// writer it wraps.
+type servedBytes struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (s *servedBytes) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *servedBytes) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(s.ResponseWriter, src)
+	s.n += n
+	return n, err
+}
+
+func (n *Node) checkIfFileExists(w http.ResponseWriter, r *http.Request) {
+
+	fileName := r.URL.Query().Get("filename")
+
+	if !validBlockName(fileName) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	exists, err := n.store.Exists(fileName)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode("File: " + fileName + " not found on the node.")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("File: " + fileName + " found on the node.")
+}
+
+func (n *Node) deleteFile(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("filename")
+
+	if !validBlockName(fileName) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	n.cache.Invalidate(fileName)
+	err := n.store.Delete(fileName)
+
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// copyFile duplicates a stored block under another name, so the central
+// server can copy files without moving their blocks over the network. The
+// local store makes the copy a hard link when the file system supports it.
+func (n *Node) copyFile(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+
+	if !validBlockName(from) || !validBlockName(to) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	err := n.store.Copy(from, to)
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "Failed to copy block %s to %s: %v", from, to, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n.cache.Invalidate(to)
+	blockIODuration.WithLabelValues("write").Observe(time.Since(start).Seconds())
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (n *Node) getCurrentNodeSpace(w http.ResponseWriter, r *http.Request) {
+	n.registration.heartbeat(r.Header.Get(centralInstanceHeader))
+	size, err := n.store.Used()
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]int64{
+		"Size": size,
+	})
+}
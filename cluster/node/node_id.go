@@ -0,0 +1,39 @@
+package node
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// nodeIDFile holds the identity of the node in its state directory, so the
+// central server recognizes the node whatever address it restarts on.
+const nodeIDFile = ".node-id"
+
+// nodeID returns the identity of the node of the state directory dir,
+// generating a random UUID the first time it is used.
+func nodeID(dir string) (string, error) {
+	path := filepath.Join(dir, nodeIDFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	id := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,171 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeTokenHeader carries the cluster token issued at registration.
+const nodeTokenHeader = "X-FDS-Node-Token"
+
+// centralInstanceHeader carries the identity of the central server process,
+// which changes whenever it restarts. It matches the central server's.
+const centralInstanceHeader = "X-FDS-Central-Instance"
+
+const (
+	minRegisterBackoff = 1 * time.Second
+	maxRegisterBackoff = 1 * time.Minute
+)
+
+// registrar keeps the node registered with the central server: it retries
+// until the central server accepts the node, and registers again when the
+// central server restarts or stops sending heartbeats.
+type registrar struct {
+	node    *Node
+	body    []byte
+	client  http.Client
+	trigger chan struct{}
+
+	mutex         sync.Mutex
+	instance      string
+	lastHeartbeat time.Time
+}
+
+// startRegistration registers the node in the background. A node that has
+// had no heartbeat for FDS_NODE_REREGISTER_AFTER (1m) registers again; 0
+// turns this off. FDS_NODE_SELF_REGISTER=false leaves registration to the
+// central server's node discovery.
+func (n *Node) startRegistration(ctx context.Context) error {
+	body, err := json.Marshal(n.registrationPayload())
+	if err != nil {
+		return err
+	}
+	n.registration = &registrar{
+		node:    n,
+		body:    body,
+		client:  n.newCentralClient(),
+		trigger: make(chan struct{}, 1),
+	}
+	if !n.config.SelfRegister {
+		return nil
+	}
+	n.registration.reregister()
+	n.run(func() { n.registration.run(ctx) })
+	if after := n.config.ReregisterAfter; after > 0 {
+		n.run(func() { n.registration.watch(ctx, after) })
+	}
+	return nil
+}
+
+// reregister asks for a new registration, unless one is already pending.
+func (r *registrar) reregister() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *registrar) run(ctx context.Context) {
+	for {
+		select {
+		case <-r.trigger:
+		case <-ctx.Done():
+			return
+		}
+
+		backoff := minRegisterBackoff
+		for {
+			err := r.register()
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to register with the central server, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, maxRegisterBackoff)
+		}
+	}
+}
+
+func (r *registrar) register() error {
+	req, err := http.NewRequest("POST", r.node.centralEndpoint("/addNode"), strings.NewReader(string(r.body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	r.node.withJoinSecret(req)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("addNode answered %s", res.Status)
+	}
+	if err := r.node.setClusterToken(res.Header.Get(nodeTokenHeader)); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.instance = res.Header.Get(centralInstanceHeader)
+	r.lastHeartbeat = time.Now()
+	r.mutex.Unlock()
+	log.Println("Registered with the central server")
+	return nil
+}
+
+// heartbeat records a heartbeat from the central server instance given, and
+// registers again if it is not the one the node registered with.
+func (r *registrar) heartbeat(instance string) {
+	r.mutex.Lock()
+	r.lastHeartbeat = time.Now()
+	restarted := instance != "" && r.instance != "" && instance != r.instance
+	if restarted {
+		// The new registration is retried until it succeeds; heartbeats
+		// arriving meanwhile need not ask for another.
+		r.instance = instance
+	}
+	r.mutex.Unlock()
+
+	if restarted {
+		log.Println("The central server restarted, registering again")
+		r.reregister()
+	}
+}
+
+// watch registers again when heartbeats stop for longer than after.
+func (r *registrar) watch(ctx context.Context, after time.Duration) {
+	ticker := time.NewTicker(after / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		r.mutex.Lock()
+		missed := !r.lastHeartbeat.IsZero() && time.Since(r.lastHeartbeat) > after
+		if missed {
+			// Wait a full period again before the next attempt.
+			r.lastHeartbeat = time.Now()
+		}
+		r.mutex.Unlock()
+
+		if missed {
+			log.Println("No heartbeat from the central server, registering again")
+			r.reregister()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// startReports pushes the usage of the node to the central server every
+// FDS_NODE_REPORT_INTERVAL (10s), so uploads can be placed without asking
+// every node first; 0 turns reports off.
+func (n *Node) startReports(ctx context.Context) {
+	interval := n.config.ReportInterval
+	if interval == 0 {
+		return
+	}
+
+	n.run(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := n.sendReport(); err != nil {
+				log.Printf("Failed to report to the central server: %v", err)
+			}
+		}
+	})
+}
+
+func (n *Node) sendReport() error {
+	used, err := n.store.Used()
+	if err != nil {
+		return err
+	}
+	free, err := n.store.Free()
+	if errors.Is(err, errors.ErrUnsupported) {
+		free = -1
+	} else if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{"Url": n.url, "ID": n.id, "Used": used, "Free": free})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.centralEndpoint("/nodes/report"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	n.withJoinSecret(req)
+
+	res, err := n.registration.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		// The central server knows the node even if its heartbeats are off.
+		n.registration.heartbeat("")
+		return nil
+	case http.StatusNotFound:
+		// The central server does not know this node, typically because it
+		// restarted.
+		n.registration.reregister()
+		return nil
+	}
+	return fmt.Errorf("report answered %s", res.Status)
+}
@@ -0,0 +1,36 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// withRequestID echoes the X-Request-ID set by the central server and keeps
+// it in the context, so node log lines can be matched with the central ones.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// logf logs like log.Printf, prefixed with the request ID of ctx if any.
+func logf(ctx context.Context, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if id, _ := ctx.Value(requestIDKey{}).(string); id != "" {
+		message = "[" + id + "] " + message
+	}
+	log.Print(message)
+}
@@ -0,0 +1,133 @@
+package node
+
+import (
+	"FDS/s3"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+)
+
+// s3Store keeps each block in an object of a bucket, under a prefix, with the
+// same FDS_S3_* settings as the central server.
+type s3Store struct {
+	client *s3.Client
+	prefix string
+}
+
+func newS3Store(spec string, cfg Config) (*s3Store, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(spec, "s3://"), "/")
+	client, err := s3.New(bucket, s3.Config{
+		Endpoint:  cfg.S3Endpoint,
+		Region:    cfg.S3Region,
+		AccessKey: cfg.S3AccessKey,
+		SecretKey: cfg.S3SecretKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{client: client, prefix: prefix}, nil
+}
+
+func (s *s3Store) key(name string) string { return s.prefix + name }
+
+// Create buffers the block and uploads it on commit; an object only becomes
+// visible once it is complete.
+func (s *s3Store) Create(name string) (BlockWriter, error) {
+	return &s3Writer{store: s, name: name}, nil
+}
+
+type s3Writer struct {
+	bytes.Buffer
+	store *s3Store
+	name  string
+}
+
+func (w *s3Writer) Commit() error {
+	return w.store.client.Put(context.Background(), w.store.key(w.name), bytes.NewReader(w.Bytes()), int64(w.Len()))
+}
+
+func (w *s3Writer) Abort() {}
+
+func (s *s3Store) Read(name string) ([]byte, error) {
+	body, err := s.client.Get(context.Background(), s.key(name))
+	if errors.Is(err, s3.ErrNotFound) {
+		return nil, notExist(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (s *s3Store) Open(name string) (io.ReadSeekCloser, error) {
+	data, err := s.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	return openBytes(data), nil
+}
+
+func (s *s3Store) Exists(name string) (bool, error) {
+	keys, err := s.client.List(context.Background(), s.key(name))
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(keys, s.key(name)), nil
+}
+
+func (s *s3Store) List() ([]string, error) {
+	keys, err := s.client.List(context.Background(), s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		// Keys further down the prefix are not blocks of this node.
+		if name := strings.TrimPrefix(key, s.prefix); !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *s3Store) Delete(name string) error {
+	exists, err := s.Exists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notExist(name)
+	}
+	return s.client.Delete(context.Background(), s.key(name))
+}
+
+func (s *s3Store) Copy(from string, to string) error {
+	data, err := s.Read(from)
+	if err != nil {
+		return err
+	}
+	return s.client.Put(context.Background(), s.key(to), bytes.NewReader(data), int64(len(data)))
+}
+
+func (s *s3Store) Used() (int64, error) {
+	objects, err := s.client.Objects(context.Background(), s.prefix)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, object := range objects {
+		size += object.Size
+	}
+	return size, nil
+}
+
+func (s *s3Store) Free() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,39 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// stateDirName is the directory, inside the storage directory, holding the
+// files of the node itself: its identity, its cluster token and the TLS key
+// and certificate issued to it. They are kept apart from the blocks, so no
+// block request reaches them whatever name it gives.
+const stateDirName = ".node"
+
+// stateFiles are the files kept in the state directory, which nodes kept
+// beside their blocks before it existed.
+var stateFiles = []string{nodeIDFile, clusterTokenFile, issuedKeyFile, issuedCertFile}
+
+// openStateDir returns the state directory of the storage directory dir,
+// creating it the first time and moving in the files left beside the blocks
+// by earlier versions.
+func openStateDir(dir string) (string, error) {
+	stateDir := filepath.Join(dir, stateDirName)
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return "", err
+	}
+	for _, name := range stateFiles {
+		err := os.Rename(filepath.Join(dir, name), filepath.Join(stateDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return stateDir, nil
+}
+
+// statePath returns the path of the state file name.
+func (n *Node) statePath(name string) string {
+	return filepath.Join(n.stateDir, name)
+}
@@ -0,0 +1,262 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// The key and certificate issued by the central server are kept in the
+// state directory, so a restarted node serves HTTPS before it registers.
+const (
+	issuedKeyFile  = ".node-key.pem"
+	issuedCertFile = ".node-cert.pem"
+)
+
+// certCheckInterval is how often the certificate is checked for renewal.
+const certCheckInterval = time.Minute
+
+func (n *Node) tlsEnabled() bool {
+	return n.config.TLSCertFile != "" || n.config.TLSIssued
+}
+
+// scheme is the scheme of the URL the node registers with.
+func (n *Node) scheme() string {
+	if n.tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// startTLS loads the certificate of the node, asking the central server for
+// one until it is issued, and keeps it renewed until ctx is done.
+func (n *Node) startTLS(ctx context.Context) error {
+	if !n.tlsEnabled() {
+		return nil
+	}
+
+	if n.config.TLSCertFile != "" {
+		modTime, err := n.loadCertFiles(time.Time{})
+		if err != nil {
+			return err
+		}
+		n.every(ctx, certCheckInterval, func() {
+			if modTime, err = n.loadCertFiles(modTime); err != nil {
+				log.Printf("Failed to reload the TLS certificate, keeping the previous one: %v", err)
+			}
+		})
+		return nil
+	}
+
+	u, err := url.Parse(n.url)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	key, err := n.issuedKey()
+	if err != nil {
+		return err
+	}
+	if cert, err := tls.LoadX509KeyPair(n.statePath(issuedCertFile), n.statePath(issuedKeyFile)); err == nil {
+		n.serverCert.Store(&cert)
+	}
+
+	backoff := minRegisterBackoff
+	for n.renewalDue() {
+		err := n.requestCertificate(host, key)
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to get a certificate from the central server, retrying in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, maxRegisterBackoff)
+	}
+	n.every(ctx, certCheckInterval, func() {
+		if !n.renewalDue() {
+			return
+		}
+		if err := n.requestCertificate(host, key); err != nil {
+			log.Printf("Failed to renew the TLS certificate: %v", err)
+		}
+	})
+	return nil
+}
+
+// every runs fn in the background at each interval until ctx is done.
+func (n *Node) every(ctx context.Context, interval time.Duration, fn func()) {
+	n.run(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// serverTLS returns the TLS configuration the node serves with.
+func (n *Node) serverTLS() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return n.serverCert.Load(), nil
+		},
+	}
+}
+
+// loadCertFiles loads the certificate files if they changed after modTime,
+// and returns their modification time.
+func (n *Node) loadCertFiles(modTime time.Time) (time.Time, error) {
+	certFile, keyFile := n.config.TLSCertFile, n.config.TLSKeyFile
+	latest := modTime
+	for _, name := range []string{certFile, keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	if !latest.After(modTime) {
+		return modTime, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return modTime, err
+	}
+	if n.serverCert.Swap(&cert) != nil {
+		log.Println("TLS certificate reloaded")
+	}
+	return latest, nil
+}
+
+// renewalDue tells whether the node has no certificate yet, or one past two
+// thirds of its lifetime.
+func (n *Node) renewalDue() bool {
+	cert := n.serverCert.Load()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return time.Now().After(cert.Leaf.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// issuedKey returns the key certificates are issued for, generated once.
+func (n *Node) issuedKey() (*ecdsa.PrivateKey, error) {
+	name := n.statePath(issuedKeyFile)
+	data, err := os.ReadFile(name)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM key", name)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ECDSA key", name)
+		}
+		return ecKey, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// requestCertificate has the central server issue a certificate for host,
+// and serves it from then on.
+func (n *Node) requestCertificate(host string, key *ecdsa.PrivateKey) error {
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: host}}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"CSR": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.centralEndpoint("/nodes/certificate"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	n.withJoinSecret(req)
+
+	client := n.newCentralClient()
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("nodes/certificate answered %s", res.Status)
+	}
+	var issued struct {
+		Certificate string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&issued); err != nil {
+		return err
+	}
+
+	keyPEM, err := os.ReadFile(n.statePath(issuedKeyFile))
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair([]byte(issued.Certificate), keyPEM)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(n.statePath(issuedCertFile), []byte(issued.Certificate), 0o600); err != nil {
+		return err
+	}
+	n.serverCert.Store(&cert)
+	log.Printf("TLS certificate issued until %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// responseRecorder captures the status code and body size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses (job events, gRPC) working through the
+// recorder.
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withAccessLog writes one JSON log line per request once it has been served
+// and records its duration. It must run after withRequestID and
+// withRequestCaller.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(recorder, r)
+
+		duration := time.Since(start)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		} else if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			route = r.URL.Path
+		}
+		observeRequest(r.Method, route, recorder.status, duration)
+
+		fields := []zap.Field{
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", recorder.status),
+			zap.Duration("duration", duration),
+			zap.Int64("bytes", recorder.bytes),
+			zap.String("caller", callerFromContext(r.Context()).Identity),
+			zap.String("remoteAddr", r.RemoteAddr),
+			zap.String("route", route),
+		}
+		if status := w.Header().Get("Grpc-Status"); status != "" {
+			fields = append(fields, zap.String("grpcStatus", status))
+		}
+
+		requestLogger(r.Context()).Info("Request served", fields...)
+	})
+}
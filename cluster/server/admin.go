@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// requireAdmin protects the /admin endpoints. With FDS_ADMIN_TOKEN set the
+// request must carry it as a bearer token; otherwise only loopback clients
+// are let through.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+				requestLogger(r.Context()).Warn("Rejected admin request",
+					zap.String("path", r.URL.Path),
+					zap.String("remoteAddr", r.RemoteAddr),
+				)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				respondWithError(w, http.StatusUnauthorized, "Admin token required")
+				return
+			}
+		} else if !isLoopback(r.RemoteAddr) {
+			respondWithError(w, http.StatusForbidden, "Admin endpoints are only available from localhost")
+			return
+		}
+
+		c := callerFromContext(r.Context())
+		c.Identity = "admin"
+		next.ServeHTTP(w, r.WithContext(withCaller(r.Context(), c)))
+	})
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type BlockReplica struct {
+	Address    string       `json:"address"`
+	State      ReplicaState `json:"state"`
+	Registered bool         `json:"registered"`
+	// Present is only reported when the nodes were asked, see GetBlockMap.
+	Present *bool  `json:"present,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BlockMapEntry struct {
+	Position int            `json:"position"`
+	Name     string         `json:"name"`
+	Size     int64          `json:"size"`
+	SHA256   string         `json:"sha256"`
+	Nodes    []BlockReplica `json:"nodes"`
+	Error    string         `json:"error,omitempty"`
+}
+
+type BlockMap struct {
+	Name string `json:"name"`
+	// Packed files list the blocks of their container.
+	Packed *PackedLocation `json:"packed,omitempty"`
+	Blocks []BlockMapEntry `json:"blocks"`
+}
+
+// GetBlockMap lists where every block of a file is stored. With check=true
+// each node is also asked whether it still holds the block.
+func (f *fileManager) GetBlockMap(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/files/{name}/blocks").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+	check, _ := strconv.ParseBool(r.URL.Query().Get("check"))
+
+	blockMap := BlockMap{Name: fileName}
+	blocksOf := FileMetadata{Name: fileName}
+	if metadata, err := f.redisManager.GetFileMetadata(fileName); err == nil {
+		blocksOf = metadata
+		if metadata.Packed != nil {
+			blockMap.Packed = metadata.Packed
+			blocksOf = FileMetadata{Name: containerFileName(metadata.Packed.Container)}
+		}
+	}
+
+	numOfBlocks, err := f.redisManager.GetNumberOfBlocksOfAFile(GenerateFileHash(blocksOf.Name))
+	if errors.Is(err, ErrFileNotFound) && blockMap.Packed != nil {
+		// The container is still staged in Redis and has no blocks yet.
+		numOfBlocks, err = 0, nil
+	}
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve number of blocks", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve block map")
+		return
+	}
+
+	registered := make(map[string]bool)
+	f.nodeManager.mutex.Lock()
+	for _, address := range f.nodeManager.NodeAddresses {
+		registered[address] = true
+	}
+	f.nodeManager.mutex.Unlock()
+
+	blockMap.Blocks = make([]BlockMapEntry, 0, numOfBlocks)
+	for i := 1; i <= numOfBlocks; i++ {
+		blockName := blocksOf.blockName(i)
+		entry := BlockMapEntry{Position: i, Name: blockName + ".bin", Size: -1, Nodes: []BlockReplica{}}
+
+		location, err := f.redisManager.GetBlockLocation(blockName)
+		if err != nil {
+			entry.Error = err.Error()
+			blockMap.Blocks = append(blockMap.Blocks, entry)
+			continue
+		}
+		entry.Size = location.Size
+		entry.SHA256 = location.Hash
+
+		for _, stored := range location.Replicas {
+			replica := BlockReplica{Address: stored.Address, State: stored.State, Registered: registered[stored.Address] || isColdAddress(stored.Address)}
+			if check {
+				present, err := f.blockPresentOnNode(r.Context(), stored.Address, entry.Name)
+				if err != nil {
+					replica.Error = err.Error()
+				} else {
+					replica.Present = &present
+				}
+			}
+			entry.Nodes = append(entry.Nodes, replica)
+		}
+
+		blockMap.Blocks = append(blockMap.Blocks, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(blockMap)
+}
+
+func (f *fileManager) blockPresentOnNode(ctx context.Context, nodeAddress, blockFileName string) (bool, error) {
+	if isColdAddress(nodeAddress) {
+		return f.coldBlockPresent(ctx, nodeAddress, blockFileName)
+	}
+	res, err := f.httpClient.Get(fmt.Sprintf("%s/checkIfFileExists?filename=%s", strings.TrimSuffix(nodeAddress, "/"), url.QueryEscape(blockFileName)))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, &nodeStatusError{Node: nodeAddress, StatusCode: res.StatusCode}
+	}
+}
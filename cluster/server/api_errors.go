@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Error codes of the API. Unlike messages, they are stable across releases:
+// clients tell errors apart by their code.
+const (
+	CodeInvalidRequest      = "invalid_request"
+	CodeInvalidFileName     = "invalid_file_name"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeInvalidAPIKey       = "invalid_api_key"
+	CodeInvalidSignature    = "invalid_signature"
+	CodeSignatureExpired    = "signature_expired"
+	CodeNotFound            = "not_found"
+	CodeFileNotFound        = "file_not_found"
+	CodeSnapshotNotFound    = "snapshot_not_found"
+	CodeBackupNotFound      = "backup_not_found"
+	CodeJobNotFound         = "job_not_found"
+	CodeUploadNotFound      = "upload_not_found"
+	CodeNodeNotRegistered   = "node_not_registered"
+	CodeNodeNotFound        = "node_not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeConflict            = "conflict"
+	CodeStaleDeltaBase      = "stale_delta_base"
+	CodeFileLocked          = "file_locked"
+	CodePreconditionFailed  = "precondition_failed"
+	CodeUploadTooLarge      = "upload_too_large"
+	CodeUnsupportedType     = "unsupported_media_type"
+	CodeUploadRejected      = "upload_rejected"
+	CodeUploadHookFailed    = "upload_hook_failed"
+	CodeRangeNotSatisfiable = "range_not_satisfiable"
+	CodeInternal            = "internal"
+	CodeUnavailable         = "unavailable"
+	CodeMaintenance         = "maintenance"
+	CodeUploadsSaturated    = "uploads_saturated"
+	CodeNoNodesAvailable    = "no_nodes_available"
+	CodeNodeEvicted         = "node_evicted"
+	CodeNodesFull           = "nodes_full"
+	CodeWriteUnverified     = "write_unverified"
+)
+
+var (
+	// errNodesFull fails the blocks no node has room for.
+	errNodesFull = errors.New("all nodes are full")
+	// errNoNodes fails the blocks no node could be found for.
+	errNoNodes = errors.New("no available nodes")
+	// errNodesUnavailable is returned when no node answers for its usage.
+	errNodesUnavailable = errors.New("all the Nodes are currently unavailable. Please try again later")
+	// errReservedName refuses file names the central server keeps for itself.
+	errReservedName = errors.New("reserved file name")
+)
+
+// checkReservedName refuses with errReservedName the names the central
+// server keeps for its own files, which no write may take.
+func checkReservedName(name string) error {
+	switch {
+	case isContainerName(name):
+		return fmt.Errorf("%w: names starting with %q are kept for containers", errReservedName, containerPrefix)
+	case isSnapshotName(name):
+		return fmt.Errorf("%w: names starting with %q are kept for snapshots", errReservedName, snapshotPrefix)
+	case isMultipartPartName(name):
+		return fmt.Errorf("%w: names starting with %q are kept for multipart uploads", errReservedName, multipartPrefix)
+	case isRewriteName(name):
+		return fmt.Errorf("%w: names starting with %q are kept for blocks stored again", errReservedName, rewritePrefix)
+	}
+	return nil
+}
+
+// ErrorResponse is the body of every error answered by the API. Details
+// carries what the code is about, such as the file, when there is one.
+type ErrorResponse struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"requestId,omitempty"`
+	// Error repeats the message for clients written before the codes.
+	Error string `json:"error"`
+}
+
+// errorCodes gives the code of the errors answered without a more precise
+// one.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:                   CodeInvalidRequest,
+	http.StatusUnauthorized:                 CodeUnauthorized,
+	http.StatusForbidden:                    CodeForbidden,
+	http.StatusNotFound:                     CodeNotFound,
+	http.StatusMethodNotAllowed:             CodeMethodNotAllowed,
+	http.StatusConflict:                     CodeConflict,
+	http.StatusLocked:                       CodeFileLocked,
+	http.StatusPreconditionFailed:           CodePreconditionFailed,
+	http.StatusRequestEntityTooLarge:        CodeUploadTooLarge,
+	http.StatusUnsupportedMediaType:         CodeUnsupportedType,
+	http.StatusRequestedRangeNotSatisfiable: CodeRangeNotSatisfiable,
+	http.StatusServiceUnavailable:           CodeUnavailable,
+	http.StatusInsufficientStorage:          CodeNodesFull,
+}
+
+func errorCodeOf(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= 400 && status < 500 {
+		return CodeInvalidRequest
+	}
+	return CodeInternal
+}
+
+func respondWithError(w http.ResponseWriter, status int, message string) {
+	respondWithErrorCode(w, status, errorCodeOf(status), message, nil)
+}
+
+// respondWithErrorCode answers an error with its code and details. The
+// request ID is the one withRequestID set on the response.
+func respondWithErrorCode(w http.ResponseWriter, status int, code string, message string, details map[string]any) {
+	log.Printf("Error %d %s: %s", status, code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: w.Header().Get(requestIDHeader),
+		Error:     message,
+	})
+}
+
+func respondFileNotFound(w http.ResponseWriter, fileName string) {
+	respondWithErrorCode(w, http.StatusNotFound, CodeFileNotFound, "File not found", map[string]any{"file": fileName})
+}
+
+// respondUploadError answers the failure of a write: a full or empty cluster,
+// or an upload refused for its content, is not a failure of the central
+// server. Other errors are answered 500 with message.
+func respondUploadError(w http.ResponseWriter, fileName string, message string, err error) {
+	details := map[string]any{"file": fileName}
+	switch {
+	case errors.Is(err, errReservedName):
+		respondWithErrorCode(w, http.StatusBadRequest, CodeInvalidFileName, err.Error(), details)
+	case errors.Is(err, errFileLocked):
+		respondWithErrorCode(w, http.StatusLocked, CodeFileLocked, err.Error(), details)
+	case errors.Is(err, errPreconditionFailed):
+		respondWithErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error(), details)
+	case errors.Is(err, errContentTypeNotAllowed):
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, CodeUnsupportedType, err.Error(), details)
+	case errors.Is(err, errUploadRejected):
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, CodeUploadRejected, err.Error(), details)
+	case errors.Is(err, errUploadHookFailed):
+		respondWithErrorCode(w, http.StatusServiceUnavailable, CodeUploadHookFailed, err.Error(), details)
+	case errors.Is(err, errNodesFull):
+		var shortfall *capacityShortfall
+		if errors.As(err, &shortfall) {
+			details["required_bytes"] = shortfall.Required
+			details["available_bytes"] = shortfall.Available
+			details["shortfall_bytes"] = shortfall.Required - shortfall.Available
+		}
+		respondWithErrorCode(w, http.StatusInsufficientStorage, CodeNodesFull, "All nodes are full", details)
+	case errors.Is(err, errWriteUnverified):
+		respondWithErrorCode(w, http.StatusServiceUnavailable, CodeWriteUnverified, err.Error(), details)
+	case errors.Is(err, errNoNodes), errors.Is(err, errNodesUnavailable):
+		respondWithErrorCode(w, http.StatusServiceUnavailable, CodeNoNodesAvailable, "No node is available", details)
+	default:
+		respondWithErrorCode(w, http.StatusInternalServerError, CodeInternal, message, details)
+	}
+}
+
+func respondNoRoute(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusNotFound, "No endpoint at "+r.URL.Path)
+}
+
+func respondMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
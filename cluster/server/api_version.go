@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiV1 prefixes the paths of version 1 of the API. Breaking changes ship
+// under a new prefix, while the previous ones keep being served.
+const apiV1 = "/v1"
+
+// withLegacyPath marks the responses served on the paths the API had before
+// it was versioned as deprecated, pointing to their /v1 successor.
+func withLegacyPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiV1+r.URL.Path+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiVersion returns the version prefix of the request path, "" for the
+// legacy paths.
+func apiVersion(r *http.Request) string {
+	if r.URL.Path == apiV1 || strings.HasPrefix(r.URL.Path, apiV1+"/") {
+		return apiV1
+	}
+	return ""
+}
+
+// unversionedPath returns the request path without its version prefix.
+func unversionedPath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, apiVersion(r))
+}
+
+// apiPath returns path under the version of the API the request was made to,
+// for the links given back to the client.
+func apiPath(r *http.Request, path string) string {
+	return apiVersion(r) + path
+}
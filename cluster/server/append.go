@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// rewriteMutex serializes appends and patches, which pick the blocks of a
+// file they write and would lose data if two of them interleaved.
+var rewriteMutex sync.Mutex
+
+// storeWhole stores the new content of a rewritten packed file, keeping its
+// annotations. It is packed again unless it has outgrown the packing
+// threshold.
+func (f *fileManager) storeWhole(ctx context.Context, timer *phaseTimer, fileName string, content []byte, annotations map[string]string) error {
+	ctx = withAnnotations(ctx, annotations)
+	if f.packer.accepts(len(content)) {
+		return f.packer.Store(ctx, fileName, content)
+	}
+	return f.storeFile(ctx, timer, fileName, content, 0, noopUploadObserver{})
+}
+
+// AppendToFile adds data at the end of an existing file without uploading
+// its content again. Only the last block of the file is read and stored
+// again, filled up to the block size, when it is partly filled; the rest of
+// the data goes into new blocks after it. As for patches, the blocks are
+// stored under names of their own before the metadata of the file points to
+// them, so a failed append leaves the file as it was and readers of the
+// version before keep reading its blocks. In the seekable layout the blocks
+// are compressed independently, like the parts of a multipart upload. A file
+// stored as a single gzip stream gets the data as a gzip member of its own,
+// which decompresses as the continuation of the stream.
+func (f *fileManager) AppendToFile(ctx context.Context, fileName string, data []byte) (FileMetadata, error) {
+	timer := newPhaseTimer()
+	metadata, err := f.appendToFile(ctx, timer, fileName, data)
+	timer.report(requestLogger(ctx), "append", config.SlowUploadThreshold, len(data), err, zap.String("fileName", fileName))
+	recordAudit(ctx, AuditFileAppend, fileName, err)
+	return metadata, err
+}
+
+func (f *fileManager) appendToFile(ctx context.Context, timer *phaseTimer, fileName string, data []byte) (FileMetadata, error) {
+	logger := requestLogger(ctx)
+	if err := f.checkWrite(ctx, fileName); err != nil {
+		return FileMetadata{}, err
+	}
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	timer.Phase("metadata")
+	if err != nil || len(data) == 0 {
+		return metadata, err
+	}
+
+	// A packed file is small: it is stored again as a whole, in blocks of
+	// its own once it outgrows the packing threshold.
+	if metadata.Packed != nil {
+		content, err := f.packer.Read(ctx, *metadata.Packed)
+		timer.Phase("container")
+		if err != nil {
+			return FileMetadata{}, err
+		}
+		if err := f.storeWhole(ctx, timer, fileName, append(bytes.Clone(content), data...), metadata.Annotations); err != nil {
+			return FileMetadata{}, err
+		}
+		return f.redisManager.GetFileMetadata(fileName)
+	}
+
+	numOfBlocks, err := f.redisManager.GetNumberOfBlocksOfAFile(GenerateFileHash(fileName))
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	// The blocks are written from position on: the last block of the file
+	// when it is partly filled, whose content is then head.
+	previous := metadata
+	position := numOfBlocks + 1
+	var head []byte
+	var compressed *bytes.Buffer
+	var blocks []FileBlock
+	if metadata.Extents != nil {
+		offset := metadata.Size
+		if last := len(metadata.Extents) - 1; last >= 0 && metadata.Extents[last].Length < int64(metadata.BlockSize) {
+			head, err = f.readExtent(ctx, timer, metadata, last)
+			if err != nil {
+				return FileMetadata{}, fmt.Errorf("failed to retrieve block %d: %w", last+1, err)
+			}
+			position, offset = last+1, metadata.Extents[last].Offset
+			metadata.Extents = metadata.Extents[:last]
+		}
+		var extents []BlockExtent
+		compressed, blocks, extents, err = compressBlocks(ctx, append(head, data...), metadata.BlockSize, position, offset)
+		metadata.Extents = append(slices.Clip(metadata.Extents), extents...)
+	} else {
+		if numOfBlocks > 0 {
+			head, err = f.readPartialBlock(ctx, timer, metadata, numOfBlocks)
+			if err != nil {
+				return FileMetadata{}, fmt.Errorf("failed to retrieve block %d: %w", numOfBlocks, err)
+			}
+			if head != nil {
+				position = numOfBlocks
+			}
+		}
+		compressed, blocks, err = appendToStream(ctx, metadata.BlockSize, position, head, data)
+	}
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	defer putBuffer(compressed)
+	timer.Phase("compress")
+
+	metadata.Size += int64(len(data))
+	metadata, err = f.storeRewrite(ctx, timer, previous, numOfBlocks, metadata, position-1+len(blocks), blocks)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	logger.Info("Data appended to file",
+		zap.String("fileName", fileName),
+		zap.Int("appendedSize", len(data)),
+		zap.Int("numOfBlocks", metadata.Blocks),
+		zap.Bool("lastBlockFilled", position <= numOfBlocks),
+	)
+	return metadata, nil
+}
+
+// readPartialBlock returns the block of a file stored as a single gzip
+// stream at position, as stored, when it is short of the block size, and nil
+// when it is full.
+func (f *fileManager) readPartialBlock(ctx context.Context, timer *phaseTimer, metadata FileMetadata, position int) ([]byte, error) {
+	blockName := metadata.blockName(position)
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil {
+		return nil, err
+	}
+	if location.Size >= int64(metadata.BlockSize) {
+		return nil, nil
+	}
+
+	var block []byte
+	err = f.readBlock(ctx, timer, blockName, location, func(stored []byte) {
+		if len(stored) < metadata.BlockSize {
+			block = bytes.Clone(stored)
+		}
+	})
+	return block, err
+}
+
+// appendToStream compresses data as a gzip member continuing the stream of
+// a file, after head, the content of its last block when it is partly
+// filled, and cuts them into blocks of blockSize bytes from position on. The
+// blocks are slices of the returned buffer, handed back by the caller with
+// putBuffer.
+func appendToStream(ctx context.Context, blockSize int, position int, head []byte, data []byte) (*bytes.Buffer, []FileBlock, error) {
+	member, err := compressBody(ctx, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(head) > 0 {
+		compressed := getBuffer()
+		compressed.Write(head)
+		compressed.Write(member.Bytes())
+		putBuffer(member)
+		member = compressed
+	}
+
+	var blocks []FileBlock
+	rest := member.Bytes()
+	for len(rest) > 0 {
+		size := min(blockSize, len(rest))
+		blocks = append(blocks, FileBlock{bytes: rest[:size], position: position + len(blocks)})
+		rest = rest[size:]
+	}
+	return member, blocks, nil
+}
+
+// AppendFile appends the raw request body to an existing file.
+func (f *fileManager) AppendFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/append").Inc()
+	// The hooks would only see the appended data, not the file it ends up in.
+	if refuseWhileHooked(w, "Appends") {
+		return
+	}
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	if !limitUploadBody(w, r, 0) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.Release()
+
+	buf, err := readPooled(r.Body, r.ContentLength)
+	if isBodyTooLarge(err) {
+		respondUploadTooLarge(w)
+		return
+	}
+	if errors.Is(err, errUploadsSaturated) {
+		respondUploadsSaturated(w)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read appended content", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read file content")
+		return
+	}
+	defer putBuffer(buf)
+
+	metadata, err := f.AppendToFile(r.Context(), fileName, buf.Bytes())
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to append to file", zap.String("fileName", fileName), zap.Error(err))
+		respondUploadError(w, fileName, "Failed to append to file", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(metadata.Version))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(metadata)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	archiveZip = "zip"
+	archiveTar = "tar"
+)
+
+// ArchiveRequest selects the files of POST /downloadArchive: the listed
+// files, every file whose name starts with Prefix, or both.
+type ArchiveRequest struct {
+	Files  []string `json:"files,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	// Format is zip (the default) or tar.
+	Format string `json:"format,omitempty"`
+}
+
+// archiveWriter writes the entries of a zip or tar archive.
+type archiveWriter interface {
+	Add(name string, modTime time.Time, data []byte) error
+	Close() error
+}
+
+type zipArchive struct{ w *zip.Writer }
+
+// Add stores the file as is: the archive is read once by the client, so
+// compressing it again would only cost CPU on the central server.
+func (a zipArchive) Add(name string, modTime time.Time, data []byte) error {
+	entry, err := a.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+func (a zipArchive) Close() error { return a.w.Close() }
+
+type tarArchive struct{ w *tar.Writer }
+
+func (a tarArchive) Add(name string, modTime time.Time, data []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}
+	if err := a.w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.w.Write(data)
+	return err
+}
+
+func (a tarArchive) Close() error { return a.w.Close() }
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	if format == archiveTar {
+		return tarArchive{w: tar.NewWriter(w)}
+	}
+	return zipArchive{w: zip.NewWriter(w)}
+}
+
+// archiveEntryName keeps file names from escaping the directory the archive
+// is extracted into.
+func archiveEntryName(fileName string) string {
+	return strings.TrimPrefix(path.Clean("/"+fileName), "/")
+}
+
+// archiveFiles returns the metadata of the files selected by req, sorted by
+// name. Every listed file must exist.
+func (f *fileManager) archiveFiles(req ArchiveRequest) ([]FileMetadata, error) {
+	selected := make(map[string]FileMetadata)
+	for _, name := range req.Files {
+		metadata, err := f.redisManager.GetFileMetadata(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, name)
+		}
+		selected[name] = metadata
+	}
+
+	if req.Prefix != "" {
+		files, err := f.redisManager.ListFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range files {
+			if strings.HasPrefix(metadata.Name, req.Prefix) && !strings.HasPrefix(metadata.Name, containerPrefix) {
+				selected[metadata.Name] = metadata
+			}
+		}
+	}
+
+	files := make([]FileMetadata, 0, len(selected))
+	for _, metadata := range selected {
+		files = append(files, metadata)
+	}
+	slices.SortFunc(files, func(a, b FileMetadata) int { return strings.Compare(a.Name, b.Name) })
+	return files, nil
+}
+
+// DownloadArchive streams a zip or tar of the requested files, reconstructing
+// them one at a time. Once the archive has started, a file that cannot be
+// reconstructed aborts the response, so the client never gets a truncated
+// archive that looks complete.
+func (f *fileManager) DownloadArchive(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	var req ArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid archive request: "+err.Error())
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		req.Format = format
+	}
+	if req.Format == "" {
+		req.Format = archiveZip
+	}
+	if req.Format != archiveZip && req.Format != archiveTar {
+		respondWithError(w, http.StatusBadRequest, "format must be zip or tar")
+		return
+	}
+	if len(req.Files) == 0 && req.Prefix == "" {
+		respondWithError(w, http.StatusBadRequest, "files or prefix is required")
+		return
+	}
+
+	files, err := f.archiveFiles(req)
+	if errors.Is(err, ErrFileNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeFileNotFound, err.Error(), nil)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to select archive files", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to select files")
+		return
+	}
+	if len(files) == 0 {
+		respondWithError(w, http.StatusNotFound, "No file matches the prefix")
+		return
+	}
+
+	logger.Info("Streaming archive",
+		zap.String("format", req.Format),
+		zap.String("prefix", req.Prefix),
+		zap.Int("files", len(files)),
+	)
+
+	contentType := "application/zip"
+	if req.Format == archiveTar {
+		contentType = "application/x-tar"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "files." + req.Format}))
+	w.WriteHeader(http.StatusOK)
+
+	archive := newArchiveWriter(req.Format, w)
+	for _, metadata := range files {
+		data, err := f.ReconstructFileFromBlocks(f.noteFileRead(r.Context(), metadata.Name), metadata.Name)
+		if err == nil {
+			err = archive.Add(archiveEntryName(metadata.Name), metadata.CreatedAt, data)
+		}
+		if err != nil {
+			logger.Error("Failed to add file to archive",
+				zap.String("fileName", metadata.Name),
+				zap.Error(err),
+			)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logger.Warn("Failed to finish archive", zap.Error(err))
+	}
+}
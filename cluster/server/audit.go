@@ -0,0 +1,351 @@
+package server
+
+import (
+	"FDS/urlsign"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const auditStreamKey = "audit"
+
+const (
+	AuditFileUpload       = "file.upload"
+	AuditFileDelete       = "file.delete"
+	AuditFileCopy         = "file.copy"
+	AuditFileAppend       = "file.append"
+	AuditFilePatch        = "file.patch"
+	AuditFileDelta        = "file.delta"
+	AuditFilePin          = "file.pin"
+	AuditFileUnpin        = "file.unpin"
+	AuditBackupCreate     = "backup.create"
+	AuditBackupRestore    = "backup.restore"
+	AuditSnapshotCreate   = "snapshot.create"
+	AuditSnapshotRollback = "snapshot.rollback"
+	AuditSnapshotDelete   = "snapshot.delete"
+	AuditTierOffload      = "tier.offload"
+	AuditTierRehydrate    = "tier.rehydrate"
+	AuditNodeAdd          = "node.add"
+	AuditNodeRemove       = "node.remove"
+	AuditNodeMove         = "node.move"
+	AuditNodeEvict        = "node.evict"
+	AuditNodeReadmit      = "node.readmit"
+	AuditNodeCertificate  = "node.certificate"
+	AuditNodeDrain        = "node.drain"
+	AuditNodeUndrain      = "node.undrain"
+	AuditNodeDecommission = "node.decommission"
+	AuditRebalance        = "rebalance"
+	AuditScrub            = "scrub"
+	AuditGC               = "gc"
+	AuditMaintenance      = "maintenance"
+)
+
+// AuditEvent records one mutating operation.
+type AuditEvent struct {
+	ID         string    `json:"id,omitempty"`
+	Time       time.Time `json:"time"`
+	Caller     string    `json:"caller"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Action     string    `json:"action"`
+	Resource   string    `json:"resource"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// AuditQuery selects events, newest first. Zero fields match everything.
+type AuditQuery struct {
+	Action string
+	Caller string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (q AuditQuery) matches(event AuditEvent) bool {
+	return (q.Action == "" || event.Action == q.Action) &&
+		(q.Caller == "" || event.Caller == q.Caller) &&
+		(q.Since.IsZero() || !event.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || event.Time.Before(q.Until))
+}
+
+// auditSink is an append-only store of audit events.
+type auditSink interface {
+	Append(event AuditEvent) error
+	Query(query AuditQuery) ([]AuditEvent, error)
+}
+
+type nopAuditSink struct{}
+
+func (nopAuditSink) Append(AuditEvent) error                { return nil }
+func (nopAuditSink) Query(AuditQuery) ([]AuditEvent, error) { return []AuditEvent{}, nil }
+
+// redisAuditSink appends events to a Redis stream, which also provides the
+// event IDs.
+type redisAuditSink struct {
+	redisClient *redis.Client
+}
+
+func (s *redisAuditSink) Append(event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.redisClient.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: auditStreamKey,
+		Values: map[string]interface{}{"event": data},
+	}).Err()
+}
+
+func (s *redisAuditSink) Query(query AuditQuery) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	end := "+"
+
+	for len(events) < query.Limit {
+		messages, err := s.redisClient.XRevRangeN(context.Background(), auditStreamKey, end, "-", int64(query.Limit)).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, message := range messages {
+			var event AuditEvent
+			data, _ := message.Values["event"].(string)
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				continue
+			}
+			event.ID = message.ID
+
+			if !query.Since.IsZero() && event.Time.Before(query.Since) {
+				return events, nil
+			}
+			if query.matches(event) {
+				events = append(events, event)
+				if len(events) == query.Limit {
+					return events, nil
+				}
+			}
+		}
+
+		if len(messages) < query.Limit {
+			break
+		}
+		end = "(" + messages[len(messages)-1].ID
+	}
+
+	return events, nil
+}
+
+// fileAuditSink appends events as JSON lines to a file. Events are numbered
+// by their line in the file.
+type fileAuditSink struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{path: path, file: file}, nil
+}
+
+func (s *fileAuditSink) Append(event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileAuditSink) Query(query AuditQuery) ([]AuditEvent, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Keep the last Limit matches in a ring, then return them newest first.
+	ring := make([]AuditEvent, 0, query.Limit)
+	next := 0
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1*MB)
+	for line := 1; scanner.Scan(); line++ {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		event.ID = strconv.Itoa(line)
+
+		if !query.matches(event) {
+			continue
+		}
+		if len(ring) < query.Limit {
+			ring = append(ring, event)
+		} else {
+			ring[next] = event
+			next = (next + 1) % query.Limit
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	events := make([]AuditEvent, 0, len(ring))
+	for i := len(ring) - 1; i >= 0; i-- {
+		events = append(events, ring[(next+i)%len(ring)])
+	}
+	return events, nil
+}
+
+func newAuditSink(redisClient *redis.Client) (auditSink, error) {
+	switch config.AuditSink {
+	case auditSinkRedis:
+		return &redisAuditSink{redisClient: redisClient}, nil
+	case auditSinkFile:
+		return newFileAuditSink(config.AuditFile)
+	default:
+		return nopAuditSink{}, nil
+	}
+}
+
+var auditLog auditSink = nopAuditSink{}
+
+// caller identifies who issued a request, for the audit log.
+type caller struct {
+	Identity   string
+	RemoteAddr string
+	// APIKey is the name of the API key the request carried, if any.
+	APIKey string
+}
+
+type callerKey struct{}
+
+var systemCaller = caller{Identity: "system"}
+
+func withCaller(ctx context.Context, c caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+func callerFromContext(ctx context.Context) caller {
+	if c, ok := ctx.Value(callerKey{}).(caller); ok {
+		return c
+	}
+	return caller{Identity: "unknown"}
+}
+
+// requestCaller derives the caller of a request: the API key it carries, if
+// it is one of FDS_API_KEYS, or whether it came through a presigned URL.
+func requestCaller(r *http.Request) caller {
+	remoteAddr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+
+	if name, ok := apiKeyName(r.Header.Get(apiKeyHeader)); ok {
+		return caller{Identity: "key:" + name, RemoteAddr: remoteAddr, APIKey: name}
+	}
+	identity := "anonymous"
+	if r.URL.Query().Get(urlsign.SignatureParam) != "" {
+		identity = "presigned"
+	}
+	return caller{Identity: identity, RemoteAddr: remoteAddr}
+}
+
+// withRequestCaller attaches the caller of every request to its context.
+func withRequestCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withCaller(r.Context(), requestCaller(r))))
+	})
+}
+
+// recordAudit appends the outcome of an operation to the audit log. Failing
+// to write the audit log is logged but does not fail the operation.
+func recordAudit(ctx context.Context, action string, resource string, err error) {
+	logger := requestLogger(ctx)
+	c := callerFromContext(ctx)
+	event := AuditEvent{
+		Time:       time.Now().UTC(),
+		Caller:     c.Identity,
+		RemoteAddr: c.RemoteAddr,
+		Action:     action,
+		Resource:   resource,
+		Result:     "ok",
+		RequestID:  requestIDFromContext(ctx),
+	}
+	if err != nil {
+		event.Result = "error"
+		event.Error = err.Error()
+	}
+
+	if err := auditLog.Append(event); err != nil {
+		logger.Error("Failed to write audit event",
+			zap.String("action", action),
+			zap.String("resource", resource),
+			zap.Error(err),
+		)
+	}
+}
+
+// GetAuditLog returns audit events, newest first, filtered by the action,
+// caller, since and until (RFC 3339) query parameters.
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+	params := r.URL.Query()
+
+	query := AuditQuery{
+		Action: params.Get("action"),
+		Caller: params.Get("caller"),
+		Limit:  100,
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 1000 {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		query.Limit = limit
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp", name))
+				return
+			}
+			*dst = t
+		}
+	}
+
+	events, err := auditLog.Query(query)
+	if err != nil {
+		logger.Error("Failed to query the audit log", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to query the audit log")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(events)
+}
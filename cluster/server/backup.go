@@ -0,0 +1,597 @@
+package server
+
+import (
+	"FDS/s3"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupConcurrency bounds how many files are backed up or restored at once.
+const backupConcurrency = 4
+
+const backupManifestName = "manifest.json"
+
+var (
+	errBackupNotFound = errors.New("backup not found")
+	errObjectNotFound = s3.ErrNotFound
+)
+
+// backupTarget is where backups are written: a local directory or an S3
+// prefix. Keys are slash-separated paths.
+type backupTarget interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// openBackupTarget parses a target: s3://bucket/prefix, or a local directory,
+// optionally as a file:// URL.
+func openBackupTarget(spec string) (backupTarget, error) {
+	if spec == "" {
+		return nil, errors.New("no backup target given and FDS_BACKUP_TARGET is not set")
+	}
+	if rest, ok := strings.CutPrefix(spec, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		client, err := newS3Client(bucket)
+		if err != nil {
+			return nil, err
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3Target{client: client, prefix: prefix}, nil
+	}
+	return dirTarget{root: strings.TrimPrefix(spec, "file://")}, nil
+}
+
+type dirTarget struct{ root string }
+
+// Put writes to a temporary file renamed into place, so an interrupted
+// backup never leaves a truncated object behind.
+func (d dirTarget) Put(_ context.Context, key string, body io.Reader, _ int64) error {
+	name := filepath.Join(d.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (d dirTarget) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(d.root, filepath.FromSlash(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return file, err
+}
+
+func (d dirTarget) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, name)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+type s3Target struct {
+	client *s3.Client
+	prefix string
+}
+
+func (s *s3Target) Put(ctx context.Context, key string, body io.Reader, size int64) error {
+	return s.client.Put(ctx, s.prefix+key, body, size)
+}
+
+func (s *s3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.Get(ctx, s.prefix+key)
+}
+
+func (s *s3Target) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := s.client.List(ctx, s.prefix+prefix)
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix)
+	}
+	return keys, err
+}
+
+// BackupFile is a file of a backup: its metadata and, unless it is packed,
+// the SHA-256 of each of its blocks.
+type BackupFile struct {
+	FileMetadata
+	BlockHashes []string `json:"block_hashes,omitempty"`
+}
+
+// BackupManifest lists the files of a backup. It is written last, so a backup
+// without a manifest is incomplete and ignored.
+type BackupManifest struct {
+	ID        string       `json:"id"`
+	CreatedAt time.Time    `json:"created_at"`
+	Files     []BackupFile `json:"files"`
+}
+
+type BackupFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// BackupSummary is the answer of a backup or a restore.
+type BackupSummary struct {
+	ID      string          `json:"id"`
+	Files   int             `json:"files"`
+	Blocks  int             `json:"blocks"`
+	Bytes   int64           `json:"bytes"`
+	Skipped int             `json:"skipped,omitempty"`
+	Failed  []BackupFailure `json:"failed"`
+}
+
+// BackupInfo describes a backup found on a target.
+type BackupInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     int       `json:"files"`
+	Size      int64     `json:"size"`
+}
+
+func newTimestampedID() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+func backupBlockKey(id string, blockName string) string {
+	return id + "/blocks/" + url.PathEscape(blockName)
+}
+
+func backupPackedKey(id string, fileName string) string {
+	return id + "/packed/" + url.PathEscape(fileName)
+}
+
+// backupFile copies the stored form of one file to the target: the blocks as
+// they are on the nodes, still compressed, or the content of a packed file.
+func (f *fileManager) backupFile(ctx context.Context, target backupTarget, id string, metadata FileMetadata) (BackupFile, int64, error) {
+	entry := BackupFile{FileMetadata: metadata}
+
+	if metadata.Packed != nil {
+		content, err := f.packer.Read(ctx, *metadata.Packed)
+		if err != nil {
+			return entry, 0, err
+		}
+		err = target.Put(ctx, backupPackedKey(id, metadata.Name), bytes.NewReader(content), int64(len(content)))
+		return entry, int64(len(content)), err
+	}
+
+	// The names of blocks stored again by patches and appends are left out
+	// of the backup, whose blocks are stored under the name of their file.
+	entry.Rewritten = nil
+	current, numOfBlocks, err := f.redisManager.GetFileBlocks(metadata.Name)
+	if err != nil {
+		return entry, 0, err
+	}
+
+	var written int64
+	for i := 1; i <= numOfBlocks; i++ {
+		blockName := current.blockName(i)
+		location, err := f.redisManager.GetBlockLocation(blockName)
+		if err != nil {
+			return entry, written, err
+		}
+
+		var block *bytes.Buffer
+		err = nodeRetryPolicy().Do(ctx, "blockFetch", func() error {
+			block, err = f.fetchBlockReplicas(ctx, location, blockName+".bin")
+			return err
+		})
+		// A mismatch, which also happens when the file is overwritten while
+		// it is being backed up, fails the fetch.
+		if err != nil {
+			return entry, written, fmt.Errorf("failed to retrieve block %d: %w", i, err)
+		}
+
+		err = target.Put(ctx, backupBlockKey(id, metadata.Name+"-block-"+strconv.Itoa(i)), bytes.NewReader(block.Bytes()), int64(block.Len()))
+		written += int64(block.Len())
+		putBuffer(block)
+		if err != nil {
+			return entry, written, fmt.Errorf("failed to write block %d: %w", i, err)
+		}
+		entry.BlockHashes = append(entry.BlockHashes, location.Hash)
+	}
+	entry.Blocks = numOfBlocks
+	return entry, written, nil
+}
+
+// Backup copies the metadata of every file and all their blocks to
+// target. Files that cannot be backed up are reported and left out of the
+// manifest; the others are still backed up.
+func (f *fileManager) Backup(ctx context.Context, target backupTarget) (BackupSummary, error) {
+	summary, err := f.createBackup(ctx, target)
+	recordAudit(ctx, AuditBackupCreate, summary.ID, err)
+	return summary, err
+}
+
+func (f *fileManager) createBackup(ctx context.Context, target backupTarget) (BackupSummary, error) {
+	logger := requestLogger(ctx)
+	summary := BackupSummary{ID: newTimestampedID(), Failed: []BackupFailure{}}
+
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return summary, err
+	}
+	slices.SortFunc(files, func(a, b FileMetadata) int { return strings.Compare(a.Name, b.Name) })
+
+	manifest := BackupManifest{ID: summary.ID, CreatedAt: time.Now().UTC(), Files: []BackupFile{}}
+	entries := make([]*BackupFile, len(files))
+	var mutex sync.Mutex
+	slots := make(chan struct{}, backupConcurrency)
+	var wg sync.WaitGroup
+	for i, metadata := range files {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, metadata FileMetadata) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			entry, written, err := f.backupFile(ctx, target, summary.ID, metadata)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			summary.Bytes += written
+			if err != nil {
+				logger.Error("Failed to back up file", zap.String("fileName", metadata.Name), zap.Error(err))
+				summary.Failed = append(summary.Failed, BackupFailure{Name: metadata.Name, Error: err.Error()})
+				return
+			}
+			entries[i] = &entry
+		}(i, metadata)
+	}
+	wg.Wait()
+
+	for _, entry := range entries {
+		if entry != nil {
+			manifest.Files = append(manifest.Files, *entry)
+			summary.Files++
+			summary.Blocks += entry.Blocks
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return summary, err
+	}
+	if err := target.Put(ctx, summary.ID+"/"+backupManifestName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return summary, fmt.Errorf("failed to write the backup manifest: %w", err)
+	}
+
+	logger.Info("Backup completed",
+		zap.String("backupID", summary.ID),
+		zap.Int("files", summary.Files),
+		zap.Int("blocks", summary.Blocks),
+		zap.Int64("bytes", summary.Bytes),
+		zap.Int("failed", len(summary.Failed)),
+	)
+	return summary, nil
+}
+
+func readBackupManifest(ctx context.Context, target backupTarget, id string) (BackupManifest, error) {
+	var manifest BackupManifest
+	body, err := target.Get(ctx, id+"/"+backupManifestName)
+	if errors.Is(err, errObjectNotFound) {
+		return manifest, errBackupNotFound
+	}
+	if err != nil {
+		return manifest, err
+	}
+	defer body.Close()
+
+	err = json.NewDecoder(body).Decode(&manifest)
+	return manifest, err
+}
+
+// ListBackups returns the complete backups of target, oldest first.
+func ListBackups(ctx context.Context, target backupTarget) ([]BackupInfo, error) {
+	keys, err := target.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []BackupInfo{}
+	for _, key := range keys {
+		id, ok := strings.CutSuffix(key, "/"+backupManifestName)
+		if !ok || strings.Contains(id, "/") {
+			continue
+		}
+		manifest, err := readBackupManifest(ctx, target, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the manifest of backup %s: %w", id, err)
+		}
+
+		info := BackupInfo{ID: id, CreatedAt: manifest.CreatedAt, Files: len(manifest.Files)}
+		for _, file := range manifest.Files {
+			info.Size += file.Size
+		}
+		backups = append(backups, info)
+	}
+	slices.SortFunc(backups, func(a, b BackupInfo) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return backups, nil
+}
+
+func readBackupObject(ctx context.Context, target backupTarget, key string) ([]byte, error) {
+	body, err := target.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// restoreFile stores one file of a backup again, its blocks placed on the
+// nodes registered now.
+func (f *fileManager) restoreFile(ctx context.Context, target backupTarget, id string, file BackupFile) (int64, error) {
+	timer := newPhaseTimer()
+
+	if file.Packed != nil {
+		content, err := readBackupObject(ctx, target, backupPackedKey(id, file.Name))
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(content)), f.storeWhole(ctx, timer, file.Name, content, file.Annotations)
+	}
+
+	blocks := make([]FileBlock, 0, len(file.BlockHashes))
+	var read int64
+	for i, hash := range file.BlockHashes {
+		data, err := readBackupObject(ctx, target, backupBlockKey(id, file.Name+"-block-"+strconv.Itoa(i+1)))
+		if err != nil {
+			return read, fmt.Errorf("failed to read block %d: %w", i+1, err)
+		}
+		if fmt.Sprintf("%x", GenerateBlockHash(data)) != hash {
+			return read, fmt.Errorf("block %d of the backup does not match its hash", i+1)
+		}
+		read += int64(len(data))
+		blocks = append(blocks, FileBlock{bytes: data, position: i + 1})
+	}
+
+	if err := f.distributeBlocks(ctx, timer, file.Name, blocks, noopUploadObserver{}); err != nil {
+		return read, err
+	}
+	if err := f.redisManager.SendBlockHashWithNumberOfBlocks(GenerateFileHash(file.Name), len(blocks)); err != nil {
+		return read, fmt.Errorf("failed to store the number of blocks: %w", err)
+	}
+
+	metadata := file.FileMetadata
+	metadata.Blocks = len(blocks)
+	metadata.Rewritten = nil
+	if err := f.redisManager.SaveFileMetadata(metadata); err != nil {
+		return read, fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	return read, nil
+}
+
+// Restore stores the files of a backup again. Files that exist are
+// skipped unless overwrite is set, in which case the current version is
+// removed first. names, when not empty, restores only those files.
+func (f *fileManager) Restore(ctx context.Context, target backupTarget, id string, names []string, overwrite bool) (BackupSummary, error) {
+	summary, err := f.restoreBackup(ctx, target, id, names, overwrite)
+	recordAudit(ctx, AuditBackupRestore, id, err)
+	return summary, err
+}
+
+func (f *fileManager) restoreBackup(ctx context.Context, target backupTarget, id string, names []string, overwrite bool) (BackupSummary, error) {
+	logger := requestLogger(ctx)
+	summary := BackupSummary{ID: id, Failed: []BackupFailure{}}
+
+	manifest, err := readBackupManifest(ctx, target, id)
+	if err != nil {
+		return summary, err
+	}
+
+	var mutex sync.Mutex
+	slots := make(chan struct{}, backupConcurrency)
+	var wg sync.WaitGroup
+	for _, file := range manifest.Files {
+		if len(names) > 0 && !slices.Contains(names, file.Name) {
+			continue
+		}
+
+		if _, err := f.redisManager.GetFileMetadata(file.Name); err == nil {
+			if !overwrite {
+				summary.Skipped++
+				continue
+			}
+			if err := f.removeFile(ctx, file.Name); err != nil {
+				summary.Failed = append(summary.Failed, BackupFailure{Name: file.Name, Error: err.Error()})
+				continue
+			}
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(file BackupFile) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			read, err := f.restoreFile(ctx, target, id, file)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			summary.Bytes += read
+			if err != nil {
+				logger.Error("Failed to restore file", zap.String("fileName", file.Name), zap.Error(err))
+				summary.Failed = append(summary.Failed, BackupFailure{Name: file.Name, Error: err.Error()})
+				return
+			}
+			summary.Files++
+			summary.Blocks += len(file.BlockHashes)
+		}(file)
+	}
+	wg.Wait()
+
+	logger.Info("Backup restored",
+		zap.String("backupID", id),
+		zap.Int("files", summary.Files),
+		zap.Int("skipped", summary.Skipped),
+		zap.Int("failed", len(summary.Failed)),
+	)
+	return summary, nil
+}
+
+// BackupRequest is the optional body of POST /admin/backups and of
+// POST /admin/backups/{id}/restore. Target defaults to FDS_BACKUP_TARGET.
+type BackupRequest struct {
+	Target    string   `json:"target,omitempty"`
+	Files     []string `json:"files,omitempty"`
+	Overwrite bool     `json:"overwrite,omitempty"`
+}
+
+// backupRequestTarget decodes the optional request body and opens its target.
+func backupRequestTarget(w http.ResponseWriter, r *http.Request) (BackupRequest, backupTarget, bool) {
+	var req BackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Invalid backup request: "+err.Error())
+		return req, nil, false
+	}
+	if req.Target == "" {
+		req.Target = r.URL.Query().Get("target")
+	}
+	if req.Target == "" {
+		req.Target = config.BackupTarget
+	}
+
+	target, err := openBackupTarget(req.Target)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return req, nil, false
+	}
+	return req, target, true
+}
+
+// CreateBackup backs up every file and answers once the backup is
+// complete.
+func (f *fileManager) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/backups").Inc()
+	logger := requestLogger(r.Context())
+
+	_, target, ok := backupRequestTarget(w, r)
+	if !ok {
+		return
+	}
+
+	summary, err := f.Backup(r.Context(), target)
+	if err != nil {
+		logger.Error("Failed to create backup", zap.String("backupID", summary.ID), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to create backup: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(summary)
+}
+
+// GetBackups lists the backups of the target query parameter, or of
+// FDS_BACKUP_TARGET.
+func (f *fileManager) GetBackups(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/backups").Inc()
+	logger := requestLogger(r.Context())
+
+	spec := r.URL.Query().Get("target")
+	if spec == "" {
+		spec = config.BackupTarget
+	}
+	target, err := openBackupTarget(spec)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	backups, err := ListBackups(r.Context(), target)
+	if err != nil {
+		logger.Error("Failed to list backups", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list backups")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(backups)
+}
+
+// RestoreBackup restores a backup and answers once every file is
+// stored again.
+func (f *fileManager) RestoreBackup(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/backups/{id}/restore").Inc()
+	logger := requestLogger(r.Context())
+	id := mux.Vars(r)["id"]
+
+	if id == "" || id != path.Base(id) || strings.HasPrefix(id, ".") {
+		respondWithError(w, http.StatusBadRequest, "invalid backup id")
+		return
+	}
+
+	req, target, ok := backupRequestTarget(w, r)
+	if !ok {
+		return
+	}
+
+	summary, err := f.Restore(r.Context(), target, id, req.Files, req.Overwrite)
+	if errors.Is(err, errBackupNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeBackupNotFound, "Backup not found", map[string]any{"backup": id})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to restore backup", zap.String("backupID", id), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to restore backup: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(summary)
+}
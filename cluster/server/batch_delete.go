@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// batchDeleteConcurrency bounds how many files of a batch are removed from
+// the nodes at once.
+const batchDeleteConcurrency = 8
+
+// BatchDeleteRequest selects the files of POST /files/batchDelete: the listed
+// files, every file whose name starts with Prefix, or both.
+type BatchDeleteRequest struct {
+	Files  []string `json:"files,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+}
+
+// BatchDeleteResult is the outcome for one file: deleted, not_found or
+// failed, with the error of a failed deletion.
+type BatchDeleteResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchDeleteResponse struct {
+	Deleted int                 `json:"deleted"`
+	Failed  int                 `json:"failed"`
+	Results []BatchDeleteResult `json:"results"`
+}
+
+func (f *fileManager) batchDeleteNames(req BatchDeleteRequest) ([]string, error) {
+	names := slices.Clone(req.Files)
+	if req.Prefix != "" {
+		files, err := f.redisManager.ListFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, metadata := range files {
+			if strings.HasPrefix(metadata.Name, req.Prefix) {
+				names = append(names, metadata.Name)
+			}
+		}
+	}
+
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// BatchDelete removes several files concurrently and reports the outcome of
+// each one; a file that fails does not stop the others.
+func (f *fileManager) BatchDelete(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	var req BatchDeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid batch delete request: "+err.Error())
+		return
+	}
+	if len(req.Files) == 0 && req.Prefix == "" {
+		respondWithError(w, http.StatusBadRequest, "files or prefix is required")
+		return
+	}
+
+	names, err := f.batchDeleteNames(req)
+	if err != nil {
+		logger.Error("Failed to list files", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list files")
+		return
+	}
+
+	results := make([]BatchDeleteResult, len(names))
+	slots := make(chan struct{}, batchDeleteConcurrency)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			result := BatchDeleteResult{Name: name, Status: "deleted"}
+			err := f.RemoveFile(r.Context(), name)
+			if errors.Is(err, ErrFileNotFound) {
+				result.Status = "not_found"
+			} else if err != nil {
+				logger.Error("Failed to delete file", zap.String("fileName", name), zap.Error(err))
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+			results[i] = result
+		}(i, name)
+	}
+	wg.Wait()
+
+	response := BatchDeleteResponse{Results: results}
+	for _, result := range results {
+		switch result.Status {
+		case "deleted":
+			response.Deleted++
+		case "failed":
+			response.Failed++
+		}
+	}
+
+	logger.Info("Batch delete completed",
+		zap.String("prefix", req.Prefix),
+		zap.Int("files", len(names)),
+		zap.Int("deleted", response.Deleted),
+		zap.Int("failed", response.Failed),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(response)
+}
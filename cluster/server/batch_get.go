@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+// batchGetConcurrency bounds how many files of a batch are reconstructed
+// ahead of the one being streamed.
+const batchGetConcurrency = 4
+
+const (
+	batchGetMultipart = "multipart"
+	batchGetTar       = "tar"
+)
+
+// batchGetErrorHeader carries the error code of the parts of a multipart
+// batch answering for a file that could not be read.
+const batchGetErrorHeader = "X-FDS-Error"
+
+// BatchGetRequest lists the files of POST /files/batchGet, streamed back in
+// that order.
+type BatchGetRequest struct {
+	Files []string `json:"files"`
+	// Format is multipart (the default), a multipart/mixed body with a part
+	// per file, or tar.
+	Format string `json:"format,omitempty"`
+}
+
+// batchGetFile is a file of a batch, read ahead of its turn.
+type batchGetFile struct {
+	metadata FileMetadata
+	data     []byte
+	err      error
+}
+
+// readAhead reconstructs the files in the background, up to
+// batchGetConcurrency of them ahead of the caller, which receives each one
+// from its channel and then frees its slot.
+func (f *fileManager) readAhead(ctx context.Context, names []string) ([]chan batchGetFile, chan struct{}) {
+	files := make([]chan batchGetFile, len(names))
+	for i := range files {
+		files[i] = make(chan batchGetFile, 1)
+	}
+	slots := make(chan struct{}, batchGetConcurrency)
+	go func() {
+		for i, name := range names {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				var file batchGetFile
+				file.metadata, file.err = f.redisManager.GetFileMetadata(name)
+				if file.err == nil {
+					file.data, file.err = f.ReconstructFileFromBlocks(f.noteFileRead(ctx, name), name)
+				}
+				files[i] <- file
+			}()
+		}
+	}()
+	return files, slots
+}
+
+// BatchGet streams back several files in one answer, saving consumers of
+// many small files a round trip each. In a multipart answer, a file that
+// cannot be read gets a part with its error, a JSON ErrorResponse with the
+// code in the X-FDS-Error header, and the others still follow. A tar answer
+// cannot carry errors: every file must exist, and one that cannot be
+// reconstructed once the archive has started aborts the response.
+func (f *fileManager) BatchGet(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	var req BatchGetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid batch get request: "+err.Error())
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		req.Format = format
+	}
+	if req.Format == "" {
+		req.Format = batchGetMultipart
+	}
+	if req.Format != batchGetMultipart && req.Format != batchGetTar {
+		respondWithError(w, http.StatusBadRequest, "format must be multipart or tar")
+		return
+	}
+	if len(req.Files) == 0 {
+		respondWithError(w, http.StatusBadRequest, "files is required")
+		return
+	}
+
+	if req.Format == batchGetTar {
+		for _, name := range req.Files {
+			_, err := f.redisManager.GetFileMetadata(name)
+			if errors.Is(err, ErrFileNotFound) {
+				respondFileNotFound(w, name)
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to retrieve file metadata", zap.String("fileName", name), zap.Error(err))
+				respondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata")
+				return
+			}
+		}
+	}
+
+	logger.Info("Streaming batch", zap.String("format", req.Format), zap.Int("files", len(req.Files)))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	files, slots := f.readAhead(ctx, req.Files)
+
+	if req.Format == batchGetTar {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.WriteHeader(http.StatusOK)
+		archive := newArchiveWriter(archiveTar, w)
+		for i, name := range req.Files {
+			file := <-files[i]
+			<-slots
+			err := file.err
+			if err == nil {
+				err = archive.Add(archiveEntryName(name), file.metadata.CreatedAt, file.data)
+			}
+			if err != nil {
+				logger.Error("Failed to add file to batch", zap.String("fileName", name), zap.Error(err))
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if err := archive.Close(); err != nil {
+			logger.Warn("Failed to finish batch", zap.Error(err))
+		}
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	w.WriteHeader(http.StatusOK)
+	failed := 0
+	for i, name := range req.Files {
+		file := <-files[i]
+		<-slots
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		body := file.data
+
+		if file.err != nil {
+			failed++
+			response := ErrorResponse{Code: CodeFileNotFound, Message: "File not found", Details: map[string]any{"file": name}, RequestID: w.Header().Get(requestIDHeader)}
+			if !errors.Is(file.err, ErrFileNotFound) {
+				logger.Error("Failed to read file of a batch", zap.String("fileName", name), zap.Error(file.err))
+				response.Code, response.Message = CodeInternal, "Failed to reconstruct file"
+			}
+			response.Error = response.Message
+			body, _ = json.Marshal(response)
+			header.Set("Content-Type", "application/json")
+			header.Set(batchGetErrorHeader, response.Code)
+		} else {
+			header.Set("Content-Type", "application/octet-stream")
+			header.Set("Last-Modified", file.metadata.CreatedAt.UTC().Format(http.TimeFormat))
+		}
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+
+		part, err := mw.CreatePart(header)
+		if err == nil {
+			_, err = part.Write(body)
+		}
+		if err != nil {
+			logger.Warn("Failed to stream batch", zap.Error(err))
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		logger.Warn("Failed to finish batch", zap.Error(err))
+	}
+
+	logger.Info("Batch streamed", zap.Int("files", len(req.Files)), zap.Int("failed", failed))
+}
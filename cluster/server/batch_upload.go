@@ -0,0 +1,213 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sync"
+)
+
+// batchUploadConcurrency bounds how many files of a batch are compressed and
+// distributed at once, and so how many of them are buffered.
+const batchUploadConcurrency = 4
+
+// BatchUploadResult is the outcome for one file: stored or failed, with the
+// error of a failed upload.
+type BatchUploadResult struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BatchUploadResponse lists the files of a batch in the order they were sent.
+// Error is set when the request body itself could not be read to the end;
+// the files read before it are still stored.
+type BatchUploadResponse struct {
+	Stored  int                 `json:"stored"`
+	Failed  int                 `json:"failed"`
+	Results []BatchUploadResult `json:"results"`
+	Error   string              `json:"error,omitempty"`
+}
+
+// batchEntries iterates over the files of a batch upload, a multipart form or
+// a tar stream. next returns io.EOF after the last file.
+type batchEntries interface {
+	next() (name string, size int64, content io.Reader, err error)
+}
+
+type multipartEntries struct{ reader *multipart.Reader }
+
+// next skips the parts that are not files. Like FormFile, only the base name
+// of a part's file name is kept.
+func (e multipartEntries) next() (string, int64, io.Reader, error) {
+	for {
+		part, err := e.reader.NextPart()
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if part.FileName() != "" {
+			return part.FileName(), -1, part, nil
+		}
+	}
+}
+
+type tarEntries struct{ reader *tar.Reader }
+
+// next skips directories and links and flattens the file names, as multipart
+// uploads do.
+func (e tarEntries) next() (string, int64, io.Reader, error) {
+	for {
+		header, err := e.reader.Next()
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			return path.Base(header.Name), header.Size, e.reader, nil
+		}
+	}
+}
+
+func newBatchEntries(r *http.Request) (batchEntries, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-tar" {
+		return tarEntries{reader: tar.NewReader(r.Body)}, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	return multipartEntries{reader: reader}, nil
+}
+
+// BatchUpload stores every file of a multipart form or a tar stream,
+// distributing several of them at once while the next ones are read. A file
+// that fails does not stop the others.
+func (f *fileManager) BatchUpload(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	if !limitUploadBody(w, r, multipartOverhead) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.Release()
+
+	blockSize, err := blockSizeFromQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := newBatchEntries(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Expected a multipart form or a tar stream: "+err.Error())
+		return
+	}
+
+	response := BatchUploadResponse{Results: []BatchUploadResult{}}
+	var resultsMutex sync.Mutex
+	slots := make(chan struct{}, batchUploadConcurrency)
+	var wg sync.WaitGroup
+
+	record := func(i int, result BatchUploadResult) {
+		resultsMutex.Lock()
+		defer resultsMutex.Unlock()
+		response.Results[i] = result
+	}
+
+	var streamErr error
+	for {
+		name, size, content, err := entries.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			streamErr = err
+			break
+		}
+
+		resultsMutex.Lock()
+		i := len(response.Results)
+		response.Results = append(response.Results, BatchUploadResult{Name: name, Size: size})
+		resultsMutex.Unlock()
+
+		if uploadTooLarge(size) {
+			record(i, BatchUploadResult{Name: name, Size: size, Status: "failed", Error: fmt.Sprintf("file exceeds the maximum upload size of %d bytes", config.MaxUploadSize)})
+			continue
+		}
+
+		slots <- struct{}{}
+		buf, err := readPooled(content, size)
+		if err != nil {
+			<-slots
+			record(i, BatchUploadResult{Name: name, Size: size, Status: "failed", Error: "failed to read file content"})
+			streamErr = err
+			break
+		}
+		logger.Info("File received", zap.String("fileName", name))
+
+		wg.Add(1)
+		go func(i int, name string, buf *bytes.Buffer) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer putBuffer(buf)
+
+			body := buf.Bytes()
+			result := BatchUploadResult{Name: name, Size: int64(len(body)), Status: "stored"}
+			if err := f.StoreFileWithProgress(r.Context(), name, body, blockSize, noopUploadObserver{}); err != nil {
+				logger.Error("Failed to store file of a batch", zap.String("fileName", name), zap.Error(err))
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+			record(i, result)
+		}(i, name, buf)
+	}
+	wg.Wait()
+
+	for _, result := range response.Results {
+		if result.Status == "stored" {
+			response.Stored++
+		} else {
+			response.Failed++
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case streamErr == nil:
+	case isBodyTooLarge(streamErr):
+		status = http.StatusRequestEntityTooLarge
+		response.Error = fmt.Sprintf("batch exceeds the maximum upload size of %d bytes", config.MaxUploadSize)
+	case errors.Is(streamErr, errUploadsSaturated):
+		status = http.StatusServiceUnavailable
+		response.Error = "too many uploads in progress, retry later"
+		setUploadRetryAfter(w)
+	default:
+		status = http.StatusBadRequest
+		response.Error = "failed to read the batch: " + streamErr.Error()
+	}
+
+	logger.Info("Batch upload completed",
+		zap.Int("files", len(response.Results)),
+		zap.Int("stored", response.Stored),
+		zap.Int("failed", response.Failed),
+		zap.Error(streamErr),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
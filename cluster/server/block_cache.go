@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var (
+	blockCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "block_cache_requests_total",
+			Help: "Block cache lookups by result (hit or miss)",
+		},
+		[]string{"result"},
+	)
+	blockCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "block_cache_evictions_total",
+		Help: "Blocks evicted from the block cache to make room",
+	})
+	blockCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "block_cache_bytes",
+		Help: "Bytes of block data held by the block cache",
+	})
+)
+
+type cachedBlock struct {
+	name string
+	hash string
+	data []byte
+}
+
+// blockLRU keeps recently served blocks in memory, up to FDS_BLOCK_CACHE_SIZE
+// bytes, so repeated downloads of popular files skip the nodes. Entries are
+// keyed by block name and carry the block's SHA-256, so a block rewritten by
+// an overwrite is never served from a stale entry.
+type blockLRU struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+}
+
+var blockCache = &blockLRU{entries: make(map[string]*list.Element), order: list.New()}
+
+// Get returns the cached block if it still has the given hash.
+func (c *blockLRU) Get(name, hash string) ([]byte, bool) {
+	if config.BlockCacheSize <= 0 {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[name]
+	if !ok || element.Value.(*cachedBlock).hash != hash {
+		blockCacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	blockCacheRequests.WithLabelValues("hit").Inc()
+	return element.Value.(*cachedBlock).data, true
+}
+
+// Put caches a copy of data, evicting the least recently used blocks as
+// needed. Blocks larger than a quarter of the cache are not cached.
+func (c *blockLRU) Put(name, hash string, data []byte) {
+	if config.BlockCacheSize <= 0 || len(data) > config.BlockCacheSize/4 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeLocked(name)
+	c.entries[name] = c.order.PushFront(&cachedBlock{name: name, hash: hash, data: bytes.Clone(data)})
+	c.size += len(data)
+
+	for c.size > config.BlockCacheSize {
+		c.removeLocked(c.order.Back().Value.(*cachedBlock).name)
+		blockCacheEvictions.Inc()
+	}
+	blockCacheBytes.Set(float64(c.size))
+}
+
+// Invalidate drops a block that was deleted or rewritten.
+func (c *blockLRU) Invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.removeLocked(name)
+	blockCacheBytes.Set(float64(c.size))
+}
+
+func (c *blockLRU) removeLocked(name string) {
+	element, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.order.Remove(element)
+	delete(c.entries, name)
+	c.size -= len(element.Value.(*cachedBlock).data)
+}
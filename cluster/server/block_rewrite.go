@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rewritePrefix starts the names blocks are stored under when patches and
+// appends store them again: the new content of a block never overwrites the
+// old one, which readers of the version before still use until the new one
+// is recorded.
+const rewritePrefix = ".rev-"
+
+func isRewriteName(name string) bool { return strings.HasPrefix(name, rewritePrefix) }
+
+func newRewriteTag() string {
+	tag := make([]byte, 8)
+	_, _ = rand.Read(tag)
+	return hex.EncodeToString(tag)
+}
+
+// rewrittenBlocksOf returns the name the blocks of fileName stored again
+// under tag are named after.
+func rewrittenBlocksOf(tag string, fileName string) string {
+	return rewritePrefix + tag + "-" + fileName
+}
+
+// fileOfBlocks returns the name of the file whose blocks are named after
+// blocksOf.
+func fileOfBlocks(blocksOf string) string {
+	if !isRewriteName(blocksOf) {
+		return blocksOf
+	}
+	_, fileName, _ := strings.Cut(strings.TrimPrefix(blocksOf, rewritePrefix), "-")
+	return fileName
+}
+
+// blocksOf returns the name the block of the file at position is named
+// after.
+func (m FileMetadata) blocksOf(position int) string {
+	if tag, ok := m.Rewritten[position]; ok {
+		return rewrittenBlocksOf(tag, m.Name)
+	}
+	return m.Name
+}
+
+// blockName returns the name of the block of the file at position.
+func (m FileMetadata) blockName(position int) string {
+	return m.blocksOf(position) + "-block-" + strconv.Itoa(position)
+}
+
+// storeRewrite stores blocks, the new content of some positions of the file
+// at previous, which had previousBlocks blocks, under names of their own, and
+// then records metadata, with numOfBlocks blocks, as the next version of the
+// file, as long as the file is still at previous. The blocks the new ones
+// replace are deleted once the new version is recorded, and the new blocks
+// when it could not be: readers see either version, whole.
+func (f *fileManager) storeRewrite(ctx context.Context, timer *phaseTimer, previous FileMetadata, previousBlocks int, metadata FileMetadata, numOfBlocks int, blocks []FileBlock) (FileMetadata, error) {
+	// The version is recorded only if the file is still at previous, which
+	// then has to match the If-Match of the request.
+	if err := matchPrecondition(ctx, previous); err != nil {
+		return FileMetadata{}, err
+	}
+
+	tag := newRewriteTag()
+	blocksOf := rewrittenBlocksOf(tag, metadata.Name)
+	positions := make([]int, len(blocks))
+	for i, block := range blocks {
+		positions[i] = block.position
+	}
+	if len(blocks) > 0 {
+		if err := f.distributeBlocks(ctx, timer, blocksOf, blocks, noopUploadObserver{}); err != nil {
+			f.dropRewrite(ctx, blocksOf, positions)
+			return FileMetadata{}, err
+		}
+	}
+	return f.commitRewrite(ctx, timer, previous, previousBlocks, metadata, numOfBlocks, tag, positions, fileETag(previous.Version))
+}
+
+// commitRewrite records metadata, with numOfBlocks blocks, as the next
+// version of the file at previous if its current version matches ifMatch,
+// the blocks at positions being those stored under tag. The blocks of
+// previous they replace, and those past numOfBlocks, are deleted once it is
+// recorded, and the blocks under tag when it could not be.
+func (f *fileManager) commitRewrite(ctx context.Context, timer *phaseTimer, previous FileMetadata, previousBlocks int, metadata FileMetadata, numOfBlocks int, tag string, positions []int, ifMatch string) (FileMetadata, error) {
+	metadata.Rewritten = make(map[int]string)
+	for position, tag := range previous.Rewritten {
+		if position <= numOfBlocks {
+			metadata.Rewritten[position] = tag
+		}
+	}
+	for _, position := range positions {
+		metadata.Rewritten[position] = tag
+	}
+	metadata.Blocks = numOfBlocks
+	metadata.CreatedAt = time.Now().UTC()
+
+	version, err := f.redisManager.SaveFileBlocksIf(metadata, numOfBlocks, ifMatch)
+	timer.Phase("index")
+	if err != nil {
+		f.dropRewrite(ctx, rewrittenBlocksOf(tag, metadata.Name), positions)
+		if errors.Is(err, errPreconditionFailed) {
+			return FileMetadata{}, fmt.Errorf("%w: it was written meanwhile", errPreconditionFailed)
+		}
+		return FileMetadata{}, fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	metadata.Version = version
+
+	for _, position := range positions {
+		if position <= previousBlocks {
+			f.removeReplacedBlock(ctx, previous.blockName(position))
+		}
+	}
+	for i := numOfBlocks + 1; i <= previousBlocks; i++ {
+		f.removeReplacedBlock(ctx, previous.blockName(i))
+	}
+	return metadata, nil
+}
+
+// dropRewrite removes the blocks stored for a version of a file that was not
+// recorded.
+func (f *fileManager) dropRewrite(ctx context.Context, blocksOf string, positions []int) {
+	for _, position := range positions {
+		f.removeReplacedBlock(ctx, blocksOf+"-block-"+strconv.Itoa(position))
+	}
+}
+
+// removeRewrittenBlocks removes the blocks of the version previous that
+// patches and appends stored under names of their own, once the file is
+// overwritten by a version whose blocks are all under its name.
+func (f *fileManager) removeRewrittenBlocks(ctx context.Context, previous FileMetadata) {
+	for position := range previous.Rewritten {
+		f.removeReplacedBlock(ctx, previous.blockName(position))
+	}
+}
+
+func (f *fileManager) removeReplacedBlock(ctx context.Context, blockName string) {
+	if err := f.removeBlock(ctx, blockName); err != nil {
+		requestLogger(ctx).Warn("Failed to remove a block no version of its file uses",
+			zap.String("blockName", blockName),
+			zap.Error(err),
+		)
+	}
+}
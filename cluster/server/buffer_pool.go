@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"github.com/klauspost/pgzip"
+	"io"
+	"sync"
+)
+
+// maxPooledBufferSize keeps the buffer of an unusually large transfer from
+// being pinned in the pool once it is done.
+const maxPooledBufferSize = 256 * MB
+
+// Compression settings of the upload path. pgzip.Writer.Reset restores its
+// defaults, so they are applied again every time a writer is reused.
+const (
+	gzipBlockSize = 100000
+	gzipBlocks    = 10
+)
+
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer returns an empty buffer from the pool. It must be handed back
+// with putBuffer once nothing refers to its contents anymore.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// readPooled reads r to the end into a pooled buffer, growing it to sizeHint
+// up front when the size is known.
+func readPooled(r io.Reader, sizeHint int64) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if sizeHint > 0 && sizeHint <= maxPooledBufferSize {
+		buf.Grow(int(sizeHint))
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() any { return pgzip.NewWriter(io.Discard) },
+}
+
+// getGzipWriter returns a pooled writer compressing into w.
+func getGzipWriter(w io.Writer) (*pgzip.Writer, error) {
+	gz := gzipWriterPool.Get().(*pgzip.Writer)
+	gz.Reset(w)
+	if err := gz.SetConcurrency(gzipBlockSize, gzipBlocks); err != nil {
+		return nil, err
+	}
+	return gz, nil
+}
+
+// putGzipWriter hands back a writer that has been closed.
+func putGzipWriter(gz *pgzip.Writer) {
+	gzipWriterPool.Put(gz)
+}
+
+var gzipReaderPool sync.Pool
+
+// getGzipReader returns a pooled reader decompressing r. Reusing a reader
+// keeps its read-ahead blocks.
+func getGzipReader(r io.Reader) (*pgzip.Reader, error) {
+	if gz, ok := gzipReaderPool.Get().(*pgzip.Reader); ok {
+		if err := gz.Reset(r); err != nil {
+			gzipReaderPool.Put(gz)
+			return nil, err
+		}
+		return gz, nil
+	}
+	return pgzip.NewReader(r)
+}
+
+// putGzipReader hands back a reader that has been closed.
+func putGzipReader(gz *pgzip.Reader) {
+	gzipReaderPool.Put(gz)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+)
+
+// capacityShortfall refuses a write the nodes have no room for before any
+// of its blocks is placed. It wraps errNodesFull.
+type capacityShortfall struct {
+	// Required is the space the blocks take with their replicas, Available
+	// the space left on the nodes they may be placed on.
+	Required  int64
+	Available int64
+}
+
+func (e *capacityShortfall) Error() string {
+	return fmt.Sprintf("%v: %d bytes are needed, %d are left", errNodesFull, e.Required, e.Available)
+}
+
+func (e *capacityShortfall) Unwrap() error { return errNodesFull }
+
+// checkCapacity returns a *capacityShortfall when the nodes at pinned, or all
+// of them if pinned is nil, draining ones aside, have less space left than
+// blocks take with FDS_REPLICATION_FACTOR replicas each, or as many as there
+// are nodes. The space the previous version of a rewritten file takes is not
+// counted as free, so the check errs on the side of refusing.
+func (n *nodeManager) checkCapacity(blocks []FileBlock, pinned []string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var available int64
+	nodes := 0
+	for _, node := range n.NodeStats {
+		if pinned != nil && !slices.Contains(pinned, node.address) || n.draining[node.address] {
+			continue
+		}
+		available += max(0, n.capacityOf(node.address)-int64(node.usage))
+		nodes++
+	}
+	// Without a node to place on, selection reports that no node is
+	// available.
+	if nodes == 0 {
+		return nil
+	}
+
+	var size int64
+	for _, block := range blocks {
+		size += int64(len(block.bytes))
+	}
+	required := size * int64(min(max(config.ReplicationFactor, 1), nodes))
+	if required > available {
+		return &capacityShortfall{Required: required, Available: available}
+	}
+	return nil
+}
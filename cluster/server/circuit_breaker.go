@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+var nodeBreakerState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "node_circuit_breaker_state",
+		Help: "Circuit breaker of each node: 0 closed, 1 open, 2 half-open",
+	},
+	[]string{"node"},
+)
+
+// circuitBreaker opens after threshold consecutive failures and rejects
+// requests for coolDown. Then a single probe is let through: its success
+// closes the breaker, its failure opens it again.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// nodeBreakers keeps one circuit breaker per node host, so a node that times
+// out is skipped at once instead of stalling every request behind the node
+// timeout.
+type nodeBreakers struct {
+	mutex     sync.Mutex
+	breakers  map[string]*circuitBreaker
+	threshold int
+	coolDown  time.Duration
+}
+
+var breakers = &nodeBreakers{breakers: make(map[string]*circuitBreaker)}
+
+func (b *nodeBreakers) configure(threshold int, coolDown time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.threshold = threshold
+	b.coolDown = coolDown
+}
+
+// breakerKey returns the host of a node address, which is also what the
+// transport sees.
+func breakerKey(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return address
+}
+
+// Allow returns errCircuitOpen if requests to host must be skipped.
+func (b *nodeBreakers) Allow(host string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	breaker, ok := b.breakers[host]
+	if !ok {
+		return nil
+	}
+
+	switch breaker.state {
+	case breakerOpen:
+		if time.Since(breaker.openedAt) < b.coolDown {
+			return errCircuitOpen
+		}
+		b.setStateLocked(host, breaker, breakerHalfOpen)
+		breaker.probing = true
+		return nil
+	case breakerHalfOpen:
+		if breaker.probing {
+			return errCircuitOpen
+		}
+		breaker.probing = true
+	}
+	return nil
+}
+
+// Open reports whether host is currently skipped, without taking the probe.
+func (b *nodeBreakers) Open(host string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	breaker, ok := b.breakers[host]
+	if b.threshold <= 0 || !ok {
+		return false
+	}
+	switch breaker.state {
+	case breakerOpen:
+		return time.Since(breaker.openedAt) < b.coolDown
+	case breakerHalfOpen:
+		return breaker.probing
+	}
+	return false
+}
+
+func (b *nodeBreakers) Record(host string, failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	breaker, ok := b.breakers[host]
+	if !ok {
+		breaker = &circuitBreaker{}
+		b.breakers[host] = breaker
+	}
+
+	if !failed {
+		breaker.failures = 0
+		breaker.probing = false
+		if breaker.state != breakerClosed {
+			b.setStateLocked(host, breaker, breakerClosed)
+		}
+		return
+	}
+
+	breaker.failures++
+	if breaker.state == breakerHalfOpen || breaker.failures >= b.threshold {
+		breaker.probing = false
+		breaker.openedAt = time.Now()
+		if breaker.state != breakerOpen {
+			b.setStateLocked(host, breaker, breakerOpen)
+		}
+	}
+}
+
+// Abandon gives back a probe whose request was cancelled by the caller.
+func (b *nodeBreakers) Abandon(host string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if breaker, ok := b.breakers[host]; ok {
+		breaker.probing = false
+	}
+}
+
+func (b *nodeBreakers) setStateLocked(host string, breaker *circuitBreaker, state breakerState) {
+	logger.Warn("Node circuit breaker changed state",
+		zap.String("node", host),
+		zap.String("from", breaker.state.String()),
+		zap.String("to", state.String()),
+	)
+	breaker.state = state
+	nodeBreakerState.WithLabelValues(host).Set(float64(state))
+}
+
+// breakerTransport puts every request to a node behind the node's circuit
+// breaker. Transport errors and 502/503/504 responses count as failures;
+// requests cancelled by the caller do not count.
+type breakerTransport struct {
+	base http.RoundTripper
+}
+
+func (t breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := breakers.Allow(host); err != nil {
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		if errors.Is(req.Context().Err(), context.Canceled) {
+			breakers.Abandon(host)
+		} else {
+			breakers.Record(host, true)
+		}
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		breakers.Record(host, true)
+	default:
+		breakers.Record(host, false)
+	}
+	return res, nil
+}
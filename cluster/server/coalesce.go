@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+var coalescedFetches = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "block_fetches_coalesced_total",
+	Help: "Block fetches that joined an identical fetch already in flight instead of asking the node again",
+})
+
+// sharedFetch is a block fetch in flight. Its buffer goes back to the pool
+// once every caller that joined it has released it.
+type sharedFetch struct {
+	done  chan struct{}
+	block *bytes.Buffer
+	err   error
+	refs  int
+}
+
+// fetchGroup coalesces concurrent fetches of the same block, so a file
+// downloaded by many clients at once is read from its nodes only once.
+type fetchGroup struct {
+	mutex   sync.Mutex
+	fetches map[string]*sharedFetch
+}
+
+var blockFetches = &fetchGroup{}
+
+// Do runs fetch for key unless a fetch of the same key is already in flight,
+// in which case it waits for that one and shares its result. The returned
+// buffer must not be modified and is handed back with release. A caller is
+// not failed by the cancellation of another caller's request: it fetches
+// again instead.
+func (g *fetchGroup) Do(ctx context.Context, key string, fetch func(ctx context.Context) (*bytes.Buffer, error)) (*bytes.Buffer, func(), error) {
+	for {
+		block, release, err := g.do(ctx, key, fetch)
+		if err != nil && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			continue
+		}
+		return block, release, err
+	}
+}
+
+func (g *fetchGroup) do(ctx context.Context, key string, fetch func(ctx context.Context) (*bytes.Buffer, error)) (*bytes.Buffer, func(), error) {
+	g.mutex.Lock()
+	if g.fetches == nil {
+		g.fetches = make(map[string]*sharedFetch)
+	}
+	call, inFlight := g.fetches[key]
+	if !inFlight {
+		call = &sharedFetch{done: make(chan struct{})}
+		g.fetches[key] = call
+	}
+	call.refs++
+	g.mutex.Unlock()
+
+	if inFlight {
+		coalescedFetches.Inc()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			g.release(call)
+			return nil, nil, ctx.Err()
+		}
+	} else {
+		call.block, call.err = fetch(ctx)
+
+		g.mutex.Lock()
+		delete(g.fetches, key)
+		g.mutex.Unlock()
+		close(call.done)
+	}
+
+	if call.err != nil {
+		g.release(call)
+		return nil, nil, call.err
+	}
+	var once sync.Once
+	return call.block, func() { once.Do(func() { g.release(call) }) }, nil
+}
+
+func (g *fetchGroup) release(call *sharedFetch) {
+	g.mutex.Lock()
+	call.refs--
+	last := call.refs == 0
+	g.mutex.Unlock()
+
+	if last {
+		putBuffer(call.block)
+	}
+}
@@ -0,0 +1,593 @@
+package server
+
+import (
+	"FDS/logging"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the tunable settings of the central server. Every field can be
+// overridden through the FDS_* environment variable named next to it; unset
+// variables keep the defaults.
+type Config struct {
+	// Listeners; a port of 0 picks a free one
+	HTTPAddr  string // FDS_HTTP_ADDR the API is served on
+	GRPCAddr  string // FDS_GRPC_ADDR the gRPC API is served on
+	RedisAddr string // FDS_REDIS_ADDR of the Redis holding the metadata
+
+	// Node traffic
+	NodeRequestTimeout      time.Duration // FDS_NODE_REQUEST_TIMEOUT
+	NodeMaxIdleConns        int           // FDS_NODE_MAX_IDLE_CONNS
+	NodeMaxIdleConnsPerHost int           // FDS_NODE_MAX_IDLE_CONNS_PER_HOST
+	NodeMaxConnsPerHost     int           // FDS_NODE_MAX_CONNS_PER_HOST
+	NodeIdleConnTimeout     time.Duration // FDS_NODE_IDLE_CONN_TIMEOUT
+	NodeHTTP2               bool          // FDS_NODE_HTTP2
+	NodeHeartbeatInterval   time.Duration // FDS_NODE_HEARTBEAT_INTERVAL
+	NodeRegistryPruneAfter  time.Duration // FDS_NODE_REGISTRY_PRUNE_AFTER, how long unreachable nodes stay in the registry at startup, 0 keeps them
+	NodeReportMaxAge        time.Duration // FDS_NODE_REPORT_MAX_AGE, how old node reports may be for placement, 0 ignores them
+	NodeDefaultCapacity     int           // FDS_NODE_DEFAULT_CAPACITY, in bytes, assumed for nodes that declare no capacity
+	LatencyAwareRouting     bool          // FDS_LATENCY_AWARE_ROUTING, steer writes away from slow nodes and reads to fast replicas
+	PlacementStrategy       string        // FDS_PLACEMENT_STRATEGY of blocks: "weighted" or "two-choices"
+	RebalanceThreshold      float64       // FDS_REBALANCE_THRESHOLD, how far above the share of the cluster in use a node may be before a rebalance moves blocks off it
+	NodeDiscovery           string        // FDS_NODE_DISCOVERY, a catalog of nodes to register, see newNodeDiscoverer
+	NodeDiscoveryInterval   time.Duration // FDS_NODE_DISCOVERY_INTERVAL
+	NodeDiscoveryScheme     string        // FDS_NODE_DISCOVERY_SCHEME discovered nodes are reached with: "http" or "https"
+	NodeRetryAttempts       int           // FDS_NODE_RETRY_ATTEMPTS, including the first one
+	NodeRetryInitialBackoff time.Duration // FDS_NODE_RETRY_INITIAL_BACKOFF, doubled on every retry
+	NodeRetryMaxBackoff     time.Duration // FDS_NODE_RETRY_MAX_BACKOFF
+	NodeBreakerThreshold    int           // FDS_NODE_BREAKER_THRESHOLD, consecutive failures opening a node's breaker, 0 disables
+	NodeBreakerCoolDown     time.Duration // FDS_NODE_BREAKER_COOL_DOWN, how long an open breaker skips the node
+	NodeEvictAfter          int           // FDS_NODE_EVICT_AFTER consecutive failed heartbeats, 0 never evicts on heartbeats
+	NodeReadmitAfter        time.Duration // FDS_NODE_READMIT_AFTER, how long an evicted node must pass its heartbeats
+	NodeFlapWindow          time.Duration // FDS_NODE_FLAP_WINDOW, an eviction this soon after a readmission quarantines the node
+	NodeQuarantine          time.Duration // FDS_NODE_QUARANTINE, the first quarantine, doubled at each flap
+	NodeQuarantineMax       time.Duration // FDS_NODE_QUARANTINE_MAX
+
+	// Direct downloads: "off", "plan" or "redirect"
+	DirectDownloads   string        // FDS_DIRECT_DOWNLOADS
+	DirectDownloadTTL time.Duration // FDS_DIRECT_DOWNLOAD_TTL
+	BlockSigningKey   string        // FDS_BLOCK_SIGNING_KEY, shared with the nodes
+
+	// Blocks, sizes in bytes of compressed data; uploads may ask for another size
+	BlockSize         int  // FDS_BLOCK_SIZE, used unless the size is adaptive
+	AdaptiveBlockSize bool // FDS_ADAPTIVE_BLOCK_SIZE, size blocks after the file
+	MinBlockSize      int  // FDS_MIN_BLOCK_SIZE of adaptive blocks
+	MaxBlockSize      int  // FDS_MAX_BLOCK_SIZE of adaptive blocks
+	BlockTargetCount  int  // FDS_BLOCK_TARGET_COUNT, blocks per file aimed at by adaptive sizing
+
+	// Uploads
+	MaxUploadSize          int           // FDS_MAX_UPLOAD_SIZE, in bytes, 0 for no limit
+	MaxConcurrentUploads   int           // FDS_MAX_CONCURRENT_UPLOADS, asynchronous ones included, 0 for no limit
+	MaxBufferedUploadBytes int           // FDS_MAX_BUFFERED_UPLOAD_BYTES held by the uploads in flight, 0 for no limit
+	UploadRetryAfter       time.Duration // FDS_UPLOAD_RETRY_AFTER sent with 503s of saturated uploads
+	UploadStagingDir       string        // FDS_UPLOAD_STAGING_DIR keeps the blocks of uploads in flight, to resume them after a crash; off if unset
+	UploadAllowedTypes     []string      // FDS_UPLOAD_ALLOWED_TYPES, media types such as image/* uploads may have; any if empty
+	UploadDeniedTypes      []string      // FDS_UPLOAD_DENIED_TYPES, media types uploads are refused with, declared or sniffed
+	UploadHooks            []string      // FDS_UPLOAD_HOOKS, the chain uploads go through before they are stored, see newUploadHook
+	UploadHookTimeout      time.Duration // FDS_UPLOAD_HOOK_TIMEOUT of each hook
+	UploadHooksFailOpen    bool          // FDS_UPLOAD_HOOKS_FAIL_OPEN stores the uploads a hook failed to run on, rather than refusing them
+	MultipartUploadTTL     time.Duration // FDS_MULTIPART_UPLOAD_TTL after which an unfinished multipart upload is dropped with its parts
+
+	// Small-file packing
+	PackThreshold      int // FDS_PACK_THRESHOLD, files up to this many bytes are packed, 0 disables
+	PackContainerSize  int // FDS_PACK_CONTAINER_SIZE, bytes after which a container is sealed
+	PackCompactPercent int // FDS_PACK_COMPACT_PERCENT of deleted bytes that triggers compaction
+
+	// Access heat: every read of a file adds 1, halved every FDS_HEAT_HALF_LIFE
+	HeatHalfLife  time.Duration // FDS_HEAT_HALF_LIFE
+	HotspotWindow time.Duration // FDS_HOTSPOT_WINDOW, the longest window of GET /admin/hotspots, at least a minute
+
+	// Block cache
+	BlockCacheSize    int     // FDS_BLOCK_CACHE_SIZE, bytes of recently served blocks kept in memory, 0 disables
+	BlockCacheMinHeat float64 // FDS_BLOCK_CACHE_MIN_HEAT files must have for their blocks to be cached
+
+	// Hedged block reads
+	HedgedReads     bool          // FDS_HEDGED_READS
+	HedgePercentile int           // FDS_HEDGE_PERCENTILE of recent fetch latencies to wait before hedging
+	HedgeMinDelay   time.Duration // FDS_HEDGE_MIN_DELAY, also used until enough latencies are known
+
+	// Presigned URLs
+	PublicURL     string        // FDS_PUBLIC_URL, base of the URLs handed out
+	PresignKey    string        // FDS_PRESIGN_KEY, random per process if unset
+	PresignMaxTTL time.Duration // FDS_PRESIGN_MAX_TTL
+
+	// File leases, POST /files/{name}/lock
+	LockDefaultTTL time.Duration // FDS_LOCK_DEFAULT_TTL of a lease asked for without ttl
+	LockMaxTTL     time.Duration // FDS_LOCK_MAX_TTL a lease may be asked for at once
+
+	// Asynchronous uploads
+	JobRetention      time.Duration // FDS_JOB_RETENTION, how long finished jobs stay queryable
+	FetchTimeout      time.Duration // FDS_FETCH_TIMEOUT, for downloading the source of POST /fetch
+	FetchAllowPrivate bool          // FDS_FETCH_ALLOW_PRIVATE lets POST /fetch reach loopback and private addresses
+
+	// Slow and large transfer logging, 0 disables a threshold
+	SlowUploadThreshold        time.Duration // FDS_SLOW_UPLOAD_THRESHOLD
+	SlowDownloadThreshold      time.Duration // FDS_SLOW_DOWNLOAD_THRESHOLD
+	SlowBlockTransmitThreshold time.Duration // FDS_SLOW_BLOCK_TRANSMIT_THRESHOLD
+	LargeTransferThreshold     int           // FDS_LARGE_TRANSFER_THRESHOLD, in bytes
+
+	// Logging, see the logging package for the FDS_LOG_* variables
+	Log logging.Options
+
+	// Administration
+	AdminToken string // FDS_ADMIN_TOKEN, admin endpoints are loopback-only if unset
+	AuditSink  string // FDS_AUDIT_SINK: "redis", "file" or "off"
+	AuditFile  string // FDS_AUDIT_FILE
+
+	// API keys and usage accounting
+	APIKeys           []string      // FDS_API_KEYS, name=key pairs; requests carrying a key in X-API-Key are accounted to its name
+	UsageRetention    time.Duration // FDS_USAGE_RETENTION of the hourly usage in Redis, 0 turns accounting off
+	UsageExportSink   string        // FDS_USAGE_EXPORT_SINK daily usage is exported to: webhook:URL, s3://bucket/prefix or a local directory; off if unset
+	UsageExportFormat string        // FDS_USAGE_EXPORT_FORMAT: "csv" or "ndjson"
+
+	// Maintenance mode, toggled through /admin/maintenance
+	MaintenanceRetryAfter time.Duration // FDS_MAINTENANCE_RETRY_AFTER sent with 503s of the maintenance mode
+
+	// TLS of the HTTP API, served over HTTPS when a certificate is set
+	TLSCertFile      string // FDS_TLS_CERT_FILE, PEM with the chain, reloaded when it changes
+	TLSKeyFile       string // FDS_TLS_KEY_FILE, PEM
+	TLSMinVersion    string // FDS_TLS_MIN_VERSION: "1.2" or "1.3"
+	HTTPRedirectPort int    // FDS_HTTP_REDIRECT_PORT, a plain HTTP port redirecting to HTTPS, 0 for none
+
+	// CORS, off unless FDS_CORS_ORIGINS is set; the lists are comma-separated
+	CORSOrigins       []string      // FDS_CORS_ORIGINS web apps may call the API from, "*" for any
+	CORSMethods       []string      // FDS_CORS_METHODS
+	CORSHeaders       []string      // FDS_CORS_HEADERS requests may carry, "*" for any
+	CORSExposeHeaders []string      // FDS_CORS_EXPOSE_HEADERS of the responses readable by the web apps
+	CORSCredentials   bool          // FDS_CORS_CREDENTIALS lets the web apps send cookies and Authorization
+	CORSMaxAge        time.Duration // FDS_CORS_MAX_AGE browsers cache a preflight answer for
+
+	// Node authentication
+	NodeAuth       bool   // FDS_NODE_AUTH issues a cluster token to the nodes, which then require it; needs NodeJoinSecret
+	NodeToken      string // FDS_NODE_TOKEN, the cluster token; generated and kept in Redis if unset
+	NodeJoinSecret string // FDS_NODE_JOIN_SECRET nodes must present to register, if set
+
+	// TLS of the nodes, whose certificates are always checked
+	NodeCAFile    string        // FDS_NODE_CA_FILE, PEM of a CA trusted for node certificates besides the system ones
+	NodeCAKeyFile string        // FDS_NODE_CA_KEY_FILE, the key of FDS_NODE_CA_FILE; nodes are issued certificates if set
+	NodeCertTTL   time.Duration // FDS_NODE_CERT_TTL of the certificates issued to the nodes
+
+	// Repair of corrupted blocks
+	RepairInterval time.Duration // FDS_REPAIR_INTERVAL between retries of unrepaired blocks; 0 turns repair off
+
+	// Replication
+	ReplicationFactor int      // FDS_REPLICATION_FACTOR, copies of each uploaded block, 1 turns replication off
+	FailureDomains    []string // FDS_FAILURE_DOMAINS, node labels replicas of a block never share when the nodes allow; host defaults to the node's host name
+
+	// Write verification
+	VerifyWrites bool // FDS_VERIFY_WRITES reads every block written back before the write succeeds
+
+	// Backups
+	BackupTarget string // FDS_BACKUP_TARGET, a local directory or s3://bucket/prefix
+
+	// Cold tier, off unless FDS_COLD_TIER is set
+	ColdTier        string        // FDS_COLD_TIER, s3://bucket/prefix blocks of cold files are moved to
+	ColdAfter       time.Duration // FDS_COLD_AFTER, how long a file goes unread before it is offloaded
+	ColdMaxHeat     float64       // FDS_COLD_MAX_HEAT, offloads files older than FDS_COLD_AFTER cooler than this instead, 0 for unread ones
+	TieringInterval time.Duration // FDS_TIERING_INTERVAL between tiering passes
+	ColdRehydrate   bool          // FDS_COLD_REHYDRATE moves a cold file back to the nodes when it is read
+
+	// S3, for backups and the cold tier
+	S3Endpoint  string // FDS_S3_ENDPOINT, AWS unless set, e.g. http://minio:9000
+	S3Region    string // FDS_S3_REGION
+	S3AccessKey string // FDS_S3_ACCESS_KEY
+	S3SecretKey string // FDS_S3_SECRET_KEY
+}
+
+const (
+	auditSinkRedis = "redis"
+	auditSinkFile  = "file"
+	auditSinkOff   = "off"
+)
+
+const (
+	placementWeighted   = "weighted"
+	placementTwoChoices = "two-choices"
+)
+
+const (
+	directDownloadsOff      = "off"
+	directDownloadsPlan     = "plan"
+	directDownloadsRedirect = "redirect"
+)
+
+var config = DefaultConfig()
+
+// DefaultConfig returns the settings the central server runs with when no
+// FDS_* variable is set.
+func DefaultConfig() Config {
+	return Config{
+		HTTPAddr:                   ":8000",
+		GRPCAddr:                   ":8001",
+		RedisAddr:                  "localhost:6379",
+		NodeRequestTimeout:         5 * time.Second,
+		NodeMaxIdleConns:           256,
+		NodeMaxIdleConnsPerHost:    32,
+		NodeMaxConnsPerHost:        0,
+		NodeIdleConnTimeout:        90 * time.Second,
+		NodeHTTP2:                  true,
+		NodeHeartbeatInterval:      10 * time.Second,
+		NodeRegistryPruneAfter:     24 * time.Hour,
+		NodeReportMaxAge:           30 * time.Second,
+		NodeDefaultCapacity:        256 * MB,
+		LatencyAwareRouting:        true,
+		PlacementStrategy:          placementWeighted,
+		RebalanceThreshold:         0.1,
+		NodeDiscoveryInterval:      30 * time.Second,
+		NodeDiscoveryScheme:        "http",
+		NodeRetryAttempts:          3,
+		NodeRetryInitialBackoff:    100 * time.Millisecond,
+		NodeRetryMaxBackoff:        2 * time.Second,
+		NodeBreakerThreshold:       5,
+		NodeBreakerCoolDown:        30 * time.Second,
+		NodeEvictAfter:             3,
+		NodeReadmitAfter:           30 * time.Second,
+		NodeFlapWindow:             10 * time.Minute,
+		NodeQuarantine:             time.Minute,
+		NodeQuarantineMax:          time.Hour,
+		BlockSize:                  128 * MB,
+		AdaptiveBlockSize:          true,
+		MinBlockSize:               4 * MB,
+		MaxBlockSize:               512 * MB,
+		BlockTargetCount:           8,
+		MaxUploadSize:              4 << 30,
+		MaxConcurrentUploads:       64,
+		MaxBufferedUploadBytes:     8 << 30,
+		UploadRetryAfter:           5 * time.Second,
+		UploadHookTimeout:          30 * time.Second,
+		MultipartUploadTTL:         24 * time.Hour,
+		MaintenanceRetryAfter:      time.Minute,
+		TLSMinVersion:              "1.2",
+		CORSMethods:                []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		CORSHeaders:                []string{"Authorization", "Content-Type", "Content-Range", "Range", "Accept", requestIDHeader, apiKeyHeader, leaseHeader, "If-Match"},
+		CORSExposeHeaders:          []string{"Content-Length", "Content-Range", "Accept-Ranges", "Content-Disposition", "ETag", "Last-Modified", "Location", "Retry-After", "Deprecation", "Link", requestIDHeader, maintenanceHeader},
+		CORSMaxAge:                 10 * time.Minute,
+		PackThreshold:              64 * 1024,
+		PackContainerSize:          4 * MB,
+		PackCompactPercent:         50,
+		DirectDownloads:            directDownloadsOff,
+		DirectDownloadTTL:          5 * time.Minute,
+		HeatHalfLife:               24 * time.Hour,
+		HotspotWindow:              time.Hour,
+		BlockCacheSize:             0,
+		BlockCacheMinHeat:          0,
+		HedgePercentile:            95,
+		HedgeMinDelay:              20 * time.Millisecond,
+		PresignMaxTTL:              24 * time.Hour,
+		LockDefaultTTL:             time.Minute,
+		LockMaxTTL:                 time.Hour,
+		JobRetention:               time.Hour,
+		FetchTimeout:               time.Hour,
+		FetchAllowPrivate:          false,
+		SlowUploadThreshold:        30 * time.Second,
+		SlowDownloadThreshold:      10 * time.Second,
+		SlowBlockTransmitThreshold: 5 * time.Second,
+		LargeTransferThreshold:     1 << 30,
+		AuditSink:                  auditSinkRedis,
+		AuditFile:                  "audit.log",
+		UsageRetention:             90 * 24 * time.Hour,
+		UsageExportFormat:          usageFormatCSV,
+		ColdAfter:                  30 * 24 * time.Hour,
+		TieringInterval:            time.Hour,
+		RepairInterval:             10 * time.Minute,
+		ReplicationFactor:          1,
+		FailureDomains:             []string{hostDomain, "zone", "rack"},
+		NodeCertTTL:                30 * 24 * time.Hour,
+		S3Region:                   "us-east-1",
+		Log:                        logging.Defaults(),
+	}
+}
+
+// LoadConfig returns the defaults overridden by the environment. All invalid
+// values are reported together.
+func LoadConfig() (Config, error) {
+	cfg := DefaultConfig()
+	env := &envLoader{}
+
+	env.string("FDS_HTTP_ADDR", &cfg.HTTPAddr)
+	env.string("FDS_GRPC_ADDR", &cfg.GRPCAddr)
+	env.string("FDS_REDIS_ADDR", &cfg.RedisAddr)
+
+	env.duration("FDS_NODE_REQUEST_TIMEOUT", &cfg.NodeRequestTimeout)
+	env.int("FDS_NODE_MAX_IDLE_CONNS", &cfg.NodeMaxIdleConns)
+	env.int("FDS_NODE_MAX_IDLE_CONNS_PER_HOST", &cfg.NodeMaxIdleConnsPerHost)
+	env.int("FDS_NODE_MAX_CONNS_PER_HOST", &cfg.NodeMaxConnsPerHost)
+	env.duration("FDS_NODE_IDLE_CONN_TIMEOUT", &cfg.NodeIdleConnTimeout)
+	env.bool("FDS_NODE_HTTP2", &cfg.NodeHTTP2)
+	env.duration("FDS_NODE_HEARTBEAT_INTERVAL", &cfg.NodeHeartbeatInterval)
+	env.duration("FDS_NODE_REGISTRY_PRUNE_AFTER", &cfg.NodeRegistryPruneAfter)
+	env.duration("FDS_NODE_REPORT_MAX_AGE", &cfg.NodeReportMaxAge)
+	env.int("FDS_NODE_DEFAULT_CAPACITY", &cfg.NodeDefaultCapacity)
+	env.bool("FDS_LATENCY_AWARE_ROUTING", &cfg.LatencyAwareRouting)
+	env.oneOf("FDS_PLACEMENT_STRATEGY", &cfg.PlacementStrategy, placementWeighted, placementTwoChoices)
+	env.float("FDS_REBALANCE_THRESHOLD", &cfg.RebalanceThreshold)
+	env.string("FDS_NODE_DISCOVERY", &cfg.NodeDiscovery)
+	env.duration("FDS_NODE_DISCOVERY_INTERVAL", &cfg.NodeDiscoveryInterval)
+	env.oneOf("FDS_NODE_DISCOVERY_SCHEME", &cfg.NodeDiscoveryScheme, "http", "https")
+	env.int("FDS_NODE_RETRY_ATTEMPTS", &cfg.NodeRetryAttempts)
+	env.duration("FDS_NODE_RETRY_INITIAL_BACKOFF", &cfg.NodeRetryInitialBackoff)
+	env.duration("FDS_NODE_RETRY_MAX_BACKOFF", &cfg.NodeRetryMaxBackoff)
+	env.int("FDS_NODE_BREAKER_THRESHOLD", &cfg.NodeBreakerThreshold)
+	env.duration("FDS_NODE_BREAKER_COOL_DOWN", &cfg.NodeBreakerCoolDown)
+	env.int("FDS_NODE_EVICT_AFTER", &cfg.NodeEvictAfter)
+	env.duration("FDS_NODE_READMIT_AFTER", &cfg.NodeReadmitAfter)
+	env.duration("FDS_NODE_FLAP_WINDOW", &cfg.NodeFlapWindow)
+	env.duration("FDS_NODE_QUARANTINE", &cfg.NodeQuarantine)
+	env.duration("FDS_NODE_QUARANTINE_MAX", &cfg.NodeQuarantineMax)
+	env.oneOf("FDS_DIRECT_DOWNLOADS", &cfg.DirectDownloads, directDownloadsOff, directDownloadsPlan, directDownloadsRedirect)
+	env.duration("FDS_DIRECT_DOWNLOAD_TTL", &cfg.DirectDownloadTTL)
+	env.string("FDS_BLOCK_SIGNING_KEY", &cfg.BlockSigningKey)
+	env.int("FDS_BLOCK_SIZE", &cfg.BlockSize)
+	env.bool("FDS_ADAPTIVE_BLOCK_SIZE", &cfg.AdaptiveBlockSize)
+	env.int("FDS_MIN_BLOCK_SIZE", &cfg.MinBlockSize)
+	env.int("FDS_MAX_BLOCK_SIZE", &cfg.MaxBlockSize)
+	env.int("FDS_BLOCK_TARGET_COUNT", &cfg.BlockTargetCount)
+	env.int("FDS_MAX_UPLOAD_SIZE", &cfg.MaxUploadSize)
+	env.int("FDS_MAX_CONCURRENT_UPLOADS", &cfg.MaxConcurrentUploads)
+	env.int("FDS_MAX_BUFFERED_UPLOAD_BYTES", &cfg.MaxBufferedUploadBytes)
+	env.duration("FDS_UPLOAD_RETRY_AFTER", &cfg.UploadRetryAfter)
+	env.string("FDS_UPLOAD_STAGING_DIR", &cfg.UploadStagingDir)
+	env.list("FDS_UPLOAD_ALLOWED_TYPES", &cfg.UploadAllowedTypes)
+	env.list("FDS_UPLOAD_DENIED_TYPES", &cfg.UploadDeniedTypes)
+	env.list("FDS_UPLOAD_HOOKS", &cfg.UploadHooks)
+	env.duration("FDS_UPLOAD_HOOK_TIMEOUT", &cfg.UploadHookTimeout)
+	env.bool("FDS_UPLOAD_HOOKS_FAIL_OPEN", &cfg.UploadHooksFailOpen)
+	env.duration("FDS_MULTIPART_UPLOAD_TTL", &cfg.MultipartUploadTTL)
+	env.int("FDS_PACK_THRESHOLD", &cfg.PackThreshold)
+	env.int("FDS_PACK_CONTAINER_SIZE", &cfg.PackContainerSize)
+	env.int("FDS_PACK_COMPACT_PERCENT", &cfg.PackCompactPercent)
+	env.duration("FDS_HEAT_HALF_LIFE", &cfg.HeatHalfLife)
+	env.duration("FDS_HOTSPOT_WINDOW", &cfg.HotspotWindow)
+	env.int("FDS_BLOCK_CACHE_SIZE", &cfg.BlockCacheSize)
+	env.float("FDS_BLOCK_CACHE_MIN_HEAT", &cfg.BlockCacheMinHeat)
+	env.bool("FDS_HEDGED_READS", &cfg.HedgedReads)
+	env.int("FDS_HEDGE_PERCENTILE", &cfg.HedgePercentile)
+	env.duration("FDS_HEDGE_MIN_DELAY", &cfg.HedgeMinDelay)
+	env.string("FDS_PUBLIC_URL", &cfg.PublicURL)
+	env.string("FDS_PRESIGN_KEY", &cfg.PresignKey)
+	env.duration("FDS_PRESIGN_MAX_TTL", &cfg.PresignMaxTTL)
+	env.duration("FDS_LOCK_DEFAULT_TTL", &cfg.LockDefaultTTL)
+	env.duration("FDS_LOCK_MAX_TTL", &cfg.LockMaxTTL)
+	env.duration("FDS_JOB_RETENTION", &cfg.JobRetention)
+	env.duration("FDS_FETCH_TIMEOUT", &cfg.FetchTimeout)
+	env.bool("FDS_FETCH_ALLOW_PRIVATE", &cfg.FetchAllowPrivate)
+	env.duration("FDS_SLOW_UPLOAD_THRESHOLD", &cfg.SlowUploadThreshold)
+	env.duration("FDS_SLOW_DOWNLOAD_THRESHOLD", &cfg.SlowDownloadThreshold)
+	env.duration("FDS_SLOW_BLOCK_TRANSMIT_THRESHOLD", &cfg.SlowBlockTransmitThreshold)
+	env.int("FDS_LARGE_TRANSFER_THRESHOLD", &cfg.LargeTransferThreshold)
+	env.string("FDS_ADMIN_TOKEN", &cfg.AdminToken)
+	env.duration("FDS_MAINTENANCE_RETRY_AFTER", &cfg.MaintenanceRetryAfter)
+	env.string("FDS_TLS_CERT_FILE", &cfg.TLSCertFile)
+	env.string("FDS_TLS_KEY_FILE", &cfg.TLSKeyFile)
+	env.oneOf("FDS_TLS_MIN_VERSION", &cfg.TLSMinVersion, "1.2", "1.3")
+	env.int("FDS_HTTP_REDIRECT_PORT", &cfg.HTTPRedirectPort)
+	env.list("FDS_CORS_ORIGINS", &cfg.CORSOrigins)
+	env.list("FDS_CORS_METHODS", &cfg.CORSMethods)
+	env.list("FDS_CORS_HEADERS", &cfg.CORSHeaders)
+	env.list("FDS_CORS_EXPOSE_HEADERS", &cfg.CORSExposeHeaders)
+	env.bool("FDS_CORS_CREDENTIALS", &cfg.CORSCredentials)
+	env.duration("FDS_CORS_MAX_AGE", &cfg.CORSMaxAge)
+	env.oneOf("FDS_AUDIT_SINK", &cfg.AuditSink, auditSinkRedis, auditSinkFile, auditSinkOff)
+	env.string("FDS_AUDIT_FILE", &cfg.AuditFile)
+	env.list("FDS_API_KEYS", &cfg.APIKeys)
+	env.duration("FDS_USAGE_RETENTION", &cfg.UsageRetention)
+	env.string("FDS_USAGE_EXPORT_SINK", &cfg.UsageExportSink)
+	env.oneOf("FDS_USAGE_EXPORT_FORMAT", &cfg.UsageExportFormat, usageFormatCSV, usageFormatNDJSON)
+	env.bool("FDS_NODE_AUTH", &cfg.NodeAuth)
+	env.string("FDS_NODE_TOKEN", &cfg.NodeToken)
+	env.string("FDS_NODE_JOIN_SECRET", &cfg.NodeJoinSecret)
+	env.string("FDS_NODE_CA_FILE", &cfg.NodeCAFile)
+	env.string("FDS_NODE_CA_KEY_FILE", &cfg.NodeCAKeyFile)
+	env.duration("FDS_NODE_CERT_TTL", &cfg.NodeCertTTL)
+	env.duration("FDS_REPAIR_INTERVAL", &cfg.RepairInterval)
+	env.int("FDS_REPLICATION_FACTOR", &cfg.ReplicationFactor)
+	env.list("FDS_FAILURE_DOMAINS", &cfg.FailureDomains)
+	env.bool("FDS_VERIFY_WRITES", &cfg.VerifyWrites)
+	env.string("FDS_BACKUP_TARGET", &cfg.BackupTarget)
+	env.string("FDS_COLD_TIER", &cfg.ColdTier)
+	env.duration("FDS_COLD_AFTER", &cfg.ColdAfter)
+	env.float("FDS_COLD_MAX_HEAT", &cfg.ColdMaxHeat)
+	env.duration("FDS_TIERING_INTERVAL", &cfg.TieringInterval)
+	env.bool("FDS_COLD_REHYDRATE", &cfg.ColdRehydrate)
+	env.string("FDS_S3_ENDPOINT", &cfg.S3Endpoint)
+	env.string("FDS_S3_REGION", &cfg.S3Region)
+	env.string("FDS_S3_ACCESS_KEY", &cfg.S3AccessKey)
+	env.string("FDS_S3_SECRET_KEY", &cfg.S3SecretKey)
+	if err := logging.LoadEnv(&cfg.Log); err != nil {
+		env.errs = append(env.errs, err)
+	}
+
+	if cfg.BlockSize < minBlockSize || cfg.BlockSize > maxBlockSize {
+		env.errs = append(env.errs, fmt.Errorf("FDS_BLOCK_SIZE: %d is not between %d and %d", cfg.BlockSize, minBlockSize, maxBlockSize))
+	}
+	if cfg.MinBlockSize < minBlockSize || cfg.MaxBlockSize > maxBlockSize || cfg.MinBlockSize > cfg.MaxBlockSize {
+		env.errs = append(env.errs, fmt.Errorf("FDS_MIN_BLOCK_SIZE, FDS_MAX_BLOCK_SIZE: %d..%d is not a range within %d..%d", cfg.MinBlockSize, cfg.MaxBlockSize, minBlockSize, maxBlockSize))
+	}
+	if cfg.RebalanceThreshold < 0 || cfg.RebalanceThreshold >= 1 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_REBALANCE_THRESHOLD: %v is not a share between 0 and 1", cfg.RebalanceThreshold))
+	}
+	if cfg.NodeDefaultCapacity <= 0 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_NODE_DEFAULT_CAPACITY: %d is not positive", cfg.NodeDefaultCapacity))
+	}
+	if cfg.BlockTargetCount < 1 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_BLOCK_TARGET_COUNT: %d is not positive", cfg.BlockTargetCount))
+	}
+	for _, pattern := range slices.Concat(cfg.UploadAllowedTypes, cfg.UploadDeniedTypes) {
+		if !validMediaTypePattern(pattern) {
+			env.errs = append(env.errs, fmt.Errorf("FDS_UPLOAD_ALLOWED_TYPES, FDS_UPLOAD_DENIED_TYPES: %q is not type/subtype, type/* or */*", pattern))
+		}
+	}
+	if _, err := newUploadHooks(cfg.UploadHooks); err != nil {
+		env.errs = append(env.errs, err)
+	}
+	if cfg.UploadHookTimeout <= 0 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_UPLOAD_HOOK_TIMEOUT: %s is not positive", cfg.UploadHookTimeout))
+	}
+	if cfg.MultipartUploadTTL <= 0 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_MULTIPART_UPLOAD_TTL: %s is not positive", cfg.MultipartUploadTTL))
+	}
+	if cfg.LockDefaultTTL < time.Second || cfg.LockDefaultTTL > cfg.LockMaxTTL {
+		env.errs = append(env.errs, fmt.Errorf("FDS_LOCK_DEFAULT_TTL: %s is not between 1s and FDS_LOCK_MAX_TTL (%s)", cfg.LockDefaultTTL, cfg.LockMaxTTL))
+	}
+	if cfg.HeatHalfLife <= 0 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_HEAT_HALF_LIFE: %s is not positive", cfg.HeatHalfLife))
+	}
+	names := make(map[string]bool, len(cfg.APIKeys))
+	for _, entry := range cfg.APIKeys {
+		name, key, _ := strings.Cut(entry, "=")
+		if name == "" || key == "" {
+			// The entry may be a bare key, which is not repeated here.
+			env.errs = append(env.errs, errors.New("FDS_API_KEYS: an entry is not name=key"))
+			continue
+		}
+		if names[name] {
+			env.errs = append(env.errs, fmt.Errorf("FDS_API_KEYS: %q is given twice", name))
+		}
+		names[name] = true
+	}
+	if cfg.UsageExportSink != "" {
+		if cfg.UsageRetention <= 0 {
+			env.errs = append(env.errs, errors.New("FDS_USAGE_EXPORT_SINK: exports need usage accounting, FDS_USAGE_RETENTION is 0"))
+		}
+		if strings.HasPrefix(cfg.UsageExportSink, "webhook:") {
+			if _, err := openUsageSink(cfg.UsageExportSink); err != nil {
+				env.errs = append(env.errs, fmt.Errorf("FDS_USAGE_EXPORT_SINK: %w", err))
+			}
+		}
+	}
+	if cfg.HotspotWindow < time.Minute {
+		env.errs = append(env.errs, fmt.Errorf("FDS_HOTSPOT_WINDOW: %s is shorter than a minute", cfg.HotspotWindow))
+	}
+	if cfg.ReplicationFactor < 1 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_REPLICATION_FACTOR: %d is not positive", cfg.ReplicationFactor))
+	}
+	if cfg.PackContainerSize < 1 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_PACK_CONTAINER_SIZE: %d is not positive", cfg.PackContainerSize))
+	}
+	if cfg.PackCompactPercent < 1 || cfg.PackCompactPercent > 100 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_PACK_COMPACT_PERCENT: %d is not between 1 and 100", cfg.PackCompactPercent))
+	}
+	if cfg.ColdTier != "" && !isColdAddress(cfg.ColdTier) {
+		env.errs = append(env.errs, fmt.Errorf("FDS_COLD_TIER: %q is not an s3://bucket/prefix", cfg.ColdTier))
+	}
+	if cfg.NodeDiscovery != "" {
+		if _, err := newNodeDiscoverer(cfg.NodeDiscovery); err != nil {
+			env.errs = append(env.errs, err)
+		}
+		if cfg.NodeDiscoveryInterval <= 0 {
+			env.errs = append(env.errs, fmt.Errorf("FDS_NODE_DISCOVERY_INTERVAL: %s is not positive", cfg.NodeDiscoveryInterval))
+		}
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		env.errs = append(env.errs, errors.New("FDS_TLS_CERT_FILE, FDS_TLS_KEY_FILE: both or neither must be set"))
+	}
+	if cfg.HTTPRedirectPort > 0 && cfg.TLSCertFile == "" {
+		env.errs = append(env.errs, errors.New("FDS_HTTP_REDIRECT_PORT: redirects to HTTPS need FDS_TLS_CERT_FILE"))
+	}
+	// Anyone could otherwise register and get the token unlocking the nodes.
+	if cfg.NodeAuth && cfg.NodeJoinSecret == "" {
+		env.errs = append(env.errs, errors.New("FDS_NODE_AUTH: issuing the cluster token needs FDS_NODE_JOIN_SECRET"))
+	}
+	if cfg.NodeCAKeyFile != "" {
+		if cfg.NodeCAFile == "" {
+			env.errs = append(env.errs, errors.New("FDS_NODE_CA_KEY_FILE: the key needs its certificate in FDS_NODE_CA_FILE"))
+		}
+		// Anyone could otherwise get a certificate the central server trusts.
+		if cfg.NodeJoinSecret == "" {
+			env.errs = append(env.errs, errors.New("FDS_NODE_CA_KEY_FILE: issuing node certificates needs FDS_NODE_JOIN_SECRET"))
+		}
+		if cfg.NodeCertTTL <= 0 {
+			env.errs = append(env.errs, fmt.Errorf("FDS_NODE_CERT_TTL: %s is not positive", cfg.NodeCertTTL))
+		}
+	}
+	if cfg.CORSCredentials && slices.Contains(cfg.CORSOrigins, "*") {
+		env.errs = append(env.errs, errors.New("FDS_CORS_CREDENTIALS: credentials cannot be allowed from any origin, list the origins in FDS_CORS_ORIGINS"))
+	}
+	if cfg.HedgePercentile < 1 || cfg.HedgePercentile > 100 {
+		env.errs = append(env.errs, fmt.Errorf("FDS_HEDGE_PERCENTILE: %d is not between 1 and 100", cfg.HedgePercentile))
+	}
+
+	return cfg, errors.Join(env.errs...)
+}
+
+type envLoader struct {
+	errs []error
+}
+
+func (e *envLoader) string(key string, dst *string) {
+	if value, ok := os.LookupEnv(key); ok {
+		*dst = value
+	}
+}
+
+func (e *envLoader) oneOf(key string, dst *string, allowed ...string) {
+	if value, ok := os.LookupEnv(key); ok {
+		if !slices.Contains(allowed, value) {
+			e.errs = append(e.errs, fmt.Errorf("%s: %q is not one of %s", key, value, strings.Join(allowed, ", ")))
+			return
+		}
+		*dst = value
+	}
+}
+
+// list reads a comma-separated list.
+func (e *envLoader) list(key string, dst *[]string) {
+	if value, ok := os.LookupEnv(key); ok {
+		*dst = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*dst = append(*dst, item)
+			}
+		}
+	}
+}
+
+func (e *envLoader) int(key string, dst *int) {
+	if value, ok := os.LookupEnv(key); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid non-negative integer %q", key, value))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envLoader) float(key string, dst *float64) {
+	if value, ok := os.LookupEnv(key); ok {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid non-negative number %q", key, value))
+			return
+		}
+		*dst = f
+	}
+}
+
+func (e *envLoader) duration(key string, dst *time.Duration) {
+	if value, ok := os.LookupEnv(key); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid duration %q", key, value))
+			return
+		}
+		*dst = d
+	}
+}
+
+func (e *envLoader) bool(key string, dst *bool) {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid boolean %q", key, value))
+			return
+		}
+		*dst = b
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// errContentTypeNotAllowed refuses uploads kept out by
+// FDS_UPLOAD_ALLOWED_TYPES or FDS_UPLOAD_DENIED_TYPES.
+var errContentTypeNotAllowed = errors.New("content type not allowed")
+
+var uploadsRefusedByType = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "uploads_refused_content_type_total",
+	Help: "Uploads refused because of their content type",
+})
+
+// executableSignatures recognizes executables, which http.DetectContentType
+// reports as application/octet-stream.
+var executableSignatures = []struct {
+	prefix    string
+	mediaType string
+}{
+	{"\x7fELF", "application/x-executable"},
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+}
+
+// genericTypes are what sniffing finds for content it cannot tell apart,
+// such as JSON or CSV, which are plain text, and most binary formats.
+var genericTypes = map[string]bool{
+	"text/plain":               true,
+	"application/octet-stream": true,
+}
+
+type declaredTypeKey struct{}
+
+// withDeclaredType records the content type an upload declares, for
+// checkContentType.
+func withDeclaredType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, declaredTypeKey{}, contentType)
+}
+
+func declaredType(ctx context.Context) string {
+	contentType, _ := ctx.Value(declaredTypeKey{}).(string)
+	return contentType
+}
+
+// sniffContentType returns the media type of body from its first bytes.
+func sniffContentType(body []byte) string {
+	for _, signature := range executableSignatures {
+		if bytes.HasPrefix(body, []byte(signature.prefix)) {
+			return signature.mediaType
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	return mediaType
+}
+
+// checkContentType refuses an upload whose sniffed or declared type is
+// denied, or, when types are allowed, whose sniffed type is not. Only
+// content sniffed as plain text or binary is let in by its declared type,
+// since sniffing cannot tell such formats apart. Empty files have no type.
+func checkContentType(declared string, body []byte) error {
+	if len(config.UploadAllowedTypes) == 0 && len(config.UploadDeniedTypes) == 0 || len(body) == 0 {
+		return nil
+	}
+	sniffed := sniffContentType(body)
+	declared, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		declared = ""
+	}
+
+	for _, mediaType := range []string{sniffed, declared} {
+		if mediaType != "" && mediaTypeMatches(config.UploadDeniedTypes, mediaType) {
+			return fmt.Errorf("%w: %s", errContentTypeNotAllowed, mediaType)
+		}
+	}
+	if len(config.UploadAllowedTypes) == 0 || mediaTypeMatches(config.UploadAllowedTypes, sniffed) {
+		return nil
+	}
+	if genericTypes[sniffed] && declared != "" {
+		if mediaTypeMatches(config.UploadAllowedTypes, declared) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", errContentTypeNotAllowed, declared)
+	}
+	return fmt.Errorf("%w: %s", errContentTypeNotAllowed, sniffed)
+}
+
+// mediaTypeMatches tells whether mediaType is one of patterns, given as
+// type/subtype, type/* or */*.
+func mediaTypeMatches(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validMediaTypePattern tells whether pattern can be matched by
+// mediaTypeMatches.
+func validMediaTypePattern(pattern string) bool {
+	mediaType, subtype, ok := strings.Cut(pattern, "/")
+	return ok && mediaType != "" && subtype != "" && !strings.ContainsAny(pattern, " ;") && (mediaType != "*" || subtype == "*")
+}
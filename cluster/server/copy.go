@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var errCopyOntoItself = errors.New("source and destination are the same file")
+
+// copyBlockOnNode asks a node to duplicate one of its blocks under another
+// name.
+func (f *fileManager) copyBlockOnNode(ctx context.Context, nodeAddress string, from string, to string) error {
+	query := url.Values{"from": {from}, "to": {to}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nodeAddress+"/copyFile?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return &nodeStatusError{Node: nodeAddress, StatusCode: res.StatusCode}
+	}
+	return nil
+}
+
+// copyBlocks has the nodes duplicate every block of source under dest and
+// records their location, leaving the metadata index alone. It returns the
+// number of blocks.
+func (f *fileManager) copyBlocks(ctx context.Context, source string, dest string) (int, error) {
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(source)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 1; i <= numOfBlocks; i++ {
+		if err := f.copyBlock(ctx, metadata.blockName(i), dest+"-block-"+strconv.Itoa(i)); err != nil {
+			return 0, fmt.Errorf("failed to copy block %d: %w", i, err)
+		}
+	}
+
+	if err := f.redisManager.SendBlockHashWithNumberOfBlocks(GenerateFileHash(dest), numOfBlocks); err != nil {
+		return 0, fmt.Errorf("failed to store the number of blocks: %w", err)
+	}
+	return numOfBlocks, nil
+}
+
+// copyBlock has the nodes holding sourceBlock duplicate it as destBlock, and
+// records the location of the copy.
+func (f *fileManager) copyBlock(ctx context.Context, sourceBlock string, destBlock string) error {
+	logger := requestLogger(ctx)
+	location, err := f.redisManager.GetBlockLocation(sourceBlock)
+	if err != nil {
+		return err
+	}
+
+	// Every healthy replica copies the block; the copy has a replica on
+	// each that succeeded.
+	var replicas []Replica
+	err = fmt.Errorf("%w: no healthy replica of %s", errBlockCorrupted, sourceBlock)
+	for _, address := range location.Healthy() {
+		copyErr := nodeRetryPolicy().Do(ctx, "blockCopy", func() error {
+			if isColdAddress(address) {
+				return f.copyColdBlock(ctx, address, sourceBlock+".bin", destBlock+".bin")
+			}
+			return f.copyBlockOnNode(ctx, address, sourceBlock+".bin", destBlock+".bin")
+		})
+		if copyErr != nil {
+			logger.Warn("Failed to copy block on node",
+				zap.String("blockName", sourceBlock),
+				zap.String("nodeAddress", address),
+				zap.Error(copyErr),
+			)
+			err = copyErr
+			continue
+		}
+		replicas = append(replicas, Replica{Address: address, State: ReplicaHealthy})
+	}
+	if len(replicas) == 0 {
+		logger.Error("Failed to copy block on node",
+			zap.String("blockName", sourceBlock),
+			zap.Strings("replicas", location.Addresses()),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	fields, err := replicaFields(replicas)
+	if err != nil {
+		return err
+	}
+	fields = append(fields, "block_hash", location.Hash)
+	if location.Size >= 0 {
+		fields = append(fields, "block_size", location.Size)
+	}
+	if err := f.redisManager.redisClient.HSet(ctx, fmt.Sprintf("%x", GenerateFileHash(destBlock)), fields...).Err(); err != nil {
+		return fmt.Errorf("failed to store block metadata for %s: %w", destBlock, err)
+	}
+	blockCache.Invalidate(destBlock)
+	_ = f.redisManager.ClearBlockCorrupted(destBlock)
+	return nil
+}
+
+// DuplicateFile stores a copy of source under dest. Each block is duplicated by
+// the node holding it, so no block goes through the central server; packed
+// files are small and are simply packed again under the new name.
+func (f *fileManager) DuplicateFile(ctx context.Context, source string, dest string) (FileMetadata, error) {
+	metadata, err := f.duplicateFile(ctx, source, dest)
+	recordAudit(ctx, AuditFileCopy, dest, err)
+	return metadata, err
+}
+
+func (f *fileManager) duplicateFile(ctx context.Context, source string, dest string) (FileMetadata, error) {
+	logger := requestLogger(ctx)
+	if source == dest {
+		return FileMetadata{}, errCopyOntoItself
+	}
+	if err := checkReservedName(dest); err != nil {
+		return FileMetadata{}, err
+	}
+	if err := f.checkWrite(ctx, dest); err != nil {
+		return FileMetadata{}, err
+	}
+
+	metadata, err := f.redisManager.GetFileMetadata(source)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	if metadata.Packed != nil {
+		data, err := f.packer.Read(ctx, *metadata.Packed)
+		if err != nil {
+			return FileMetadata{}, err
+		}
+		if err := f.packer.Store(ctx, dest, data); err != nil {
+			return FileMetadata{}, err
+		}
+		return f.redisManager.GetFileMetadata(dest)
+	}
+
+	previous, previousErr := f.redisManager.GetFileMetadata(dest)
+
+	numOfBlocks, err := f.copyBlocks(ctx, source, dest)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	copied := FileMetadata{
+		Name:        dest,
+		Size:        metadata.Size,
+		Blocks:      numOfBlocks,
+		BlockSize:   metadata.BlockSize,
+		CreatedAt:   time.Now().UTC(),
+		Extents:     metadata.Extents,
+		Annotations: metadata.Annotations,
+		Owner:       fileOwner(ctx),
+	}
+	version, err := f.redisManager.SaveFileMetadataIf(copied, ifMatchFromContext(ctx))
+	if err != nil {
+		return FileMetadata{}, fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	copied.Version = version
+
+	// A previous version packed into a container is dead space there now,
+	// as are the blocks of one that patches and appends stored again.
+	if previousErr == nil && previous.Packed != nil {
+		f.packer.Release(ctx, dest, *previous.Packed)
+	}
+	if previousErr == nil {
+		f.removeRewrittenBlocks(ctx, previous)
+	}
+	// The nodes duplicated the blocks where the source is.
+	f.followPin(ctx, dest)
+
+	logger.Info("File copied",
+		zap.String("source", source),
+		zap.String("dest", dest),
+		zap.Int("numOfBlocks", numOfBlocks),
+	)
+	return copied, nil
+}
+
+func (f *fileManager) CopyFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/copy").Inc()
+	// The nodes copy the blocks, which the hooks never see under the new name.
+	if refuseWhileHooked(w, "Copies") {
+		return
+	}
+	logger := requestLogger(r.Context())
+	source := mux.Vars(r)["name"]
+	dest := r.URL.Query().Get("dest")
+
+	if dest == "" {
+		respondWithError(w, http.StatusBadRequest, "dest is required")
+		return
+	}
+
+	metadata, err := f.DuplicateFile(r.Context(), source, dest)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, source)
+		return
+	}
+	if errors.Is(err, errCopyOntoItself) || errors.Is(err, errReservedName) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to copy file",
+			zap.String("source", source),
+			zap.String("dest", dest),
+			zap.Error(err),
+		)
+		respondUploadError(w, dest, "Failed to copy file", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(metadata.Version))
+	w.Header().Set("Location", apiPath(r, "/files/"+url.PathEscape(dest)))
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(metadata)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// withCORS lets web apps served from the origins of FDS_CORS_ORIGINS call the
+// API. Preflight requests are answered here, before the router, which would
+// refuse OPTIONS on most routes; requests from other origins get no CORS
+// headers, so browsers keep the responses from the page.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(config.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !corsAllowed(config.CORSOrigins, origin) {
+			if preflight {
+				respondWithError(w, http.StatusForbidden, "Origin not allowed")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if slices.Contains(config.CORSOrigins, "*") && !config.CORSCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if config.CORSCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(config.CORSExposeHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(config.CORSExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !corsAllowed(config.CORSMethods, method) {
+			respondWithError(w, http.StatusForbidden, "Method not allowed: "+method)
+			return
+		}
+		var headers []string
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			header = strings.TrimSpace(header)
+			if header == "" {
+				continue
+			}
+			if !corsAllowedHeader(header) {
+				respondWithError(w, http.StatusForbidden, "Header not allowed: "+header)
+				return
+			}
+			headers = append(headers, header)
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(config.CORSMethods, ", "))
+		if len(headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+		if config.CORSMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORSMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func corsAllowed(allowed []string, value string) bool {
+	return slices.Contains(allowed, "*") || slices.Contains(allowed, value)
+}
+
+func corsAllowedHeader(header string) bool {
+	return slices.ContainsFunc(config.CORSHeaders, func(allowed string) bool {
+		return allowed == "*" || strings.EqualFold(allowed, header)
+	})
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"FDS/rollsum"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultDeltaChunkSize = 64 * 1024
+	minDeltaChunkSize     = 512
+	maxDeltaChunkSize     = 16 * MB
+)
+
+var (
+	errStaleDeltaBase = errors.New("the file changed since its signature was taken")
+	errInvalidDelta   = errors.New("invalid delta")
+)
+
+// ChunkSignature identifies one chunk of a file: the rsync rolling checksum,
+// to find it at any offset cheaply, and its SHA-256 to confirm a match.
+type ChunkSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// FileSignature is the answer of GET /files/{name}/signature. The file is cut
+// into chunks of ChunkSize bytes, the last one holding the remainder; Base is
+// the SHA-256 of the whole file, which a delta must be built against.
+type FileSignature struct {
+	Name      string           `json:"name"`
+	Size      int64            `json:"size"`
+	ChunkSize int              `json:"chunk_size"`
+	Base      string           `json:"base"`
+	Chunks    []ChunkSignature `json:"chunks"`
+}
+
+// DeltaOp is one instruction of a delta: either literal Data, or Count chunks
+// of the current version starting at Chunk (one when Count is 0).
+type DeltaOp struct {
+	Chunk int    `json:"chunk,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// DeltaRequest is the body of POST /files/{name}/delta: the new version of
+// the file, described against the signature Base and ChunkSize.
+type DeltaRequest struct {
+	Base      string    `json:"base"`
+	ChunkSize int       `json:"chunk_size"`
+	Ops       []DeltaOp `json:"ops"`
+}
+
+func chunkSizeFromQuery(r *http.Request) (int, error) {
+	chunkSizeStr := r.URL.Query().Get("chunkSize")
+	if chunkSizeStr == "" {
+		return defaultDeltaChunkSize, nil
+	}
+
+	chunkSize, err := strconv.Atoi(chunkSizeStr)
+	if err != nil || chunkSize < minDeltaChunkSize || chunkSize > maxDeltaChunkSize {
+		return 0, fmt.Errorf("chunkSize must be between %d and %d bytes", minDeltaChunkSize, maxDeltaChunkSize)
+	}
+	return chunkSize, nil
+}
+
+// readCurrentVersion returns the content of a file, packed or not, as a slice
+// the caller owns.
+func (f *fileManager) readCurrentVersion(ctx context.Context, timer *phaseTimer, metadata FileMetadata) ([]byte, error) {
+	if metadata.Packed != nil {
+		content, err := f.packer.Read(ctx, *metadata.Packed)
+		timer.Phase("container")
+		return bytes.Clone(content), err
+	}
+	return f.reconstructFile(ctx, timer, metadata.Name)
+}
+
+func signContent(name string, content []byte, chunkSize int) FileSignature {
+	signature := FileSignature{
+		Name:      name,
+		Size:      int64(len(content)),
+		ChunkSize: chunkSize,
+		Base:      fmt.Sprintf("%x", sha256.Sum256(content)),
+		Chunks:    []ChunkSignature{},
+	}
+	for offset := 0; offset < len(content); offset += chunkSize {
+		chunk := content[offset:min(offset+chunkSize, len(content))]
+		signature.Chunks = append(signature.Chunks, ChunkSignature{
+			Weak:   rollsum.Sum(chunk),
+			Strong: fmt.Sprintf("%x", sha256.Sum256(chunk)),
+		})
+	}
+	return signature
+}
+
+// applyDelta builds the new version of a file from the current one.
+func applyDelta(base []byte, chunkSize int, ops []DeltaOp) ([]byte, error) {
+	var content []byte
+	for i, op := range ops {
+		if len(op.Data) > 0 {
+			content = append(content, op.Data...)
+			continue
+		}
+
+		count := max(op.Count, 1)
+		start := op.Chunk * chunkSize
+		if op.Chunk < 0 || op.Count < 0 || start >= len(base) {
+			return nil, fmt.Errorf("%w: op %d: chunk %d does not exist", errInvalidDelta, i, op.Chunk)
+		}
+		end := min(start+count*chunkSize, len(base))
+		if (end-start+chunkSize-1)/chunkSize != count {
+			return nil, fmt.Errorf("%w: op %d: chunks %d to %d do not exist", errInvalidDelta, i, op.Chunk, op.Chunk+count-1)
+		}
+		content = append(content, base[start:end]...)
+	}
+	return content, nil
+}
+
+// SignFile returns the chunk signature of a file, which a client compares
+// with the new version of the file to build a delta.
+func (f *fileManager) SignFile(ctx context.Context, fileName string, chunkSize int) (FileSignature, error) {
+	timer := newPhaseTimer()
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	timer.Phase("metadata")
+	if err != nil {
+		return FileSignature{}, err
+	}
+
+	content, err := f.readCurrentVersion(ctx, timer, metadata)
+	if err != nil {
+		return FileSignature{}, err
+	}
+	signature := signContent(fileName, content, chunkSize)
+	timer.Phase("sign")
+	timer.report(requestLogger(ctx), "sign", config.SlowDownloadThreshold, len(content), nil, zap.String("fileName", fileName))
+	return signature, nil
+}
+
+// ApplyFileDelta stores a new version of a file from a delta against its
+// signature: the chunks the client still has are copied from the current
+// version on the server, so only the changed data is uploaded. Like a patch,
+// only the blocks whose content changed are rewritten.
+func (f *fileManager) ApplyFileDelta(ctx context.Context, fileName string, req DeltaRequest) (FileMetadata, error) {
+	timer := newPhaseTimer()
+	metadata, err := f.applyFileDelta(ctx, timer, fileName, req)
+	timer.report(requestLogger(ctx), "delta", config.SlowUploadThreshold, int(metadata.Size), err, zap.String("fileName", fileName))
+	recordAudit(ctx, AuditFileDelta, fileName, err)
+	return metadata, err
+}
+
+func (f *fileManager) applyFileDelta(ctx context.Context, timer *phaseTimer, fileName string, req DeltaRequest) (FileMetadata, error) {
+	logger := requestLogger(ctx)
+	if err := f.checkWrite(ctx, fileName); err != nil {
+		return FileMetadata{}, err
+	}
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	timer.Phase("metadata")
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	base, err := f.readCurrentVersion(ctx, timer, metadata)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(base)) != req.Base {
+		return FileMetadata{}, errStaleDeltaBase
+	}
+
+	content, err := applyDelta(base, req.ChunkSize, req.Ops)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	timer.Phase("apply")
+
+	if metadata.Packed != nil {
+		if err := f.storeWhole(ctx, timer, fileName, content, metadata.Annotations); err != nil {
+			return FileMetadata{}, err
+		}
+		return f.redisManager.GetFileMetadata(fileName)
+	}
+
+	metadata, rewritten, err := f.rewriteBlocks(ctx, timer, metadata, content)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	var literal int
+	for _, op := range req.Ops {
+		literal += len(op.Data)
+	}
+	logger.Info("File delta applied",
+		zap.String("fileName", fileName),
+		zap.Int("ops", len(req.Ops)),
+		zap.Int("literalSize", literal),
+		zap.Int64("size", metadata.Size),
+		zap.Int("rewrittenBlocks", rewritten),
+	)
+	return metadata, nil
+}
+
+// GetFileSignature answers with the chunk signature of a file, in chunks of
+// the chunkSize query parameter.
+func (f *fileManager) GetFileSignature(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/signature").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	chunkSize, err := chunkSizeFromQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	signature, err := f.SignFile(r.Context(), fileName, chunkSize)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to sign file", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to sign file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(signature)
+}
+
+// UploadFileDelta stores a new version of a file from a delta.
+func (f *fileManager) UploadFileDelta(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/delta").Inc()
+	// The hooks would only see the delta, not the file it rebuilds.
+	if refuseWhileHooked(w, "Delta uploads") {
+		return
+	}
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	if !limitUploadBody(w, r, 0) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.Release()
+
+	buf, err := readPooled(r.Body, r.ContentLength)
+	if isBodyTooLarge(err) {
+		respondUploadTooLarge(w)
+		return
+	}
+	if errors.Is(err, errUploadsSaturated) {
+		respondUploadsSaturated(w)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read delta", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read delta")
+		return
+	}
+	defer putBuffer(buf)
+
+	var req DeltaRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delta: "+err.Error())
+		return
+	}
+	if req.ChunkSize < minDeltaChunkSize || req.ChunkSize > maxDeltaChunkSize {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("chunk_size must be between %d and %d bytes", minDeltaChunkSize, maxDeltaChunkSize))
+		return
+	}
+
+	metadata, err := f.ApplyFileDelta(r.Context(), fileName, req)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if errors.Is(err, errStaleDeltaBase) {
+		respondWithErrorCode(w, http.StatusConflict, CodeStaleDeltaBase, err.Error(), map[string]any{"file": fileName})
+		return
+	}
+	if errors.Is(err, errInvalidDelta) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to apply delta", zap.String("fileName", fileName), zap.Error(err))
+		respondUploadError(w, fileName, "Failed to apply delta", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(metadata.Version))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(metadata)
+}
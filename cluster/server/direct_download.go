@@ -0,0 +1,238 @@
+package server
+
+import (
+	"FDS/urlsign"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const blockPlanContentType = "application/vnd.fds.block-plan+json"
+
+// BlockPlan tells a client where to fetch the blocks of a file directly from
+// the nodes. Blocks hold consecutive pieces of one gzip stream: concatenating
+// them in order and decompressing yields the file. Blocks with an extent are
+// gzip members of their own, each decompressing alone into that extent of
+// the file, so a client can read a range from the blocks it spans.
+type BlockPlan struct {
+	Name        string         `json:"name"`
+	Size        int64          `json:"size"`
+	BlockSize   int            `json:"block_size,omitempty"`
+	Version     int64          `json:"version"`
+	Compression string         `json:"compression"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	Blocks      []PlannedBlock `json:"blocks"`
+}
+
+// PlannedBlock is a block of a BlockPlan. URL is a healthy replica, and
+// Replicas the others, to fall back on or to spread the fetches over. Size
+// is the size of the block as stored, compressed.
+type PlannedBlock struct {
+	Position int          `json:"position"`
+	URL      string       `json:"url"`
+	Replicas []string     `json:"replicas,omitempty"`
+	Size     int64        `json:"size"`
+	SHA256   string       `json:"sha256"`
+	Extent   *BlockExtent `json:"extent,omitempty"`
+}
+
+// signedBlockURL returns the node URL serving a block. When a signing key is
+// configured the URL carries a signature valid until expires, which the node
+// checks before serving the block. A non-empty downloadName makes the node
+// serve a single-block file as that file, gzip content encoding included.
+func signedBlockURL(nodeAddress, blockFileName string, expires time.Time, downloadName string) string {
+	query := url.Values{}
+	query.Set("filename", blockFileName)
+	if downloadName != "" {
+		query.Set("encoding", "gzip")
+		query.Set("download", downloadName)
+	}
+	if config.BlockSigningKey != "" {
+		urlsign.SignQuery([]byte(config.BlockSigningKey), query, http.MethodGet, blockFileName, expires)
+	}
+
+	return strings.TrimSuffix(nodeAddress, "/") + "/retrieveFile?" + query.Encode()
+}
+
+// errPackedFile is returned for block plans of packed files, which share their
+// blocks with other files and are only served through the central server.
+var errPackedFile = errors.New("file is packed into a container")
+
+func (f *fileManager) BuildBlockPlan(fileName string) (BlockPlan, error) {
+	if metadata, err := f.redisManager.GetFileMetadata(fileName); err == nil && metadata.Packed != nil {
+		return BlockPlan{}, errPackedFile
+	}
+
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(fileName)
+	if err != nil {
+		return BlockPlan{}, err
+	}
+
+	plan := BlockPlan{
+		Name:        fileName,
+		Size:        -1,
+		Compression: "gzip",
+		ExpiresAt:   time.Now().Add(config.DirectDownloadTTL).UTC().Truncate(time.Second),
+		Blocks:      make([]PlannedBlock, 0, numOfBlocks),
+	}
+	// Files in the metadata index always have a block size, the legacy one
+	// when none was recorded.
+	if metadata.BlockSize > 0 {
+		plan.Size = metadata.Size
+		plan.BlockSize = metadata.BlockSize
+		plan.Version = metadata.Version
+	}
+	extents := metadata.Extents
+
+	for i := 1; i <= numOfBlocks; i++ {
+		blockName := metadata.blockName(i)
+
+		location, err := f.redisManager.GetBlockLocation(blockName)
+		if err != nil {
+			return BlockPlan{}, err
+		}
+		if isColdAddress(location.NodeAddress) {
+			return BlockPlan{}, errColdFile
+		}
+		healthy := nodeHealthMetrics.ByLatency(location.Healthy())
+		if len(healthy) == 0 {
+			return BlockPlan{}, fmt.Errorf("%w: no healthy replica of %s", errBlockCorrupted, blockName)
+		}
+
+		planned := PlannedBlock{
+			Position: i,
+			URL:      signedBlockURL(healthy[0], blockName+".bin", plan.ExpiresAt, ""),
+			Size:     location.Size,
+			SHA256:   location.Hash,
+		}
+		for _, address := range healthy[1:] {
+			planned.Replicas = append(planned.Replicas, signedBlockURL(address, blockName+".bin", plan.ExpiresAt, ""))
+		}
+		if len(extents) == numOfBlocks {
+			planned.Extent = &extents[i-1]
+		}
+		plan.Blocks = append(plan.Blocks, planned)
+	}
+
+	return plan, nil
+}
+
+// GetFileManifest answers the block plan of a file as JSON, for clients
+// downloading its blocks from the nodes in parallel and checking each one
+// against its SHA-256 themselves.
+func (f *fileManager) GetFileManifest(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/manifest").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	if config.DirectDownloads == directDownloadsOff {
+		respondWithError(w, http.StatusForbidden, "Direct downloads are disabled")
+		return
+	}
+
+	plan, err := f.BuildBlockPlan(fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if errors.Is(err, errPackedFile) || errors.Is(err, errColdFile) {
+		respondWithErrorCode(w, http.StatusConflict, CodeConflict, err.Error()+", download it from the central server", map[string]any{"file": fileName})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to build block plan", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to build block plan")
+		return
+	}
+	f.noteFileRead(r.Context(), fileName)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("ETag", fileETag(plan.Version))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(plan)
+}
+
+func wantsBlockPlan(r *http.Request) bool {
+	if plan, err := strconv.ParseBool(r.URL.Query().Get("plan")); err == nil {
+		return plan
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == blockPlanContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// serveDirectDownload answers a download request without proxying the file
+// content, either with a block plan or with a redirect to the node holding a
+// single-block file. It reports whether the request was handled.
+func (f *fileManager) serveDirectDownload(w http.ResponseWriter, r *http.Request, fileName string) bool {
+	logger := requestLogger(r.Context())
+	if wantsBlockPlan(r) {
+		if config.DirectDownloads == directDownloadsOff {
+			respondWithError(w, http.StatusBadRequest, "Direct downloads are disabled")
+			return true
+		}
+
+		plan, err := f.BuildBlockPlan(fileName)
+		if errors.Is(err, errPackedFile) || errors.Is(err, errColdFile) {
+			return false
+		}
+		if errors.Is(err, ErrFileNotFound) {
+			respondFileNotFound(w, fileName)
+			return true
+		}
+		if err != nil {
+			logger.Error("Failed to build block plan", zap.String("fileName", fileName), zap.Error(err))
+			respondWithError(w, http.StatusInternalServerError, "Failed to build block plan")
+			return true
+		}
+
+		w.Header().Set("Content-Type", blockPlanContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(plan)
+		return true
+	}
+
+	// Only whole-file GETs of single-block files can be redirected: the node
+	// serves the block as the gzip-encoded file, which a Range request could
+	// not address, and which clients that do not accept gzip get decompressed
+	// through the central server instead.
+	if config.DirectDownloads != directDownloadsRedirect || r.Method != http.MethodGet || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+		return false
+	}
+
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(fileName)
+	if err != nil || numOfBlocks != 1 {
+		return false
+	}
+
+	blockName := metadata.blockName(1)
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil || len(location.Healthy()) == 0 || isColdAddress(location.NodeAddress) || !f.nodeManager.servesCodec(location.NodeAddress, "gzip") {
+		return false
+	}
+
+	blockURL := signedBlockURL(location.NodeAddress, blockName+".bin", time.Now().Add(config.DirectDownloadTTL), fileName)
+
+	logger.Info("Redirecting download to node",
+		zap.String("fileName", fileName),
+		zap.String("nodeAddress", location.NodeAddress),
+	)
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, blockURL, http.StatusTemporaryRedirect)
+	return true
+}
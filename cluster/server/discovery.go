@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeDiscoverer lists the addresses of the nodes found in a catalog.
+type nodeDiscoverer interface {
+	Discover(ctx context.Context) ([]string, error)
+}
+
+// nodeWatcher is a nodeDiscoverer that can also tell when its catalog
+// changes, so nodes join and leave without waiting for the next interval.
+type nodeWatcher interface {
+	Watch(ctx context.Context, changed func()) error
+}
+
+// discoveryMutex keeps passes triggered by the interval and by a watch from
+// registering the same node twice.
+var discoveryMutex sync.Mutex
+
+// newNodeDiscoverer parses FDS_NODE_DISCOVERY:
+//
+//   - srv:_fds._tcp.example.com looks up DNS SRV records;
+//   - consul:http://consul:8500/fds lists the passing instances of a Consul
+//     service;
+//   - etcd:http://etcd:2379/fds/nodes/ reads node URLs from the values of the
+//     keys under a prefix, through the etcd v3 JSON gateway;
+//   - k8s:namespace/service[:port] follows the ready endpoints of a
+//     Kubernetes Service.
+func newNodeDiscoverer(spec string) (nodeDiscoverer, error) {
+	scheme, target, _ := strings.Cut(spec, ":")
+	switch scheme {
+	case "k8s":
+		return newK8sDiscoverer(target)
+	case "srv":
+		if target == "" {
+			break
+		}
+		return srvDiscoverer{name: target}, nil
+	case "consul", "etcd":
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			break
+		}
+		base := u.Scheme + "://" + u.Host
+		if scheme == "consul" {
+			return consulDiscoverer{base: base, service: strings.Trim(u.Path, "/")}, nil
+		}
+		return etcdDiscoverer{base: base, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+	}
+	return nil, fmt.Errorf("FDS_NODE_DISCOVERY: %q is not srv:name, consul:http://host/service, etcd:http://host/prefix or k8s:namespace/service", spec)
+}
+
+type srvDiscoverer struct{ name string }
+
+func (d srvDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, config.NodeDiscoveryScheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return addresses, nil
+}
+
+type consulDiscoverer struct {
+	base    string
+	service string
+}
+
+func (d consulDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	var entries []struct {
+		Node    struct{ Address string }
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	endpoint := d.base + "/v1/health/service/" + url.PathEscape(d.service) + "?passing=true"
+	if err := discoveryRequest(ctx, http.MethodGet, endpoint, nil, &entries); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// Services registered without an address use the one of their node.
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addresses = append(addresses, config.NodeDiscoveryScheme+"://"+net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return addresses, nil
+}
+
+type etcdDiscoverer struct {
+	base   string
+	prefix string
+}
+
+func (d etcdDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	// The range of a prefix ends at the prefix with its last byte incremented.
+	end := []byte(d.prefix)
+	end[len(end)-1]++
+	request := map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(d.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	}
+
+	var response struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := discoveryRequest(ctx, http.MethodPost, d.base+"/v3/kv/range", request, &response); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, strings.TrimSpace(string(value)))
+	}
+	return addresses, nil
+}
+
+func discoveryRequest(ctx context.Context, method string, endpoint string, body any, response any) error {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", method, endpoint, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
+
+// RunDiscovery keeps the nodes found by d registered, at each interval.
+// Nodes that registered themselves are left alone.
+func (n *nodeManager) RunDiscovery(ctx context.Context, d nodeDiscoverer, interval time.Duration) {
+	if w, ok := d.(nodeWatcher); ok {
+		go n.watchDiscovery(ctx, d, w)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n.discoverNodes(d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *nodeManager) watchDiscovery(ctx context.Context, d nodeDiscoverer, w nodeWatcher) {
+	for {
+		err := w.Watch(ctx, func() { n.discoverNodes(d) })
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("Node discovery watch ended, restarting", zap.Error(err))
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (n *nodeManager) discoverNodes(d nodeDiscoverer) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(withCaller(context.Background(), systemCaller), time.Minute)
+	defer cancel()
+
+	found, err := d.Discover(ctx)
+	if err != nil {
+		// Keep the nodes as they are rather than drop them all.
+		logger.Error("Failed to discover nodes", zap.Error(err))
+		return
+	}
+	n.reconcileDiscovered(ctx, found)
+}
+
+// reconcileDiscovered registers the nodes found that are not registered yet,
+// once they answer their health check, and removes those discovered before
+// that are no longer found.
+func (n *nodeManager) reconcileDiscovered(ctx context.Context, found []string) {
+	for _, address := range found {
+		n.mutex.Lock()
+		known := slices.Contains(n.NodeAddresses, address)
+		n.mutex.Unlock()
+		if known {
+			continue
+		}
+
+		// Nodes that are not ready yet are tried again on the next pass.
+		if err := n.checkNodeHealth(ctx, address); err != nil {
+			logger.Warn("Discovered node is not healthy",
+				zap.String("nodeAddress", address),
+				zap.Error(err),
+			)
+			continue
+		}
+		n.registerNode(address, "", nil)
+		recordAudit(ctx, AuditNodeAdd, address, nil)
+
+		n.mutex.Lock()
+		if n.discovered == nil {
+			n.discovered = make(map[string]bool)
+		}
+		n.discovered[address] = true
+		n.mutex.Unlock()
+		logger.Info("Discovered node added", zap.String("nodeAddress", address))
+	}
+
+	n.mutex.Lock()
+	var gone []string
+	for address := range n.discovered {
+		if !slices.Contains(found, address) {
+			gone = append(gone, address)
+			delete(n.discovered, address)
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, address := range gone {
+		n.DeleteNode(Node{address: address})
+		logger.Info("Node no longer discovered, removed", zap.String("nodeAddress", address))
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+)
+
+// drainingNodesKey is the set of the nodes drained through the admin API.
+// It outlives restarts and registrations, so a drained node that registers
+// again gets no blocks either.
+const drainingNodesKey = "nodes:draining"
+
+var errNoNodeLeft = errors.New("no other node can take the block")
+
+// Decommission is the answer of POST /admin/nodes/decommission: the blocks
+// moved off the node and those that could not be. The node is removed from
+// the registry once it holds no block any more.
+type Decommission struct {
+	Address    string          `json:"address"`
+	Moved      int             `json:"moved"`
+	MovedBytes int64           `json:"moved_bytes"`
+	Failed     []BackupFailure `json:"failed"`
+	Removed    bool            `json:"removed"`
+}
+
+// loadDraining reads the nodes drained before a restart.
+func (n *nodeManager) loadDraining(ctx context.Context) error {
+	addresses, err := n.redisClient.SMembers(ctx, drainingNodesKey).Result()
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.draining = make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		n.draining[address] = true
+	}
+	return nil
+}
+
+// upStatus is the status of a node that answers: DRAINING for drained
+// nodes, UP for the others.
+func (n *nodeManager) upStatus(address string) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.draining[address] {
+		return NodeDraining
+	}
+	return NodeUp
+}
+
+// setDraining drains a node, or puts it back in placement, and shows it in
+// the registry. It returns ErrNodeNotFound for nodes not in the registry.
+func (n *nodeManager) setDraining(ctx context.Context, address string, draining bool) (NodeStatus, error) {
+	status, err := n.registry.GetNodeStatus(address)
+	if err != nil {
+		return status, err
+	}
+	if draining {
+		err = n.redisClient.SAdd(ctx, drainingNodesKey, address).Err()
+	} else {
+		err = n.redisClient.SRem(ctx, drainingNodesKey, address).Err()
+	}
+	if err != nil {
+		return status, err
+	}
+
+	n.mutex.Lock()
+	if n.draining == nil {
+		n.draining = make(map[string]bool)
+	}
+	if draining {
+		n.draining[address] = true
+	} else {
+		delete(n.draining, address)
+	}
+	n.mutex.Unlock()
+
+	if status.Status != NodeDown {
+		status.Status = n.upStatus(address)
+	}
+	return status, n.registry.SaveNodeStatus(status)
+}
+
+// nodeAddressParam reads the ?address= of the node endpoints, answering 400
+// when it is missing and 404 when no such node is registered.
+func (n *nodeManager) nodeAddressParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, CodeInvalidRequest, "address is required", nil)
+		return "", false
+	}
+	if _, err := n.registry.GetNodeStatus(address); errors.Is(err, ErrNodeNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeNodeNotFound, "Node not found", map[string]any{"address": address})
+		return "", false
+	} else if err != nil {
+		requestLogger(r.Context()).Error("Failed to read the node registry", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read the node registry")
+		return "", false
+	}
+	return address, true
+}
+
+// DrainNode stops placing blocks on the node at ?address=. The blocks it
+// holds stay there and are still read from it.
+func (n *nodeManager) DrainNode(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/nodes/drain").Inc()
+	n.respondDraining(w, r, true, AuditNodeDrain)
+}
+
+// UndrainNode places blocks on the node at ?address= again.
+func (n *nodeManager) UndrainNode(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/nodes/drain").Inc()
+	n.respondDraining(w, r, false, AuditNodeUndrain)
+}
+
+func (n *nodeManager) respondDraining(w http.ResponseWriter, r *http.Request, draining bool, action string) {
+	address, ok := n.nodeAddressParam(w, r)
+	if !ok {
+		return
+	}
+	status, err := n.setDraining(r.Context(), address, draining)
+	recordAudit(r.Context(), action, address, err)
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to drain the node", zap.String("nodeAddress", address), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to update the node")
+		return
+	}
+	requestLogger(r.Context()).Info("Node drain changed", zap.String("nodeAddress", address), zap.Bool("draining", draining))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// blockFiles returns the metadata of what blocks are stored for, which names
+// them and counts them: the files that are not packed, and the containers of
+// those that are.
+func (f *fileManager) blockFiles(files []FileMetadata) map[string]FileMetadata {
+	blocks := make(map[string]FileMetadata, len(files))
+	for _, metadata := range files {
+		if metadata.Packed == nil {
+			blocks[metadata.Name] = metadata
+			continue
+		}
+		container := containerFileName(metadata.Packed.Container)
+		if _, seen := blocks[container]; seen {
+			continue
+		}
+		// A container still staged in Redis has no blocks yet.
+		count, err := f.redisManager.GetNumberOfBlocksOfAFile(GenerateFileHash(container))
+		if err == nil {
+			blocks[container] = FileMetadata{Name: container, Blocks: count}
+		}
+	}
+	return blocks
+}
+
+// evacuateBlock moves the replica of a block on address to another node,
+// among the pinned ones if the file is pinned, and reports whether there was
+// one to move.
+func (f *fileManager) evacuateBlock(ctx context.Context, blockName string, address string, pinned []string) (int64, bool, error) {
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil {
+		return 0, false, err
+	}
+	addresses := location.Addresses()
+	if !slices.Contains(addresses, address) {
+		return 0, false, nil
+	}
+
+	data, err := f.healthyCopy(ctx, location, blockName)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read the block: %w", err)
+	}
+	node, relaxed, ok := f.nodeManager.selectReplicaNode(FileBlock{bytes: data}, pinned, addresses, nil)
+	if !ok {
+		return 0, false, errNoNodeLeft
+	}
+	if relaxed && len(addresses) > 1 {
+		replicaPlacementDegraded.WithLabelValues("shared_domain").Inc()
+	}
+	err = nodeRetryPolicy().Do(ctx, "blockPush", func() error {
+		return f.streamBlock(ctx, newPhaseTimer(), node.address, GenerateBlockHash(data), blockName+".bin", data, func(int64) {})
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to copy the block to %s: %w", node.address, err)
+	}
+
+	replicas := slices.Clone(location.Replicas)
+	for i := range replicas {
+		if replicas[i].Address == address {
+			replicas[i] = Replica{Address: node.address, State: ReplicaHealthy}
+		}
+	}
+	if err := f.redisManager.SetBlockReplicas(ctx, blockName, replicas); err != nil {
+		return 0, false, fmt.Errorf("failed to record the new replica: %w", err)
+	}
+	f.deleteFormerReplicas(ctx, blockName, addresses, BlockLocation{Replicas: replicas})
+	return int64(len(data)), true, nil
+}
+
+// decommissionNode drains a node, moves every block it holds to the other
+// nodes and, once none is left on it, removes it from the registry.
+func (f *fileManager) decommissionNode(ctx context.Context, address string) (Decommission, error) {
+	result := Decommission{Address: address, Failed: []BackupFailure{}}
+	if _, err := f.nodeManager.setDraining(ctx, address, true); err != nil {
+		return result, err
+	}
+
+	stats, err := f.nodeManager.PlacementStats()
+	if err != nil {
+		return result, fmt.Errorf("failed to retrieve node statistics: %w", err)
+	}
+	f.nodeManager.mutex.Lock()
+	f.nodeManager.NodeStats = stats
+	f.nodeManager.mutex.Unlock()
+
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return result, err
+	}
+	for name, metadata := range f.blockFiles(files) {
+		pinned, err := f.placementContext(ctx, name)
+		if err != nil {
+			result.Failed = append(result.Failed, BackupFailure{Name: name, Error: err.Error()})
+			continue
+		}
+		for i := 1; i <= metadata.Blocks; i++ {
+			blockName := metadata.blockName(i)
+			size, moved, err := f.evacuateBlock(ctx, blockName, address, pinnedNodes(pinned))
+			if err != nil {
+				result.Failed = append(result.Failed, BackupFailure{Name: blockName, Error: err.Error()})
+				continue
+			}
+			if moved {
+				result.Moved++
+				result.MovedBytes += size
+			}
+		}
+	}
+	if len(result.Failed) > 0 {
+		return result, nil
+	}
+
+	f.nodeManager.DeleteNode(Node{address: address})
+	if err := f.redisManager.DeleteNodeStatus(address); err != nil {
+		return result, err
+	}
+	result.Removed = true
+	return result, nil
+}
+
+// DecommissionNode empties the node at ?address= and removes it from the
+// cluster. A node some blocks could not be moved off stays, drained, for the
+// decommission to be run again.
+func (f *fileManager) DecommissionNode(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/nodes/decommission").Inc()
+	logger := requestLogger(r.Context())
+	address, ok := f.nodeManager.nodeAddressParam(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := f.decommissionNode(r.Context(), address)
+	auditErr := err
+	if auditErr == nil && len(result.Failed) > 0 {
+		auditErr = fmt.Errorf("%d blocks could not be moved", len(result.Failed))
+	}
+	recordAudit(r.Context(), AuditNodeDecommission, address, auditErr)
+	if err != nil {
+		logger.Error("Failed to decommission the node", zap.String("nodeAddress", address), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to decommission the node")
+		return
+	}
+	logger.Info("Node decommissioned",
+		zap.String("nodeAddress", address),
+		zap.Int("moved", result.Moved),
+		zap.Int64("bytes", result.MovedBytes),
+		zap.Int("failed", len(result.Failed)),
+		zap.Bool("removed", result.Removed),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+)
+
+// FetchRequest is the body of POST /fetch. Name defaults to the last element
+// of the URL path.
+type FetchRequest struct {
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
+}
+
+// fetchDialControl refuses connections to loopback, private and link-local
+// addresses unless FDS_FETCH_ALLOW_PRIVATE is set, so POST /fetch cannot be
+// used to reach services next to the central server. It sees the resolved
+// address, which covers redirects and DNS names alike.
+func fetchDialControl(_ string, address string, _ syscall.RawConn) error {
+	if config.FetchAllowPrivate {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("fetching from %s is not allowed", host)
+	}
+	return nil
+}
+
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: fetchDialControl}
+	return &http.Client{
+		Timeout:   config.FetchTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+	}
+}
+
+// fetchProgress reports the bytes read from the source to the job, which
+// learns the size of the source once it is read to the end. With a ticket,
+// it also reserves them with the upload admission control.
+type fetchProgress struct {
+	io.Reader
+	job    *uploadJob
+	ticket *uploadTicket
+}
+
+func (p *fetchProgress) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	if n > 0 && p.ticket != nil {
+		if growErr := p.ticket.Grow(int64(n)); growErr != nil {
+			return n, growErr
+		}
+	}
+	if n > 0 || errors.Is(err, io.EOF) {
+		p.job.update(func(status *UploadJob) {
+			status.Fetched += int64(n)
+			if errors.Is(err, io.EOF) {
+				status.Size = status.Fetched
+			}
+		})
+	}
+	return n, err
+}
+
+// errSourceTooLarge fails fetches of sources larger than the maximum upload
+// size.
+var errSourceTooLarge = errors.New("source exceeds the maximum upload size")
+
+// openSource starts the download of the source of a fetch job.
+func openSource(ctx context.Context, source string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newFetchClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("source answered %s", res.Status)
+	}
+	if uploadTooLarge(res.ContentLength) {
+		res.Body.Close()
+		return nil, fmt.Errorf("%w of %d bytes", errSourceTooLarge, config.MaxUploadSize)
+	}
+	return res, nil
+}
+
+// StartFetch downloads source in the background and stores it like an
+// asynchronous upload, returning its job at once. The job owns ticket.
+func (j *jobManager) StartFetch(ctx context.Context, fileName string, source string, blockSize int, ticket *uploadTicket) UploadJob {
+	job := j.add(ctx, UploadJob{FileName: fileName, SourceURL: source, Size: -1, State: JobFetching})
+
+	go func() {
+		defer ticket.Release()
+		ctx := context.WithoutCancel(ctx)
+		j.finish(ctx, job, j.fetch(ctx, job, fileName, source, blockSize, ticket))
+	}()
+
+	return job.Snapshot()
+}
+
+// fetch stores the content of source as fileName. It is streamed to the
+// nodes block by block as it is downloaded, unless upload hooks are set:
+// they look at whole files, so the content is then read whole first.
+func (j *jobManager) fetch(ctx context.Context, job *uploadJob, fileName string, source string, blockSize int, ticket *uploadTicket) error {
+	res, err := openSource(ctx, source)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", source, err)
+	}
+	defer res.Body.Close()
+	ctx = withDeclaredType(ctx, res.Header.Get("Content-Type"))
+
+	var body io.Reader = res.Body
+	if config.MaxUploadSize > 0 {
+		body = io.LimitReader(body, int64(config.MaxUploadSize)+1)
+	}
+
+	if len(uploadHooks) == 0 {
+		return j.fileManager.StoreStream(ctx, fileName, &fetchProgress{Reader: body, job: job}, res.ContentLength, blockSize, ticket, job)
+	}
+
+	buf, err := readPooled(&fetchProgress{Reader: body, job: job, ticket: ticket}, res.ContentLength)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", source, err)
+	}
+	defer putBuffer(buf)
+	if uploadTooLarge(int64(buf.Len())) {
+		return fmt.Errorf("failed to fetch %s: %w of %d bytes", source, errSourceTooLarge, config.MaxUploadSize)
+	}
+
+	job.update(func(status *UploadJob) {
+		status.Size = int64(buf.Len())
+		status.State = JobPending
+	})
+	return j.fileManager.StoreFileWithProgress(ctx, fileName, buf.Bytes(), blockSize, job)
+}
+
+// StoreStream stores the content read from body, of size bytes or -1 when
+// unknown, as fileName, like StoreFileWithProgress but without holding it
+// whole: content fitting in one block is stored as any upload, larger
+// content is compressed and sent to the nodes a block at a time as it is
+// read. Its admission to the uploads in flight, ticket, reserves those
+// blocks.
+func (f *fileManager) StoreStream(ctx context.Context, fileName string, body io.Reader, size int64, blockSize int, ticket *uploadTicket, observer uploadObserver) error {
+	chosen := blockSize
+	if chosen == 0 {
+		chosen = chooseBlockSize(int(max(size, 0)))
+	}
+	// A block read and its compressed copy are all that is held at a time.
+	if err := ticket.Grow(2 * int64(chosen)); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, chosen)
+	n, err := readChunk(body, chunk)
+	if errors.Is(err, io.EOF) {
+		return f.StoreFileWithProgress(ctx, fileName, chunk[:n], blockSize, observer)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the content: %w", err)
+	}
+
+	timer := newPhaseTimer()
+	var stored int64
+	err = checkContentType(declaredType(ctx), chunk)
+	switch {
+	case err != nil:
+		uploadsRefusedByType.Inc()
+	default:
+		err = checkReservedName(fileName)
+		if err == nil {
+			stored, err = f.storeStream(ctx, timer, fileName, body, chunk, observer)
+		}
+	}
+	timer.report(requestLogger(ctx), "upload", config.SlowUploadThreshold, int(stored), err, zap.String("fileName", fileName))
+	recordAudit(ctx, AuditFileUpload, fileName, err)
+	return err
+}
+
+// readChunk fills chunk from body, returning io.EOF with what it read when
+// body ends first. Unlike io.ReadFull, it tells a body that ends from one cut
+// short, which fails with io.ErrUnexpectedEOF.
+func readChunk(body io.Reader, chunk []byte) (int, error) {
+	n := 0
+	for n < len(chunk) {
+		read, err := body.Read(chunk[n:])
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// storeStream stores chunk, the first block of the content of fileName, and
+// the rest of the content read from body, in blocks of len(chunk) bytes. As
+// for patches, the blocks are stored under names of their own, and the file
+// is only switched to them once all are stored: a source failing midway
+// leaves the file as it was. It returns the number of bytes stored.
+func (f *fileManager) storeStream(ctx context.Context, timer *phaseTimer, fileName string, body io.Reader, chunk []byte, observer uploadObserver) (int64, error) {
+	logger := requestLogger(ctx)
+	blockSize := len(chunk)
+	tag := newRewriteTag()
+	blocksOf := rewrittenBlocksOf(tag, fileName)
+
+	var positions []int
+	var extents []BlockExtent
+	var size int64
+	for n := len(chunk); n > 0; {
+		compressed, blocks, added, err := compressBlocks(ctx, chunk[:n], blockSize, len(positions)+1, size)
+		if err != nil {
+			f.dropRewrite(ctx, blocksOf, positions)
+			return 0, err
+		}
+		timer.Phase("compress")
+		positions = append(positions, blocks[0].position)
+		err = f.distributeBlocks(ctx, timer, blocksOf, blocks, observer)
+		putBuffer(compressed)
+		if err != nil {
+			f.dropRewrite(ctx, blocksOf, positions)
+			return 0, err
+		}
+		extents = append(extents, added...)
+		size += int64(n)
+
+		n, err = readChunk(body, chunk)
+		timer.Phase("read")
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		if err == nil && uploadTooLarge(size+int64(n)) {
+			err = fmt.Errorf("%w of %d bytes", errSourceTooLarge, config.MaxUploadSize)
+		}
+		if err != nil {
+			f.dropRewrite(ctx, blocksOf, positions)
+			return 0, fmt.Errorf("failed to read the content: %w", err)
+		}
+	}
+	fileTransferSize.WithLabelValues("upload").Observe(float64(size))
+
+	// The lease or the version asked for may have changed while the content
+	// was read.
+	if err := f.checkWrite(ctx, fileName); err != nil {
+		f.dropRewrite(ctx, blocksOf, positions)
+		return 0, err
+	}
+	// The blocks of the version replaced are removed, so it must be the one
+	// read here.
+	previous, err := f.redisManager.GetFileMetadata(fileName)
+	ifMatch, previousBlocks := ifMatchFromContext(ctx), 0
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		previous = FileMetadata{}
+	case err != nil:
+		f.dropRewrite(ctx, blocksOf, positions)
+		return 0, err
+	default:
+		ifMatch = fileETag(previous.Version)
+		if previous.Packed == nil {
+			previousBlocks, err = f.redisManager.GetNumberOfBlocksOfAFile(GenerateFileHash(fileName))
+			if err != nil && !errors.Is(err, ErrFileNotFound) {
+				f.dropRewrite(ctx, blocksOf, positions)
+				return 0, err
+			}
+		}
+	}
+
+	metadata := FileMetadata{
+		Name:        fileName,
+		Size:        size,
+		BlockSize:   blockSize,
+		Extents:     extents,
+		Annotations: uploadAnnotations(ctx, fileName),
+		Owner:       fileOwner(ctx),
+	}
+	if _, err := f.commitRewrite(ctx, timer, previous, previousBlocks, metadata, len(positions), tag, positions, ifMatch); err != nil {
+		return 0, err
+	}
+	if previous.Packed != nil {
+		f.packer.Release(ctx, fileName, *previous.Packed)
+	}
+
+	logger.Info("File streamed and distributed",
+		zap.String("fileName", fileName),
+		zap.Int64("size", size),
+		zap.Int("numOfBlocks", len(positions)),
+	)
+	return size, nil
+}
+
+// FetchFile stores the content of a remote URL. The download and the
+// distribution run in the background; the answer is the job tracking them.
+func (f *fileManager) FetchFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+	var req FetchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid fetch request: "+err.Error())
+		return
+	}
+
+	source, err := url.Parse(req.URL)
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+
+	fileName := req.Name
+	if fileName == "" {
+		fileName = path.Base(source.Path)
+	}
+	if fileName == "" || fileName == "." || fileName == "/" {
+		respondWithError(w, http.StatusBadRequest, "name is required when the URL has no file name")
+		return
+	}
+
+	blockSize, err := blockSizeFromQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// A fetch bound to be refused is answered now rather than by its job.
+	err = checkReservedName(fileName)
+	if err == nil {
+		err = f.checkWrite(r.Context(), fileName)
+	}
+	if err != nil {
+		respondUploadError(w, fileName, err.Error(), err)
+		return
+	}
+
+	ticket, err := uploads.Admit(0)
+	if err != nil {
+		respondUploadsSaturated(w)
+		return
+	}
+
+	job := f.jobs.StartFetch(r.Context(), fileName, source.String(), blockSize, ticket)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/jobs/"+job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// filesAccessedKey records when each file was last read, as Unix
+	// seconds.
+	filesAccessedKey = "files:accessed"
+	// filesReadsKey counts the reads of each file.
+	filesReadsKey = "files:reads"
+	// filesHeatKey holds the heat of each file as of its last read: every
+	// read adds 1, and the heat halves every FDS_HEAT_HALF_LIFE.
+	filesHeatKey = "files:heat"
+)
+
+// recordReadScript counts a read of a file and warms it, atomically so that
+// concurrent reads of a hot file are all counted. Names that are not in the
+// files index are left alone. It returns the read count and the new heat.
+var recordReadScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return false
+end
+local now = tonumber(ARGV[2])
+local heat = tonumber(redis.call('HGET', KEYS[4], ARGV[1]) or '0')
+local at = redis.call('HGET', KEYS[3], ARGV[1])
+if at then
+	heat = heat * math.pow(2, (tonumber(at) - now) / tonumber(ARGV[3]))
+end
+heat = heat + 1
+local count = redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[4], ARGV[1], tostring(heat))
+return {count, tostring(heat)}
+`)
+
+// FileAccess is what is known of the reads of a file. Heat is decayed to the
+// time it was retrieved.
+type FileAccess struct {
+	ReadCount    int64      `json:"read_count"`
+	LastAccessed *time.Time `json:"last_accessed,omitempty"`
+	Heat         float64    `json:"heat"`
+}
+
+// FileStat is a file as GET /files and GET /files/{name} show it.
+type FileStat struct {
+	FileMetadata
+	FileAccess
+}
+
+// decayHeat returns what a heat recorded at at has cooled down to by now.
+func decayHeat(heat float64, at time.Time, now time.Time) float64 {
+	return heat * math.Exp2(-now.Sub(at).Seconds()/config.HeatHalfLife.Seconds())
+}
+
+func newFileAccess(reads string, accessed string, heat string, now time.Time) FileAccess {
+	var access FileAccess
+	access.ReadCount, _ = strconv.ParseInt(reads, 10, 64)
+	if seconds, err := strconv.ParseInt(accessed, 10, 64); err == nil {
+		at := time.Unix(seconds, 0).UTC()
+		access.LastAccessed = &at
+		if value, err := strconv.ParseFloat(heat, 64); err == nil {
+			access.Heat = decayHeat(value, at, now)
+		}
+	}
+	return access
+}
+
+// RecordFileRead counts a read of fileName and returns its new heat. Reads
+// of names that are not files are not recorded, and have no heat.
+func (r *RedisManager) RecordFileRead(ctx context.Context, fileName string) (float64, error) {
+	keys := []string{filesIndexKey, filesReadsKey, filesAccessedKey, filesHeatKey}
+	result, err := recordReadScript.Run(ctx, r.redisClient, keys, fileName, time.Now().Unix(), config.HeatHalfLife.Seconds()).Slice()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	heat, _ := strconv.ParseFloat(result[1].(string), 64)
+	return heat, nil
+}
+
+// GetFileAccess returns what is known of the reads of a file.
+func (r *RedisManager) GetFileAccess(ctx context.Context, fileName string) (FileAccess, error) {
+	pipe := r.redisClient.Pipeline()
+	reads := pipe.HGet(ctx, filesReadsKey, fileName)
+	accessed := pipe.HGet(ctx, filesAccessedKey, fileName)
+	heat := pipe.HGet(ctx, filesHeatKey, fileName)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return FileAccess{}, err
+	}
+	return newFileAccess(reads.Val(), accessed.Val(), heat.Val(), time.Now()), nil
+}
+
+// ListFileAccesses returns what is known of the reads of every file read at
+// least once, by name.
+func (r *RedisManager) ListFileAccesses(ctx context.Context) (map[string]FileAccess, error) {
+	pipe := r.redisClient.Pipeline()
+	reads := pipe.HGetAll(ctx, filesReadsKey)
+	accessed := pipe.HGetAll(ctx, filesAccessedKey)
+	heat := pipe.HGetAll(ctx, filesHeatKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	accesses := make(map[string]FileAccess, len(accessed.Val()))
+	for name, at := range accessed.Val() {
+		accesses[name] = newFileAccess(reads.Val()[name], at, heat.Val()[name], now)
+	}
+	return accesses, nil
+}
+
+// DeleteFileAccess forgets the reads of a deleted file.
+func (r *RedisManager) DeleteFileAccess(ctx context.Context, fileName string) error {
+	pipe := r.redisClient.Pipeline()
+	pipe.HDel(ctx, filesReadsKey, fileName)
+	pipe.HDel(ctx, filesAccessedKey, fileName)
+	pipe.HDel(ctx, filesHeatKey, fileName)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+type fileHeatKey struct{}
+
+// withFileHeat returns ctx carrying the heat of the file being read, which
+// decides whether its blocks are worth caching.
+func withFileHeat(ctx context.Context, heat float64) context.Context {
+	return context.WithValue(ctx, fileHeatKey{}, heat)
+}
+
+// admitToCache reports whether blocks read under ctx may enter the block
+// cache: those of files at least FDS_BLOCK_CACHE_MIN_HEAT hot. Reads that are
+// not downloads, such as copies, backups or repairs, have no heat.
+func admitToCache(ctx context.Context) bool {
+	heat, _ := ctx.Value(fileHeatKey{}).(float64)
+	return heat >= config.BlockCacheMinHeat
+}
+
+// noteFileRead records a download of fileName and returns ctx carrying its
+// heat. With FDS_COLD_REHYDRATE, a file read from the cold tier is moved
+// back to the nodes in the background; the read itself is proxied from the
+// bucket.
+func (f *fileManager) noteFileRead(ctx context.Context, fileName string) context.Context {
+	heat, err := f.redisManager.RecordFileRead(ctx, fileName)
+	if err != nil {
+		requestLogger(ctx).Warn("Failed to record file access", zap.String("fileName", fileName), zap.Error(err))
+	}
+	if heat > 0 {
+		hotspots.FileDownloaded(fileName)
+	}
+
+	if config.ColdTier != "" && config.ColdRehydrate && f.inColdTier(fileName) {
+		go func() {
+			_, _ = f.RehydrateFile(context.WithoutCancel(ctx), fileName)
+		}()
+	}
+	return withFileHeat(ctx, heat)
+}
+
+// inColdTier reports whether the blocks of fileName are in the cold tier, which
+// they all are when the first one is.
+func (f *fileManager) inColdTier(fileName string) bool {
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	if err != nil {
+		return false
+	}
+	location, err := f.redisManager.GetBlockLocation(metadata.blockName(1))
+	return err == nil && isColdAddress(location.NodeAddress)
+}
@@ -0,0 +1,1238 @@
+package server
+
+import (
+	"FDS/blocksign"
+	"FDS/dfspb"
+	"FDS/grpcwire"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/klauspost/pgzip"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type fileManager struct {
+	redisManager *RedisManager
+	httpClient   *http.Client
+	blockClient  *http.Client
+	nodeManager  *nodeManager
+	jobs         *jobManager
+	packer       *packer
+	mutex        *sync.Mutex
+}
+
+var blockTransmissedByNode = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "block_transmissed_per_block",
+		Help: "Total number of block trasmissed by node",
+	},
+	[]string{"node"},
+)
+
+func (f *fileManager) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+	fileName := r.URL.Query().Get("fileName")
+
+	if r.Method == http.MethodGet {
+		r = r.WithContext(f.noteFileRead(r.Context(), fileName))
+	}
+	metadata, metadataErr := f.redisManager.GetFileMetadata(fileName)
+	if metadataErr == nil {
+		w.Header().Set("ETag", fileETag(metadata.Version))
+	}
+	if f.serveDirectDownload(w, r, fileName) {
+		return
+	}
+	if f.serveCompressedDownload(w, r, fileName) {
+		return
+	}
+	if metadataErr == nil && f.serveRange(w, r, metadata) {
+		return
+	}
+
+	recomposedBytes, err := f.ReconstructFileFromBlocks(r.Context(), fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to reconstruct file",
+			zap.String("fileName", fileName),
+			zap.Error(err),
+		)
+		respondWithError(w, http.StatusInternalServerError, "Failed to download file")
+		return
+	}
+
+	var modTime time.Time
+	if metadataErr == nil {
+		modTime = metadata.CreatedAt
+	}
+
+	// ServeContent takes care of Range requests, so clients can resume or
+	// stream from an offset.
+	http.ServeContent(w, r, fileName, modTime, bytes.NewReader(recomposedBytes))
+}
+
+func (f *fileManager) ListFiles(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		logger.Error("Failed to list files", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list files")
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	accesses, err := f.redisManager.ListFileAccesses(r.Context())
+	if err != nil {
+		logger.Error("Failed to list file accesses", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list files")
+		return
+	}
+	stats := make([]FileStat, len(files))
+	for i, metadata := range files {
+		stats[i] = FileStat{FileMetadata: metadata, FileAccess: accesses[metadata.Name]}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+func (f *fileManager) GetFileInfo(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve file metadata", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata")
+		return
+	}
+	access, err := f.redisManager.GetFileAccess(r.Context(), fileName)
+	if err != nil {
+		logger.Error("Failed to retrieve file access", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(metadata.Version))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(FileStat{FileMetadata: metadata, FileAccess: access})
+}
+
+func (f *fileManager) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	err := f.RemoveFile(r.Context(), fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if errors.Is(err, errFileLocked) {
+		respondWithErrorCode(w, http.StatusLocked, CodeFileLocked, err.Error(), map[string]any{"file": fileName})
+		return
+	}
+	if errors.Is(err, errPreconditionFailed) {
+		respondWithErrorCode(w, http.StatusPreconditionFailed, CodePreconditionFailed, err.Error(), map[string]any{"file": fileName})
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to delete file", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete file")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fileManager) ReconstructFileFromBlocks(ctx context.Context, filename string) ([]byte, error) {
+	timer := newPhaseTimer()
+	var data []byte
+	var err error
+	if metadata, metadataErr := f.redisManager.GetFileMetadata(filename); metadataErr == nil && metadata.Packed != nil {
+		data, err = f.packer.Read(ctx, *metadata.Packed)
+		timer.Phase("container")
+	} else {
+		data, err = f.reconstructFile(ctx, timer, filename)
+	}
+	timer.report(requestLogger(ctx), "download", config.SlowDownloadThreshold, len(data), err, zap.String("fileName", filename))
+	return data, err
+}
+
+func (f *fileManager) reconstructFile(ctx context.Context, timer *phaseTimer, filename string) ([]byte, error) {
+	logger := requestLogger(ctx)
+	compressed, err := f.fetchCompressedFile(ctx, timer, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer putBuffer(compressed)
+
+	gz, err := getGzipReader(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		logger.Error("Failed to create gzip reader", zap.Error(err))
+		return nil, err
+	}
+	defer func(gz *pgzip.Reader) {
+		err := gz.Close()
+		if err != nil {
+			logger.Warn("Failed to close gzip reader", zap.Error(err))
+			return
+		}
+		putGzipReader(gz)
+	}(gz)
+
+	// The decompressed file is handed to the caller, so it is not pooled;
+	// sizing it from the metadata index avoids growing it block by block.
+	var decompressed bytes.Buffer
+	if metadata, err := f.redisManager.GetFileMetadata(filename); err == nil && metadata.Size > 0 {
+		decompressed.Grow(int(metadata.Size))
+	}
+	_, err = decompressed.ReadFrom(gz)
+	decompressedBytes := decompressed.Bytes()
+	timer.Phase("decompress")
+	if err != nil {
+		logger.Error("Failed to decompress file", zap.Error(err))
+		return nil, err
+	}
+
+	logger.Info("File reconstruction completed",
+		zap.String("fileName", filename),
+		zap.Int("finalFileSize", len(decompressedBytes)),
+	)
+	fileTransferSize.WithLabelValues("download").Observe(float64(len(decompressedBytes)))
+
+	return decompressedBytes, nil
+}
+
+// fetchCompressedFile fetches and verifies the blocks of a file and returns
+// them concatenated, which is the gzip stream the file was stored as. The
+// pooled buffer is handed back by the caller with putBuffer.
+func (f *fileManager) fetchCompressedFile(ctx context.Context, timer *phaseTimer, filename string) (*bytes.Buffer, error) {
+	logger := requestLogger(ctx)
+	fileHashedName := GenerateFileHash(filename)
+	compressed := getBuffer()
+	returned := false
+	defer func() {
+		if !returned {
+			putBuffer(compressed)
+		}
+	}()
+
+	logger.Info("Starting file reconstruction",
+		zap.String("fileName", filename),
+		zap.String("hashedFileName", fmt.Sprintf("%x", fileHashedName)),
+	)
+
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(filename)
+	timer.Phase("metadata")
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Retrieved number of blocks",
+		zap.String("fileName", filename),
+		zap.Int("numOfBlocks", numOfBlocks),
+	)
+
+	for i := 0; i < numOfBlocks; i++ {
+		fileBlockName := metadata.blockName(i + 1)
+
+		location, err := f.redisManager.GetBlockLocation(fileBlockName)
+		timer.Phase("metadata")
+		if err != nil {
+			logger.Error("Failed to retrieve block metadata from Redis",
+				zap.String("blockName", fileBlockName),
+				zap.Error(err),
+			)
+			return nil, err
+		}
+
+		logger.Debug("Block metadata retrieved",
+			zap.String("blockName", fileBlockName),
+			zap.Strings("replicas", location.Healthy()),
+			zap.String("originalBlockHash", location.Hash),
+		)
+
+		err = f.readBlock(ctx, timer, fileBlockName, location, func(block []byte) {
+			if i == 0 {
+				compressed.Grow(numOfBlocks * len(block))
+			}
+			compressed.Write(block)
+		})
+		if errors.Is(err, errBlockCorrupted) {
+			logger.Error("No intact replica of block",
+				zap.String("blockName", fileBlockName),
+				zap.Strings("replicas", location.Addresses()),
+				zap.Error(err),
+			)
+			return nil, err
+		}
+		if err != nil {
+			logger.Error("Failed to retrieve block from node",
+				zap.String("blockName", fileBlockName),
+				zap.Strings("replicas", location.Healthy()),
+				zap.Error(err),
+			)
+			return nil, errors.New("failed to retrieve block from node")
+		}
+		logger.Debug("Block successfully appended",
+			zap.String("blockName", fileBlockName),
+			zap.Int("currentFileSize", compressed.Len()),
+		)
+	}
+
+	returned = true
+	return compressed, nil
+}
+
+// readBlock hands the content of a block, as stored, to use, which must not
+// keep it. The block comes from the block cache or from one of its replicas.
+func (f *fileManager) readBlock(ctx context.Context, timer *phaseTimer, blockName string, location BlockLocation, use func([]byte)) error {
+	if cached, ok := blockCache.Get(blockName, location.Hash); ok {
+		use(cached)
+		timer.Phase("cache")
+		return nil
+	}
+
+	// Concurrent downloads of the same block share one fetch; the hash is
+	// part of the key so a fetch of an overwritten block is never joined.
+	// Each fetch falls back on the other replicas, and checks the hash.
+	block, release, err := blockFetches.Do(ctx, blockName+"@"+location.Hash, func(ctx context.Context) (*bytes.Buffer, error) {
+		var block *bytes.Buffer
+		err := nodeRetryPolicy().Do(ctx, "blockFetch", func() error {
+			var err error
+			block, err = f.fetchBlockReplicas(ctx, location, blockName+".bin")
+			return err
+		})
+		return block, err
+	})
+	timer.Phase("fetch")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	use(block.Bytes())
+	if admitToCache(ctx) {
+		blockCache.Put(blockName, location.Hash, block.Bytes())
+	}
+	return nil
+}
+
+// errBlockCorrupted is returned when the node holding a block finds that it
+// no longer matches the checksum the node recorded.
+var errBlockCorrupted = errors.New("block is corrupted on its node")
+
+// errStoredBlockMismatch is returned when the hash a node reports for the
+// block it committed differs from the hash of what was sent. The transfer is
+// retried: the damage may have happened on the way.
+var errStoredBlockMismatch = errors.New("block stored on the node does not match what was sent")
+
+// fetchBlock downloads one block from the node holding it into a pooled
+// buffer, which the caller hands back with putBuffer.
+func (f *fileManager) fetchBlock(ctx context.Context, nodeAddress string, blockFileName string) (*bytes.Buffer, error) {
+	if isColdAddress(nodeAddress) {
+		return f.fetchColdBlock(ctx, nodeAddress, blockFileName)
+	}
+	blockURL := signedBlockURL(nodeAddress, blockFileName, time.Now().Add(time.Minute), "")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blockURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == blocksign.StatusCorrupt {
+		return nil, fmt.Errorf("%w: %w", errBlockCorrupted, &nodeStatusError{Node: nodeAddress, StatusCode: res.StatusCode})
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &nodeStatusError{Node: nodeAddress, StatusCode: res.StatusCode}
+	}
+	block, err := readPooled(res.Body, res.ContentLength)
+	if err == nil {
+		hotspots.BlockRead(nodeAddress, block.Len())
+	}
+	return block, err
+}
+
+func (f *fileManager) UploadFileAndDistributeBlocks(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	if !limitUploadBody(w, r, multipartOverhead) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	// An asynchronous upload hands its ticket over to the job.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			ticket.Release()
+		}
+	}()
+
+	file, header, err := r.FormFile("file")
+	if isBodyTooLarge(err) {
+		respondUploadTooLarge(w)
+		return
+	}
+	if errors.Is(err, errUploadsSaturated) {
+		respondUploadsSaturated(w)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to parse form file", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to parse uploaded file")
+		return
+	}
+	if uploadTooLarge(header.Size) {
+		respondUploadTooLarge(w)
+		return
+	}
+	logger.Info("File received", zap.String("fileName", header.Filename))
+
+	blockSize, err := blockSizeFromQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	buf, err := readPooled(file, header.Size)
+	if err != nil {
+		logger.Error("Failed to read uploaded file content", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read file content")
+		return
+	}
+	defer putBuffer(buf)
+	body := buf.Bytes()
+	ctx := withDeclaredType(r.Context(), header.Header.Get("Content-Type"))
+
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		// A refused type is answered now rather than by the job.
+		if err := checkContentType(declaredType(ctx), body); err != nil {
+			uploadsRefusedByType.Inc()
+			recordAudit(ctx, AuditFileUpload, header.Filename, err)
+			respondUploadError(w, header.Filename, err.Error(), err)
+			return
+		}
+		// The job outlives the request, so it gets its own copy.
+		job := f.jobs.StartUpload(ctx, header.Filename, bytes.Clone(body), blockSize, ticket.Release)
+		handedOff = true
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", apiPath(r, "/jobs/"+job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	if err := f.StoreFileWithProgress(ctx, header.Filename, body, blockSize, noopUploadObserver{}); err != nil {
+		respondUploadError(w, header.Filename, err.Error(), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// UploadFileByName stores the raw request body under the name in the path,
+// which is what presigned upload URLs point to.
+func (f *fileManager) UploadFileByName(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	if !limitUploadBody(w, r, 0) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.Release()
+
+	logger.Info("File received", zap.String("fileName", fileName))
+
+	blockSize, err := blockSizeFromQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	buf, err := readPooled(r.Body, r.ContentLength)
+	if isBodyTooLarge(err) {
+		respondUploadTooLarge(w)
+		return
+	}
+	if errors.Is(err, errUploadsSaturated) {
+		respondUploadsSaturated(w)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read uploaded file content", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read file content")
+		return
+	}
+	defer putBuffer(buf)
+
+	ctx := withDeclaredType(r.Context(), r.Header.Get("Content-Type"))
+	if err := f.StoreFileWithProgress(ctx, fileName, buf.Bytes(), blockSize, noopUploadObserver{}); err != nil {
+		respondUploadError(w, fileName, err.Error(), err)
+		return
+	}
+
+	if metadata, err := f.redisManager.GetFileMetadata(fileName); err == nil {
+		w.Header().Set("ETag", fileETag(metadata.Version))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// blockSizeFromQuery returns the block size an upload asks for with the
+// blockSize query parameter, or 0 if it does not ask for one.
+func blockSizeFromQuery(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("blockSize")
+	if value == "" {
+		return 0, nil
+	}
+	blockSize, err := strconv.Atoi(value)
+	if err != nil || blockSize < minBlockSize || blockSize > maxBlockSize {
+		return 0, fmt.Errorf("blockSize must be a number of bytes between %d and %d", minBlockSize, maxBlockSize)
+	}
+	return blockSize, nil
+}
+
+// StoreFile compresses the given content, splits it into blocks and distributes
+// them across the registered nodes, recording the file in the metadata index.
+func (f *fileManager) StoreFile(ctx context.Context, fileName string, body []byte) error {
+	return f.StoreFileWithProgress(ctx, fileName, body, 0, noopUploadObserver{})
+}
+
+// StoreFileWithProgress is StoreFile with blocks of blockSize bytes, reporting
+// its progress to observer. A blockSize of 0 leaves the choice to
+// chooseBlockSize.
+func (f *fileManager) StoreFileWithProgress(ctx context.Context, fileName string, body []byte, blockSize int, observer uploadObserver) error {
+	timer := newPhaseTimer()
+	err := checkContentType(declaredType(ctx), body)
+	switch {
+	case err != nil:
+		uploadsRefusedByType.Inc()
+	default:
+		err = checkReservedName(fileName)
+		if err == nil {
+			err = f.checkWrite(ctx, fileName)
+		}
+		if err == nil {
+			body, ctx, err = runUploadHooks(ctx, timer, fileName, body)
+		}
+		switch {
+		case err != nil:
+		case blockSize == 0 && f.packer.accepts(len(body)) && !f.isPinned(fileName):
+			err = f.packer.Store(ctx, fileName, body)
+		default:
+			err = f.storeFile(ctx, timer, fileName, body, blockSize, observer)
+		}
+	}
+	timer.report(requestLogger(ctx), "upload", config.SlowUploadThreshold, len(body), err, zap.String("fileName", fileName))
+	recordAudit(ctx, AuditFileUpload, fileName, err)
+	return err
+}
+
+func (f *fileManager) storeFile(ctx context.Context, timer *phaseTimer, fileName string, body []byte, blockSize int, observer uploadObserver) error {
+	logger := requestLogger(ctx)
+	fileTransferSize.WithLabelValues("upload").Observe(float64(len(body)))
+
+	previous, previousErr := f.redisManager.GetFileMetadata(fileName)
+
+	extents, blockSize, err := f.storeBlocks(ctx, timer, fileName, body, blockSize, observer)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.redisManager.SaveFileMetadataIf(FileMetadata{
+		Name:        fileName,
+		Size:        int64(len(body)),
+		Blocks:      len(extents),
+		BlockSize:   blockSize,
+		Extents:     extents,
+		CreatedAt:   time.Now().UTC(),
+		Annotations: uploadAnnotations(ctx, fileName),
+		Owner:       fileOwner(ctx),
+	}, ifMatchFromContext(ctx))
+	timer.Phase("index")
+	if errors.Is(err, errPreconditionFailed) {
+		// Another writer got there first; the upload is not to be recovered.
+		_ = f.endUpload(ctx, fileName)
+		return err
+	}
+	if err != nil {
+		// The upload log is left for RecoverUploads to add the file.
+		logger.Error("Failed to store file in the metadata index", zap.Error(err))
+		return errors.New("failed to store file metadata")
+	}
+	if err := f.endUpload(ctx, fileName); err != nil {
+		logger.Warn("Failed to drop the upload log", zap.Error(err))
+	}
+
+	// A previous version packed into a container is dead space there now,
+	// as are the blocks of one that patches and appends stored again.
+	if previousErr == nil && previous.Packed != nil {
+		f.packer.Release(ctx, fileName, *previous.Packed)
+	}
+	if previousErr == nil {
+		f.removeRewrittenBlocks(ctx, previous)
+	}
+
+	logger.Info("File upload and distribution completed successfully", zap.String("fileName", fileName))
+	return nil
+}
+
+// storeBlocks splits body into blocks of blockSize bytes, compressed
+// independently, and distributes them across the nodes under fileName,
+// without touching the metadata index. It returns the extents of the blocks
+// and the block size used.
+func (f *fileManager) storeBlocks(ctx context.Context, timer *phaseTimer, fileName string, body []byte, blockSize int, observer uploadObserver) ([]BlockExtent, int, error) {
+	logger := requestLogger(ctx)
+
+	if blockSize == 0 {
+		blockSize = chooseBlockSize(len(body))
+	}
+
+	// The blocks are slices of the compressed buffer, so it goes back to the
+	// pool only once every block has been distributed.
+	compressedBuffer, blocks, extents, err := compressBlocks(ctx, body, blockSize, 1, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer putBuffer(compressedBuffer)
+
+	timer.Phase("compress")
+	logger.Info("File compression completed",
+		zap.String("fileName", fileName),
+		zap.Int("compressedSize", compressedBuffer.Len()),
+	)
+
+	numOfBlocks := len(blocks)
+	hashedFileName := GenerateFileHash(fileName)
+	logger.Info("File split into blocks",
+		zap.String("fileName", fileName),
+		zap.Int("numberOfBlocks", numOfBlocks),
+		zap.Int("blockSize", blockSize),
+	)
+
+	// Containers are logged by the packer, which cleans up after them.
+	logged := !isContainerName(fileName)
+	if logged {
+		previousBlocks, err := f.redisManager.GetNumberOfBlocksOfAFile(hashedFileName)
+		if errors.Is(err, ErrFileNotFound) {
+			err = nil
+		}
+		if err == nil {
+			err = f.redisManager.beginUpload(ctx, UploadIntent{
+				File:           fileName,
+				Size:           int64(len(body)),
+				Blocks:         numOfBlocks,
+				BlockSize:      blockSize,
+				StartedAt:      time.Now().UTC(),
+				PreviousBlocks: previousBlocks,
+				Extents:        extents,
+				Annotations:    uploadAnnotations(ctx, fileName),
+				Owner:          fileOwner(ctx),
+			})
+		}
+		if err != nil {
+			logger.Error("Failed to log the upload", zap.Error(err))
+			return nil, 0, errors.New("failed to store file metadata")
+		}
+		observer = loggedUploadObserver{uploadObserver: observer, ctx: ctx, redis: f.redisManager, fileName: fileName}
+	}
+
+	if logged {
+		if err := stageBlocks(ctx, fileName, blocks); err != nil {
+			logger.Error("Failed to stage the blocks of the upload", zap.Error(err))
+			f.abortUpload(ctx, fileName)
+			return nil, 0, errors.New("failed to stage the upload")
+		}
+		timer.Phase("stage")
+	}
+
+	err = f.redisManager.SendBlockHashWithNumberOfBlocks(hashedFileName, numOfBlocks)
+	if err == nil && logged {
+		err = f.redisManager.uploadDistributing(ctx, fileName)
+	}
+	timer.Phase("metadata")
+	if err != nil {
+		logger.Error("Failed to store file metadata in Redis", zap.Error(err))
+		if logged {
+			f.abortUpload(ctx, fileName)
+		}
+		return nil, 0, errors.New("failed to store file metadata")
+	}
+	if err := f.distributeBlocks(ctx, timer, fileName, blocks, observer); err != nil {
+		if logged {
+			f.abortUpload(ctx, fileName)
+		}
+		return nil, 0, err
+	}
+
+	return extents, blockSize, nil
+}
+
+// compressBody gzips body into a pooled buffer, handed back by the caller
+// with putBuffer.
+func compressBody(ctx context.Context, body []byte) (*bytes.Buffer, error) {
+	compressedBuffer := getBuffer()
+	if err := compressInto(ctx, compressedBuffer, body); err != nil {
+		putBuffer(compressedBuffer)
+		return nil, err
+	}
+	return compressedBuffer, nil
+}
+
+// compressInto appends body to buf as a gzip member.
+func compressInto(ctx context.Context, buf *bytes.Buffer, body []byte) error {
+	logger := requestLogger(ctx)
+
+	gz, err := getGzipWriter(buf)
+	if err != nil {
+		logger.Error("Failed to set gzip concurrency", zap.Error(err))
+		return errors.New("failed to set gzip concurrency")
+	}
+
+	if _, err := gz.Write(body); err != nil {
+		logger.Error("Failed to compress file", zap.Error(err))
+		return errors.New("failed to compress file")
+	}
+
+	if err := gz.Close(); err != nil {
+		logger.Error("Failed to close gzip writer", zap.Error(err))
+		return errors.New("failed to close compression stream")
+	}
+	putGzipWriter(gz)
+	return nil
+}
+
+// distributeBlocks sends the blocks of fileName to the nodes concurrently,
+// recording where each one is stored.
+func (f *fileManager) distributeBlocks(ctx context.Context, timer *phaseTimer, fileName string, blocks []FileBlock, observer uploadObserver) error {
+	logger := requestLogger(ctx)
+
+	ctx, err := f.placementContext(ctx, fileOfBlocks(fileName))
+	if err != nil {
+		logger.Error("Failed to read the pin of the file", zap.String("fileName", fileName), zap.Error(err))
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	ErrorChannel := make(chan error, len(blocks))
+
+	nodesRes, err := f.nodeManager.PlacementStats()
+	timer.Phase("nodeStats")
+	if err != nil {
+		logger.Error("Failed to retrieve node statistics", zap.Error(err))
+		return fmt.Errorf("failed to retrieve node statistics: %w", err)
+	}
+
+	f.nodeManager.NodeStats = nodesRes
+	logger.Info("Node statistics retrieved", zap.Int("nodeCount", len(nodesRes)))
+
+	// A write the nodes have no room for is refused before any block is
+	// placed, rather than failing halfway.
+	if err := f.nodeManager.checkCapacity(blocks, pinnedNodes(ctx)); err != nil {
+		logger.Warn("Not enough space left on the nodes", zap.String("fileName", fileName), zap.Error(err))
+		return err
+	}
+
+	observer.Distributing(blocks)
+
+	for _, block := range blocks {
+		wg.Add(1)
+
+		go func(block FileBlock) {
+			logger.Debug("Sending block to node",
+				zap.Int("blockPosition", block.position),
+			)
+			f.SendBlockToNode(ctx, block, &wg, ErrorChannel, fileName, observer)
+		}(block)
+	}
+
+	wg.Wait()
+	close(ErrorChannel)
+	timer.Phase("distribute")
+
+	for err := range ErrorChannel {
+		if err != nil && err.Error() != "" {
+			logger.Error("Error during block distribution", zap.Error(err))
+			return fmt.Errorf("error during block distribution: %w", err)
+		}
+	}
+
+	if config.VerifyWrites {
+		if err := f.verifyBlocks(ctx, fileName, blocks); err != nil {
+			logger.Error("Blocks written could not be verified", zap.String("fileName", fileName), zap.Error(err))
+			return err
+		}
+		timer.Phase("verify")
+	}
+
+	// Cached blocks of a previous version carry another hash and would miss
+	// anyway; dropping them frees their memory.
+	for _, block := range blocks {
+		blockCache.Invalidate(fileName + "-block-" + strconv.Itoa(block.position))
+	}
+
+	return nil
+}
+
+// RemoveFile removes every block of the file from the nodes holding it and
+// drops all of its metadata from Redis.
+func (f *fileManager) RemoveFile(ctx context.Context, fileName string) error {
+	err := f.checkWrite(ctx, fileName)
+	if err == nil {
+		err = f.removeFile(ctx, fileName)
+	}
+	recordAudit(ctx, AuditFileDelete, fileName, err)
+	return err
+}
+
+func (f *fileManager) removeFile(ctx context.Context, fileName string) error {
+	logger := requestLogger(ctx)
+
+	if metadata, err := f.redisManager.GetFileMetadata(fileName); err == nil && metadata.Packed != nil {
+		if err := f.redisManager.DeleteFileMetadata(fileName); err != nil {
+			return fmt.Errorf("failed to remove file from the metadata index: %w", err)
+		}
+		f.packer.Release(ctx, fileName, *metadata.Packed)
+
+		logger.Info("Packed file deleted",
+			zap.String("fileName", fileName),
+			zap.String("container", metadata.Packed.Container),
+		)
+		return nil
+	}
+
+	if err := f.removeBlocks(ctx, fileName); err != nil {
+		return err
+	}
+
+	if err := f.redisManager.DeleteFileMetadata(fileName); err != nil {
+		return fmt.Errorf("failed to remove file from the metadata index: %w", err)
+	}
+	_ = f.redisManager.DeleteFileAccess(context.Background(), fileName)
+	_ = f.redisManager.DeleteFilePin(fileName)
+
+	logger.Info("File deletion completed", zap.String("fileName", fileName))
+	return nil
+}
+
+// removeBlocks deletes the blocks stored under fileName from the nodes and
+// their metadata from Redis, leaving the metadata index alone.
+func (f *fileManager) removeBlocks(ctx context.Context, fileName string) error {
+	logger := requestLogger(ctx)
+	fileHashedName := GenerateFileHash(fileName)
+
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(fileName)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Starting file deletion",
+		zap.String("fileName", fileName),
+		zap.Int("numOfBlocks", numOfBlocks),
+	)
+
+	for i := 0; i < numOfBlocks; i++ {
+		if err := f.removeBlock(ctx, metadata.blockName(i+1)); err != nil {
+			return err
+		}
+	}
+
+	if err := f.redisManager.redisClient.Del(context.Background(), fmt.Sprintf("%x", fileHashedName)).Err(); err != nil {
+		return fmt.Errorf("failed to delete file metadata: %w", err)
+	}
+	return nil
+}
+
+// removeBlock deletes one block from the nodes holding it and its metadata
+// from Redis.
+func (f *fileManager) removeBlock(ctx context.Context, fileBlockName string) error {
+	logger := requestLogger(ctx)
+	formattedBs := fmt.Sprintf("%x", GenerateFileHash(fileBlockName))
+
+	location, err := f.redisManager.GetBlockLocation(fileBlockName)
+	if err != nil {
+		logger.Warn("Block metadata missing, skipping node cleanup",
+			zap.String("blockName", fileBlockName),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	for _, nodeAddress := range location.Addresses() {
+		if err := f.DeleteBlockFromNode(ctx, nodeAddress, fileBlockName+".bin"); err != nil {
+			logger.Warn("Failed to delete block from node",
+				zap.String("blockName", fileBlockName),
+				zap.String("nodeAddress", nodeAddress),
+				zap.Error(err),
+			)
+		}
+	}
+
+	if err := f.redisManager.redisClient.Del(context.Background(), formattedBs).Err(); err != nil {
+		return fmt.Errorf("failed to delete block metadata for %s: %w", fileBlockName, err)
+	}
+	blockCache.Invalidate(fileBlockName)
+	_ = f.redisManager.ClearBlockCorrupted(fileBlockName)
+	return nil
+}
+
+func (f *fileManager) DeleteBlockFromNode(ctx context.Context, nodeAddress string, blockFileName string) error {
+	if isColdAddress(nodeAddress) {
+		return f.deleteColdBlock(ctx, nodeAddress, blockFileName)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/deleteFile?filename=%s", nodeAddress, url.QueryEscape(blockFileName)), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := f.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return &nodeStatusError{Node: nodeAddress, StatusCode: res.StatusCode}
+	}
+
+	return nil
+}
+
+func (f *fileManager) SendBlockToNode(ctx context.Context, block FileBlock, wg *sync.WaitGroup, errChan chan error, fileName string, observer uploadObserver) {
+	logger := requestLogger(ctx)
+	defer wg.Done()
+
+	logger.Info("Starting transmission for block",
+		zap.Int("blockPosition", block.position),
+		zap.String("fileName", fileName),
+	)
+
+	pinned := pinnedNodes(ctx)
+	noNodes := errNoNodes
+	if pinned != nil {
+		noNodes = errNoPinnedNodes
+	}
+	selectedNode, ok := f.nodeManager.selectNode(block, pinned)
+	if !ok {
+		logger.Error("No available nodes for block",
+			zap.Int("blockPosition", block.position),
+			zap.String("fileName", fileName),
+		)
+		observer.BlockFailed(block.position, noNodes)
+		errChan <- noNodes
+		return
+	}
+
+	bs := GenerateFileHash(fileName + "-block-" + strconv.Itoa(block.position))
+
+	if int64(selectedNode.usage+len(block.bytes)) > f.nodeManager.capacity(selectedNode.address) {
+		logger.Error("All nodes are full",
+			zap.Int("blockPosition", block.position),
+			zap.String("fileName", fileName),
+		)
+		observer.BlockFailed(block.position, errNodesFull)
+		errChan <- errNodesFull
+		return
+	}
+
+	logger.Info("Preparing block for transmission",
+		zap.Int("blockPosition", block.position),
+		zap.String("fileName", fileName),
+	)
+
+	blockFileName, blockDataHash, formattedBs := f.PrepareBlockForTransmission(block, fileName, bs)
+
+	for {
+		logger.Info("Attempting to send block to node",
+			zap.Int("blockPosition", block.position),
+			zap.String("fileName", fileName),
+			zap.String("nodeAddress", selectedNode.address),
+		)
+
+		// Transient failures are retried on the same node; it is only
+		// evicted once the retries are exhausted.
+		err := nodeRetryPolicy().Do(ctx, "blockPush", func() error {
+			start := time.Now()
+			err := f.TransmitBlock(ctx, formattedBs, selectedNode, blockDataHash, blockFileName, block.bytes, func(received int64) {
+				observer.BlockTransferred(block.position, received)
+			})
+			duration := time.Since(start)
+			blockTransmitDuration.WithLabelValues(resultLabel(err)).Observe(duration.Seconds())
+			nodeHealthMetrics.Transmitted(selectedNode.address, len(block.bytes), duration, err)
+			return err
+		})
+
+		if err == nil {
+			if config.ReplicationFactor > 1 {
+				f.replicateBlock(ctx, block, blockFileName, blockDataHash, selectedNode.address)
+			}
+			logger.Info("Successfully transmitted block",
+				zap.Int("blockPosition", block.position),
+				zap.String("fileName", fileName),
+				zap.String("nodeAddress", selectedNode.address),
+			)
+			observer.BlockStored(block.position, selectedNode.address)
+			return
+		}
+
+		logger.Error("Failed to transmit block",
+			zap.Int("blockPosition", block.position),
+			zap.String("fileName", fileName),
+			zap.String("nodeAddress", selectedNode.address),
+			zap.Error(err),
+		)
+
+		f.nodeManager.evictNode(selectedNode.address, "transmit")
+
+		selectedNode, ok = f.nodeManager.selectNode(block, pinned)
+		if !ok {
+			logger.Error("No available nodes for block",
+				zap.Int("blockPosition", block.position),
+				zap.String("fileName", fileName),
+			)
+			observer.BlockFailed(block.position, noNodes)
+			errChan <- noNodes
+			return
+		}
+		logger.Info("Retrying transmission with new node",
+			zap.Int("blockPosition", block.position),
+			zap.String("fileName", fileName),
+			zap.String("newNodeAddress", selectedNode.address),
+		)
+	}
+}
+
+func (f *fileManager) PrepareBlockForTransmission(block FileBlock, fileName string, bs []byte) (string, []byte, string) {
+	logger.Info("Starting preparation for transmission",
+		zap.Int("blockPosition", block.position),
+		zap.String("fileName", fileName),
+	)
+
+	blockFileName := fileName + "-block-" + strconv.Itoa(block.position) + ".bin"
+	blockDataHash := GenerateBlockHash(block.bytes)
+	formattedBs := fmt.Sprintf("%x", bs)
+
+	logger.Info("Successfully prepared block for transmission",
+		zap.Int("blockPosition", block.position),
+		zap.String("fileName", fileName),
+		zap.String("blockHash", formattedBs),
+	)
+
+	return blockFileName, blockDataHash, formattedBs
+}
+
+// TransmitBlock streams the block to the node, calling progress with the
+// number of bytes the node has acknowledged so far.
+func (f *fileManager) TransmitBlock(ctx context.Context, formattedBs string, selectedNode Node, blockDataHash []byte, blockFileName string, data []byte, progress func(received int64)) error {
+	// The gRPC client does not keep the transport error, so an open breaker
+	// is checked here to fail without retrying.
+	if breakers.Open(breakerKey(selectedNode.address)) {
+		return fmt.Errorf("node %s: %w", selectedNode.address, errCircuitOpen)
+	}
+
+	timer := newPhaseTimer()
+	err := f.transmitBlock(ctx, timer, formattedBs, selectedNode, blockDataHash, blockFileName, data, progress)
+	timer.report(requestLogger(ctx), "blockTransmit", config.SlowBlockTransmitThreshold, len(data), err,
+		zap.String("blockFileName", blockFileName),
+		zap.String("nodeAddress", selectedNode.address),
+	)
+	return err
+}
+
+func (f *fileManager) transmitBlock(ctx context.Context, timer *phaseTimer, formattedBs string, selectedNode Node, blockDataHash []byte, blockFileName string, data []byte, progress func(received int64)) error {
+	logger := requestLogger(ctx)
+	logger.Info("Starting block transmission to Redis",
+		zap.String("blockHash", formattedBs),
+		zap.String("nodeAddress", selectedNode.address),
+	)
+
+	// Step 1: Memorizzazione su Redis. A rewritten block starts over with a
+	// single replica.
+	fields, err := replicaFields([]Replica{{Address: selectedNode.address, State: ReplicaHealthy}})
+	if err == nil {
+		fields = append(fields, "block_hash", fmt.Sprintf("%x", blockDataHash), "block_size", len(data))
+		err = f.redisManager.redisClient.HSet(context.Background(), formattedBs, fields...).Err()
+	}
+	timer.Phase("metadata")
+
+	if err != nil {
+		logger.Error("Failed to store blockHash in Redis",
+			zap.String("blockHash", formattedBs),
+			zap.Error(err),
+		)
+		return fmt.Errorf("failed to store blockHash in Redis: %w", err)
+	}
+
+	logger.Info("Successfully stored blockHash in Redis",
+		zap.String("blockHash", formattedBs),
+	)
+
+	// Step 2: Trasmissione del blocco al nodo
+	if err := f.streamBlock(ctx, timer, selectedNode.address, blockDataHash, blockFileName, data, progress); err != nil {
+		return err
+	}
+
+	logger.Info("Successfully transmitted block to node",
+		zap.String("nodeAddress", selectedNode.address),
+		zap.String("blockHash", formattedBs),
+	)
+
+	blockTransmissedByNode.WithLabelValues(selectedNode.address).Inc()
+	_ = f.redisManager.ClearBlockCorrupted(strings.TrimSuffix(blockFileName, ".bin"))
+
+	return nil
+}
+
+// streamBlock sends the content of a block to a node over gRPC and waits for
+// the node to commit it, and to report the hash of the block it stored.
+func (f *fileManager) streamBlock(ctx context.Context, timer *phaseTimer, address string, blockDataHash []byte, blockFileName string, data []byte, progress func(received int64)) error {
+	logger := requestLogger(ctx)
+	logger.Info("Streaming block to node",
+		zap.String("nodeAddress", address),
+		zap.String("blockFileName", blockFileName),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, blockTransferTimeout)
+	defer cancel()
+
+	// The node checks the block against its hash and digests, and its
+	// signature when it shares the signing key, before committing it.
+	metadata := http.Header{}
+	blocksign.SetHeaders(metadata, []byte(config.BlockSigningKey), fmt.Sprintf("%x", blockDataHash), blockFileName, time.Now())
+	blocksign.SetDigests(metadata, blockDataHash, data)
+	ctx = grpcwire.WithMetadata(ctx, metadata)
+
+	stream, err := dfspb.NewBlockServiceClient(grpcwire.Dial(address, grpcwire.WithHTTPClient(f.blockClient))).StoreBlock(ctx)
+	timer.Phase("connect")
+	if err != nil {
+		return fmt.Errorf("failed to open block stream to node %s: %w", address, err)
+	}
+
+	// The chunks are sent from a separate goroutine so the node's per-chunk
+	// acknowledgements are drained while the upload is still in flight.
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sendBlockChunks(stream, blockFileName, data)
+	}()
+
+	var ack *dfspb.StoreBlockResponse
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logger.Error("Failed to transmit block to node",
+				zap.String("nodeAddress", address),
+				zap.Error(err),
+			)
+			return fmt.Errorf("failed to transmit block to node %s: %w", address, err)
+		}
+		ack = res
+		progress(res.GetReceived())
+	}
+
+	timer.Phase("stream")
+
+	if err := <-sendErr; err != nil {
+		return fmt.Errorf("failed to send block to node %s: %w", address, err)
+	}
+
+	if ack == nil || !ack.GetCommitted() || ack.GetReceived() != int64(len(data)) {
+		logger.Warn("Node did not commit the block",
+			zap.String("nodeAddress", address),
+			zap.String("blockFileName", blockFileName),
+		)
+		return fmt.Errorf("node %s did not commit block %s", address, blockFileName)
+	}
+	// Nodes that predate stored hashes report none.
+	if stored := ack.GetSha256(); stored != "" && stored != fmt.Sprintf("%x", blockDataHash) {
+		blockCorruptions.WithLabelValues("store").Inc()
+		logger.Warn("Node stored a different block",
+			zap.String("nodeAddress", address),
+			zap.String("blockFileName", blockFileName),
+			zap.String("storedHash", stored),
+		)
+		return fmt.Errorf("%w: %s on node %s", errStoredBlockMismatch, blockFileName, address)
+	}
+	return nil
+}
+
+// sendBlockChunks streams data in grpcChunkSize pieces, each carrying the
+// CRC-32C of everything sent so far so the node can verify it as it writes.
+// The block name travels on the first message only.
+func sendBlockChunks(stream dfspb.BlockService_StoreBlockClient, blockFileName string, data []byte) error {
+	var checksum uint32
+	offset := 0
+
+	for {
+		end := min(offset+grpcChunkSize, len(data))
+		chunk := data[offset:end]
+		checksum = crc32.Update(checksum, castagnoliTable, chunk)
+
+		req := &dfspb.StoreBlockRequest{
+			Offset:   int64(offset),
+			Chunk:    chunk,
+			Checksum: checksum,
+			Last:     end == len(data),
+		}
+		if offset == 0 {
+			req.Name = blockFileName
+		}
+
+		if err := stream.Send(req); err != nil {
+			// io.EOF means the node ended the call; Recv reports why.
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if req.Last {
+			return stream.CloseSend()
+		}
+		offset = end
+	}
+}
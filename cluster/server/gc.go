@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// GCSummary is the answer of POST /admin/gc.
+type GCSummary struct {
+	// ExpiredUploads counts the multipart uploads dropped with their parts.
+	ExpiredUploads int `json:"expired_uploads"`
+	// ClearedCorruptions counts the blocks recorded as corrupted that no
+	// longer exist, such as those of deleted files.
+	ClearedCorruptions int `json:"cleared_corruptions"`
+}
+
+// clearStaleCorruptions forgets the corrupted blocks that have no location
+// any more, which repairs would otherwise retry forever.
+func (f *fileManager) clearStaleCorruptions(ctx context.Context) (int, error) {
+	blocks, err := f.redisManager.CorruptedBlocks()
+	if err != nil {
+		return 0, err
+	}
+	cleared := 0
+	for _, blockName := range blocks {
+		if _, err := f.redisManager.GetBlockLocation(blockName); err == nil {
+			continue
+		}
+		if err := f.redisManager.ClearBlockCorrupted(blockName); err != nil {
+			return cleared, err
+		}
+		requestLogger(ctx).Info("Forgot corrupted block that no longer exists", zap.String("blockName", blockName))
+		cleared++
+	}
+	return cleared, nil
+}
+
+// GC collects the garbage the periodic sweeps otherwise leave until their
+// next pass: expired multipart uploads and the records of corrupted blocks
+// that were deleted since.
+func (f *fileManager) GC(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/gc").Inc()
+	logger := requestLogger(r.Context())
+
+	var summary GCSummary
+	var err error
+	summary.ExpiredUploads, err = f.ExpireMultipartUploads(r.Context())
+	if err == nil {
+		summary.ClearedCorruptions, err = f.clearStaleCorruptions(r.Context())
+	}
+	recordAudit(r.Context(), AuditGC, "", err)
+	if err != nil {
+		logger.Error("Garbage collection failed", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Garbage collection failed")
+		return
+	}
+	logger.Info("Garbage collection completed",
+		zap.Int("expiredUploads", summary.ExpiredUploads),
+		zap.Int("clearedCorruptions", summary.ClearedCorruptions),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"FDS/dfspb"
+	"FDS/grpcwire"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const grpcChunkSize = 1 * MB
+
+// blockTransferTimeout bounds the streaming of a single block to a node.
+const blockTransferTimeout = 2 * time.Minute
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// grpcFileService serves the file operations of the HTTP API over gRPC.
+type grpcFileService struct {
+	fileManager *fileManager
+}
+
+func (c *clients) SetupGrpcServer() *grpcwire.Server {
+	server := grpcwire.NewServer()
+	dfspb.RegisterFileServiceServer(server, &grpcFileService{fileManager: c.fileManager})
+	return server
+}
+
+func (g *grpcFileService) Upload(stream dfspb.FileService_UploadServer) error {
+	httpRequestsTotal.WithLabelValues("GRPC", dfspb.FileService_Upload_FullMethodName).Inc()
+	if err := maintenance.Check(true); err != nil {
+		return grpcwire.Errorf(grpcwire.Unavailable, "%v, retry later", err)
+	}
+
+	ticket, err := uploads.Admit(0)
+	if err != nil {
+		return grpcwire.Errorf(grpcwire.Unavailable, "%v, retry later", err)
+	}
+	defer ticket.Release()
+
+	var fileName string
+	body := getBuffer()
+	defer putBuffer(body)
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if fileName == "" {
+			fileName = req.GetName()
+			if fileName == "" {
+				return grpcwire.Errorf(grpcwire.InvalidArgument, "the first message must carry the file name")
+			}
+		}
+		if err := ticket.Grow(int64(len(req.GetChunk()))); err != nil {
+			return grpcwire.Errorf(grpcwire.Unavailable, "%v, retry later", err)
+		}
+		body.Write(req.GetChunk())
+		if uploadTooLarge(int64(body.Len())) {
+			return grpcwire.Errorf(grpcwire.ResourceExhausted, "file exceeds the maximum upload size of %d bytes", config.MaxUploadSize)
+		}
+	}
+
+	if fileName == "" {
+		return grpcwire.Errorf(grpcwire.InvalidArgument, "no file name received")
+	}
+	if err := stream.Context().Err(); err != nil {
+		return grpcwire.Errorf(grpcwire.Canceled, "upload canceled before distribution")
+	}
+
+	requestLogger(stream.Context()).Info("File received over gRPC", zap.String("fileName", fileName), zap.Int("size", body.Len()))
+
+	if err := g.fileManager.StoreFile(stream.Context(), fileName, body.Bytes()); err != nil {
+		if errors.Is(err, errContentTypeNotAllowed) || errors.Is(err, errUploadRejected) {
+			return grpcwire.Errorf(grpcwire.InvalidArgument, "%v", err)
+		}
+		if errors.Is(err, errUploadHookFailed) || errors.Is(err, errWriteUnverified) {
+			return grpcwire.Errorf(grpcwire.Unavailable, "%v", err)
+		}
+		if errors.Is(err, errFileLocked) || errors.Is(err, errPreconditionFailed) {
+			return grpcwire.Errorf(grpcwire.FailedPrecondition, "%v", err)
+		}
+		if errors.Is(err, errNodesFull) {
+			return grpcwire.Errorf(grpcwire.ResourceExhausted, "%v", err)
+		}
+		return grpcwire.Errorf(grpcwire.Internal, "%v", err)
+	}
+
+	metadata, err := g.fileManager.redisManager.GetFileMetadata(fileName)
+	if err != nil {
+		return grpcwire.Errorf(grpcwire.Internal, "failed to retrieve file metadata: %v", err)
+	}
+
+	return stream.SendAndClose(&dfspb.UploadResponse{File: fileInfoToProto(metadata)})
+}
+
+func (g *grpcFileService) Download(req *dfspb.DownloadRequest, stream dfspb.FileService_DownloadServer) error {
+	httpRequestsTotal.WithLabelValues("GRPC", dfspb.FileService_Download_FullMethodName).Inc()
+	if err := maintenance.Check(false); err != nil {
+		return grpcwire.Errorf(grpcwire.Unavailable, "%v, retry later", err)
+	}
+
+	ctx := g.fileManager.noteFileRead(stream.Context(), req.GetName())
+	data, err := g.fileManager.ReconstructFileFromBlocks(ctx, req.GetName())
+	if errors.Is(err, ErrFileNotFound) {
+		return grpcwire.Errorf(grpcwire.NotFound, "file %s not found", req.GetName())
+	}
+	if err != nil {
+		requestLogger(stream.Context()).Error("Failed to reconstruct file for gRPC download", zap.String("fileName", req.GetName()), zap.Error(err))
+		return grpcwire.Errorf(grpcwire.Internal, "failed to download file")
+	}
+
+	for offset := 0; offset < len(data); offset += grpcChunkSize {
+		end := min(offset+grpcChunkSize, len(data))
+		if err := stream.Send(&dfspb.DownloadResponse{Chunk: data[offset:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *grpcFileService) List(_ context.Context, _ *dfspb.ListRequest) (*dfspb.ListResponse, error) {
+	httpRequestsTotal.WithLabelValues("GRPC", dfspb.FileService_List_FullMethodName).Inc()
+	if err := maintenance.Check(false); err != nil {
+		return nil, grpcwire.Errorf(grpcwire.Unavailable, "%v, retry later", err)
+	}
+
+	files, err := g.fileManager.redisManager.ListFiles()
+	if err != nil {
+		logger.Error("Failed to list files for gRPC", zap.Error(err))
+		return nil, grpcwire.Errorf(grpcwire.Internal, "failed to list files")
+	}
+
+	res := &dfspb.ListResponse{}
+	for _, metadata := range files {
+		res.Files = append(res.Files, fileInfoToProto(metadata))
+	}
+	return res, nil
+}
+
+func (g *grpcFileService) Delete(ctx context.Context, req *dfspb.DeleteRequest) (*dfspb.DeleteResponse, error) {
+	httpRequestsTotal.WithLabelValues("GRPC", dfspb.FileService_Delete_FullMethodName).Inc()
+	if err := maintenance.Check(true); err != nil {
+		return nil, grpcwire.Errorf(grpcwire.Unavailable, "%v, retry later", err)
+	}
+	logger := requestLogger(ctx)
+
+	err := g.fileManager.RemoveFile(ctx, req.GetName())
+	if errors.Is(err, ErrFileNotFound) {
+		return nil, grpcwire.Errorf(grpcwire.NotFound, "file %s not found", req.GetName())
+	}
+	if errors.Is(err, errFileLocked) || errors.Is(err, errPreconditionFailed) {
+		return nil, grpcwire.Errorf(grpcwire.FailedPrecondition, "%v", err)
+	}
+	if err != nil {
+		logger.Error("Failed to delete file for gRPC", zap.String("fileName", req.GetName()), zap.Error(err))
+		return nil, grpcwire.Errorf(grpcwire.Internal, "failed to delete file")
+	}
+	return &dfspb.DeleteResponse{}, nil
+}
+
+func fileInfoToProto(metadata FileMetadata) *dfspb.FileInfo {
+	return &dfspb.FileInfo{
+		Name:      metadata.Name,
+		Size:      metadata.Size,
+		Blocks:    int32(metadata.Blocks),
+		CreatedAt: timestamppb.New(metadata.CreatedAt),
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// Healthz reports that the process is alive. It does not look at any
+// dependency, so a restart is only triggered when the server itself hangs.
+func (c *clients) Healthz(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	writeHealth(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Readyz reports whether the cluster can serve requests: Redis must answer
+// and at least one node must be UP in the registry.
+func (c *clients) Readyz(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	checks := []HealthCheck{c.checkRedis(ctx)}
+	if checks[0].OK {
+		checks = append(checks, c.checkNodes())
+	} else {
+		// The node registry lives in Redis.
+		checks = append(checks, HealthCheck{Name: "nodes", Detail: "node registry unavailable"})
+	}
+
+	response := HealthResponse{Status: "ready", Checks: checks}
+	code := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			response.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	writeHealth(w, code, response)
+}
+
+func (c *clients) checkRedis(ctx context.Context) HealthCheck {
+	if err := c.redisClient.Ping(ctx).Err(); err != nil {
+		return HealthCheck{Name: "redis", Detail: err.Error()}
+	}
+	return HealthCheck{Name: "redis", OK: true}
+}
+
+func (c *clients) checkNodes() HealthCheck {
+	nodes, err := c.nodeManager.registry.ListNodeStatuses()
+	if err != nil {
+		return HealthCheck{Name: "nodes", Detail: err.Error()}
+	}
+
+	up := 0
+	for _, node := range nodes {
+		if node.Status == NodeUp {
+			up++
+		}
+	}
+
+	return HealthCheck{Name: "nodes", OK: up > 0, Detail: fmt.Sprintf("%d of %d nodes up", up, len(nodes))}
+}
+
+func writeHealth(w http.ResponseWriter, code int, response HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"slices"
+	"sync"
+	"time"
+)
+
+var hedgedFetches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "block_hedged_fetches_total",
+		Help: "Hedged block fetches sent, and how many of them answered first",
+	},
+	[]string{"outcome"},
+)
+
+// minLatencySamples is how many fetches are needed before the hedge delay is
+// taken from the observed latencies rather than FDS_HEDGE_MIN_DELAY.
+const minLatencySamples = 20
+
+// latencyTracker keeps the most recent block fetch latencies.
+type latencyTracker struct {
+	mutex   sync.Mutex
+	samples [512]time.Duration
+	count   int
+	next    int
+}
+
+var blockFetchLatency = &latencyTracker{}
+
+func (t *latencyTracker) Observe(d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % len(t.samples)
+	t.count = min(t.count+1, len(t.samples))
+}
+
+// Percentile returns the p-th percentile of the recent latencies, or false
+// while there are too few of them.
+func (t *latencyTracker) Percentile(p int) (time.Duration, bool) {
+	t.mutex.Lock()
+	samples := slices.Clone(t.samples[:t.count])
+	t.mutex.Unlock()
+
+	if len(samples) < minLatencySamples {
+		return 0, false
+	}
+	slices.Sort(samples)
+	return samples[min(len(samples)-1, len(samples)*p/100)], true
+}
+
+func hedgeDelay() time.Duration {
+	delay, ok := blockFetchLatency.Percentile(config.HedgePercentile)
+	if !ok {
+		return config.HedgeMinDelay
+	}
+	return max(delay, config.HedgeMinDelay)
+}
+
+// fetchBlockHedged fetches a block from the first replica. With hedged reads
+// enabled, a second request goes to the next replica if the first has not
+// answered within the hedge delay; the first answer wins and the other
+// request is cancelled. With a single replica the hedge goes to the same
+// node, which still gets around a stalled connection. It returns the address
+// of the replica whose answer it returns.
+func (f *fileManager) fetchBlockHedged(ctx context.Context, replicas []string, blockFileName string) (*bytes.Buffer, string, error) {
+	type result struct {
+		data    *bytes.Buffer
+		address string
+		err     error
+		hedge   bool
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	fetch := func(address string, hedge bool) {
+		start := time.Now()
+		data, err := f.fetchBlock(ctx, address, blockFileName)
+		if err == nil {
+			blockFetchLatency.Observe(time.Since(start))
+			nodeHealthMetrics.Fetched(address, time.Since(start))
+		}
+		results <- result{data: data, address: address, err: err, hedge: hedge}
+	}
+
+	go fetch(replicas[0], false)
+	if !config.HedgedReads {
+		res := <-results
+		return res.data, res.address, res.err
+	}
+
+	timer := time.NewTimer(hedgeDelay())
+	defer timer.Stop()
+
+	inFlight := 1
+	hedged := false
+	for {
+		select {
+		case <-timer.C:
+			hedged = true
+			inFlight++
+			hedgedFetches.WithLabelValues("sent").Inc()
+			go fetch(replicas[1%len(replicas)], true)
+		case res := <-results:
+			inFlight--
+			if res.err == nil {
+				if res.hedge {
+					hedgedFetches.WithLabelValues("won").Inc()
+				}
+				return res.data, res.address, nil
+			}
+			// Without a hedge in flight the error goes back to the retry
+			// policy.
+			if !hedged || inFlight == 0 {
+				return nil, res.address, res.err
+			}
+		}
+	}
+}
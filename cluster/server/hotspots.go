@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hotspotBuckets is the number of buckets FDS_HOTSPOT_WINDOW is cut into. A
+// report sums the buckets its window overlaps, so it may reach back one
+// bucket further than asked.
+const hotspotBuckets = 60
+
+type hotspotBucket struct {
+	start time.Time
+	files map[string]int64
+	nodes map[string]*BusyNode
+}
+
+// hotspotTracker counts the downloads of each file and the block reads
+// served by each node over the last FDS_HOTSPOT_WINDOW, in memory: the
+// counts start over when the central server restarts.
+type hotspotTracker struct {
+	mutex   sync.Mutex
+	buckets [hotspotBuckets]hotspotBucket
+}
+
+var hotspots = &hotspotTracker{}
+
+// bucketLocked returns the bucket of now, emptied if it last held an older
+// period.
+func (t *hotspotTracker) bucketLocked(now time.Time) *hotspotBucket {
+	width := config.HotspotWindow / hotspotBuckets
+	start := now.Truncate(width)
+	bucket := &t.buckets[start.UnixNano()/int64(width)%hotspotBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = hotspotBucket{start: start, files: make(map[string]int64), nodes: make(map[string]*BusyNode)}
+	}
+	return bucket
+}
+
+// FileDownloaded counts a download of a file.
+func (t *hotspotTracker) FileDownloaded(fileName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.bucketLocked(time.Now()).files[fileName]++
+}
+
+// BlockRead counts a block of size bytes read from the node at address.
+func (t *hotspotTracker) BlockRead(address string, size int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	bucket := t.bucketLocked(time.Now())
+	node, ok := bucket.nodes[address]
+	if !ok {
+		node = &BusyNode{Address: address}
+		bucket.nodes[address] = node
+	}
+	node.Reads++
+	node.Bytes += int64(size)
+}
+
+// HotFile is a file of the hotspot report.
+type HotFile struct {
+	Name      string `json:"name"`
+	Downloads int64  `json:"downloads"`
+}
+
+// BusyNode is a node of the hotspot report: the blocks read from it and
+// their stored size.
+type BusyNode struct {
+	Address string `json:"address"`
+	Reads   int64  `json:"reads"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// HotspotReport is the answer of GET /admin/hotspots.
+type HotspotReport struct {
+	Since time.Time  `json:"since"`
+	Files []HotFile  `json:"files"`
+	Nodes []BusyNode `json:"nodes"`
+}
+
+// Report returns the limit most downloaded files and the limit nodes that
+// served the most bytes over the last window.
+func (t *hotspotTracker) Report(window time.Duration, limit int) HotspotReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	width := config.HotspotWindow / hotspotBuckets
+	report := HotspotReport{Since: now, Files: []HotFile{}, Nodes: []BusyNode{}}
+	files := make(map[string]int64)
+	nodes := make(map[string]*BusyNode)
+	for _, bucket := range t.buckets {
+		if bucket.start.IsZero() || !bucket.start.Add(width).After(now.Add(-window)) {
+			continue
+		}
+		if bucket.start.Before(report.Since) {
+			report.Since = bucket.start
+		}
+		for name, downloads := range bucket.files {
+			files[name] += downloads
+		}
+		for address, traffic := range bucket.nodes {
+			node, ok := nodes[address]
+			if !ok {
+				node = &BusyNode{Address: address}
+				nodes[address] = node
+			}
+			node.Reads += traffic.Reads
+			node.Bytes += traffic.Bytes
+		}
+	}
+
+	for name, downloads := range files {
+		report.Files = append(report.Files, HotFile{Name: name, Downloads: downloads})
+	}
+	sort.Slice(report.Files, func(i, j int) bool {
+		if report.Files[i].Downloads != report.Files[j].Downloads {
+			return report.Files[i].Downloads > report.Files[j].Downloads
+		}
+		return report.Files[i].Name < report.Files[j].Name
+	})
+	for _, node := range nodes {
+		report.Nodes = append(report.Nodes, *node)
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		if report.Nodes[i].Bytes != report.Nodes[j].Bytes {
+			return report.Nodes[i].Bytes > report.Nodes[j].Bytes
+		}
+		return report.Nodes[i].Address < report.Nodes[j].Address
+	})
+
+	report.Files = report.Files[:min(limit, len(report.Files))]
+	report.Nodes = report.Nodes[:min(limit, len(report.Nodes))]
+	return report
+}
+
+// GetHotspots reports the most downloaded files and the nodes serving the
+// most read traffic over a window of at most FDS_HOTSPOT_WINDOW.
+func GetHotspots(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	params := r.URL.Query()
+
+	window := config.HotspotWindow
+	if value := params.Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > config.HotspotWindow {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("window must be a duration up to %s", config.HotspotWindow))
+			return
+		}
+		window = d
+	}
+
+	limit := 10
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > 1000 {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(hotspots.Report(window, limit))
+}
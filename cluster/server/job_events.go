@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+const (
+	// minJobEventInterval coalesces bursts of updates, e.g. the per-chunk
+	// acknowledgements of many blocks in flight, into one event.
+	minJobEventInterval = 250 * time.Millisecond
+	jobEventHeartbeat   = 15 * time.Second
+)
+
+// JobProgress is the payload of the events streamed for a job.
+type JobProgress struct {
+	ID               string   `json:"id"`
+	FileName         string   `json:"file_name"`
+	State            JobState `json:"state"`
+	Error            string   `json:"error,omitempty"`
+	BytesFetched     int64    `json:"bytes_fetched,omitempty"`
+	BytesTransferred int64    `json:"bytes_transferred"`
+	BytesTotal       int64    `json:"bytes_total"`
+	BlocksPlaced     int      `json:"blocks_placed"`
+	BlocksTotal      int      `json:"blocks_total"`
+	// ETASeconds is estimated from the transfer rate so far; it is omitted
+	// until a rate can be measured, and while a fetch is still reading its
+	// source.
+	ETASeconds *float64 `json:"eta_seconds,omitempty"`
+}
+
+func jobProgress(job UploadJob) JobProgress {
+	progress := JobProgress{
+		ID:           job.ID,
+		FileName:     job.FileName,
+		State:        job.State,
+		Error:        job.Error,
+		BytesFetched: job.Fetched,
+		BlocksTotal:  len(job.Blocks),
+	}
+
+	for _, block := range job.Blocks {
+		progress.BytesTotal += int64(block.Size)
+		progress.BytesTransferred += block.Transferred
+		if block.State == BlockStored {
+			progress.BlocksPlaced++
+		}
+	}
+
+	switch {
+	case job.State == JobDone:
+		eta := 0.0
+		progress.ETASeconds = &eta
+	case job.State == JobDistributing && progress.BytesTransferred > 0 && job.Size >= 0:
+		elapsed := time.Since(job.DistributingAt).Seconds()
+		rate := float64(progress.BytesTransferred) / elapsed
+		eta := float64(progress.BytesTotal-progress.BytesTransferred) / rate
+		progress.ETASeconds = &eta
+	}
+
+	return progress
+}
+
+// StreamJobEvents streams the progress of a job as Server-Sent Events. A
+// "progress" event is sent on every change and the stream ends with a "done"
+// or "failed" event.
+func (j *jobManager) StreamJobEvents(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/jobs/{id}/events").Inc()
+
+	job, ok := j.Get(mux.Vars(r)["id"])
+	if !ok {
+		respondWithErrorCode(w, http.StatusNotFound, CodeJobNotFound, "Job not found", nil)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(jobEventHeartbeat)
+	defer heartbeat.Stop()
+
+	for eventID := 1; ; eventID++ {
+		status, changed := job.Watch()
+		progress := jobProgress(status)
+
+		event := "progress"
+		if status.State == JobDone || status.State == JobFailed {
+			event = string(status.State)
+		}
+
+		data, _ := json.Marshal(progress)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", eventID, event, data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		if event != "progress" {
+			return
+		}
+		sentAt := time.Now()
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				break wait
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(time.Until(sentAt.Add(minJobEventInterval))):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobPending      JobState = "pending"
+	JobFetching     JobState = "fetching"
+	JobDistributing JobState = "distributing"
+	JobDone         JobState = "done"
+	JobFailed       JobState = "failed"
+)
+
+const (
+	BlockPending = "pending"
+	BlockStored  = "stored"
+	BlockFailed  = "failed"
+)
+
+// uploadObserver is notified by StoreFileWithProgress as the upload
+// advances. Block callbacks are invoked concurrently.
+type uploadObserver interface {
+	Distributing(blocks []FileBlock)
+	BlockTransferred(position int, received int64)
+	BlockStored(position int, nodeAddress string)
+	BlockFailed(position int, err error)
+}
+
+type noopUploadObserver struct{}
+
+func (noopUploadObserver) Distributing([]FileBlock)    {}
+func (noopUploadObserver) BlockTransferred(int, int64) {}
+func (noopUploadObserver) BlockStored(int, string)     {}
+func (noopUploadObserver) BlockFailed(int, error)      {}
+
+type BlockProgress struct {
+	Position    int    `json:"position"`
+	Size        int    `json:"size"`
+	Transferred int64  `json:"transferred"`
+	State       string `json:"state"`
+	Node        string `json:"node,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// UploadJob is the state of an upload running in the background.
+type UploadJob struct {
+	ID       string `json:"id"`
+	FileName string `json:"file_name"`
+	// SourceURL and Fetched are set for uploads fetched from a URL, Size
+	// only once the size is known.
+	SourceURL string    `json:"source_url,omitempty"`
+	Fetched   int64     `json:"fetched,omitempty"`
+	Size      int64     `json:"size"`
+	State     JobState  `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DistributingAt is when the blocks started to be sent to the nodes.
+	DistributingAt time.Time       `json:"distributing_at,omitzero"`
+	Blocks         []BlockProgress `json:"blocks"`
+}
+
+// uploadJob guards an UploadJob updated by the upload goroutines. changed is
+// closed and replaced on every update so watchers can wait for the next one.
+type uploadJob struct {
+	mutex   sync.Mutex
+	status  UploadJob
+	changed chan struct{}
+}
+
+// Snapshot returns a copy of the job state that is safe to read and encode.
+func (j *uploadJob) Snapshot() UploadJob {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.snapshotLocked()
+}
+
+func (j *uploadJob) snapshotLocked() UploadJob {
+	status := j.status
+	status.Blocks = append([]BlockProgress(nil), j.status.Blocks...)
+	return status
+}
+
+// Watch returns the current state and a channel closed on the next update.
+func (j *uploadJob) Watch() (UploadJob, <-chan struct{}) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.snapshotLocked(), j.changed
+}
+
+func (j *uploadJob) update(change func(status *UploadJob)) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	change(&j.status)
+	j.status.UpdatedAt = time.Now().UTC()
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Distributing adds blocks to the job, or starts them over when they were
+// already sent: uploads streamed from their source distribute their blocks
+// one at a time.
+func (j *uploadJob) Distributing(blocks []FileBlock) {
+	j.update(func(status *UploadJob) {
+		status.State = JobDistributing
+		if status.DistributingAt.IsZero() {
+			status.DistributingAt = time.Now().UTC()
+		}
+		for _, block := range blocks {
+			progress := BlockProgress{Position: block.position, Size: len(block.bytes), State: BlockPending}
+			if existing := status.block(block.position); existing != nil {
+				*existing = progress
+			} else {
+				status.Blocks = append(status.Blocks, progress)
+			}
+		}
+	})
+}
+
+func (j *uploadJob) BlockTransferred(position int, received int64) {
+	j.update(func(status *UploadJob) {
+		if block := status.block(position); block != nil {
+			block.Transferred = received
+		}
+	})
+}
+
+func (j *uploadJob) BlockStored(position int, nodeAddress string) {
+	j.update(func(status *UploadJob) {
+		if block := status.block(position); block != nil {
+			block.State = BlockStored
+			block.Transferred = int64(block.Size)
+			block.Node = nodeAddress
+		}
+	})
+}
+
+func (j *uploadJob) BlockFailed(position int, err error) {
+	j.update(func(status *UploadJob) {
+		if block := status.block(position); block != nil {
+			block.State = BlockFailed
+			block.Error = err.Error()
+		}
+	})
+}
+
+func (u *UploadJob) block(position int) *BlockProgress {
+	for i := range u.Blocks {
+		if u.Blocks[i].Position == position {
+			return &u.Blocks[i]
+		}
+	}
+	return nil
+}
+
+// jobManager runs asynchronous uploads and keeps their state in memory for
+// config.JobRetention after they finish.
+type jobManager struct {
+	fileManager *fileManager
+	mutex       sync.Mutex
+	jobs        map[string]*uploadJob
+}
+
+func newJobManager(fileManager *fileManager) *jobManager {
+	return &jobManager{fileManager: fileManager, jobs: make(map[string]*uploadJob)}
+}
+
+func newJobID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// StartUpload stores the file in the background, in blocks of blockSize bytes
+// (0 for the default), and returns its job at once. The upload outlives ctx
+// but keeps its values, such as the caller. done is called once the upload
+// has finished.
+func (j *jobManager) StartUpload(ctx context.Context, fileName string, body []byte, blockSize int, done func()) UploadJob {
+	job := j.add(ctx, UploadJob{FileName: fileName, Size: int64(len(body)), State: JobPending})
+
+	go func() {
+		defer done()
+		j.finish(ctx, job, j.fileManager.StoreFileWithProgress(context.WithoutCancel(ctx), fileName, body, blockSize, job))
+	}()
+
+	return job.Snapshot()
+}
+
+// add registers a new job starting from status.
+func (j *jobManager) add(ctx context.Context, status UploadJob) *uploadJob {
+	now := time.Now().UTC()
+	status.ID = newJobID()
+	status.CreatedAt = now
+	status.UpdatedAt = now
+	status.Blocks = []BlockProgress{}
+	job := &uploadJob{status: status, changed: make(chan struct{})}
+
+	j.mutex.Lock()
+	j.pruneLocked()
+	j.jobs[status.ID] = job
+	j.mutex.Unlock()
+
+	requestLogger(ctx).Info("Asynchronous upload started",
+		zap.String("jobID", status.ID),
+		zap.String("fileName", status.FileName),
+	)
+	return job
+}
+
+// finish records the outcome of a job.
+func (j *jobManager) finish(ctx context.Context, job *uploadJob, err error) {
+	job.update(func(status *UploadJob) {
+		if err != nil {
+			status.State = JobFailed
+			status.Error = err.Error()
+		} else {
+			status.State = JobDone
+		}
+	})
+
+	status := job.Snapshot()
+	requestLogger(ctx).Info("Asynchronous upload finished",
+		zap.String("jobID", status.ID),
+		zap.String("fileName", status.FileName),
+		zap.Error(err),
+	)
+}
+
+func (j *jobManager) Get(id string) (*uploadJob, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+// pruneLocked forgets jobs that finished more than config.JobRetention ago.
+func (j *jobManager) pruneLocked() {
+	for id, job := range j.jobs {
+		snapshot := job.Snapshot()
+		if (snapshot.State == JobDone || snapshot.State == JobFailed) && time.Since(snapshot.UpdatedAt) > config.JobRetention {
+			delete(j.jobs, id)
+		}
+	}
+}
+
+func (j *jobManager) GetJob(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/jobs/{id}").Inc()
+
+	job, ok := j.Get(mux.Vars(r)["id"])
+	if !ok {
+		respondWithErrorCode(w, http.StatusNotFound, CodeJobNotFound, "Job not found", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(job.Snapshot())
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sDiscoverer finds the nodes behind a Kubernetes Service from its
+// EndpointSlices, through the API server the central server runs under. Only
+// ready endpoints are returned, so nodes failing their readiness probe leave
+// the cluster until they pass it again.
+type k8sDiscoverer struct {
+	api       string
+	client    *http.Client
+	tokenFile string
+	namespace string
+	service   string
+	// port is the name of the port of the slices to use; the first one when
+	// empty.
+	port string
+}
+
+// newK8sDiscoverer parses namespace/service or namespace/service:port-name,
+// and reads the in-cluster credentials of the pod.
+func newK8sDiscoverer(target string) (*k8sDiscoverer, error) {
+	namespace, service, ok := strings.Cut(target, "/")
+	service, port, _ := strings.Cut(service, ":")
+	if !ok || namespace == "" || service == "" {
+		return nil, fmt.Errorf("FDS_NODE_DISCOVERY: %q is not k8s:namespace/service[:port]", "k8s:"+target)
+	}
+
+	host, apiPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || apiPort == "" {
+		return nil, errors.New("FDS_NODE_DISCOVERY: k8s discovery only works inside a Kubernetes pod")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("FDS_NODE_DISCOVERY: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	return &k8sDiscoverer{
+		api:       "https://" + net.JoinHostPort(host, apiPort),
+		client:    &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+		tokenFile: serviceAccountDir + "/token",
+		namespace: namespace,
+		service:   service,
+		port:      port,
+	}, nil
+}
+
+type endpointSlice struct {
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+func (k *k8sDiscoverer) request(ctx context.Context, watch bool) (*http.Response, error) {
+	query := url.Values{"labelSelector": {"kubernetes.io/service-name=" + k.service}}
+	if watch {
+		query.Set("watch", "true")
+	}
+	endpoint := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", k.api, url.PathEscape(k.namespace), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Service account tokens are rotated, so the file is read every time.
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("listing the endpoints of %s/%s: %s", k.namespace, k.service, res.Status)
+	}
+	return res, nil
+}
+
+func (k *k8sDiscoverer) Discover(ctx context.Context) ([]string, error) {
+	res, err := k.request(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var list struct {
+		Items []endpointSlice `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, slice := range list.Items {
+		port := 0
+		for _, p := range slice.Ports {
+			if k.port == "" || p.Name == k.port {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			// Endpoints without a ready condition are to be taken as ready.
+			ready := endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+			if !ready || len(endpoint.Addresses) == 0 {
+				continue
+			}
+			addresses = append(addresses, config.NodeDiscoveryScheme+"://"+net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(port)))
+		}
+	}
+	return addresses, nil
+}
+
+// Watch calls changed whenever the EndpointSlices of the service change,
+// until the watch ends.
+func (k *k8sDiscoverer) Watch(ctx context.Context, changed func()) error {
+	res, err := k.request(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var event struct {
+			Type string `json:"type"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			return errors.New("the endpoint watch was interrupted")
+		}
+		changed()
+	}
+}
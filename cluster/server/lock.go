@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// leaseHeader carries the lease a request holds on the file it writes.
+const leaseHeader = "X-FDS-Lease"
+
+// fileLockPrefix prefixes the key of the lease held on a file name. The key
+// expires with the lease.
+const fileLockPrefix = "file_lock:"
+
+var (
+	// errFileLocked refuses writes to a file leased to someone else.
+	errFileLocked = errors.New("file is locked")
+	errNotLocked  = errors.New("file is not locked")
+)
+
+// lockScript grants the lease ARGV[1] on a name, or extends it, unless
+// another lease holds the name. It returns the lease holding the name and
+// its remaining time in milliseconds.
+var lockScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current and cjson.decode(current).lease_id ~= ARGV[1] then
+	return {current, redis.call('PTTL', KEYS[1])}
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return {ARGV[2], tonumber(ARGV[3])}
+`)
+
+// unlockScript drops the lease ARGV[1]: it returns 1 once dropped, 0 when the
+// name is not leased and -1 when another lease holds it.
+var unlockScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+if cjson.decode(current).lease_id ~= ARGV[1] then
+	return -1
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// FileLease is an exclusive, time-limited right to write a file name. The
+// name need not exist: a pipeline may lease its output before writing it.
+type FileLease struct {
+	File string `json:"file"`
+	// LeaseID is only shown to the holder, which sends it in X-FDS-Lease.
+	LeaseID   string    `json:"lease_id,omitempty"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type storedLease struct {
+	LeaseID string `json:"lease_id"`
+	Holder  string `json:"holder"`
+}
+
+func fileLockKey(fileName string) string {
+	return fileLockPrefix + fileName
+}
+
+func newLeaseID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func decodeLease(fileName string, value string, ttl time.Duration) (FileLease, error) {
+	var stored storedLease
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return FileLease{}, err
+	}
+	return FileLease{
+		File:      fileName,
+		LeaseID:   stored.LeaseID,
+		Holder:    stored.Holder,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}, nil
+}
+
+// LockFile grants the lease leaseID on a name for ttl, or extends it. When
+// another lease holds the name, that lease is returned with errFileLocked.
+func (r *RedisManager) LockFile(ctx context.Context, fileName string, leaseID string, holder string, ttl time.Duration) (FileLease, error) {
+	encoded, err := json.Marshal(storedLease{LeaseID: leaseID, Holder: holder})
+	if err != nil {
+		return FileLease{}, err
+	}
+	result, err := lockScript.Run(ctx, r.redisClient, []string{fileLockKey(fileName)}, leaseID, encoded, ttl.Milliseconds()).Slice()
+	if err != nil {
+		return FileLease{}, err
+	}
+	value, _ := result[0].(string)
+	remaining, _ := result[1].(int64)
+	lease, err := decodeLease(fileName, value, time.Duration(remaining)*time.Millisecond)
+	if err != nil {
+		return FileLease{}, err
+	}
+	if lease.LeaseID != leaseID {
+		return lease, errFileLocked
+	}
+	return lease, nil
+}
+
+// UnlockFile drops the lease leaseID on a name.
+func (r *RedisManager) UnlockFile(ctx context.Context, fileName string, leaseID string) error {
+	result, err := unlockScript.Run(ctx, r.redisClient, []string{fileLockKey(fileName)}, leaseID).Int()
+	if err != nil {
+		return err
+	}
+	switch result {
+	case 0:
+		return errNotLocked
+	case -1:
+		return errFileLocked
+	}
+	return nil
+}
+
+// GetFileLease returns the lease holding a name, errNotLocked if none does.
+func (r *RedisManager) GetFileLease(ctx context.Context, fileName string) (FileLease, error) {
+	pipe := r.redisClient.Pipeline()
+	value := pipe.Get(ctx, fileLockKey(fileName))
+	ttl := pipe.PTTL(ctx, fileLockKey(fileName))
+	if _, err := pipe.Exec(ctx); errors.Is(err, redis.Nil) {
+		return FileLease{}, errNotLocked
+	} else if err != nil {
+		return FileLease{}, err
+	}
+	return decodeLease(fileName, value.Val(), ttl.Val())
+}
+
+type leaseKey struct{}
+
+// withLease attaches the lease of X-FDS-Lease to the context of every
+// request, so that the writes it makes to the leased file go through.
+func withLease(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lease := r.Header.Get(leaseHeader); lease != "" {
+			r = r.WithContext(context.WithValue(r.Context(), leaseKey{}, lease))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func leaseFromContext(ctx context.Context) string {
+	lease, _ := ctx.Value(leaseKey{}).(string)
+	return lease
+}
+
+// checkLease refuses a write to fileName with errFileLocked when the name is
+// leased and ctx does not hold the lease.
+func (f *fileManager) checkLease(ctx context.Context, fileName string) error {
+	lease, err := f.redisManager.GetFileLease(ctx, fileName)
+	if errors.Is(err, errNotLocked) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the lease of the file: %w", err)
+	}
+	if lease.LeaseID == leaseFromContext(ctx) {
+		return nil
+	}
+	return fmt.Errorf("%w by %s until %s", errFileLocked, lease.Holder, lease.ExpiresAt.Format(time.RFC3339))
+}
+
+func respondFileLocked(w http.ResponseWriter, lease FileLease) {
+	respondWithErrorCode(w, http.StatusLocked, CodeFileLocked, "File is locked", map[string]any{
+		"file":       lease.File,
+		"holder":     lease.Holder,
+		"expires_at": lease.ExpiresAt,
+	})
+}
+
+// LockFile grants an exclusive lease on a file name for ?ttl= seconds
+// (FDS_LOCK_DEFAULT_TTL by default, at most FDS_LOCK_MAX_TTL). Sent with
+// the X-FDS-Lease of the lease, it extends it instead.
+func (f *fileManager) LockFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/lock").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	ttl := config.LockDefaultTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > config.LockMaxTTL {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("ttl must be between 1 and %d seconds", int(config.LockMaxTTL.Seconds())))
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	leaseID := leaseFromContext(r.Context())
+	renewing := leaseID != ""
+	if !renewing {
+		leaseID = newLeaseID()
+	}
+
+	lease, err := f.redisManager.LockFile(r.Context(), fileName, leaseID, callerFromContext(r.Context()).Identity, ttl)
+	if errors.Is(err, errFileLocked) {
+		respondFileLocked(w, lease)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to lock file", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to lock file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if renewing {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(lease)
+}
+
+// GetFileLock answers with the lease holding a file name, without its ID.
+func (f *fileManager) GetFileLock(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/lock").Inc()
+	fileName := mux.Vars(r)["name"]
+
+	lease, err := f.redisManager.GetFileLease(r.Context(), fileName)
+	if errors.Is(err, errNotLocked) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeNotFound, "File is not locked", map[string]any{"file": fileName})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read the lock")
+		return
+	}
+
+	lease.LeaseID = ""
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(lease)
+}
+
+// UnlockFile releases the lease sent in X-FDS-Lease before it expires.
+func (f *fileManager) UnlockFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/lock").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	leaseID := leaseFromContext(r.Context())
+	if leaseID == "" {
+		respondWithError(w, http.StatusBadRequest, leaseHeader+" is required")
+		return
+	}
+
+	err := f.redisManager.UnlockFile(r.Context(), fileName, leaseID)
+	switch {
+	case errors.Is(err, errNotLocked):
+		respondWithErrorCode(w, http.StatusNotFound, CodeNotFound, "File is not locked", map[string]any{"file": fileName})
+	case errors.Is(err, errFileLocked):
+		lease, _ := f.redisManager.GetFileLease(r.Context(), fileName)
+		lease.File, lease.LeaseID = fileName, ""
+		respondFileLocked(w, lease)
+	case err != nil:
+		logger.Error("Failed to unlock file", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to unlock file")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceKey holds the maintenance mode as JSON, so it survives a restart
+// of the central server.
+const maintenanceKey = "maintenance"
+
+// maintenanceHeader tells clients a 503 comes from maintenance mode rather
+// than from a failure of the cluster.
+const maintenanceHeader = "X-FDS-Maintenance"
+
+var errMaintenance = errors.New("the central server is in maintenance")
+
+// Maintenance is the maintenance mode of the central server. While enabled,
+// writes are answered 503, and reads too if Reads is set; the admin, metrics
+// and health endpoints and the requests of the nodes are still served.
+type Maintenance struct {
+	Enabled bool      `json:"enabled"`
+	Reads   bool      `json:"reads"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since,omitzero"`
+}
+
+type maintenanceMode struct {
+	mutex sync.Mutex
+	state Maintenance
+}
+
+var maintenance = &maintenanceMode{}
+
+func (m *maintenanceMode) Get() Maintenance {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.state
+}
+
+func (m *maintenanceMode) set(state Maintenance) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.state = state
+}
+
+// Check returns errMaintenance if a write, or a read when write is false,
+// must be refused.
+func (m *maintenanceMode) Check(write bool) error {
+	state := m.Get()
+	if state.Enabled && (write || state.Reads) {
+		return errMaintenance
+	}
+	return nil
+}
+
+// loadMaintenance restores the maintenance mode recorded in Redis.
+func loadMaintenance(redisClient *redis.Client) error {
+	encoded, err := redisClient.Get(context.Background(), maintenanceKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state Maintenance
+	if err := json.Unmarshal([]byte(encoded), &state); err != nil {
+		return err
+	}
+	maintenance.set(state)
+	if state.Enabled {
+		logger.Warn("Central server is in maintenance", zap.Bool("reads", state.Reads), zap.String("reason", state.Reason))
+	}
+	return nil
+}
+
+// maintenanceExempt lists the paths served during maintenance, besides the
+// admin endpoints.
+var maintenanceExempt = map[string]bool{
+	"/metrics":           true,
+	"/version":           true,
+	"/openapi.json":      true,
+	"/healthz":           true,
+	"/readyz":            true,
+	"/addNode":           true,
+	"/nodes/report":      true,
+	"/nodes/corruption":  true,
+	"/nodes/certificate": true,
+}
+
+// readPosts lists the POST endpoints that only read.
+var readPosts = map[string]bool{
+	"/fetch":           true,
+	"/downloadArchive": true,
+	"/files/batchGet":  true,
+}
+
+// isWrite reports whether a request may change the files.
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return false
+	case http.MethodPost:
+		return !readPosts[unversionedPath(r)]
+	}
+	return true
+}
+
+// withMaintenance answers 503 with Retry-After to the requests refused by the
+// maintenance mode.
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := unversionedPath(r)
+		if maintenanceExempt[path] || path == "/admin" || strings.HasPrefix(path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := maintenance.Check(isWrite(r)); err != nil {
+			respondMaintenance(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func respondMaintenance(w http.ResponseWriter) {
+	state := maintenance.Get()
+	message := "The central server is in maintenance, retry later"
+	if state.Reason != "" {
+		message += ": " + state.Reason
+	}
+	mode := "writes"
+	if state.Reads {
+		mode = "all"
+	}
+	w.Header().Set(maintenanceHeader, mode)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(config.MaintenanceRetryAfter.Seconds()))))
+	respondWithErrorCode(w, http.StatusServiceUnavailable, CodeMaintenance, message, map[string]any{"mode": mode})
+}
+
+// GetMaintenance returns the maintenance mode.
+func (c *clients) GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(maintenance.Get())
+}
+
+// MaintenanceRequest turns the maintenance mode on.
+type MaintenanceRequest struct {
+	Reads  bool   `json:"reads"`
+	Reason string `json:"reason"`
+}
+
+// EnableMaintenance turns the maintenance mode on, for writes only unless the
+// body asks for reads too.
+func (c *clients) EnableMaintenance(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+	var req MaintenanceRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	state := Maintenance{Enabled: true, Reads: req.Reads, Reason: req.Reason, Since: time.Now().UTC()}
+	if !c.saveMaintenance(w, r, state) {
+		return
+	}
+	requestLogger(r.Context()).Warn("Maintenance mode enabled", zap.Bool("reads", state.Reads), zap.String("reason", state.Reason))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(state)
+}
+
+// DisableMaintenance turns the maintenance mode off.
+func (c *clients) DisableMaintenance(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+	if !c.saveMaintenance(w, r, Maintenance{}) {
+		return
+	}
+	requestLogger(r.Context()).Info("Maintenance mode disabled")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *clients) saveMaintenance(w http.ResponseWriter, r *http.Request, state Maintenance) bool {
+	encoded, err := json.Marshal(state)
+	if err == nil {
+		err = c.redisClient.Set(r.Context(), maintenanceKey, encoded, 0).Err()
+	}
+	recordAudit(r.Context(), AuditMaintenance, strconv.FormatBool(state.Enabled), err)
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to record the maintenance mode", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to record the maintenance mode")
+		return false
+	}
+	maintenance.set(state)
+	return true
+}
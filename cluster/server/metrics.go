@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"net"
+	"strconv"
+	"time"
+)
+
+// sizeBuckets go from 1KB to 1GB.
+var sizeBuckets = prometheus.ExponentialBuckets(1024, 4, 11)
+
+var httpRequestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP and gRPC requests",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"method", "route", "code"},
+)
+
+var fileTransferSize = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "file_transfer_size_bytes",
+		Help:    "Size of uploaded and downloaded files",
+		Buckets: sizeBuckets,
+	},
+	[]string{"operation"},
+)
+
+var blockTransmitDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "block_transmit_duration_seconds",
+		Help:    "Time to stream one block to a node",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	},
+	[]string{"result"},
+)
+
+var redisOperationDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "redis_operation_duration_seconds",
+		Help:    "Latency of Redis commands",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+	},
+	[]string{"operation", "result"},
+)
+
+func observeRequest(method, route string, code int, duration time.Duration) {
+	httpRequestDuration.WithLabelValues(method, route, strconv.Itoa(code)).Observe(duration.Seconds())
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// redisMetricsHook times every Redis command. A missing key is not an error.
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(cmd.Name(), err, time.Since(start))
+		return err
+	}
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeRedis("pipeline", err, time.Since(start))
+		return err
+	}
+}
+
+func observeRedis(operation string, err error, duration time.Duration) {
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	redisOperationDuration.WithLabelValues(operation, resultLabel(err)).Observe(duration.Seconds())
+}
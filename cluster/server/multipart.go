@@ -0,0 +1,596 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	multipartPrefix     = ".mpu-"
+	multipartUploadsKey = "multipart_uploads"
+	// maxMultipartParts is the highest part number, as in S3.
+	maxMultipartParts = 10000
+	// multipartSweepInterval is how often expired multipart uploads are
+	// looked for.
+	multipartSweepInterval = 10 * time.Minute
+)
+
+// Fields of the hash of a multipart upload, besides a part:<n> field per
+// part.
+const (
+	multipartUploadField     = "upload"
+	multipartCompletingField = "completing"
+	multipartPartFieldPrefix = "part:"
+)
+
+var errMultipartNotFound = errors.New("multipart upload not found")
+
+// errMultipartCompleting refuses changes to an upload being completed.
+var errMultipartCompleting = errors.New("multipart upload is being completed")
+
+// multipartKey holds the state of a multipart upload.
+func multipartKey(id string) string { return "multipart:" + id }
+
+// multipartPartName is the name the blocks of a part are stored under until
+// the upload is completed. Each attempt at a part gets its own, so a part
+// sent again never overwrites the blocks of the previous attempt before it
+// replaces it.
+func multipartPartName(id string, part int, attempt string) string {
+	return multipartPrefix + id + "-" + strconv.Itoa(part) + "-" + attempt
+}
+
+func isMultipartPartName(name string) bool { return strings.HasPrefix(name, multipartPrefix) }
+
+// MultipartUpload is a file uploaded in parts, which clients send in
+// parallel and in any order before completing the upload.
+type MultipartUpload struct {
+	ID          string    `json:"upload_id"`
+	File        string    `json:"file"`
+	BlockSize   int       `json:"block_size"`
+	ContentType string    `json:"content_type,omitempty"`
+	InitiatedAt time.Time `json:"initiated_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// Parts are listed by GET /files/{name}/uploads/{id}.
+	Parts []UploadedPart `json:"parts,omitempty"`
+}
+
+// UploadedPart is a part received for a multipart upload. Its ETag is the
+// SHA-256 of its content.
+type UploadedPart struct {
+	Number     int       `json:"part"`
+	Size       int64     `json:"size"`
+	ETag       string    `json:"etag"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// storedPart is a part as recorded: the blocks it was stored under, and
+// their extents within the part.
+type storedPart struct {
+	UploadedPart
+	Name    string        `json:"name"`
+	Extents []BlockExtent `json:"extents"`
+}
+
+// CompleteMultipartRequest lists the parts making up the file, in order,
+// with the ETag each was answered with. Without parts, every part received
+// makes up the file in the order of their numbers.
+type CompleteMultipartRequest struct {
+	Parts []CompletedPart `json:"parts,omitempty"`
+}
+
+type CompletedPart struct {
+	Number int    `json:"part"`
+	ETag   string `json:"etag"`
+}
+
+// loadMultipart returns the multipart upload id of fileName with its parts,
+// in the order of their numbers.
+func (f *fileManager) loadMultipart(ctx context.Context, fileName string, id string) (MultipartUpload, []storedPart, error) {
+	fields, err := f.redisManager.redisClient.HGetAll(ctx, multipartKey(id)).Result()
+	if err != nil {
+		return MultipartUpload{}, nil, err
+	}
+	encoded, ok := fields[multipartUploadField]
+	if !ok {
+		return MultipartUpload{}, nil, errMultipartNotFound
+	}
+	var upload MultipartUpload
+	if err := json.Unmarshal([]byte(encoded), &upload); err != nil {
+		return MultipartUpload{}, nil, err
+	}
+	if upload.File != fileName {
+		return MultipartUpload{}, nil, errMultipartNotFound
+	}
+	if _, completing := fields[multipartCompletingField]; completing {
+		return upload, nil, errMultipartCompleting
+	}
+
+	var parts []storedPart
+	for field, value := range fields {
+		if !strings.HasPrefix(field, multipartPartFieldPrefix) {
+			continue
+		}
+		var part storedPart
+		if err := json.Unmarshal([]byte(value), &part); err != nil {
+			return MultipartUpload{}, nil, err
+		}
+		parts = append(parts, part)
+	}
+	slices.SortFunc(parts, func(a, b storedPart) int { return a.Number - b.Number })
+	return upload, parts, nil
+}
+
+// dropMultipart removes a multipart upload and the blocks of its parts.
+func (f *fileManager) dropMultipart(ctx context.Context, id string) error {
+	fields, err := f.redisManager.redisClient.HGetAll(ctx, multipartKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	for field, value := range fields {
+		if !strings.HasPrefix(field, multipartPartFieldPrefix) {
+			continue
+		}
+		var part storedPart
+		if err := json.Unmarshal([]byte(value), &part); err != nil {
+			return err
+		}
+		if err := f.removeBlocks(ctx, part.Name); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
+	}
+
+	pipe := f.redisManager.redisClient.TxPipeline()
+	pipe.Del(ctx, multipartKey(id))
+	pipe.SRem(ctx, multipartUploadsKey, id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// respondMultipartError answers the errors of loadMultipart.
+func respondMultipartError(w http.ResponseWriter, id string, err error) {
+	switch {
+	case errors.Is(err, errMultipartNotFound):
+		respondWithErrorCode(w, http.StatusNotFound, CodeUploadNotFound, "Multipart upload not found", map[string]any{"upload_id": id})
+	case errors.Is(err, errMultipartCompleting):
+		respondWithErrorCode(w, http.StatusConflict, CodeConflict, "Multipart upload is being completed", map[string]any{"upload_id": id})
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Failed to read the multipart upload")
+	}
+}
+
+// InitiateMultipartUpload starts the upload of a file in parts. The parts
+// are stored in blocks of the same size, from the blockSize query parameter,
+// the size parameter (the expected size of the file) or FDS_BLOCK_SIZE. The
+// Content-Type of the request is the declared type of the file.
+func (f *fileManager) InitiateMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/uploads").Inc()
+	fileName := mux.Vars(r)["name"]
+
+	if err := checkReservedName(fileName); err != nil {
+		respondUploadError(w, fileName, err.Error(), err)
+		return
+	}
+	// Hooks look at whole files, which are never in one place here.
+	if refuseWhileHooked(w, "Multipart uploads") {
+		return
+	}
+
+	blockSize, err := blockSizeFromQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if blockSize == 0 {
+		blockSize = config.BlockSize
+		if value := r.URL.Query().Get("size"); value != "" {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				respondWithError(w, http.StatusBadRequest, "size must be a number of bytes")
+				return
+			}
+			if uploadTooLarge(size) {
+				respondUploadTooLarge(w)
+				return
+			}
+			blockSize = chooseBlockSize(int(size))
+		}
+	}
+
+	now := time.Now().UTC()
+	upload := MultipartUpload{
+		ID:          newJobID(),
+		File:        fileName,
+		BlockSize:   blockSize,
+		ContentType: r.Header.Get("Content-Type"),
+		InitiatedAt: now,
+		ExpiresAt:   now.Add(config.MultipartUploadTTL),
+	}
+	encoded, err := json.Marshal(upload)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start the multipart upload")
+		return
+	}
+	pipe := f.redisManager.redisClient.TxPipeline()
+	pipe.HSet(r.Context(), multipartKey(upload.ID), multipartUploadField, encoded)
+	pipe.SAdd(r.Context(), multipartUploadsKey, upload.ID)
+	if _, err := pipe.Exec(r.Context()); err != nil {
+		requestLogger(r.Context()).Error("Failed to record the multipart upload", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to start the multipart upload")
+		return
+	}
+	requestLogger(r.Context()).Info("Multipart upload started",
+		zap.String("fileName", fileName),
+		zap.String("uploadId", upload.ID),
+		zap.Int("blockSize", blockSize),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/files/"+url.PathEscape(fileName)+"/uploads/"+upload.ID))
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(upload)
+}
+
+// UploadPart stores the raw request body as a part of a multipart upload.
+// The part is compressed and sent to the nodes right away, so parts sent
+// over several connections are stored in parallel. A part sent again
+// replaces the previous one.
+func (f *fileManager) UploadPart(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/uploads/{id}/parts/{part}").Inc()
+	logger := requestLogger(r.Context())
+	vars := mux.Vars(r)
+	fileName, id := vars["name"], vars["id"]
+
+	number, err := strconv.Atoi(vars["part"])
+	if err != nil || number < 1 || number > maxMultipartParts {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("part must be a number between 1 and %d", maxMultipartParts))
+		return
+	}
+
+	if !limitUploadBody(w, r, 0) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.Release()
+
+	upload, parts, err := f.loadMultipart(r.Context(), fileName, id)
+	if err != nil {
+		respondMultipartError(w, id, err)
+		return
+	}
+
+	buf, err := readPooled(r.Body, r.ContentLength)
+	if isBodyTooLarge(err) {
+		respondUploadTooLarge(w)
+		return
+	}
+	if errors.Is(err, errUploadsSaturated) {
+		respondUploadsSaturated(w)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read uploaded part", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read part content")
+		return
+	}
+	defer putBuffer(buf)
+	body := buf.Bytes()
+
+	// The first part is the start of the file, which its type is told by.
+	if number == 1 {
+		if err := checkContentType(upload.ContentType, body); err != nil {
+			uploadsRefusedByType.Inc()
+			respondUploadError(w, fileName, err.Error(), err)
+			return
+		}
+	}
+	size := int64(len(body))
+	for _, part := range parts {
+		if part.Number != number {
+			size += part.Size
+		}
+	}
+	if uploadTooLarge(size) {
+		respondUploadTooLarge(w)
+		return
+	}
+
+	timer := newPhaseTimer()
+	part := storedPart{
+		UploadedPart: UploadedPart{Number: number, Size: int64(len(body)), UploadedAt: time.Now().UTC()},
+		Name:         multipartPartName(id, number, newJobID()[:8]),
+	}
+	sum := sha256.Sum256(body)
+	part.ETag = hex.EncodeToString(sum[:])
+
+	part.Extents, _, err = f.storeBlocks(r.Context(), timer, part.Name, body, upload.BlockSize, noopUploadObserver{})
+	if err != nil {
+		timer.report(logger, "upload", config.SlowUploadThreshold, len(body), err, zap.String("fileName", fileName), zap.Int("part", number))
+		respondUploadError(w, fileName, "Failed to store part", err)
+		return
+	}
+	// The part is kept by the multipart upload, not by its upload log.
+	if err := f.endUpload(r.Context(), part.Name); err != nil {
+		logger.Warn("Failed to drop the upload log", zap.Error(err))
+	}
+
+	encoded, err := json.Marshal(part)
+	if err == nil {
+		err = f.redisManager.redisClient.HSet(r.Context(), multipartKey(id), multipartPartFieldPrefix+strconv.Itoa(number), encoded).Err()
+	}
+	timer.Phase("index")
+	timer.report(logger, "upload", config.SlowUploadThreshold, len(body), err, zap.String("fileName", fileName), zap.Int("part", number))
+	if err != nil {
+		logger.Error("Failed to record part", zap.String("fileName", fileName), zap.Int("part", number), zap.Error(err))
+		_ = f.removeBlocks(context.WithoutCancel(r.Context()), part.Name)
+		respondWithError(w, http.StatusInternalServerError, "Failed to record part")
+		return
+	}
+	fileTransferSize.WithLabelValues("upload").Observe(float64(len(body)))
+
+	for _, previous := range parts {
+		if previous.Number == number {
+			if err := f.removeBlocks(r.Context(), previous.Name); err != nil {
+				logger.Warn("Failed to remove the replaced part", zap.String("fileName", fileName), zap.Int("part", number), zap.Error(err))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", strconv.Quote(part.ETag))
+	_ = json.NewEncoder(w).Encode(part.UploadedPart)
+}
+
+// GetMultipartUpload answers with a multipart upload and the parts received
+// so far.
+func (f *fileManager) GetMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/uploads/{id}").Inc()
+	vars := mux.Vars(r)
+
+	upload, parts, err := f.loadMultipart(r.Context(), vars["name"], vars["id"])
+	if err != nil {
+		respondMultipartError(w, vars["id"], err)
+		return
+	}
+	for _, part := range parts {
+		upload.Parts = append(upload.Parts, part.UploadedPart)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(upload)
+}
+
+// AbortMultipartUpload drops a multipart upload and the parts received.
+func (f *fileManager) AbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/uploads/{id}").Inc()
+	vars := mux.Vars(r)
+
+	if _, _, err := f.loadMultipart(r.Context(), vars["name"], vars["id"]); err != nil {
+		respondMultipartError(w, vars["id"], err)
+		return
+	}
+	if err := f.dropMultipart(r.Context(), vars["id"]); err != nil {
+		requestLogger(r.Context()).Error("Failed to abort the multipart upload", zap.String("uploadId", vars["id"]), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to abort the multipart upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CompleteMultipartUpload assembles the file from its parts. Their blocks
+// are duplicated into place by the nodes holding them, as copies are, so no
+// part goes through the central server again.
+func (f *fileManager) CompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/uploads/{id}/complete").Inc()
+	logger := requestLogger(r.Context())
+	vars := mux.Vars(r)
+	fileName, id := vars["name"], vars["id"]
+
+	var req CompleteMultipartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Invalid complete request: "+err.Error())
+		return
+	}
+
+	upload, parts, err := f.loadMultipart(r.Context(), fileName, id)
+	if err != nil {
+		respondMultipartError(w, id, err)
+		return
+	}
+	selected, err := selectParts(parts, req.Parts)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Parts sent, and completions, from now on are refused.
+	completing, err := f.redisManager.redisClient.HSetNX(r.Context(), multipartKey(id), multipartCompletingField, 1).Result()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to complete the multipart upload")
+		return
+	}
+	if !completing {
+		respondMultipartError(w, id, errMultipartCompleting)
+		return
+	}
+
+	metadata, err := f.completeMultipart(r.Context(), upload, selected)
+	recordAudit(r.Context(), AuditFileUpload, fileName, err)
+	if err != nil {
+		logger.Error("Failed to complete the multipart upload", zap.String("fileName", fileName), zap.String("uploadId", id), zap.Error(err))
+		// The parts are still there for another attempt.
+		_ = f.redisManager.redisClient.HDel(context.WithoutCancel(r.Context()), multipartKey(id), multipartCompletingField).Err()
+		respondUploadError(w, fileName, "Failed to complete the multipart upload", err)
+		return
+	}
+	if err := f.dropMultipart(context.WithoutCancel(r.Context()), id); err != nil {
+		logger.Warn("Failed to drop the completed multipart upload, left for expiry", zap.String("uploadId", id), zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(metadata.Version))
+	w.Header().Set("Location", apiPath(r, "/files/"+url.PathEscape(fileName)))
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(metadata)
+}
+
+// selectParts returns the parts listed by a complete request, checked
+// against those received, or all of them if it lists none.
+func selectParts(parts []storedPart, listed []CompletedPart) ([]storedPart, error) {
+	if len(listed) == 0 {
+		if len(parts) == 0 {
+			return nil, errors.New("no part was uploaded")
+		}
+		return parts, nil
+	}
+
+	byNumber := make(map[int]storedPart, len(parts))
+	for _, part := range parts {
+		byNumber[part.Number] = part
+	}
+	selected := make([]storedPart, 0, len(listed))
+	for i, completed := range listed {
+		if i > 0 && completed.Number <= listed[i-1].Number {
+			return nil, errors.New("parts must be listed in ascending order")
+		}
+		part, ok := byNumber[completed.Number]
+		if !ok {
+			return nil, fmt.Errorf("part %d was not uploaded", completed.Number)
+		}
+		if etag := strings.Trim(completed.ETag, `"`); etag != "" && etag != part.ETag {
+			return nil, fmt.Errorf("part %d does not match its ETag", completed.Number)
+		}
+		selected = append(selected, part)
+	}
+	return selected, nil
+}
+
+// completeMultipart duplicates the blocks of the parts under the file, one
+// after the other, and records the file.
+func (f *fileManager) completeMultipart(ctx context.Context, upload MultipartUpload, parts []storedPart) (FileMetadata, error) {
+	if err := f.checkWrite(ctx, upload.File); err != nil {
+		return FileMetadata{}, err
+	}
+	timer := newPhaseTimer()
+	previous, previousErr := f.redisManager.GetFileMetadata(upload.File)
+
+	var extents []BlockExtent
+	var size int64
+	for _, part := range parts {
+		for i, extent := range part.Extents {
+			position := len(extents) + 1
+			if err := f.copyBlock(ctx, part.Name+"-block-"+strconv.Itoa(i+1), upload.File+"-block-"+strconv.Itoa(position)); err != nil {
+				return FileMetadata{}, fmt.Errorf("failed to copy block %d of part %d: %w", i+1, part.Number, err)
+			}
+			extents = append(extents, BlockExtent{Offset: size + extent.Offset, Length: extent.Length})
+		}
+		size += part.Size
+	}
+	timer.Phase("copy")
+
+	if err := f.redisManager.SendBlockHashWithNumberOfBlocks(GenerateFileHash(upload.File), len(extents)); err != nil {
+		return FileMetadata{}, fmt.Errorf("failed to store the number of blocks: %w", err)
+	}
+	metadata := FileMetadata{
+		Name:      upload.File,
+		Size:      size,
+		Blocks:    len(extents),
+		BlockSize: upload.BlockSize,
+		Extents:   extents,
+		CreatedAt: time.Now().UTC(),
+		Owner:     fileOwner(ctx),
+	}
+	version, err := f.redisManager.SaveFileMetadataIf(metadata, ifMatchFromContext(ctx))
+	if err != nil {
+		return FileMetadata{}, fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	metadata.Version = version
+	timer.Phase("index")
+
+	// A previous version packed into a container is dead space there now,
+	// as are the blocks of one that patches and appends stored again.
+	if previousErr == nil && previous.Packed != nil {
+		f.packer.Release(ctx, upload.File, *previous.Packed)
+	}
+	if previousErr == nil {
+		f.removeRewrittenBlocks(ctx, previous)
+	}
+	// The nodes duplicated the blocks where the parts are.
+	f.followPin(ctx, upload.File)
+
+	logger := requestLogger(ctx)
+	timer.report(logger, "upload", config.SlowUploadThreshold, 0, nil, zap.String("fileName", upload.File))
+	logger.Info("Multipart upload completed",
+		zap.String("fileName", upload.File),
+		zap.String("uploadId", upload.ID),
+		zap.Int("parts", len(parts)),
+		zap.Int("numOfBlocks", len(extents)),
+	)
+	return metadata, nil
+}
+
+// RunMultipartExpiry drops the multipart uploads left unfinished past
+// FDS_MULTIPART_UPLOAD_TTL, with their parts.
+func (f *fileManager) RunMultipartExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Dropping parts deletes blocks, which maintenance holds off.
+		if maintenance.Check(true) != nil {
+			continue
+		}
+		if _, err := f.ExpireMultipartUploads(ctx); err != nil {
+			logger.Error("Multipart upload expiry failed", zap.Error(err))
+		}
+	}
+}
+
+// ExpireMultipartUploads drops the multipart uploads past their expiry and
+// returns how many it dropped.
+func (f *fileManager) ExpireMultipartUploads(ctx context.Context) (int, error) {
+	ids, err := f.redisManager.redisClient.SMembers(ctx, multipartUploadsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	expired := 0
+	for _, id := range ids {
+		encoded, err := f.redisManager.redisClient.HGet(ctx, multipartKey(id), multipartUploadField).Result()
+		var upload MultipartUpload
+		if err == nil {
+			err = json.Unmarshal([]byte(encoded), &upload)
+		}
+		if err == nil && now.Before(upload.ExpiresAt) {
+			continue
+		}
+		if err := f.dropMultipart(ctx, id); err != nil {
+			logger.Warn("Failed to drop an expired multipart upload", zap.String("uploadId", id), zap.Error(err))
+			continue
+		}
+		logger.Info("Expired multipart upload dropped", zap.String("uploadId", id), zap.String("fileName", upload.File))
+		expired++
+	}
+	return expired, nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// nodeTokenHeader carries the cluster token to a node in the answer to its
+// registration. The node then requires it on its data endpoints.
+const nodeTokenHeader = "X-FDS-Node-Token"
+
+// nodeTokenKey holds the cluster token generated when FDS_NODE_TOKEN is not
+// set, shared by all central servers using the same Redis.
+const nodeTokenKey = "node_token"
+
+// nodeAuthCluster is the authentication capability of nodes accepting the
+// cluster token.
+const nodeAuthCluster = "cluster-token"
+
+// nodeToken authenticates the central server to the nodes; empty unless
+// NodeAuth is on.
+var nodeToken string
+
+// loadNodeToken sets nodeToken from the configuration, or from Redis where
+// the first central server to start stores a random one.
+func loadNodeToken(redisClient *redis.Client) error {
+	if !config.NodeAuth {
+		return nil
+	}
+	if config.NodeToken != "" {
+		nodeToken = config.NodeToken
+		return nil
+	}
+
+	token := make([]byte, 32)
+	_, _ = rand.Read(token)
+	ctx := context.Background()
+	if err := redisClient.SetNX(ctx, nodeTokenKey, hex.EncodeToString(token), 0).Err(); err != nil {
+		return err
+	}
+	stored, err := redisClient.Get(ctx, nodeTokenKey).Result()
+	if err != nil {
+		return err
+	}
+	nodeToken = stored
+	return nil
+}
+
+// issueNodeToken hands the cluster token to a registering node that can use
+// it.
+func issueNodeToken(w http.ResponseWriter, capabilities *NodeCapabilities) {
+	if nodeToken != "" && capabilities != nil && slices.Contains(capabilities.Auth, nodeAuthCluster) {
+		w.Header().Set(nodeTokenHeader, nodeToken)
+	}
+}
+
+// validJoinSecret checks the FDS_NODE_JOIN_SECRET nodes must present to
+// register and report, when one is set.
+func validJoinSecret(r *http.Request) bool {
+	if config.NodeJoinSecret == "" {
+		return true
+	}
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(secret), []byte(config.NodeJoinSecret)) == 1
+}
+
+// nodeAuthTransport authenticates the requests to the nodes with the cluster
+// token.
+type nodeAuthTransport struct {
+	base http.RoundTripper
+}
+
+func (t nodeAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if nodeToken != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+nodeToken)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"FDS/version"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+)
+
+var errIncompatibleNode = errors.New("node is incompatible with this central server")
+
+// NodeCapabilities is what a node declared about itself when it registered.
+type NodeCapabilities struct {
+	Version       string   `json:"version,omitempty"`
+	APIVersion    int      `json:"api_version,omitempty"`
+	MinAPIVersion int      `json:"min_api_version,omitempty"`
+	Features      []string `json:"features,omitempty"`
+	// MaxBlockSize is the largest block the node accepts; 0 for any size.
+	MaxBlockSize int64    `json:"max_block_size,omitempty"`
+	Codecs       []string `json:"codecs,omitempty"`
+	Auth         []string `json:"auth,omitempty"`
+	// Capacity is the space the node offers for blocks; 0 if it declared
+	// none.
+	Capacity int64 `json:"capacity,omitempty"`
+}
+
+// checkNodeCompatibility refuses nodes whose protocol this build cannot
+// speak, and lists what works differently with the others. Nodes predating
+// the handshake declare nothing, and are trusted to behave as they always
+// did.
+func checkNodeCompatibility(node NodeRegistrationRequest) (*NodeCapabilities, []string, error) {
+	if node.Version == nil {
+		return nil, nil, nil
+	}
+
+	capabilities := &NodeCapabilities{
+		Version:       node.Version.Version,
+		APIVersion:    node.Version.APIVersion,
+		MinAPIVersion: node.Version.MinAPIVersion,
+		Features:      node.Version.Features,
+		MaxBlockSize:  node.MaxBlockSize,
+		Capacity:      node.Capacity,
+		Codecs:        node.Codecs,
+		Auth:          node.Auth,
+	}
+	if capabilities.APIVersion < version.MinAPIVersion || capabilities.MinAPIVersion > version.APIVersion {
+		return capabilities, nil, fmt.Errorf("%w: the node speaks API %d and accepts %d and later, the central server speaks API %d and accepts %d and later",
+			errIncompatibleNode, capabilities.APIVersion, capabilities.MinAPIVersion, version.APIVersion, version.MinAPIVersion)
+	}
+
+	var degraded []string
+	if capabilities.MaxBlockSize > 0 && capabilities.MaxBlockSize < int64(max(config.BlockSize, config.MaxBlockSize)) {
+		degraded = append(degraded, fmt.Sprintf("blocks over %d bytes are placed on other nodes", capabilities.MaxBlockSize))
+	}
+	if config.NodeAuth && !slices.Contains(capabilities.Auth, nodeAuthCluster) {
+		degraded = append(degraded, "the data endpoints of the node are not authenticated")
+	}
+	if !slices.Contains(capabilities.Codecs, "gzip") {
+		degraded = append(degraded, "downloads are not redirected to the node")
+	}
+	return capabilities, degraded, nil
+}
+
+// recordCapabilities keeps what a node declared for placement and downloads,
+// and shows it in the registry.
+func (n *nodeManager) recordCapabilities(address string, capabilities *NodeCapabilities, degraded []string) error {
+	n.mutex.Lock()
+	if n.capabilities == nil {
+		n.capabilities = make(map[string]*NodeCapabilities)
+	}
+	n.capabilities[address] = capabilities
+	capacity := n.capacityOf(address)
+	n.mutex.Unlock()
+
+	status, err := n.registry.GetNodeStatus(address)
+	if err != nil {
+		return err
+	}
+	status.Capabilities = capabilities
+	status.setUsage(int64(status.Usage), capacity)
+	status.Degraded = degraded
+	return n.registry.SaveNodeStatus(status)
+}
+
+// acceptsBlock reports whether a node takes blocks of size bytes: it is not
+// draining and the blocks are within its limit. The caller holds n.mutex.
+func (n *nodeManager) acceptsBlock(address string, size int) bool {
+	if n.draining[address] {
+		return false
+	}
+	capabilities := n.capabilities[address]
+	return capabilities == nil || capabilities.MaxBlockSize == 0 || int64(size) <= capabilities.MaxBlockSize
+}
+
+// capacityOf returns the space a node offers for blocks: the capacity it
+// declared when it registered, or FDS_NODE_DEFAULT_CAPACITY for nodes that
+// declared none. The caller holds n.mutex.
+func (n *nodeManager) capacityOf(address string) int64 {
+	if capabilities := n.capabilities[address]; capabilities != nil && capabilities.Capacity > 0 {
+		return capabilities.Capacity
+	}
+	return int64(config.NodeDefaultCapacity)
+}
+
+// capacity is capacityOf for callers that do not hold n.mutex.
+func (n *nodeManager) capacity(address string) int64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.capacityOf(address)
+}
+
+// hasRoom reports whether a node has size bytes left for another block. The
+// caller holds n.mutex.
+func (n *nodeManager) hasRoom(node Node, size int) bool {
+	return int64(node.usage+size) <= n.capacityOf(node.address)
+}
+
+// freeShare returns the fraction of its capacity a node has left, between 0
+// and 1. The caller holds n.mutex.
+func (n *nodeManager) freeShare(node Node) float64 {
+	capacity := n.capacityOf(node.address)
+	return float64(max(0, capacity-int64(node.usage))) / float64(capacity)
+}
+
+// shuffleByFreeShare orders the nodes placement picks from at random, each
+// node coming first with a chance proportional to the fraction of its
+// capacity it has left: a small node that is nearly full is passed over for a
+// large one that has used more bytes but has room to spare, and blocks are
+// spread over nodes with similar headroom rather than all sent to the
+// emptiest. With FDS_LATENCY_AWARE_ROUTING, the chance is also scaled by how
+// much slower than the fastest node a node has been. Full nodes come last.
+// The caller holds n.mutex.
+func (n *nodeManager) shuffleByFreeShare() {
+	latencies := map[string]float64{}
+	if config.LatencyAwareRouting {
+		latencies = nodeHealthMetrics.Latencies()
+	}
+	fastest := math.Inf(1)
+	for _, node := range n.NodeStats {
+		if latency, ok := latencies[node.address]; ok {
+			fastest = min(fastest, latency)
+		}
+	}
+
+	// Weighted sampling without replacement: sorting by u^(1/weight), with u
+	// uniform in [0, 1), draws each node in proportion to its weight.
+	keys := make(map[string]float64, len(n.NodeStats))
+	for _, node := range n.NodeStats {
+		weight := n.freeShare(node)
+		// Nodes not measured yet are taken to be as fast as the fastest.
+		if latency, ok := latencies[node.address]; ok {
+			weight *= fastest / latency
+		}
+		if weight > 0 {
+			keys[node.address] = math.Pow(rand.Float64(), 1/weight)
+		} else {
+			keys[node.address] = -1
+		}
+	}
+	sort.SliceStable(n.NodeStats, func(i, j int) bool {
+		return keys[n.NodeStats[i].address] > keys[n.NodeStats[j].address]
+	})
+}
+
+// servesCodec reports whether a node can serve blocks with the given
+// encoding.
+func (n *nodeManager) servesCodec(address string, codec string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	capabilities := n.capabilities[address]
+	return capabilities == nil || slices.Contains(capabilities.Codecs, codec)
+}
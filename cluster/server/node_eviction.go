@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"slices"
+	"sync"
+	"time"
+)
+
+// NodeEvicted is the registry status of a node taken out of placement after
+// failing, until its health checks pass again for FDS_NODE_READMIT_AFTER.
+const NodeEvicted = "EVICTED"
+
+var (
+	nodeEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "node_evictions_total",
+			Help: "Nodes taken out of placement, by what failed: heartbeat or transmit",
+		},
+		[]string{"reason"},
+	)
+	nodeReadmissions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "node_readmissions_total",
+			Help: "Evicted nodes placed on again after passing their health checks",
+		},
+	)
+)
+
+// nodeAdmission is what the central server remembers of the failures of a
+// node.
+type nodeAdmission struct {
+	failures     int
+	healthySince time.Time
+	evicted      bool
+	// flaps counts the evictions that came within FDS_NODE_FLAP_WINDOW of
+	// the previous readmission; each one doubles the quarantine.
+	flaps            int
+	quarantinedUntil time.Time
+	admittedAt       time.Time
+}
+
+// nodeAdmissions evicts nodes whose heartbeats keep failing, and readmits
+// them once their heartbeats have passed for readmitAfter. A node evicted
+// again soon after being readmitted is flapping: it is quarantined, and not
+// readmitted before the quarantine is over, however healthy it looks.
+type nodeAdmissions struct {
+	mutex         sync.Mutex
+	nodes         map[string]*nodeAdmission
+	evictAfter    int
+	readmitAfter  time.Duration
+	flapWindow    time.Duration
+	quarantine    time.Duration
+	quarantineMax time.Duration
+}
+
+var admissions = &nodeAdmissions{nodes: make(map[string]*nodeAdmission)}
+
+func (a *nodeAdmissions) configure(evictAfter int, readmitAfter time.Duration, flapWindow time.Duration, quarantine time.Duration, quarantineMax time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.evictAfter = evictAfter
+	a.readmitAfter = readmitAfter
+	a.flapWindow = flapWindow
+	a.quarantine = quarantine
+	a.quarantineMax = quarantineMax
+}
+
+func (a *nodeAdmissions) nodeLocked(address string) *nodeAdmission {
+	node, ok := a.nodes[address]
+	if !ok {
+		node = &nodeAdmission{}
+		a.nodes[address] = node
+	}
+	return node
+}
+
+// Failed records a failed heartbeat, and reports whether the node must be
+// evicted.
+func (a *nodeAdmissions) Failed(address string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	node := a.nodeLocked(address)
+	node.failures++
+	node.healthySince = time.Time{}
+	return !node.evicted && a.evictAfter > 0 && node.failures >= a.evictAfter
+}
+
+// Succeeded records a passing heartbeat, and reports whether the node, if
+// evicted, must now be readmitted.
+func (a *nodeAdmissions) Succeeded(address string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	node := a.nodeLocked(address)
+	now := time.Now()
+	node.failures = 0
+	if node.healthySince.IsZero() {
+		node.healthySince = now
+	}
+	if !node.evicted || now.Before(node.quarantinedUntil) {
+		return false
+	}
+	// Heartbeats passed during the quarantine do not count.
+	if now.Sub(later(node.healthySince, node.quarantinedUntil)) < a.readmitAfter {
+		return false
+	}
+	a.admitLocked(node, now)
+	return true
+}
+
+// Evict records that the node was taken out of placement, and returns the
+// end of its quarantine, zero if it is not flapping.
+func (a *nodeAdmissions) Evict(address string) time.Time {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	node := a.nodeLocked(address)
+	now := time.Now()
+	node.evicted = true
+	node.healthySince = time.Time{}
+	if node.admittedAt.IsZero() || now.Sub(node.admittedAt) > a.flapWindow {
+		node.flaps = 0
+		return time.Time{}
+	}
+
+	node.flaps++
+	quarantine := a.quarantine
+	for i := 1; i < node.flaps && quarantine < a.quarantineMax; i++ {
+		quarantine *= 2
+	}
+	node.quarantinedUntil = now.Add(min(quarantine, a.quarantineMax))
+	return node.quarantinedUntil
+}
+
+func (a *nodeAdmissions) admitLocked(node *nodeAdmission, now time.Time) {
+	node.evicted = false
+	node.failures = 0
+	node.quarantinedUntil = time.Time{}
+	node.admittedAt = now
+}
+
+// Evicted reports whether the node is evicted, and returns the end of its
+// quarantine, zero if it is not quarantined.
+func (a *nodeAdmissions) Evicted(address string) (time.Time, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	node, ok := a.nodes[address]
+	if !ok || !node.evicted {
+		return time.Time{}, false
+	}
+	if !time.Now().Before(node.quarantinedUntil) {
+		return time.Time{}, true
+	}
+	return node.quarantinedUntil, true
+}
+
+// describe records in status whether the node is evicted, and until when it
+// is quarantined.
+func (a *nodeAdmissions) describe(status *NodeStatus) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	status.QuarantinedUntil = nil
+	node, ok := a.nodes[status.Address]
+	if !ok || !node.evicted {
+		if status.Status == NodeEvicted {
+			status.Status = NodeDown
+		}
+		return
+	}
+	status.Status = NodeEvicted
+	if time.Now().Before(node.quarantinedUntil) {
+		until := node.quarantinedUntil.UTC()
+		status.QuarantinedUntil = &until
+	}
+}
+
+func later(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// placesOn reports whether blocks are placed on the node.
+func (n *nodeManager) placesOn(address string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return slices.Contains(n.NodeAddresses, address)
+}
+
+// evictNode takes a failing node out of placement. It stays in the registry,
+// where its heartbeats readmit it.
+func (n *nodeManager) evictNode(address string, reason string) {
+	until := admissions.Evict(address)
+
+	n.mutex.Lock()
+	n.NodeStats = slices.DeleteFunc(n.NodeStats, func(stat Node) bool {
+		return stat.address == address
+	})
+	n.NodeAddresses = slices.DeleteFunc(n.NodeAddresses, func(node string) bool {
+		return node == address
+	})
+	n.mutex.Unlock()
+
+	nodeEvictions.WithLabelValues(reason).Inc()
+	fields := []zap.Field{zap.String("nodeAddress", address), zap.String("reason", reason)}
+	if !until.IsZero() {
+		fields = append(fields, zap.Time("quarantinedUntil", until))
+	}
+	logger.Warn("Node evicted", fields...)
+
+	if status, err := n.registry.GetNodeStatus(address); err == nil {
+		admissions.describe(&status)
+		if err := n.registry.SaveNodeStatus(status); err != nil {
+			logger.Error("Failed to update the node registry",
+				zap.String("nodeAddress", address),
+				zap.Error(err),
+			)
+		}
+	}
+	recordAudit(withCaller(context.Background(), systemCaller), AuditNodeEvict, address, nil)
+}
+
+// readmitNode places a node evicted earlier on again.
+func (n *nodeManager) readmitNode(address string) {
+	n.mutex.Lock()
+	if !slices.Contains(n.NodeAddresses, address) {
+		n.NodeAddresses = append(n.NodeAddresses, address)
+	}
+	if nodesWithUsage, err := n.RetrieveNodeStats(); err == nil {
+		n.NodeStats = nodesWithUsage
+	}
+	n.mutex.Unlock()
+
+	nodeReadmissions.Inc()
+	logger.Info("Node readmitted", zap.String("nodeAddress", address))
+	recordAudit(withCaller(context.Background(), systemCaller), AuditNodeReadmit, address, nil)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"slices"
+)
+
+// nodeIDsKey is a hash of node ID to the address the node last registered
+// from. Nodes generate their ID once and keep it in their storage directory,
+// so a node restarted on another port or host is recognized by it.
+const nodeIDsKey = "node_ids"
+
+// NodeAddressByID returns the address the node last registered from, or ""
+// for a node never seen before.
+func (r *RedisManager) NodeAddressByID(id string) (string, error) {
+	address, err := r.redisClient.HGet(context.Background(), nodeIDsKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return address, err
+}
+
+func (r *RedisManager) SaveNodeID(id string, address string) error {
+	return r.redisClient.HSet(context.Background(), nodeIDsKey, id, address).Err()
+}
+
+func (r *RedisManager) DeleteNodeStatus(address string) error {
+	return r.redisClient.HDel(context.Background(), nodeRegistryKey, address).Err()
+}
+
+// ReaddressBlocks records every replica located on from as located on to,
+// and returns how many blocks it moved. Block records are the only hashes
+// with a node_address field, so it walks the hashes of the keyspace.
+func (r *RedisManager) ReaddressBlocks(ctx context.Context, from string, to string) (int, error) {
+	moved := 0
+	iter := r.redisClient.ScanType(ctx, 0, "*", 1000, "hash").Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		values, err := r.redisClient.HMGet(ctx, key, "node_address", replicasField).Result()
+		if err != nil {
+			return moved, err
+		}
+		address, _ := values[0].(string)
+		if address == "" {
+			continue
+		}
+		encoded, _ := values[1].(string)
+		replicas := parseReplicas(encoded, address)
+		found := false
+		for i := range replicas {
+			if replicas[i].Address == from {
+				replicas[i].Address = to
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		fields, err := replicaFields(replicas)
+		if err != nil {
+			return moved, err
+		}
+		if err := r.redisClient.HSet(ctx, key, fields...).Err(); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, iter.Err()
+}
+
+// identifyNode records that the node with the given ID now answers at
+// address. A node seen before at another address has moved: its blocks are
+// still on it, so they are readdressed instead of being considered lost.
+func (n *nodeManager) identifyNode(ctx context.Context, id string, address string) error {
+	previous, err := n.registry.NodeAddressByID(id)
+	if err != nil {
+		return err
+	}
+	if previous != "" && previous != address {
+		err := n.moveNode(ctx, previous, address)
+		recordAudit(ctx, AuditNodeMove, previous+" -> "+address, err)
+		if err != nil {
+			return err
+		}
+	}
+	return n.registry.SaveNodeID(id, address)
+}
+
+func (n *nodeManager) moveNode(ctx context.Context, from string, to string) error {
+	n.mutex.Lock()
+	n.NodeAddresses = slices.DeleteFunc(n.NodeAddresses, func(address string) bool {
+		return address == from || address == to
+	})
+	n.NodeAddresses = append(n.NodeAddresses, to)
+	n.NodeStats = slices.DeleteFunc(n.NodeStats, func(node Node) bool {
+		return node.address == from
+	})
+	n.mutex.Unlock()
+
+	if err := n.registry.DeleteNodeStatus(from); err != nil {
+		return err
+	}
+
+	moved, err := n.registry.ReaddressBlocks(ctx, from, to)
+	requestLogger(ctx).Info("Node moved",
+		zap.String("from", from),
+		zap.String("to", to),
+		zap.Int("blocks", moved),
+	)
+	return err
+}
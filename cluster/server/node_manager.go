@@ -0,0 +1,360 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type NodeManager interface {
+	VerifyAndRegisterNode(w http.ResponseWriter, r *http.Request)
+	RetrieveNodeStats() ([]Node, error)
+}
+
+type Node struct {
+	address string
+	usage   int
+}
+
+const (
+	NodeUp       = "UP"
+	NodeDown     = "DOWN"
+	NodeDraining = "DRAINING"
+)
+
+// NodeStatus is the registry entry of a node, refreshed by the heartbeats.
+type NodeStatus struct {
+	Address       string            `json:"address"`
+	ID            string            `json:"id,omitempty"`
+	Status        string            `json:"status"`
+	Usage         int               `json:"usage"`
+	Capacity      int64             `json:"capacity"`
+	FreeSpace     int64             `json:"free_space"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Capabilities  *NodeCapabilities `json:"capabilities,omitempty"`
+	// Degraded lists what works differently with the node, given its
+	// capabilities.
+	Degraded []string `json:"degraded,omitempty"`
+	// QuarantinedUntil is set while an evicted node is flapping.
+	QuarantinedUntil *time.Time `json:"quarantined_until,omitempty"`
+}
+
+// setUsage records the usage of a node, and the space it leaves of capacity.
+func (s *NodeStatus) setUsage(usage int64, capacity int64) {
+	s.Usage = int(usage)
+	s.Capacity = capacity
+	s.FreeSpace = max(0, capacity-usage)
+}
+
+type NodeUsageResponse struct {
+	Size int `json:"Size"`
+}
+
+type nodeManager struct {
+	NodeAddresses []string
+	NodeStats     []Node
+	httpClient    *http.Client
+	// probeClient checks the health of addresses that may not be nodes of
+	// the cluster, so it sends no cluster token.
+	probeClient *http.Client
+	mutex       *sync.Mutex
+	redisClient *redis.Client
+	registry    *RedisManager
+	// reports holds the last report pushed by each node.
+	reports map[string]nodeReport
+	// discovered holds the nodes registered through FDS_NODE_DISCOVERY.
+	discovered map[string]bool
+	// capabilities holds what each node declared when it registered, nil
+	// for nodes that predate the handshake.
+	capabilities map[string]*NodeCapabilities
+	// labels holds the labels of each node, which failure domains are read
+	// from.
+	labels map[string]map[string]string
+	// draining holds the nodes no block is placed on any more, see
+	// drain.go.
+	draining map[string]bool
+}
+
+func (n *nodeManager) VerifyAndRegisterNode(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	if !validJoinSecret(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid join secret")
+		return
+	}
+	var node NodeRegistrationRequest
+	err := json.NewDecoder(r.Body).Decode(&node)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := url.ParseRequestURI(node.Url)
+
+	if err != nil || u == nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// An evicted node is readmitted by its heartbeats, not by registering.
+	if until, evicted := admissions.Evicted(u.String()); evicted {
+		retryAfter := config.NodeReadmitAfter
+		if !until.IsZero() {
+			retryAfter = time.Until(until)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithErrorCode(w, http.StatusServiceUnavailable, CodeNodeEvicted, "Node is evicted until its health checks pass", nil)
+		return
+	}
+
+	capabilities, degraded, err := checkNodeCompatibility(node)
+	if err != nil {
+		recordAudit(r.Context(), AuditNodeAdd, u.String(), err)
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	err = nodeRetryPolicy().Do(r.Context(), "healthCheck", func() error {
+		return n.checkNodeHealth(r.Context(), u.String())
+	})
+
+	if err != nil {
+		recordAudit(r.Context(), AuditNodeAdd, u.String(), err)
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if node.ID != "" {
+		if err := n.identifyNode(r.Context(), node.ID, u.String()); err != nil {
+			recordAudit(r.Context(), AuditNodeAdd, u.String(), err)
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	n.registerNode(u.String(), node.ID, node.Labels)
+	if err := n.recordCapabilities(u.String(), capabilities, degraded); err != nil {
+		log.Println(err)
+	}
+	for _, reason := range degraded {
+		log.Printf("Node %s is degraded: %s", u.String(), reason)
+	}
+	recordAudit(r.Context(), AuditNodeAdd, u.String(), nil)
+	w.Header().Set(centralInstanceHeader, centralInstance)
+	issueNodeToken(w, capabilities)
+	w.WriteHeader(http.StatusOK)
+
+	log.Println("Node added")
+}
+
+func (n *nodeManager) checkNodeHealth(ctx context.Context, address string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address+"/health", nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := n.probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return &nodeStatusError{Node: address, StatusCode: res.StatusCode}
+	}
+	return nil
+}
+
+func (n *nodeManager) registerNode(node string, id string, labels map[string]string) {
+	n.mutex.Lock()
+	if !slices.Contains(n.NodeAddresses, node) {
+		n.NodeAddresses = append(n.NodeAddresses, node)
+	}
+	if n.labels == nil {
+		n.labels = make(map[string]map[string]string)
+	}
+	n.labels[node] = labels
+	nodesWithUsage, err := n.RetrieveNodeStats()
+	if err == nil {
+		n.NodeStats = nodesWithUsage
+	}
+
+	nodeStatus := NodeStatus{
+		Address:       node,
+		ID:            id,
+		Status:        NodeUp,
+		LastHeartbeat: time.Now().UTC(),
+		Labels:        labels,
+	}
+	if n.draining[node] {
+		nodeStatus.Status = NodeDraining
+	}
+	nodeStatus.setUsage(0, n.capacityOf(node))
+	for _, stat := range n.NodeStats {
+		if stat.address == node {
+			nodeStatus.setUsage(int64(stat.usage), n.capacityOf(node))
+		}
+	}
+
+	err = n.registry.SaveNodeStatus(nodeStatus)
+
+	if err != nil {
+		log.Println(err)
+	}
+	n.mutex.Unlock()
+}
+
+func (n *nodeManager) RetrieveNodeStats() ([]Node, error) {
+	var nodes []Node
+
+	for _, addr := range n.NodeAddresses {
+		var usage int
+		err := nodeRetryPolicy().Do(context.Background(), "nodeUsage", func() error {
+			var err error
+			usage, err = n.fetchNodeUsage(addr)
+			return err
+		})
+
+		if err != nil {
+			continue
+		}
+
+		nodes = append(nodes, Node{
+			address: addr,
+			usage:   usage,
+		})
+	}
+
+	if len(nodes) == 0 {
+		return nil, errNodesUnavailable
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].usage < nodes[j].usage
+	})
+
+	return nodes, nil
+}
+
+// GetNodeUsage fans out to every node and writes one JSON object per line.
+//
+// Deprecated: use GET /nodes, which returns the registry as a JSON array.
+func (n *nodeManager) GetNodeUsage(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	nodes, err := n.RetrieveNodeStats()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	for _, tmp := range nodes {
+		err := json.NewEncoder(w).Encode(map[string]float64{
+			tmp.address: float64(tmp.usage),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+}
+
+// SelectAndUpdateNode picks a node whose circuit breaker is not open and
+// that accepts and has room for blocks of this size, at random in proportion
+// to the share of its capacity it has left, or any node if there is none.
+// With FDS_PLACEMENT_STRATEGY=two-choices it takes the better of two such
+// nodes drawn at random instead.
+func (n *nodeManager) SelectAndUpdateNode(block FileBlock) Node {
+	node, _ := n.selectNode(block, nil)
+	return node
+}
+
+// selectNode is SelectAndUpdateNode among the nodes at pinned, or all of them
+// if pinned is nil. It reports false if there is no such node.
+func (n *nodeManager) selectNode(block FileBlock, pinned []string) (Node, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	selected := -1
+	if config.PlacementStrategy == placementTwoChoices {
+		selected = n.sampleTwoChoices(block, pinned)
+	}
+	if selected < 0 {
+		n.shuffleByFreeShare()
+		for i, node := range n.NodeStats {
+			if pinned != nil && !slices.Contains(pinned, node.address) || n.draining[node.address] {
+				continue
+			}
+			if selected < 0 {
+				selected = i
+			}
+			if n.placeable(node, block, pinned) {
+				selected = i
+				break
+			}
+		}
+	}
+	if selected < 0 {
+		return Node{}, false
+	}
+	selectedNode := n.NodeStats[selected]
+	n.NodeStats[selected].usage = selectedNode.usage + len(block.bytes)
+	return selectedNode, true
+}
+
+// placeable reports whether block can go to node: the node is among those
+// at pinned, if pinned is not nil, its circuit breaker is not open, and it
+// accepts and has room for the block. The caller holds n.mutex.
+func (n *nodeManager) placeable(node Node, block FileBlock, pinned []string) bool {
+	if pinned != nil && !slices.Contains(pinned, node.address) {
+		return false
+	}
+	return !breakers.Open(breakerKey(node.address)) && n.acceptsBlock(node.address, len(block.bytes)) && n.hasRoom(node, len(block.bytes))
+}
+
+// sampleTwoChoices is the "two-choices" placement strategy: it draws two
+// nodes that can take block at random and returns the index of the one with
+// the larger share of its capacity left, without ordering every node as the
+// weighted strategy does. It returns -1 if its draws find no such node, for
+// the caller to fall back on the weighted strategy. The caller holds
+// n.mutex.
+func (n *nodeManager) sampleTwoChoices(block FileBlock, pinned []string) int {
+	best, found := -1, 0
+	for attempt := 0; found < 2 && attempt < 2*len(n.NodeStats); attempt++ {
+		i := rand.IntN(len(n.NodeStats))
+		if i == best || !n.placeable(n.NodeStats[i], block, pinned) {
+			continue
+		}
+		found++
+		if best < 0 || n.freeShare(n.NodeStats[i]) > n.freeShare(n.NodeStats[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (n *nodeManager) DeleteNode(node Node) {
+	n.mutex.Lock()
+	n.NodeStats = slices.DeleteFunc(n.NodeStats, func(stat Node) bool {
+		return stat.address == node.address
+	})
+	n.NodeAddresses = slices.DeleteFunc(n.NodeAddresses, func(address string) bool {
+		return address == node.address
+	})
+	log.Println("Node removed from nodestats")
+	n.mutex.Unlock()
+
+	n.markNodeDown(node.address)
+	recordAudit(withCaller(context.Background(), systemCaller), AuditNodeRemove, node.address, nil)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyAlpha is the weight of the latest request in the latency average
+// of a node.
+const latencyAlpha = 0.2
+
+// nodeHealth is what the central server has observed of one node.
+type nodeHealth struct {
+	consecutiveFailures int
+	lastHeartbeat       time.Time
+	bytesSent           int64
+	transmitErrors      int64
+	transmitSeconds     float64
+	transmits           uint64
+	// latency is the exponentially weighted moving average of the seconds
+	// the node took to store or serve a block, 0 until it has done either.
+	latency float64
+}
+
+func (h *nodeHealth) observeLatency(duration time.Duration) {
+	if h.latency == 0 {
+		h.latency = duration.Seconds()
+		return
+	}
+	h.latency += latencyAlpha * (duration.Seconds() - h.latency)
+}
+
+// nodeMetrics exports per-node health as seen from the central server, so a
+// degrading node can be alerted on before it is evicted. The heartbeat age is
+// computed at scrape time.
+type nodeMetrics struct {
+	mutex sync.Mutex
+	nodes map[string]*nodeHealth
+}
+
+var (
+	nodeConsecutiveFailuresDesc = prometheus.NewDesc("node_consecutive_failures",
+		"Heartbeats and block transmissions that failed in a row", []string{"node"}, nil)
+	nodeLastHeartbeatAgeDesc = prometheus.NewDesc("node_last_heartbeat_age_seconds",
+		"Time since the last successful heartbeat", []string{"node"}, nil)
+	nodeBytesSentDesc = prometheus.NewDesc("node_bytes_sent_total",
+		"Block bytes committed by the node", []string{"node"}, nil)
+	nodeTransmitErrorsDesc = prometheus.NewDesc("node_transmit_errors_total",
+		"Failed block transmissions", []string{"node"}, nil)
+	nodeTransmitLatencyDesc = prometheus.NewDesc("node_transmit_latency_seconds",
+		"Block transmission latency; sum/count is the average", []string{"node"}, nil)
+	nodeLatencyEWMADesc = prometheus.NewDesc("node_latency_ewma_seconds",
+		"Moving average of the time the node takes to store or serve a block, which placement and reads are steered by", []string{"node"}, nil)
+)
+
+var nodeHealthMetrics = &nodeMetrics{nodes: make(map[string]*nodeHealth)}
+
+// reset forgets every node; the metrics stay registered.
+func (m *nodeMetrics) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nodes = make(map[string]*nodeHealth)
+}
+
+func (m *nodeMetrics) nodeLocked(address string) *nodeHealth {
+	node, ok := m.nodes[address]
+	if !ok {
+		node = &nodeHealth{}
+		m.nodes[address] = node
+	}
+	return node
+}
+
+func (m *nodeMetrics) HeartbeatSucceeded(address string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	node := m.nodeLocked(address)
+	node.consecutiveFailures = 0
+	node.lastHeartbeat = time.Now()
+}
+
+func (m *nodeMetrics) HeartbeatFailed(address string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nodeLocked(address).consecutiveFailures++
+}
+
+func (m *nodeMetrics) Transmitted(address string, size int, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	node := m.nodeLocked(address)
+	node.transmitSeconds += duration.Seconds()
+	node.transmits++
+	if err != nil {
+		node.consecutiveFailures++
+		node.transmitErrors++
+		return
+	}
+	node.consecutiveFailures = 0
+	node.bytesSent += int64(size)
+	node.observeLatency(duration)
+}
+
+// Fetched records the time a node took to serve a block.
+func (m *nodeMetrics) Fetched(address string, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nodeLocked(address).observeLatency(duration)
+}
+
+// Latencies returns the latency average of every node that has stored or
+// served a block, in seconds.
+func (m *nodeMetrics) Latencies() map[string]float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	latencies := make(map[string]float64, len(m.nodes))
+	for address, node := range m.nodes {
+		if node.latency > 0 {
+			latencies[address] = node.latency
+		}
+	}
+	return latencies
+}
+
+// ByLatency returns addresses with the fastest nodes first, when
+// FDS_LATENCY_AWARE_ROUTING is on. Nodes not measured yet come first, so that
+// they are measured.
+func (m *nodeMetrics) ByLatency(addresses []string) []string {
+	if !config.LatencyAwareRouting || len(addresses) < 2 {
+		return addresses
+	}
+	latencies := m.Latencies()
+	sorted := slices.Clone(addresses)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		switch {
+		case latencies[a] < latencies[b]:
+			return -1
+		case latencies[a] > latencies[b]:
+			return 1
+		}
+		return 0
+	})
+	return sorted
+}
+
+func (m *nodeMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nodeConsecutiveFailuresDesc
+	ch <- nodeLastHeartbeatAgeDesc
+	ch <- nodeBytesSentDesc
+	ch <- nodeTransmitErrorsDesc
+	ch <- nodeTransmitLatencyDesc
+	ch <- nodeLatencyEWMADesc
+}
+
+func (m *nodeMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for address, node := range m.nodes {
+		ch <- prometheus.MustNewConstMetric(nodeConsecutiveFailuresDesc, prometheus.GaugeValue, float64(node.consecutiveFailures), address)
+		if !node.lastHeartbeat.IsZero() {
+			ch <- prometheus.MustNewConstMetric(nodeLastHeartbeatAgeDesc, prometheus.GaugeValue, time.Since(node.lastHeartbeat).Seconds(), address)
+		}
+		ch <- prometheus.MustNewConstMetric(nodeBytesSentDesc, prometheus.CounterValue, float64(node.bytesSent), address)
+		ch <- prometheus.MustNewConstMetric(nodeTransmitErrorsDesc, prometheus.CounterValue, float64(node.transmitErrors), address)
+		ch <- prometheus.MustNewConstSummary(nodeTransmitLatencyDesc, node.transmits, node.transmitSeconds, nil, address)
+		if node.latency > 0 {
+			ch <- prometheus.MustNewConstMetric(nodeLatencyEWMADesc, prometheus.GaugeValue, node.latency, address)
+		}
+	}
+}
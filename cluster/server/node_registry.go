@@ -0,0 +1,352 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// nodeRegistryKey is a hash of node address to NodeStatus JSON. It replaces
+// the "nodes" list, which accumulated one entry per registration.
+const nodeRegistryKey = "node_registry"
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// centralInstanceHeader tells the nodes which central server is talking to
+// them, a new one for every Server. A node registers again when it changes,
+// since a restarted central server only knows the nodes that registered with
+// it.
+const centralInstanceHeader = "X-FDS-Central-Instance"
+
+var centralInstance = newCentralInstance()
+
+func newCentralInstance() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (r *RedisManager) SaveNodeStatus(status NodeStatus) error {
+	jsonData, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return r.redisClient.HSet(context.Background(), nodeRegistryKey, status.Address, jsonData).Err()
+}
+
+func (r *RedisManager) GetNodeStatus(address string) (NodeStatus, error) {
+	var status NodeStatus
+
+	val, err := r.redisClient.HGet(context.Background(), nodeRegistryKey, address).Result()
+	if errors.Is(err, redis.Nil) {
+		return status, ErrNodeNotFound
+	}
+	if err != nil {
+		return status, err
+	}
+
+	err = json.Unmarshal([]byte(val), &status)
+	return status, err
+}
+
+func (r *RedisManager) ListNodeStatuses() ([]NodeStatus, error) {
+	values, err := r.redisClient.HGetAll(context.Background(), nodeRegistryKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]NodeStatus, 0, len(values))
+	for _, val := range values {
+		var status NodeStatus
+		if err := json.Unmarshal([]byte(val), &status); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, status)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Address < nodes[j].Address
+	})
+	return nodes, nil
+}
+
+// fetchNodeUsage asks a node how many bytes it stores.
+func (n *nodeManager) fetchNodeUsage(address string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(address, "/")+"/getCurrentNodeSpace", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(centralInstanceHeader, centralInstance)
+
+	res, err := n.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, &nodeStatusError{Node: address, StatusCode: res.StatusCode}
+	}
+
+	var nodeResp NodeUsageResponse
+	if err := json.NewDecoder(res.Body).Decode(&nodeResp); err != nil {
+		return 0, err
+	}
+	return nodeResp.Size, nil
+}
+
+// RunHeartbeats checks every node of the registry at each interval and
+// records its status and usage, so the registry can be read without
+// contacting the nodes.
+func (n *nodeManager) RunHeartbeats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.checkRegisteredNodes()
+	}
+}
+
+func (n *nodeManager) checkRegisteredNodes() {
+	nodes, err := n.registry.ListNodeStatuses()
+	if err != nil {
+		logger.Error("Failed to read the node registry", zap.Error(err))
+		return
+	}
+
+	for _, status := range nodes {
+		var usage int
+		err := nodeRetryPolicy().Do(context.Background(), "heartbeat", func() error {
+			var err error
+			usage, err = n.fetchNodeUsage(status.Address)
+			return err
+		})
+		if err != nil {
+			nodeHealthMetrics.HeartbeatFailed(status.Address)
+			if status.Status != NodeDown && status.Status != NodeEvicted {
+				logger.Warn("Node missed its heartbeat",
+					zap.String("nodeAddress", status.Address),
+					zap.Error(err),
+				)
+			}
+			status.Status = NodeDown
+			if admissions.Failed(status.Address) && n.placesOn(status.Address) {
+				n.evictNode(status.Address, "heartbeat")
+			}
+		} else {
+			nodeHealthMetrics.HeartbeatSucceeded(status.Address)
+			if admissions.Succeeded(status.Address) {
+				n.readmitNode(status.Address)
+			}
+			// A draining node stays draining while it is reachable.
+			status.Status = n.upStatus(status.Address)
+			status.setUsage(int64(usage), n.capacity(status.Address))
+			status.LastHeartbeat = time.Now().UTC()
+		}
+		admissions.describe(&status)
+
+		if err := n.registry.SaveNodeStatus(status); err != nil {
+			logger.Error("Failed to update the node registry",
+				zap.String("nodeAddress", status.Address),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (n *nodeManager) markNodeDown(address string) {
+	status, err := n.registry.GetNodeStatus(address)
+	if err != nil {
+		return
+	}
+
+	status.Status = NodeDown
+	if err := n.registry.SaveNodeStatus(status); err != nil {
+		logger.Error("Failed to update the node registry",
+			zap.String("nodeAddress", address),
+			zap.Error(err),
+		)
+	}
+}
+
+// ListNodes returns the cluster topology as recorded in the node registry.
+func (n *nodeManager) ListNodes(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	nodes, err := n.registry.ListNodeStatuses()
+	if err != nil {
+		logger.Error("Failed to read the node registry", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list nodes")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(nodes)
+}
+
+// legacyNodesKey is the list registrations were pushed to before the
+// registry became a hash; reconcileRegistry folds it into the hash.
+const legacyNodesKey = "nodes"
+
+// legacyNodeStatuses returns the entries of the legacy list of nodes.
+func (r *RedisManager) legacyNodeStatuses() ([]NodeStatus, error) {
+	values, err := r.redisClient.LRange(context.Background(), legacyNodesKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []NodeStatus
+	for _, val := range values {
+		var status NodeStatus
+		if json.Unmarshal([]byte(val), &status) == nil && status.Address != "" {
+			nodes = append(nodes, status)
+		}
+	}
+	return nodes, nil
+}
+
+// ReconcileRegistry rebuilds the nodes known to the central server from the
+// registry persisted in Redis, so a restart does not wait for every node to
+// register again. Entries are deduplicated by address and by node ID, keeping
+// the one heard from last; the nodes answering their health check are
+// registered again, the others are marked DOWN, or removed from the registry
+// once their last heartbeat is older than pruneAfter (0 never removes them).
+func (n *nodeManager) ReconcileRegistry(ctx context.Context, pruneAfter time.Duration) error {
+	if err := n.loadDraining(ctx); err != nil {
+		return err
+	}
+	nodes, err := n.registry.ListNodeStatuses()
+	if err != nil {
+		return err
+	}
+	legacy, err := n.registry.legacyNodeStatuses()
+	if err != nil {
+		return err
+	}
+
+	// Newest first, so the first entry seen for an address or ID wins.
+	all := slices.Concat(nodes, legacy)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].LastHeartbeat.After(all[j].LastHeartbeat)
+	})
+	var latest []NodeStatus
+	addresses := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, status := range all {
+		status.Address = strings.TrimSuffix(status.Address, "/")
+		if addresses[status.Address] || (status.ID != "" && ids[status.ID]) {
+			continue
+		}
+		// A node that moved is recorded under its ID at its new address.
+		if status.ID != "" {
+			if address, err := n.registry.NodeAddressByID(status.ID); err == nil && address != "" && address != status.Address {
+				continue
+			}
+			ids[status.ID] = true
+		}
+		addresses[status.Address] = true
+		latest = append(latest, status)
+	}
+
+	for _, status := range nodes {
+		if !addresses[status.Address] {
+			logger.Info("Pruned duplicate node registry entry", zap.String("nodeAddress", status.Address))
+			if err := n.registry.DeleteNodeStatus(status.Address); err != nil {
+				return err
+			}
+		}
+	}
+
+	var healthy []NodeStatus
+	for _, status := range latest {
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := n.checkNodeHealth(checkCtx, status.Address)
+		cancel()
+		if err == nil {
+			healthy = append(healthy, status)
+			continue
+		}
+
+		if pruneAfter > 0 && time.Since(status.LastHeartbeat) > pruneAfter {
+			logger.Info("Pruned dead node from the registry",
+				zap.String("nodeAddress", status.Address),
+				zap.Time("lastHeartbeat", status.LastHeartbeat),
+			)
+			if err := n.registry.DeleteNodeStatus(status.Address); err != nil {
+				return err
+			}
+			continue
+		}
+		logger.Warn("Registered node is unreachable",
+			zap.String("nodeAddress", status.Address),
+			zap.Error(err),
+		)
+		status.Status = NodeDown
+		if err := n.registry.SaveNodeStatus(status); err != nil {
+			return err
+		}
+	}
+
+	n.mutex.Lock()
+	for _, status := range healthy {
+		if !slices.Contains(n.NodeAddresses, status.Address) {
+			n.NodeAddresses = append(n.NodeAddresses, status.Address)
+		}
+		if status.Capabilities != nil {
+			if n.capabilities == nil {
+				n.capabilities = make(map[string]*NodeCapabilities)
+			}
+			n.capabilities[status.Address] = status.Capabilities
+		}
+		if status.Labels != nil {
+			if n.labels == nil {
+				n.labels = make(map[string]map[string]string)
+			}
+			n.labels[status.Address] = status.Labels
+		}
+	}
+	if len(n.NodeAddresses) > 0 {
+		if stats, err := n.RetrieveNodeStats(); err == nil {
+			n.NodeStats = stats
+		}
+	}
+	usage := make(map[string]int, len(n.NodeStats))
+	for _, stat := range n.NodeStats {
+		usage[stat.address] = stat.usage
+	}
+	n.mutex.Unlock()
+
+	for _, status := range healthy {
+		// A draining node stays draining.
+		status.Status = n.upStatus(status.Address)
+		if used, ok := usage[status.Address]; ok {
+			status.setUsage(int64(used), n.capacity(status.Address))
+		}
+		status.LastHeartbeat = time.Now().UTC()
+		if err := n.registry.SaveNodeStatus(status); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Reconciled the node registry",
+		zap.Int("nodes", len(healthy)),
+		zap.Int("unreachable", len(latest)-len(healthy)),
+	)
+	return n.registry.redisClient.Del(ctx, legacyNodesKey).Err()
+}
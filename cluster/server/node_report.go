@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+)
+
+// NodeReport is what a node pushes about itself every few seconds, so that
+// placement need not ask every node for its usage on each upload.
+type NodeReport struct {
+	Url  string `json:"Url"`
+	ID   string `json:"ID,omitempty"`
+	Used int64  `json:"Used"`
+	// Free is -1 for stores without a fixed capacity.
+	Free int64 `json:"Free"`
+}
+
+// nodeReport is the last report of a node, as kept for placement.
+type nodeReport struct {
+	usage int
+	at    time.Time
+}
+
+// ReceiveNodeReport records the usage pushed by a node in the registry. It
+// answers 404 to nodes this process does not know, which makes them
+// register again.
+func (n *nodeManager) ReceiveNodeReport(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+	if !validJoinSecret(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid join secret")
+		return
+	}
+
+	var report NodeReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	u, err := url.ParseRequestURI(report.Url)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	address := u.String()
+
+	if !n.acceptReport(address, report) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeNodeNotRegistered, "Node is not registered", nil)
+		return
+	}
+
+	status, err := n.registry.GetNodeStatus(address)
+	if errors.Is(err, ErrNodeNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeNodeNotRegistered, "Node is not registered", nil)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read the node registry", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to record the report")
+		return
+	}
+
+	// A draining node stays draining while it reports.
+	status.Status = n.upStatus(status.Address)
+	// A node offers the capacity it declared, unless its disk holds less.
+	status.setUsage(report.Used, n.capacity(address))
+	if report.Free >= 0 {
+		status.FreeSpace = min(status.FreeSpace, report.Free)
+	}
+	status.LastHeartbeat = time.Now().UTC()
+	if err := n.registry.SaveNodeStatus(status); err != nil {
+		logger.Error("Failed to update the node registry",
+			zap.String("nodeAddress", address),
+			zap.Error(err),
+		)
+		respondWithError(w, http.StatusInternalServerError, "Failed to record the report")
+		return
+	}
+	nodeHealthMetrics.HeartbeatSucceeded(address)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptReport keeps the report of a node known to this process.
+func (n *nodeManager) acceptReport(address string, report NodeReport) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if !slices.Contains(n.NodeAddresses, address) {
+		return false
+	}
+	if n.reports == nil {
+		n.reports = make(map[string]nodeReport)
+	}
+	n.reports[address] = nodeReport{usage: int(report.Used), at: time.Now()}
+	return true
+}
+
+// PlacementStats returns the usage of the nodes from their reports when
+// every node has reported within NodeReportMaxAge, and asks the nodes
+// otherwise.
+func (n *nodeManager) PlacementStats() ([]Node, error) {
+	if nodes, ok := n.reportedStats(); ok {
+		return nodes, nil
+	}
+	return n.RetrieveNodeStats()
+}
+
+func (n *nodeManager) reportedStats() ([]Node, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if config.NodeReportMaxAge <= 0 || len(n.NodeAddresses) == 0 {
+		return nil, false
+	}
+
+	nodes := make([]Node, 0, len(n.NodeAddresses))
+	for _, address := range n.NodeAddresses {
+		report, ok := n.reports[address]
+		if !ok || time.Since(report.at) > config.NodeReportMaxAge {
+			return nil, false
+		}
+		nodes = append(nodes, Node{address: address, usage: report.usage})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].usage < nodes[j].usage
+	})
+	return nodes, true
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+)
+
+// NodeCertificateRequest asks for a certificate for the key of a node
+// serving HTTPS. CSR is a PEM certificate request naming the host names and
+// addresses the node is reached at.
+type NodeCertificateRequest struct {
+	CSR string `json:"CSR"`
+}
+
+// NodeCertificate is a certificate issued to a node, with the CA the
+// central server checks it against.
+type NodeCertificate struct {
+	Certificate string    `json:"Certificate"`
+	CA          string    `json:"CA"`
+	NotAfter    time.Time `json:"NotAfter"`
+}
+
+// nodeCA is the CA of FDS_NODE_CA_FILE, with its key when the central
+// server issues node certificates.
+type nodeCA struct {
+	cert *x509.Certificate
+	pem  []byte
+	key  crypto.Signer
+}
+
+var (
+	// nodeTLS is used to check the certificates of nodes served over HTTPS;
+	// nil trusts the system certificates only.
+	nodeTLS *tls.Config
+	// nodeIssuer issues node certificates; nil unless FDS_NODE_CA_KEY_FILE
+	// is set.
+	nodeIssuer *nodeCA
+)
+
+// loadNodeCA trusts the CA of FDS_NODE_CA_FILE for node certificates,
+// besides the system ones, and loads its key to issue them.
+func loadNodeCA() error {
+	if config.NodeCAFile == "" {
+		return nil
+	}
+	caPEM, err := os.ReadFile(config.NodeCAFile)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificate found in %s", config.NodeCAFile)
+	}
+	nodeTLS = &tls.Config{RootCAs: pool}
+
+	if config.NodeCAKeyFile == "" {
+		return nil
+	}
+	pair, err := tls.LoadX509KeyPair(config.NodeCAFile, config.NodeCAKeyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return fmt.Errorf("%s is not a CA certificate and key", config.NodeCAFile)
+	}
+	nodeIssuer = &nodeCA{cert: cert, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), key: key}
+	return nil
+}
+
+// issue signs a server certificate for the names of csr, valid for ttl.
+func (ca *nodeCA) issue(csr *x509.CertificateRequest, ttl time.Duration) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 {
+		return nil, errors.New("the request names no host")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		// Leave room for clocks running behind.
+		NotBefore:   now.Add(-5 * time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// IssueNodeCertificate signs the certificate request of a node, so it can
+// serve HTTPS with a certificate the central server trusts. Only nodes
+// presenting the join secret get one.
+func (n *nodeManager) IssueNodeCertificate(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	if nodeIssuer == nil {
+		respondWithError(w, http.StatusNotFound, "Node certificates are not issued")
+		return
+	}
+	if !validJoinSecret(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid join secret")
+		return
+	}
+
+	var request NodeCertificateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	block, _ := pem.Decode([]byte(request.CSR))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		respondWithError(w, http.StatusBadRequest, "CSR is not a PEM certificate request")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cert, err := nodeIssuer.issue(csr, config.NodeCertTTL)
+	recordAudit(r.Context(), AuditNodeCertificate, csr.Subject.CommonName, err)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NodeCertificate{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		CA:          string(nodeIssuer.pem),
+		NotAfter:    cert.NotAfter,
+	})
+}
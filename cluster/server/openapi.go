@@ -0,0 +1,506 @@
+package server
+
+import (
+	"FDS/version"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiParam is a query parameter or header of an endpoint.
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+	Required    bool
+}
+
+// apiDoc annotates an endpoint for the OpenAPI document. Body and Response
+// are values of the Go types of the JSON bodies, from which their schemas are
+// derived; BodyType and ResponseType give the media type of other bodies.
+type apiDoc struct {
+	ID           string
+	Summary      string
+	Query        []apiParam
+	Headers      []apiParam
+	Body         any
+	BodyType     string
+	Response     any
+	ResponseType string
+	// Status is the status of a successful answer, 200 if not set.
+	Status int
+	Errors []int
+}
+
+var usageExportParams = []apiParam{
+	{Name: "date", Type: "string", Description: "YYYY-MM-DD, yesterday if unset"},
+	{Name: "format", Type: "string", Description: "csv or ndjson"},
+}
+
+// leaseParams are sent by the writers of a leased file.
+var leaseParams = []apiParam{{Name: leaseHeader, Type: "string", Description: "ID of the lease held on the file"}}
+
+// writeParams are the headers of the requests writing or deleting a file.
+var writeParams = []apiParam{
+	{Name: leaseHeader, Type: "string", Description: "ID of the lease held on the file"},
+	{Name: "If-Match", Type: "string", Description: "ETags of the versions the file must be at"},
+}
+
+var presignParams = []apiParam{
+	{Name: "expires", Type: "integer", Description: "Expiry of a presigned URL, in Unix seconds"},
+	{Name: "signature", Type: "string", Description: "Signature of a presigned URL"},
+}
+
+// apiDocs annotates the endpoints registered by setupAPI, by method and path
+// template without the version prefix. Endpoints left out are still listed,
+// with only their path parameters.
+var apiDocs = map[string]apiDoc{
+	"GET /version":      {ID: "getVersion", Summary: "Build and protocol version of the central server", Response: version.Info{}},
+	"GET /openapi.json": {ID: "getOpenAPI", Summary: "This OpenAPI document", ResponseType: "application/json"},
+	"GET /healthz":      {ID: "getHealth", Summary: "Liveness check", Response: HealthResponse{}},
+	"GET /readyz":       {ID: "getReadiness", Summary: "Readiness check of Redis and the nodes", Response: HealthResponse{}, Errors: []int{503}},
+
+	"POST /sendFile": {
+		ID:       "uploadFile",
+		Summary:  "Upload a file from the file field of a multipart form",
+		BodyType: "multipart/form-data",
+		Query: []apiParam{
+			{Name: "async", Type: "boolean", Description: "Answer 202 with a job once the file is received"},
+			{Name: "blockSize", Type: "integer", Description: "Block size of this upload, in bytes"},
+		},
+		Headers:  writeParams,
+		Response: UploadJob{},
+		Errors:   []int{400, 412, 413, 415, 422, 423, 503, 507},
+	},
+	"POST /fetch": {
+		ID:       "fetchFile",
+		Summary:  "Store a file downloaded from a URL, as a job",
+		Body:     FetchRequest{},
+		Response: UploadJob{},
+		Status:   202,
+		Errors:   []int{400},
+	},
+	"GET /nodesUsage": {ID: "getNodesUsage", Summary: "Usage of each node placed on, as a stream of JSON objects", Response: map[string]float64{}},
+	"GET /nodes":      {ID: "listNodes", Summary: "Nodes of the registry with their status", Response: []NodeStatus{}},
+	"GET /retrieveFile": {
+		ID:      "downloadFile",
+		Summary: "Download a file, or its block plan",
+		Query: append([]apiParam{
+			{Name: "fileName", Type: "string", Required: true},
+			{Name: "plan", Type: "boolean", Description: "Answer with the block plan instead of the content"},
+		}, presignParams...),
+		Headers:      []apiParam{{Name: "Range", Type: "string"}},
+		ResponseType: "application/octet-stream",
+		Errors:       []int{403, 404, 416},
+	},
+	"POST /downloadArchive": {
+		ID:           "downloadArchive",
+		Summary:      "Download several files as one zip or tar archive",
+		Query:        []apiParam{{Name: "format", Type: "string", Description: "zip or tar"}},
+		Body:         ArchiveRequest{},
+		ResponseType: "application/octet-stream",
+		Errors:       []int{400, 404},
+	},
+	"POST /addNode":           {ID: "registerNode", Summary: "Register a node", Body: NodeRegistrationRequest{}, Errors: []int{400, 401, 409, 503}},
+	"POST /nodes/report":      {ID: "reportNode", Summary: "Report the usage of a node", Body: NodeReport{}, Status: 204, Errors: []int{400, 401, 404}},
+	"POST /nodes/corruption":  {ID: "reportCorruption", Summary: "Report a corrupt block held by a node", Body: CorruptionReport{}, Status: 204, Errors: []int{400, 401}},
+	"POST /nodes/certificate": {ID: "issueNodeCertificate", Summary: "Issue a TLS certificate to a node", Body: NodeCertificateRequest{}, Response: NodeCertificate{}, Errors: []int{400, 401, 404}},
+
+	"GET /files":              {ID: "listFiles", Summary: "List the files", Response: []FileStat{}},
+	"POST /files/batchUpload": {ID: "batchUpload", Summary: "Upload every file of a multipart form or tar stream", BodyType: "multipart/form-data", Response: BatchUploadResponse{}, Errors: []int{400, 413, 503}},
+	"POST /files/batchDelete": {ID: "batchDelete", Summary: "Delete files by name or prefix", Body: BatchDeleteRequest{}, Response: BatchDeleteResponse{}, Errors: []int{400}},
+	"POST /files/batchGet": {
+		ID:           "batchGet",
+		Summary:      "Download several files in one multipart/mixed or tar answer",
+		Query:        []apiParam{{Name: "format", Type: "string", Description: "multipart or tar"}},
+		Body:         BatchGetRequest{},
+		ResponseType: "multipart/mixed",
+		Errors:       []int{400, 404},
+	},
+	"GET /files/{name}": {ID: "getFile", Summary: "Metadata of a file", Response: FileStat{}, Errors: []int{404}},
+	"PUT /files/{name}": {
+		ID:       "putFile",
+		Summary:  "Upload the raw request body as a file",
+		Query:    append([]apiParam{{Name: "blockSize", Type: "integer", Description: "Block size of this upload, in bytes"}}, presignParams...),
+		Headers:  writeParams,
+		BodyType: "application/octet-stream",
+		Status:   201,
+		Errors:   []int{400, 403, 412, 413, 415, 422, 423, 503, 507},
+	},
+	"DELETE /files/{name}": {ID: "deleteFile", Summary: "Delete a file", Headers: writeParams, Status: 204, Errors: []int{404, 412, 423}},
+	"PATCH /files/{name}": {
+		ID:       "patchFile",
+		Summary:  "Overwrite part of a file with the raw request body",
+		Query:    []apiParam{{Name: "offset", Type: "integer"}},
+		Headers:  append([]apiParam{{Name: "Content-Range", Type: "string"}}, writeParams...),
+		BodyType: "application/octet-stream",
+		Response: FileMetadata{},
+		Errors:   []int{400, 404, 412, 416, 423},
+	},
+	"POST /files/{name}/presign": {
+		ID:       "presignFile",
+		Summary:  "Presigned download and upload URLs of a file",
+		Query:    []apiParam{{Name: "expires_in", Type: "integer", Description: "Lifetime of the URLs, in seconds"}},
+		Response: PresignResponse{},
+		Errors:   []int{400},
+	},
+	"POST /files/{name}/copy": {
+		ID:       "copyFile",
+		Summary:  "Copy a file",
+		Query:    []apiParam{{Name: "dest", Type: "string", Required: true}},
+		Headers:  writeParams,
+		Response: FileMetadata{},
+		Status:   201,
+		Errors:   []int{400, 404, 412, 423},
+	},
+	"POST /files/{name}/append": {ID: "appendFile", Summary: "Append the raw request body to a file", Headers: writeParams, BodyType: "application/octet-stream", Response: FileMetadata{}, Errors: []int{404, 412, 423}},
+	"GET /files/{name}/lock":    {ID: "getFileLock", Summary: "Lease held on a file name, without its ID", Response: FileLease{}, Errors: []int{404}},
+	"POST /files/{name}/lock": {
+		ID:       "lockFile",
+		Summary:  "Lease a file name exclusively, or extend the lease sent in X-FDS-Lease",
+		Query:    []apiParam{{Name: "ttl", Type: "integer", Description: "Lifetime of the lease, in seconds"}},
+		Headers:  leaseParams,
+		Response: FileLease{},
+		Status:   201,
+		Errors:   []int{400, 423},
+	},
+	"DELETE /files/{name}/lock": {ID: "unlockFile", Summary: "Release the lease sent in X-FDS-Lease", Headers: leaseParams, Status: 204, Errors: []int{400, 404, 423}},
+	"GET /files/{name}/signature": {
+		ID:       "getFileSignature",
+		Summary:  "rsync-style signature of a file",
+		Query:    []apiParam{{Name: "chunkSize", Type: "integer"}},
+		Response: FileSignature{},
+		Errors:   []int{400, 404},
+	},
+	"GET /files/{name}/manifest": {ID: "getFileManifest", Summary: "Block plan of a file, for parallel downloads from the nodes", Response: BlockPlan{}, Errors: []int{403, 404, 409}},
+	"POST /files/{name}/delta":   {ID: "uploadFileDelta", Summary: "Store a new version of a file from a delta", Headers: writeParams, Body: DeltaRequest{}, Response: FileMetadata{}, Errors: []int{400, 404, 409, 412, 423}},
+	"POST /files/{name}/uploads": {
+		ID:      "initiateMultipartUpload",
+		Summary: "Start uploading a file in parts",
+		Query: []apiParam{
+			{Name: "blockSize", Type: "integer", Description: "Block size of the parts, in bytes"},
+			{Name: "size", Type: "integer", Description: "Expected size of the file, to choose the block size from"},
+		},
+		Response: MultipartUpload{},
+		Status:   201,
+		Errors:   []int{400, 409, 413},
+	},
+	"GET /files/{name}/uploads/{id}":    {ID: "getMultipartUpload", Summary: "A multipart upload and the parts received", Response: MultipartUpload{}, Errors: []int{404, 409}},
+	"DELETE /files/{name}/uploads/{id}": {ID: "abortMultipartUpload", Summary: "Drop a multipart upload and its parts", Status: 204, Errors: []int{404, 409}},
+	"PUT /files/{name}/uploads/{id}/parts/{part}": {
+		ID:       "uploadPart",
+		Summary:  "Store the raw request body as a part of a multipart upload",
+		BodyType: "application/octet-stream",
+		Response: UploadedPart{},
+		Errors:   []int{400, 404, 409, 413, 415, 503},
+	},
+	"POST /files/{name}/uploads/{id}/complete": {
+		ID:       "completeMultipartUpload",
+		Summary:  "Assemble the file from the parts of a multipart upload",
+		Headers:  writeParams,
+		Body:     CompleteMultipartRequest{},
+		Response: FileMetadata{},
+		Status:   201,
+		Errors:   []int{400, 404, 409, 412, 423},
+	},
+
+	"GET /snapshots":                     {ID: "listSnapshots", Summary: "List the snapshots", Response: []Snapshot{}},
+	"POST /snapshots":                    {ID: "createSnapshot", Summary: "Take a snapshot of the files", Response: Snapshot{}, Status: 201},
+	"DELETE /snapshots/{id}":             {ID: "deleteSnapshot", Summary: "Delete a snapshot", Status: 204, Errors: []int{404}},
+	"GET /snapshots/{id}/files":          {ID: "listSnapshotFiles", Summary: "Files of a snapshot", Response: []FileMetadata{}, Errors: []int{404}},
+	"GET /snapshots/{id}/files/{name}":   {ID: "downloadSnapshotFile", Summary: "Download a file as of a snapshot", Headers: []apiParam{{Name: "Range", Type: "string"}}, ResponseType: "application/octet-stream", Errors: []int{404, 416}},
+	"POST /snapshots/{id}/rollback":      {ID: "rollbackSnapshot", Summary: "Restore the files of a snapshot", Response: SnapshotRollback{}, Errors: []int{404}},
+	"GET /jobs/{id}":                     {ID: "getJob", Summary: "State of a job", Response: UploadJob{}, Errors: []int{404}},
+	"GET /jobs/{id}/events":              {ID: "streamJobEvents", Summary: "Progress of a job as server-sent events", ResponseType: "text/event-stream", Errors: []int{404}},
+	"GET /admin/audit":                   {ID: "getAuditLog", Summary: "Audit events, newest first", Query: []apiParam{{Name: "action", Type: "string"}, {Name: "caller", Type: "string"}, {Name: "since", Type: "string", Description: "RFC 3339"}, {Name: "until", Type: "string", Description: "RFC 3339"}, {Name: "limit", Type: "integer"}}, Response: []AuditEvent{}, Errors: []int{400}},
+	"GET /admin/files/{name}/blocks":     {ID: "getBlockMap", Summary: "Blocks of a file and their replicas", Query: []apiParam{{Name: "check", Type: "boolean"}}, Response: BlockMap{}, Errors: []int{404}},
+	"GET /admin/stats":                   {ID: "getClusterStats", Summary: "Statistics of the cluster", Response: ClusterStats{}},
+	"GET /admin/usage":                   {ID: "getUsage", Summary: "Traffic of the API keys by hour", Query: []apiParam{{Name: "key", Type: "string", Description: "Name of an API key, all if unset"}, {Name: "from", Type: "string", Description: "RFC 3339"}, {Name: "to", Type: "string", Description: "RFC 3339"}}, Response: []KeyUsage{}, Errors: []int{400}},
+	"GET /admin/usage/export":            {ID: "getUsageExport", Summary: "Usage of the API keys on a day, as CSV or NDJSON", Query: usageExportParams, ResponseType: "text/csv", Errors: []int{400}},
+	"POST /admin/usage/export":           {ID: "exportUsage", Summary: "Export the usage of the API keys on a day to a sink", Query: append(usageExportParams, apiParam{Name: "sink", Type: "string", Description: "webhook:URL, s3://bucket/prefix or a directory, FDS_USAGE_EXPORT_SINK if unset"}), Response: UsageExport{}, Errors: []int{400}},
+	"GET /admin/hotspots":                {ID: "getHotspots", Summary: "Most downloaded files and busiest nodes", Query: []apiParam{{Name: "window", Type: "string", Description: "Go duration, up to FDS_HOTSPOT_WINDOW"}, {Name: "limit", Type: "integer"}}, Response: HotspotReport{}, Errors: []int{400}},
+	"GET /admin/backups":                 {ID: "listBackups", Summary: "List the backups of a target", Query: []apiParam{{Name: "target", Type: "string"}}, Response: []BackupInfo{}, Errors: []int{400}},
+	"POST /admin/backups":                {ID: "createBackup", Summary: "Back the files up", Body: BackupRequest{}, Response: BackupSummary{}, Status: 201, Errors: []int{400}},
+	"POST /admin/backups/{id}/restore":   {ID: "restoreBackup", Summary: "Restore files from a backup", Body: BackupRequest{}, Response: BackupSummary{}, Errors: []int{400, 404}},
+	"POST /admin/tiering/run":            {ID: "runTiering", Summary: "Offload the cold files now", Response: TieringSummary{}, Errors: []int{400}},
+	"POST /admin/rebalance":              {ID: "rebalance", Summary: "Move block replicas to even out the usage of the nodes", Query: []apiParam{{Name: "dryRun", Type: "boolean", Description: "Only plan the moves"}, {Name: "threshold", Type: "number", Description: "Share of their capacity the nodes may use above that of the cluster, FDS_REBALANCE_THRESHOLD if unset"}, {Name: "maxBytes", Type: "integer", Description: "Most bytes to move, no limit if unset"}}, Response: RebalancePlan{}, Errors: []int{400}},
+	"POST /admin/scrub":                  {ID: "scrub", Summary: "Read back every replica of the blocks and check their content", Query: []apiParam{{Name: "file", Type: "string", Description: "Only the blocks of this file"}}, Response: ScrubSummary{}, Errors: []int{404}},
+	"POST /admin/gc":                     {ID: "collectGarbage", Summary: "Drop expired multipart uploads and the records of deleted corrupted blocks", Response: GCSummary{}},
+	"PUT /admin/nodes/drain":             {ID: "drainNode", Summary: "Stop placing blocks on a node", Query: []apiParam{{Name: "address", Type: "string", Required: true}}, Response: NodeStatus{}, Errors: []int{400, 404}},
+	"DELETE /admin/nodes/drain":          {ID: "undrainNode", Summary: "Place blocks on a drained node again", Query: []apiParam{{Name: "address", Type: "string", Required: true}}, Response: NodeStatus{}, Errors: []int{400, 404}},
+	"POST /admin/nodes/decommission":     {ID: "decommissionNode", Summary: "Move every block off a node and remove it", Query: []apiParam{{Name: "address", Type: "string", Required: true}}, Response: Decommission{}, Errors: []int{400, 404}},
+	"POST /admin/files/{name}/offload":   {ID: "offloadFile", Summary: "Move a file to the cold tier", Response: TieredFile{}, Errors: []int{400, 404, 409}},
+	"POST /admin/files/{name}/rehydrate": {ID: "rehydrateFile", Summary: "Move a file back to the nodes", Response: TieredFile{}, Errors: []int{400, 404, 409}},
+	"GET /admin/files/{name}/pin":        {ID: "getFilePin", Summary: "Nodes a file is pinned to", Response: FilePin{}, Errors: []int{404}},
+	"PUT /admin/files/{name}/pin":        {ID: "pinFile", Summary: "Pin a file to a set of nodes, moving its blocks onto them", Body: PinRequest{}, Response: PinResult{}, Errors: []int{400, 404, 409, 503}},
+	"DELETE /admin/files/{name}/pin":     {ID: "unpinFile", Summary: "Let the blocks of a file go to any node", Status: 204},
+	"GET /admin/maintenance":             {ID: "getMaintenance", Summary: "Maintenance mode", Response: Maintenance{}},
+	"PUT /admin/maintenance":             {ID: "enableMaintenance", Summary: "Turn the maintenance mode on", Body: MaintenanceRequest{}, Response: Maintenance{}, Errors: []int{400}},
+	"DELETE /admin/maintenance":          {ID: "disableMaintenance", Summary: "Turn the maintenance mode off", Status: 204},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// openAPIHandler serves the OpenAPI 3 document of the API registered on
+// router. It is built from the routes themselves on the first request, so
+// it lists every endpoint the router serves.
+func openAPIHandler(router *mux.Router) http.HandlerFunc {
+	document := sync.OnceValues(func() ([]byte, error) {
+		return json.Marshal(openAPIDocument(router))
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+
+		encoded, err := document()
+		if err != nil {
+			requestLogger(r.Context()).Error("Failed to encode the OpenAPI document", zap.Error(err))
+			respondWithError(w, http.StatusInternalServerError, "Failed to encode the OpenAPI document")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(encoded)
+	}
+}
+
+// openAPIDocument describes the versioned routes of router, and the
+// unversioned ones registered at its root, leaving out the legacy aliases.
+func openAPIDocument(router *mux.Router) map[string]any {
+	schemas := &schemaSet{schemas: map[string]any{}}
+	errorSchema := schemas.of(reflect.TypeOf(ErrorResponse{}))
+	paths := map[string]map[string]any{}
+
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path, versioned := strings.CutPrefix(template, apiV1)
+		if !versioned && len(ancestors) > 0 {
+			return nil
+		}
+
+		for _, method := range methods {
+			if method == http.MethodHead {
+				continue
+			}
+			doc, documented := apiDocs[method+" "+path]
+			if !documented {
+				doc.ID = strings.ToLower(method) + strings.NewReplacer("/", "_", "{", "", "}", "").Replace(path)
+			}
+			operation := openAPIOperation(schemas, errorSchema, doc, path, versioned)
+			key := pathParamPattern.ReplaceAllString(template, "{$1}")
+			if paths[key] == nil {
+				paths[key] = map[string]any{}
+			}
+			paths[key][strings.ToLower(method)] = operation
+		}
+		return nil
+	})
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "DFS central server",
+			"version":     strings.TrimPrefix(version.Version, "v"),
+			"description": "The endpoints are also served without the " + apiV1 + " prefix, as deprecated aliases.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]any{
+				"adminToken": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIOperation(schemas *schemaSet, errorSchema map[string]any, doc apiDoc, path string, versioned bool) map[string]any {
+	operation := map[string]any{"operationId": doc.ID}
+	if doc.Summary != "" {
+		operation["summary"] = doc.Summary
+	}
+	if versioned {
+		segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+		operation["tags"] = []string{segments[0]}
+	}
+	if strings.HasPrefix(path, "/admin/") {
+		operation["security"] = []map[string][]string{{"adminToken": {}}}
+	}
+
+	var parameters []map[string]any
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]any{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, group := range []struct {
+		in     string
+		params []apiParam
+	}{{"query", doc.Query}, {"header", doc.Headers}} {
+		for _, param := range group.params {
+			parameter := map[string]any{"name": param.Name, "in": group.in, "schema": map[string]any{"type": param.Type}}
+			if param.Required {
+				parameter["required"] = true
+			}
+			if param.Description != "" {
+				parameter["description"] = param.Description
+			}
+			parameters = append(parameters, parameter)
+		}
+	}
+	if parameters != nil {
+		operation["parameters"] = parameters
+	}
+
+	if doc.Body != nil {
+		operation["requestBody"] = map[string]any{
+			"content": map[string]any{"application/json": map[string]any{"schema": schemas.of(reflect.TypeOf(doc.Body))}},
+		}
+	} else if doc.BodyType != "" {
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{doc.BodyType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}},
+		}
+	}
+
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if doc.Response != nil {
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.of(reflect.TypeOf(doc.Response))}}
+	} else if doc.ResponseType != "" {
+		success["content"] = map[string]any{doc.ResponseType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+	}
+	responses := map[string]any{strconv.Itoa(status): success}
+	for _, code := range doc.Errors {
+		responses[strconv.Itoa(code)] = errorResponse(errorSchema, http.StatusText(code))
+	}
+	responses["default"] = errorResponse(errorSchema, "Error")
+	operation["responses"] = responses
+	return operation
+}
+
+func errorResponse(schema map[string]any, description string) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+// schemaSet derives JSON schemas from Go types the way encoding/json encodes
+// them. Named structs are added to the components of the document and
+// referenced.
+type schemaSet struct {
+	schemas map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s *schemaSet) of(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.of(t.Elem())
+		if _, ref := schema["$ref"]; ref {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := s.schemas[t.Name()]; !ok {
+			// Registered first, for the types that refer to themselves.
+			s.schemas[t.Name()] = map[string]any{}
+			s.schemas[t.Name()] = s.object(t)
+		}
+		return ref
+	}
+	return map[string]any{}
+}
+
+func (s *schemaSet) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	s.fields(t, properties, &required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (s *schemaSet) fields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				s.fields(embedded, properties, required)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = s.of(field.Type)
+		optional := field.Type.Kind() == reflect.Pointer
+		for _, option := range strings.Split(options, ",") {
+			optional = optional || option == "omitempty" || option == "omitzero"
+		}
+		if !optional {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Small files are not worth blocks and Redis keys of their own. They are
+// appended to a shared container instead, which is staged in Redis while it
+// fills up and then sealed: its live entries are stored on the nodes like the
+// blocks of a file named containerPrefix + id. A packed file's metadata
+// records the container and its offset there.
+//
+// Deleting or overwriting a packed file leaves dead bytes in its container.
+// Once they reach FDS_PACK_COMPACT_PERCENT of a sealed container, its live
+// entries are rewritten into a new one and the old container is deleted.
+
+// containerPrefix starts the internal file names of containers, which uploads
+// may not use.
+const containerPrefix = ".pack-"
+
+// PackedLocation is where a packed file lives in its container.
+type PackedLocation struct {
+	Container string `json:"container"`
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+}
+
+const (
+	packOpenKey       = "pack:open"
+	packContainersKey = "pack:containers"
+)
+
+// packDataKey holds the content of a container until it is sealed.
+func packDataKey(id string) string { return "pack:data:" + id }
+
+// packContainerKey holds the size, live bytes and sealed flag of a container.
+func packContainerKey(id string) string { return "pack:container:" + id }
+
+// packFilesKey holds the names of the files that were packed into a
+// container. The metadata index decides which of them are still live.
+func packFilesKey(id string) string { return "pack:files:" + id }
+
+func containerFileName(id string) string { return containerPrefix + id }
+
+func isContainerName(name string) bool { return strings.HasPrefix(name, containerPrefix) }
+
+func newContainerID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type packer struct {
+	files *fileManager
+	mutex sync.Mutex
+	// rewriting holds the containers being sealed or compacted.
+	rewriting map[string]bool
+}
+
+func newPacker(files *fileManager) *packer {
+	return &packer{files: files, rewriting: make(map[string]bool)}
+}
+
+// accepts reports whether a file of size bytes is packed.
+func (p *packer) accepts(size int) bool {
+	return config.PackThreshold > 0 && size <= config.PackThreshold
+}
+
+// Store appends body to the open container and records fileName as packed
+// there. The upload that fills the container also seals it, in the
+// background.
+func (p *packer) Store(ctx context.Context, fileName string, body []byte) error {
+	logger := requestLogger(ctx)
+	rdb := p.files.redisManager.redisClient
+	fileTransferSize.WithLabelValues("upload").Observe(float64(len(body)))
+
+	previous, previousErr := p.files.redisManager.GetFileMetadata(fileName)
+
+	p.mutex.Lock()
+	id, err := p.openContainerLocked(ctx)
+	if err != nil {
+		p.mutex.Unlock()
+		logger.Error("Failed to open a container", zap.Error(err))
+		return errors.New("failed to store file metadata")
+	}
+
+	end, err := rdb.Append(ctx, packDataKey(id), string(body)).Result()
+	if err != nil {
+		p.mutex.Unlock()
+		logger.Error("Failed to append file to container", zap.String("container", id), zap.Error(err))
+		return errors.New("failed to store file content")
+	}
+	location := PackedLocation{Container: id, Offset: end - int64(len(body)), Length: int64(len(body))}
+
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, packContainerKey(id), "size", end)
+	pipe.HIncrBy(ctx, packContainerKey(id), "live", location.Length)
+	pipe.SAdd(ctx, packFilesKey(id), fileName)
+	_, err = pipe.Exec(ctx)
+	if err == nil {
+		_, err = p.files.redisManager.SaveFileMetadataIf(FileMetadata{
+			Name:        fileName,
+			Size:        int64(len(body)),
+			Packed:      &location,
+			CreatedAt:   time.Now().UTC(),
+			Annotations: uploadAnnotations(ctx, fileName),
+			Owner:       fileOwner(ctx),
+		}, ifMatchFromContext(ctx))
+	}
+
+	full := end >= int64(config.PackContainerSize)
+	if full {
+		rdb.Del(ctx, packOpenKey)
+	}
+	p.mutex.Unlock()
+
+	if errors.Is(err, errPreconditionFailed) {
+		// The content just appended is dead space.
+		p.Release(ctx, fileName, location)
+		return err
+	}
+	if err != nil {
+		logger.Error("Failed to store file in the metadata index", zap.Error(err))
+		return errors.New("failed to store file metadata")
+	}
+
+	if previousErr == nil {
+		if previous.Packed != nil {
+			p.Release(ctx, fileName, *previous.Packed)
+		} else if err := p.files.removeBlocks(ctx, fileName); err != nil && !errors.Is(err, ErrFileNotFound) {
+			logger.Warn("Failed to delete the blocks of the previous version", zap.String("fileName", fileName), zap.Error(err))
+		} else {
+			// The file is packed now, so removeBlocks only knew the blocks
+			// under its name.
+			p.files.removeRewrittenBlocks(ctx, previous)
+		}
+	}
+
+	logger.Info("File packed",
+		zap.String("fileName", fileName),
+		zap.String("container", id),
+		zap.Int64("offset", location.Offset),
+	)
+
+	if full {
+		go p.sealPending(context.WithoutCancel(ctx))
+	}
+	return nil
+}
+
+// openContainerLocked returns the container small files are appended to,
+// starting a new one if there is none.
+func (p *packer) openContainerLocked(ctx context.Context) (string, error) {
+	rdb := p.files.redisManager.redisClient
+
+	id, err := rdb.Get(ctx, packOpenKey).Result()
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return "", err
+	}
+
+	id = newContainerID()
+	pipe := rdb.TxPipeline()
+	pipe.SAdd(ctx, packContainersKey, id)
+	pipe.HSet(ctx, packContainerKey(id), "size", 0, "live", 0, "sealed", 0)
+	pipe.Set(ctx, packOpenKey, id, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Read returns the content of a packed file.
+func (p *packer) Read(ctx context.Context, location PackedLocation) ([]byte, error) {
+	if location.Length == 0 {
+		return []byte{}, nil
+	}
+
+	staged, err := p.files.redisManager.redisClient.GetRange(ctx, packDataKey(location.Container), location.Offset, location.Offset+location.Length-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(staged)) == location.Length {
+		fileTransferSize.WithLabelValues("download").Observe(float64(len(staged)))
+		return []byte(staged), nil
+	}
+
+	content, err := p.files.reconstructFile(ctx, newPhaseTimer(), containerFileName(location.Container))
+	if err != nil {
+		return nil, err
+	}
+	if location.Offset+location.Length > int64(len(content)) {
+		return nil, fmt.Errorf("container %s is shorter than the packed file", location.Container)
+	}
+	return bytes.Clone(content[location.Offset : location.Offset+location.Length]), nil
+}
+
+// Release marks the bytes of a deleted or overwritten packed file as dead and
+// compacts its container in the background if enough of it is dead.
+func (p *packer) Release(ctx context.Context, fileName string, location PackedLocation) {
+	rdb := p.files.redisManager.redisClient
+
+	p.mutex.Lock()
+	pipe := rdb.TxPipeline()
+	// An overwrite packed into the same container is still listed there.
+	current, err := p.files.redisManager.GetFileMetadata(fileName)
+	if err != nil || current.Packed == nil || current.Packed.Container != location.Container {
+		pipe.SRem(ctx, packFilesKey(location.Container), fileName)
+	}
+	pipe.HIncrBy(ctx, packContainerKey(location.Container), "live", -location.Length)
+	_, err = pipe.Exec(ctx)
+	p.mutex.Unlock()
+
+	if err != nil {
+		requestLogger(ctx).Warn("Failed to release packed file",
+			zap.String("fileName", fileName),
+			zap.String("container", location.Container),
+			zap.Error(err),
+		)
+		return
+	}
+
+	go p.maybeCompact(context.WithoutCancel(ctx), location.Container)
+}
+
+type containerInfo struct {
+	size   int64
+	live   int64
+	sealed bool
+}
+
+func (p *packer) containerInfo(ctx context.Context, id string) (containerInfo, error) {
+	values, err := p.files.redisManager.redisClient.HGetAll(ctx, packContainerKey(id)).Result()
+	if err != nil {
+		return containerInfo{}, err
+	}
+	var info containerInfo
+	info.size, _ = strconv.ParseInt(values["size"], 10, 64)
+	info.live, _ = strconv.ParseInt(values["live"], 10, 64)
+	info.sealed = values["sealed"] == "1"
+	return info, nil
+}
+
+// maybeCompact deletes a container without live files and rewrites a sealed
+// one whose dead bytes reached FDS_PACK_COMPACT_PERCENT. The open container
+// is left alone; sealing drops its dead bytes anyway.
+func (p *packer) maybeCompact(ctx context.Context, id string) {
+	if open, _ := p.files.redisManager.redisClient.Get(ctx, packOpenKey).Result(); open == id {
+		return
+	}
+
+	info, err := p.containerInfo(ctx, id)
+	if err != nil || info.size == 0 {
+		return
+	}
+	if !info.sealed {
+		return
+	}
+	if info.live > 0 && (info.size-info.live)*100 < info.size*int64(config.PackCompactPercent) {
+		return
+	}
+
+	if err := p.rewrite(ctx, id); err != nil {
+		requestLogger(ctx).Warn("Failed to compact container", zap.String("container", id), zap.Error(err))
+	}
+}
+
+// sealPending seals every container that is no longer open but still staged
+// in Redis, including those whose sealing failed before.
+func (p *packer) sealPending(ctx context.Context) {
+	rdb := p.files.redisManager.redisClient
+
+	ids, err := rdb.SMembers(ctx, packContainersKey).Result()
+	if err != nil {
+		requestLogger(ctx).Warn("Failed to list containers", zap.Error(err))
+		return
+	}
+	open, _ := rdb.Get(ctx, packOpenKey).Result()
+
+	for _, id := range ids {
+		if id == open {
+			continue
+		}
+		info, err := p.containerInfo(ctx, id)
+		if err != nil || info.sealed {
+			continue
+		}
+		if err := p.rewrite(ctx, id); err != nil {
+			requestLogger(ctx).Warn("Failed to seal container", zap.String("container", id), zap.Error(err))
+		}
+	}
+}
+
+type packedEntry struct {
+	name     string
+	location PackedLocation
+}
+
+// rewrite copies the live files of a container into a new sealed container
+// stored on the nodes, points their metadata at it and deletes the old
+// container.
+func (p *packer) rewrite(ctx context.Context, id string) error {
+	logger := requestLogger(ctx)
+	rdb := p.files.redisManager.redisClient
+
+	p.mutex.Lock()
+	if p.rewriting[id] {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.rewriting[id] = true
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		delete(p.rewriting, id)
+		p.mutex.Unlock()
+	}()
+
+	entries, err := p.liveEntries(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return p.removeContainer(ctx, id)
+	}
+
+	content, err := p.content(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	newID := newContainerID()
+	var packed bytes.Buffer
+	moved := make([]packedEntry, 0, len(entries))
+	for _, entry := range entries {
+		end := entry.location.Offset + entry.location.Length
+		if end > int64(len(content)) {
+			return fmt.Errorf("container %s is shorter than its file %s", id, entry.name)
+		}
+		location := PackedLocation{Container: newID, Offset: int64(packed.Len()), Length: entry.location.Length}
+		packed.Write(content[entry.location.Offset:end])
+		moved = append(moved, packedEntry{name: entry.name, location: location})
+	}
+
+	// The new container is registered as sealed right away, so that
+	// sealPending leaves it alone while it is being stored.
+	pipe := rdb.TxPipeline()
+	pipe.SAdd(ctx, packContainersKey, newID)
+	pipe.HSet(ctx, packContainerKey(newID), "size", packed.Len(), "live", 0, "sealed", 1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if _, _, err := p.files.storeBlocks(ctx, newPhaseTimer(), containerFileName(newID), packed.Bytes(), 0, noopUploadObserver{}); err != nil {
+		rdb.Del(ctx, packContainerKey(newID))
+		rdb.SRem(ctx, packContainersKey, newID)
+		return err
+	}
+
+	// Files deleted or overwritten while the container was being stored are
+	// not moved.
+	p.mutex.Lock()
+	var live int64
+	for i, entry := range moved {
+		metadata, err := p.files.redisManager.GetFileMetadata(entry.name)
+		if err != nil || metadata.Packed == nil || *metadata.Packed != entries[i].location {
+			continue
+		}
+		metadata.Packed = &entry.location
+		if err := p.files.redisManager.UpdateFileMetadata(metadata); err != nil {
+			logger.Warn("Failed to move packed file", zap.String("fileName", entry.name), zap.Error(err))
+			continue
+		}
+		rdb.SAdd(ctx, packFilesKey(newID), entry.name)
+		live += entry.location.Length
+	}
+	err = rdb.HSet(ctx, packContainerKey(newID), "live", live).Err()
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Container rewritten",
+		zap.String("container", id),
+		zap.String("newContainer", newID),
+		zap.Int("files", len(moved)),
+		zap.Int("size", packed.Len()),
+	)
+	return p.removeContainer(ctx, id)
+}
+
+// liveEntries returns the files whose metadata still points into the
+// container.
+func (p *packer) liveEntries(ctx context.Context, id string) ([]packedEntry, error) {
+	names, err := p.files.redisManager.redisClient.SMembers(ctx, packFilesKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]packedEntry, 0, len(names))
+	for _, name := range names {
+		metadata, err := p.files.redisManager.GetFileMetadata(name)
+		if errors.Is(err, ErrFileNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if metadata.Packed != nil && metadata.Packed.Container == id {
+			entries = append(entries, packedEntry{name: name, location: *metadata.Packed})
+		}
+	}
+	return entries, nil
+}
+
+// content returns the whole content of a container, staged or sealed.
+func (p *packer) content(ctx context.Context, id string) ([]byte, error) {
+	staged, err := p.files.redisManager.redisClient.Get(ctx, packDataKey(id)).Bytes()
+	if err == nil {
+		return staged, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	return p.files.reconstructFile(ctx, newPhaseTimer(), containerFileName(id))
+}
+
+func (p *packer) removeContainer(ctx context.Context, id string) error {
+	rdb := p.files.redisManager.redisClient
+
+	staged, err := rdb.Exists(ctx, packDataKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	if staged == 0 {
+		if err := p.files.removeBlocks(ctx, containerFileName(id)); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
+	}
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, packDataKey(id), packContainerKey(id), packFilesKey(id))
+	pipe.SRem(ctx, packContainersKey, id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var errRangeNotSatisfiable = errors.New("range starts past the end of the file")
+
+// PatchFileRange overwrites the bytes of an existing file starting at offset,
+// extending the file when the data runs past its end. In the seekable layout
+// only the blocks the range overlaps are read and rewritten.
+func (f *fileManager) PatchFileRange(ctx context.Context, fileName string, offset int64, data []byte) (FileMetadata, error) {
+	timer := newPhaseTimer()
+	metadata, err := f.patchFileRange(ctx, timer, fileName, offset, data)
+	timer.report(requestLogger(ctx), "patch", config.SlowUploadThreshold, len(data), err, zap.String("fileName", fileName))
+	recordAudit(ctx, AuditFilePatch, fileName, err)
+	return metadata, err
+}
+
+func (f *fileManager) patchFileRange(ctx context.Context, timer *phaseTimer, fileName string, offset int64, data []byte) (FileMetadata, error) {
+	logger := requestLogger(ctx)
+	if err := f.checkWrite(ctx, fileName); err != nil {
+		return FileMetadata{}, err
+	}
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	timer.Phase("metadata")
+	if err != nil {
+		return FileMetadata{}, err
+	}
+	if offset < 0 || offset > metadata.Size {
+		return FileMetadata{}, errRangeNotSatisfiable
+	}
+	if len(data) == 0 {
+		return metadata, nil
+	}
+
+	if metadata.Packed == nil && metadata.Extents != nil {
+		metadata, rewritten, err := f.patchExtents(ctx, timer, metadata, offset, data)
+		if err != nil {
+			return FileMetadata{}, err
+		}
+		logger.Info("File patched",
+			zap.String("fileName", fileName),
+			zap.Int64("offset", offset),
+			zap.Int("patchSize", len(data)),
+			zap.Int("numOfBlocks", metadata.Blocks),
+			zap.Int("rewrittenBlocks", rewritten),
+		)
+		return metadata, nil
+	}
+
+	// Packed files and files stored as a single gzip stream are patched in
+	// their whole content.
+	var content []byte
+	if metadata.Packed != nil {
+		content, err = f.packer.Read(ctx, *metadata.Packed)
+		content = bytes.Clone(content)
+		timer.Phase("container")
+	} else {
+		content, err = f.reconstructFile(ctx, timer, fileName)
+	}
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	if end := int(offset) + len(data); end > len(content) {
+		content = append(content, make([]byte, end-len(content))...)
+	}
+	copy(content[offset:], data)
+
+	if metadata.Packed != nil {
+		if err := f.storeWhole(ctx, timer, fileName, content, metadata.Annotations); err != nil {
+			return FileMetadata{}, err
+		}
+		return f.redisManager.GetFileMetadata(fileName)
+	}
+
+	metadata, rewritten, err := f.rewriteBlocks(ctx, timer, metadata, content)
+	if err != nil {
+		return FileMetadata{}, err
+	}
+
+	logger.Info("File patched",
+		zap.String("fileName", fileName),
+		zap.Int64("offset", offset),
+		zap.Int("patchSize", len(data)),
+		zap.Int("numOfBlocks", metadata.Blocks),
+		zap.Int("rewrittenBlocks", rewritten),
+	)
+	return metadata, nil
+}
+
+// patchExtents patches a file in the seekable layout from its blocks: only
+// the blocks the range overlaps are fetched, patched and compressed again,
+// and data running past the end of the file goes into new blocks, as for an
+// append. It returns the updated metadata and the number of blocks written.
+func (f *fileManager) patchExtents(ctx context.Context, timer *phaseTimer, metadata FileMetadata, offset int64, data []byte) (FileMetadata, int, error) {
+	numOfBlocks, err := f.redisManager.GetNumberOfBlocksOfAFile(GenerateFileHash(metadata.Name))
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+
+	end := offset + int64(len(data))
+	inside := data[:min(end, metadata.Size)-offset]
+
+	// Each block overlapped is compressed on its own into a buffer handed
+	// back once the blocks are distributed.
+	var buffers []*bytes.Buffer
+	defer func() {
+		for _, buffer := range buffers {
+			putBuffer(buffer)
+		}
+	}()
+
+	var changed []FileBlock
+	for i, extent := range metadata.Extents {
+		if len(inside) == 0 || extent.Offset+extent.Length <= offset || extent.Offset >= offset+int64(len(inside)) {
+			continue
+		}
+		content, err := f.readExtent(ctx, timer, metadata, i)
+		if err != nil {
+			return FileMetadata{}, 0, fmt.Errorf("failed to retrieve block %d: %w", i+1, err)
+		}
+		from := max(offset, extent.Offset)
+		n := copy(content[from-extent.Offset:], inside[from-offset:])
+		if n == 0 {
+			continue
+		}
+
+		compressed, err := compressBody(ctx, content)
+		if err != nil {
+			return FileMetadata{}, 0, err
+		}
+		buffers = append(buffers, compressed)
+		block := FileBlock{bytes: compressed.Bytes(), position: i + 1}
+		if f.blockUnchanged(metadata, block) {
+			continue
+		}
+		changed = append(changed, block)
+	}
+
+	var extents []BlockExtent
+	if end > metadata.Size {
+		compressed, blocks, added, err := compressBlocks(ctx, data[len(inside):], metadata.BlockSize, numOfBlocks+1, metadata.Size)
+		if err != nil {
+			return FileMetadata{}, 0, err
+		}
+		buffers = append(buffers, compressed)
+		changed = append(changed, blocks...)
+		extents = added
+	}
+	timer.Phase("compress")
+
+	previous := metadata
+	metadata.Size = max(metadata.Size, end)
+	metadata.Extents = append(slices.Clip(metadata.Extents), extents...)
+	metadata, err = f.storeRewrite(ctx, timer, previous, numOfBlocks, metadata, numOfBlocks+len(extents), changed)
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+	return metadata, len(changed), nil
+}
+
+// blockUnchanged reports whether block holds what the block at its position
+// in the file at metadata already holds, and need not be stored again.
+func (f *fileManager) blockUnchanged(metadata FileMetadata, block FileBlock) bool {
+	location, err := f.redisManager.GetBlockLocation(metadata.blockName(block.position))
+	return err == nil && location.Hash == fmt.Sprintf("%x", GenerateBlockHash(block.bytes))
+}
+
+// rewriteBlocks stores content as the new version of a file kept in blocks,
+// in the seekable layout. Blocks are compressed independently, so those
+// whose content did not change keep their hash and are reused; only the
+// others are sent to the nodes. A file stored as a single gzip stream is
+// rewritten whole. It returns the updated metadata and the number of blocks
+// rewritten.
+func (f *fileManager) rewriteBlocks(ctx context.Context, timer *phaseTimer, metadata FileMetadata, content []byte) (FileMetadata, int, error) {
+	numOfBlocks, err := f.redisManager.GetNumberOfBlocksOfAFile(GenerateFileHash(metadata.Name))
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+
+	compressed, blocks, extents, err := compressBlocks(ctx, content, metadata.BlockSize, 1, 0)
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+	defer putBuffer(compressed)
+	timer.Phase("compress")
+
+	// Only the blocks whose content changed are sent again.
+	var changed []FileBlock
+	for _, block := range blocks {
+		if block.position <= numOfBlocks && f.blockUnchanged(metadata, block) {
+			continue
+		}
+		changed = append(changed, block)
+	}
+	timer.Phase("diff")
+
+	previous := metadata
+	metadata.Size = int64(len(content))
+	metadata.Extents = extents
+	metadata, err = f.storeRewrite(ctx, timer, previous, numOfBlocks, metadata, len(blocks), changed)
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+	return metadata, len(changed), nil
+}
+
+// patchOffset reads where a patch starts, from a "Content-Range: bytes
+// first-last/*" header or an offset query parameter. The range of the header
+// must cover the body exactly.
+func patchOffset(r *http.Request, bodyLength int) (int64, error) {
+	if header := r.Header.Get("Content-Range"); header != "" {
+		spec, ok := strings.CutPrefix(header, "bytes ")
+		if !ok {
+			return 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+		spec, _, _ = strings.Cut(spec, "/")
+		firstStr, lastStr, ok := strings.Cut(spec, "-")
+		if !ok {
+			return 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+		first, err := strconv.ParseInt(firstStr, 10, 64)
+		if err != nil || first < 0 {
+			return 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+		last, err := strconv.ParseInt(lastStr, 10, 64)
+		if err != nil || last < first {
+			return 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+		if last-first+1 != int64(bodyLength) {
+			return 0, fmt.Errorf("Content-Range covers %d bytes but the body has %d", last-first+1, bodyLength)
+		}
+		return first, nil
+	}
+
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, fmt.Errorf("invalid offset %q", offsetStr)
+		}
+		return offset, nil
+	}
+	return 0, errors.New("Content-Range or offset is required")
+}
+
+// PatchFile overwrites a byte range of an existing file with the request
+// body.
+func (f *fileManager) PatchFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}").Inc()
+	// The hooks would only see the patch, not the file it ends up in.
+	if refuseWhileHooked(w, "Patches") {
+		return
+	}
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	if !limitUploadBody(w, r, 0) {
+		return
+	}
+	ticket, ok := admitUpload(w, r)
+	if !ok {
+		return
+	}
+	defer ticket.Release()
+
+	buf, err := readPooled(r.Body, r.ContentLength)
+	if isBodyTooLarge(err) {
+		respondUploadTooLarge(w)
+		return
+	}
+	if errors.Is(err, errUploadsSaturated) {
+		respondUploadsSaturated(w)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to read patch content", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read file content")
+		return
+	}
+	defer putBuffer(buf)
+
+	offset, err := patchOffset(r, buf.Len())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata, err := f.PatchFileRange(r.Context(), fileName, offset, buf.Bytes())
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if errors.Is(err, errRangeNotSatisfiable) {
+		respondWithError(w, http.StatusRequestedRangeNotSatisfiable, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to patch file", zap.String("fileName", fileName), zap.Error(err))
+		respondUploadError(w, fileName, "Failed to patch file", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", fileETag(metadata.Version))
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(metadata)
+}
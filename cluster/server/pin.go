@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// filePinsKey is a hash of file name to the FilePin of the file. Pins belong
+// to the name: they outlive overwrites and go away with the file.
+const filePinsKey = "file_pins"
+
+var (
+	errNotPinned = errors.New("file is not pinned")
+	// errNoPinnedNodes fails the blocks of a pinned file when none of its
+	// nodes can take them.
+	errNoPinnedNodes = fmt.Errorf("%w: none of the pinned nodes is available", errNoNodes)
+)
+
+// FilePin keeps the blocks of a file on a set of nodes, such as those
+// co-located with a compute cluster.
+type FilePin struct {
+	File string `json:"file"`
+	// Nodes are the addresses or IDs of the nodes, as given; IDs follow a
+	// node that moves.
+	Nodes    []string  `json:"nodes"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+type PinRequest struct {
+	Nodes []string `json:"nodes"`
+}
+
+// PinResult is a pin with the blocks moved onto its nodes to honor it.
+type PinResult struct {
+	FilePin
+	MovedBlocks int   `json:"moved_blocks"`
+	MovedBytes  int64 `json:"moved_bytes"`
+}
+
+func (r *RedisManager) GetFilePin(fileName string) (FilePin, error) {
+	val, err := r.redisClient.HGet(context.Background(), filePinsKey, fileName).Result()
+	if errors.Is(err, redis.Nil) {
+		return FilePin{}, errNotPinned
+	}
+	if err != nil {
+		return FilePin{}, err
+	}
+	var pin FilePin
+	err = json.Unmarshal([]byte(val), &pin)
+	return pin, err
+}
+
+func (r *RedisManager) SaveFilePin(pin FilePin) error {
+	encoded, err := json.Marshal(pin)
+	if err != nil {
+		return err
+	}
+	return r.redisClient.HSet(context.Background(), filePinsKey, pin.File, encoded).Err()
+}
+
+func (r *RedisManager) DeleteFilePin(fileName string) error {
+	return r.redisClient.HDel(context.Background(), filePinsKey, fileName).Err()
+}
+
+// pinnedAddresses returns the current address of each node of the pin found
+// in the registry, along with the entries of the pin matching no node.
+func (r *RedisManager) pinnedAddresses(nodes []string) ([]string, []string, error) {
+	statuses, err := r.ListNodeStatuses()
+	if err != nil {
+		return nil, nil, err
+	}
+	var addresses, unknown []string
+	for _, node := range nodes {
+		i := slices.IndexFunc(statuses, func(status NodeStatus) bool {
+			return status.Address == node || (status.ID != "" && status.ID == node)
+		})
+		if i < 0 {
+			unknown = append(unknown, node)
+			continue
+		}
+		if !slices.Contains(addresses, statuses[i].Address) {
+			addresses = append(addresses, statuses[i].Address)
+		}
+	}
+	return addresses, unknown, nil
+}
+
+type pinnedNodesKey struct{}
+
+// withPinnedNodes restricts the placement of the blocks written with ctx to
+// the nodes at addresses.
+func withPinnedNodes(ctx context.Context, addresses []string) context.Context {
+	return context.WithValue(ctx, pinnedNodesKey{}, addresses)
+}
+
+// pinnedNodes returns the nodes blocks are restricted to, nil for any.
+func pinnedNodes(ctx context.Context) []string {
+	addresses, _ := ctx.Value(pinnedNodesKey{}).([]string)
+	return addresses
+}
+
+// placementContext returns ctx restricted to the pinned nodes of fileName,
+// if it is pinned.
+func (f *fileManager) placementContext(ctx context.Context, fileName string) (context.Context, error) {
+	pin, err := f.redisManager.GetFilePin(fileName)
+	if errors.Is(err, errNotPinned) {
+		return ctx, nil
+	}
+	if err != nil {
+		return ctx, err
+	}
+	addresses, _, err := f.redisManager.pinnedAddresses(pin.Nodes)
+	if err != nil {
+		return ctx, err
+	}
+	if len(addresses) == 0 {
+		return ctx, errNoPinnedNodes
+	}
+	return withPinnedNodes(ctx, addresses), nil
+}
+
+func (f *fileManager) isPinned(fileName string) bool {
+	pinned, _ := f.redisManager.redisClient.HExists(context.Background(), filePinsKey, fileName).Result()
+	return pinned
+}
+
+// moveToPinnedNodes moves the replicas of the blocks of a file that are not
+// on one of the nodes at pinned onto them, keeping as many replicas as the
+// pinned nodes allow. Blocks in the cold tier are left there, and placed on
+// the pinned nodes when they are rehydrated. It returns the number of blocks
+// moved and their size.
+func (f *fileManager) moveToPinnedNodes(ctx context.Context, fileName string, pinned []string) (int, int64, error) {
+	logger := requestLogger(ctx)
+
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	stats, err := f.nodeManager.PlacementStats()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to retrieve node statistics: %w", err)
+	}
+	f.nodeManager.NodeStats = stats
+
+	moved, movedBytes := 0, int64(0)
+	for i := 1; i <= numOfBlocks; i++ {
+		blockName := metadata.blockName(i)
+		location, err := f.redisManager.GetBlockLocation(blockName)
+		if err != nil {
+			return moved, movedBytes, err
+		}
+		if isColdAddress(location.NodeAddress) {
+			continue
+		}
+
+		var replicas []Replica
+		for _, replica := range location.Replicas {
+			if slices.Contains(pinned, replica.Address) {
+				replicas = append(replicas, replica)
+			}
+		}
+		missing := len(location.Replicas) - len(replicas)
+		if missing == 0 {
+			continue
+		}
+
+		data, err := f.healthyCopy(ctx, location, blockName)
+		if err != nil {
+			return moved, movedBytes, fmt.Errorf("failed to read block %d: %w", i, err)
+		}
+		hash := GenerateBlockHash(data)
+		for range missing {
+			holders := BlockLocation{Replicas: replicas}.Addresses()
+			node, relaxed, ok := f.nodeManager.selectReplicaNode(FileBlock{bytes: data, position: i}, pinned, holders, nil)
+			if !ok {
+				break
+			}
+			if relaxed && len(holders) > 0 {
+				replicaPlacementDegraded.WithLabelValues("shared_domain").Inc()
+			}
+			err := nodeRetryPolicy().Do(ctx, "blockPush", func() error {
+				return f.streamBlock(ctx, newPhaseTimer(), node.address, hash, blockName+".bin", data, func(int64) {})
+			})
+			if err != nil {
+				return moved, movedBytes, fmt.Errorf("failed to move block %d to %s: %w", i, node.address, err)
+			}
+			replicas = append(replicas, Replica{Address: node.address, State: ReplicaHealthy})
+		}
+		if len(replicas) == 0 {
+			return moved, movedBytes, errNoPinnedNodes
+		}
+
+		// A block rewritten in the meantime already went to the pinned
+		// nodes; the copies just written are left for the new version.
+		if current, err := f.redisManager.GetBlockLocation(blockName); err != nil || current.Hash != location.Hash {
+			continue
+		}
+		if err := f.redisManager.SetBlockReplicas(ctx, blockName, replicas); err != nil {
+			return moved, movedBytes, fmt.Errorf("failed to record the location of block %d: %w", i, err)
+		}
+		f.deleteFormerReplicas(ctx, blockName, location.Addresses(), BlockLocation{Replicas: replicas})
+		moved++
+		movedBytes += int64(len(data))
+	}
+
+	if moved > 0 {
+		logger.Info("File moved to its pinned nodes",
+			zap.String("fileName", fileName),
+			zap.Strings("nodes", pinned),
+			zap.Int("blocks", moved),
+			zap.Int64("bytes", movedBytes),
+		)
+	}
+	return moved, movedBytes, nil
+}
+
+// followPin moves a file written without going through the placement of
+// blocks, such as a copy duplicated by the nodes, to its pinned nodes.
+func (f *fileManager) followPin(ctx context.Context, fileName string) {
+	pin, err := f.redisManager.GetFilePin(fileName)
+	if err != nil {
+		return
+	}
+	addresses, _, err := f.redisManager.pinnedAddresses(pin.Nodes)
+	if err == nil && len(addresses) == 0 {
+		err = errNoPinnedNodes
+	}
+	if err == nil {
+		_, _, err = f.moveToPinnedNodes(ctx, fileName, addresses)
+	}
+	if err != nil {
+		requestLogger(ctx).Warn("Failed to move the file to its pinned nodes", zap.String("fileName", fileName), zap.Error(err))
+	}
+}
+
+// PinFile pins a file to the nodes of the JSON body, given by address or ID,
+// and moves its blocks onto them. Its blocks are written to those nodes only
+// from then on, and the cold-tier passes leave it alone.
+func (f *fileManager) PinFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/files/{name}/pin").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	var req PinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid pin request: "+err.Error())
+		return
+	}
+	if len(req.Nodes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "nodes is required")
+		return
+	}
+
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to retrieve file metadata", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata")
+		return
+	}
+	if metadata.Packed != nil {
+		respondWithError(w, http.StatusConflict, "Packed files share their blocks and cannot be pinned")
+		return
+	}
+
+	addresses, unknown, err := f.redisManager.pinnedAddresses(req.Nodes)
+	if err != nil {
+		logger.Error("Failed to read the node registry", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to read the node registry")
+		return
+	}
+	if len(unknown) > 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, CodeInvalidRequest, "Unknown nodes", map[string]any{"nodes": unknown})
+		return
+	}
+
+	// The pin is recorded first, so blocks written during the move go to
+	// the pinned nodes already.
+	result := PinResult{FilePin: FilePin{File: fileName, Nodes: req.Nodes, PinnedAt: time.Now().UTC()}}
+	err = f.redisManager.SaveFilePin(result.FilePin)
+	if err == nil {
+		result.MovedBlocks, result.MovedBytes, err = f.moveToPinnedNodes(r.Context(), fileName, addresses)
+	}
+	recordAudit(r.Context(), AuditFilePin, fileName, err)
+	if err != nil {
+		logger.Error("Failed to pin file", zap.String("fileName", fileName), zap.Error(err))
+		respondUploadError(w, fileName, "Failed to move the file to its pinned nodes", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// GetFilePin answers with the pin of a file.
+func (f *fileManager) GetFilePin(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/files/{name}/pin").Inc()
+	fileName := mux.Vars(r)["name"]
+
+	pin, err := f.redisManager.GetFilePin(fileName)
+	if errors.Is(err, errNotPinned) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeNotFound, "File is not pinned", map[string]any{"file": fileName})
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read the pin")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(pin)
+}
+
+// UnpinFile lets the blocks of a file go to any node again. They stay where
+// they are until they are rewritten.
+func (f *fileManager) UnpinFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/files/{name}/pin").Inc()
+	fileName := mux.Vars(r)["name"]
+
+	err := f.redisManager.DeleteFilePin(fileName)
+	recordAudit(r.Context(), AuditFileUnpin, fileName, err)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove the pin")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
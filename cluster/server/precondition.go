@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errPreconditionFailed refuses a write sent with If-Match once the file
+// has moved on to another version.
+var errPreconditionFailed = errors.New("file is not at the version given in If-Match")
+
+// fileETag returns the ETag of a version of a file.
+func fileETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// matchedVersions turns an If-Match header into what saveMetadataScript
+// expects: "" without one, "*" for any version, or the versions it lists,
+// separated by spaces. Weak and foreign ETags match no version.
+func matchedVersions(ifMatch string) string {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return ifMatch
+	}
+	var versions []string
+	for _, tag := range strings.Split(ifMatch, ",") {
+		value, err := strconv.Unquote(strings.TrimSpace(tag))
+		if err != nil {
+			continue
+		}
+		if version, err := strconv.ParseInt(value, 10, 64); err == nil && version >= 0 {
+			versions = append(versions, strconv.FormatInt(version, 10))
+		}
+	}
+	if len(versions) == 0 {
+		return "-1"
+	}
+	return strings.Join(versions, " ")
+}
+
+type ifMatchKey struct{}
+
+// withPrecondition attaches the If-Match of a request to its context: the
+// file the request writes or deletes must be at one of the versions listed.
+func withPrecondition(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			r = r.WithContext(context.WithValue(r.Context(), ifMatchKey{}, ifMatch))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ifMatchFromContext(ctx context.Context) string {
+	ifMatch, _ := ctx.Value(ifMatchKey{}).(string)
+	return ifMatch
+}
+
+// checkPrecondition refuses a write to fileName with errPreconditionFailed
+// when ctx carries an If-Match the file does not match. It only spares the
+// upload of a write bound to fail: the version is checked again when the
+// new one is recorded.
+func (f *fileManager) checkPrecondition(ctx context.Context, fileName string) error {
+	versions := matchedVersions(ifMatchFromContext(ctx))
+	if versions == "" {
+		return nil
+	}
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		return errPreconditionFailed
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the version of the file: %w", err)
+	}
+	return matchPrecondition(ctx, metadata)
+}
+
+// matchPrecondition refuses a write to the file at metadata with
+// errPreconditionFailed when ctx carries an If-Match it does not match.
+func matchPrecondition(ctx context.Context, metadata FileMetadata) error {
+	versions := matchedVersions(ifMatchFromContext(ctx))
+	if versions != "" && versions != "*" && !slices.Contains(strings.Fields(versions), strconv.FormatInt(metadata.Version, 10)) {
+		return fmt.Errorf("%w: it is at version %d", errPreconditionFailed, metadata.Version)
+	}
+	return nil
+}
+
+// checkWrite refuses a write to fileName before its content is handled:
+// when the name is leased to someone else, or when the file is not at the
+// version ctx asks for.
+func (f *fileManager) checkWrite(ctx context.Context, fileName string) error {
+	if err := f.checkLease(ctx, fileName); err != nil {
+		return err
+	}
+	return f.checkPrecondition(ctx, fileName)
+}
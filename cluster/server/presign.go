@@ -0,0 +1,150 @@
+package server
+
+import (
+	"FDS/urlsign"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPresignTTL = 15 * time.Minute
+
+type PresignResponse struct {
+	Name         string    `json:"name"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	DownloadURL  string    `json:"download_url"`
+	UploadURL    string    `json:"upload_url"`
+	UploadMethod string    `json:"upload_method"`
+}
+
+// ensurePresignKey generates a random signing key when none is configured.
+// URLs signed with it stop working when the process restarts.
+func ensurePresignKey() {
+	if config.PresignKey != "" {
+		return
+	}
+
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	config.PresignKey = hex.EncodeToString(key)
+
+	logger.Warn("FDS_PRESIGN_KEY is not set, presigned URLs will not survive a restart")
+}
+
+// publicBaseURL returns the scheme and host clients should use to reach this
+// server, preferring the configured public URL over the request's own host.
+func publicBaseURL(r *http.Request) string {
+	if config.PublicURL != "" {
+		return strings.TrimSuffix(config.PublicURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func presignedURL(base string, path string, query url.Values, method, fileName string, expires time.Time) string {
+	urlsign.SignQuery([]byte(config.PresignKey), query, method, fileName, expires)
+	return base + path + "?" + query.Encode()
+}
+
+// PresignFile returns time-limited URLs to download and upload the file
+// without further credentials. The validity defaults to 15 minutes and can
+// be set in seconds with expires_in, up to the configured maximum.
+func (f *fileManager) PresignFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/files/{name}/presign").Inc()
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	ttl := defaultPresignTTL
+	if value := r.URL.Query().Get("expires_in"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			respondWithError(w, http.StatusBadRequest, "expires_in must be a positive number of seconds")
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl > config.PresignMaxTTL {
+		respondWithError(w, http.StatusBadRequest, "expires_in exceeds the maximum of "+config.PresignMaxTTL.String())
+		return
+	}
+
+	expires := time.Now().Add(ttl).UTC().Truncate(time.Second)
+	base := publicBaseURL(r)
+
+	response := PresignResponse{
+		Name:         fileName,
+		ExpiresAt:    expires,
+		DownloadURL:  presignedURL(base, apiPath(r, "/retrieveFile"), url.Values{"fileName": {fileName}}, http.MethodGet, fileName, expires),
+		UploadURL:    presignedURL(base, apiPath(r, "/files/"+url.PathEscape(fileName)), url.Values{}, http.MethodPut, fileName, expires),
+		UploadMethod: http.MethodPut,
+	}
+
+	logger.Info("Presigned URLs issued",
+		zap.String("fileName", fileName),
+		zap.Time("expiresAt", expires),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// withPresignedURL checks presigned URLs on the endpoints they point to.
+// A request carrying a signature is rejected unless it authorizes this method
+// on this file; requests without one are passed through unchanged.
+func withPresignedURL(fileName func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get(urlsign.SignatureParam) == "" {
+			next(w, r)
+			return
+		}
+
+		method := r.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+
+		name := fileName(r)
+		err := urlsign.VerifyQuery([]byte(config.PresignKey), query, method, name, time.Now())
+		if errors.Is(err, urlsign.ErrExpired) {
+			respondWithErrorCode(w, http.StatusForbidden, CodeSignatureExpired, "Presigned URL has expired", nil)
+			return
+		}
+		if err != nil {
+			requestLogger(r.Context()).Warn("Rejected presigned URL",
+				zap.String("fileName", name),
+				zap.String("method", r.Method),
+				zap.Error(err),
+			)
+			respondWithErrorCode(w, http.StatusForbidden, CodeInvalidSignature, "Invalid presigned URL", nil)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func fileNameFromQuery(r *http.Request) string {
+	return r.URL.Query().Get("fileName")
+}
+
+func fileNameFromPath(r *http.Request) string {
+	return mux.Vars(r)["name"]
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// RebalanceMove is the move of one replica of a block from a node to
+// another.
+type RebalanceMove struct {
+	Block string `json:"block"`
+	Size  int64  `json:"size"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// hash is the content the move was planned for: a block rewritten
+	// since is left where it is.
+	hash string
+}
+
+// NodeProjection is the usage of a node before and after a rebalance, in
+// bytes and as a share of its capacity.
+type NodeProjection struct {
+	Address        string  `json:"address"`
+	Capacity       int64   `json:"capacity"`
+	Usage          int64   `json:"usage"`
+	ProjectedUsage int64   `json:"projected_usage"`
+	Share          float64 `json:"share"`
+	ProjectedShare float64 `json:"projected_share"`
+}
+
+// RebalancePlan is the answer of POST /admin/rebalance: the moves planned,
+// what they transfer and the usage they leave each node with. Moved,
+// MovedBytes and Failed report what was done, unless DryRun is set.
+type RebalancePlan struct {
+	DryRun    bool    `json:"dry_run"`
+	Threshold float64 `json:"threshold"`
+	// MeanShare is the share of the capacity of the cluster in use, which
+	// the rebalance brings every node towards.
+	MeanShare  float64          `json:"mean_share"`
+	Moves      []RebalanceMove  `json:"moves"`
+	Blocks     int              `json:"blocks"`
+	Bytes      int64            `json:"bytes"`
+	Nodes      []NodeProjection `json:"nodes"`
+	Moved      int              `json:"moved"`
+	MovedBytes int64            `json:"moved_bytes"`
+	Failed     []BackupFailure  `json:"failed"`
+}
+
+// accepts is acceptsBlock for callers that do not hold n.mutex.
+func (n *nodeManager) accepts(address string, size int) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.acceptsBlock(address, size)
+}
+
+// planRebalance plans the replica moves that bring every node whose share
+// of its capacity in use exceeds that of the cluster by more than threshold
+// back within it, moving at most maxBytes (0 for no limit). Replicas go to
+// the node with the smallest share in use that does not hold the block yet,
+// as long as it stays under the share of the cluster. Packed, pinned and
+// cold files are left alone.
+func (f *fileManager) planRebalance(ctx context.Context, threshold float64, maxBytes int64) (RebalancePlan, error) {
+	plan := RebalancePlan{Threshold: threshold, Moves: []RebalanceMove{}, Failed: []BackupFailure{}}
+
+	stats, err := f.nodeManager.PlacementStats()
+	if err != nil {
+		return plan, fmt.Errorf("failed to retrieve node statistics: %w", err)
+	}
+	capacity := make(map[string]int64, len(stats))
+	projected := make(map[string]int64, len(stats))
+	var used, total int64
+	for _, node := range stats {
+		capacity[node.address] = f.nodeManager.capacity(node.address)
+		projected[node.address] = int64(node.usage)
+		used += int64(node.usage)
+		total += capacity[node.address]
+	}
+	share := func(address string) float64 {
+		return float64(projected[address]) / float64(capacity[address])
+	}
+	plan.MeanShare = float64(used) / float64(total)
+	overloaded := func(address string) bool {
+		_, known := capacity[address]
+		return known && share(address) > plan.MeanShare+threshold
+	}
+	anyOverloaded := func() bool {
+		return slices.ContainsFunc(stats, func(node Node) bool { return overloaded(node.address) })
+	}
+
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return plan, err
+	}
+	pins, err := f.redisManager.redisClient.HGetAll(ctx, filePinsKey).Result()
+	if err != nil {
+		return plan, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+planning:
+	for _, metadata := range files {
+		if !anyOverloaded() {
+			break
+		}
+		if metadata.Packed != nil || pins[metadata.Name] != "" {
+			continue
+		}
+		for i := 1; i <= metadata.Blocks; i++ {
+			blockName := metadata.blockName(i)
+			location, err := f.redisManager.GetBlockLocation(blockName)
+			if err != nil || isColdAddress(location.NodeAddress) {
+				continue
+			}
+			holders := location.Addresses()
+			for _, from := range location.Healthy() {
+				if !overloaded(from) {
+					continue
+				}
+				if maxBytes > 0 && plan.Bytes+location.Size > maxBytes {
+					break planning
+				}
+				to := ""
+				for _, node := range stats {
+					candidate := node.address
+					if slices.Contains(holders, candidate) || !f.nodeManager.accepts(candidate, int(location.Size)) {
+						continue
+					}
+					if float64(projected[candidate]+location.Size)/float64(capacity[candidate]) > plan.MeanShare {
+						continue
+					}
+					if to == "" || share(candidate) < share(to) {
+						to = candidate
+					}
+				}
+				if to == "" {
+					continue
+				}
+				plan.Moves = append(plan.Moves, RebalanceMove{Block: blockName, Size: location.Size, From: from, To: to, hash: location.Hash})
+				plan.Blocks++
+				plan.Bytes += location.Size
+				projected[from] -= location.Size
+				projected[to] += location.Size
+				holders = append(slices.DeleteFunc(holders, func(address string) bool { return address == from }), to)
+			}
+		}
+	}
+
+	for _, node := range stats {
+		plan.Nodes = append(plan.Nodes, NodeProjection{
+			Address:        node.address,
+			Capacity:       capacity[node.address],
+			Usage:          int64(node.usage),
+			ProjectedUsage: projected[node.address],
+			Share:          float64(node.usage) / float64(capacity[node.address]),
+			ProjectedShare: share(node.address),
+		})
+	}
+	sort.Slice(plan.Nodes, func(i, j int) bool { return plan.Nodes[i].Address < plan.Nodes[j].Address })
+	return plan, nil
+}
+
+// moveReplica carries out a move: it copies the block to its new node,
+// records the new replica in place of the former one and deletes the former
+// copy. A block rewritten or moved since it was planned is left alone.
+func (f *fileManager) moveReplica(ctx context.Context, move RebalanceMove) (bool, error) {
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	location, err := f.redisManager.GetBlockLocation(move.Block)
+	if err != nil {
+		return false, err
+	}
+	addresses := location.Addresses()
+	if location.Hash != move.hash || !slices.Contains(addresses, move.From) || slices.Contains(addresses, move.To) {
+		return false, nil
+	}
+
+	data, err := f.healthyCopy(ctx, location, move.Block)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the block: %w", err)
+	}
+	err = nodeRetryPolicy().Do(ctx, "blockPush", func() error {
+		return f.streamBlock(ctx, newPhaseTimer(), move.To, GenerateBlockHash(data), move.Block+".bin", data, func(int64) {})
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to copy the block to %s: %w", move.To, err)
+	}
+
+	replicas := slices.Clone(location.Replicas)
+	for i := range replicas {
+		if replicas[i].Address == move.From {
+			replicas[i] = Replica{Address: move.To, State: ReplicaHealthy}
+		}
+	}
+	if err := f.redisManager.SetBlockReplicas(ctx, move.Block, replicas); err != nil {
+		return false, fmt.Errorf("failed to record the new replica: %w", err)
+	}
+	f.deleteFormerReplicas(ctx, move.Block, addresses, BlockLocation{Replicas: replicas})
+	return true, nil
+}
+
+// Rebalance plans the moves of block replicas that even out the share of
+// their capacity the nodes use and, unless ?dryRun=true, carries them out.
+// ?threshold= is how far above the share of the cluster a node may be
+// (FDS_REBALANCE_THRESHOLD by default), ?maxBytes= caps the bytes moved.
+func (f *fileManager) Rebalance(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/rebalance").Inc()
+	logger := requestLogger(r.Context())
+	query := r.URL.Query()
+
+	var err error
+	dryRun := false
+	if value := query.Get("dryRun"); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "dryRun must be a boolean")
+			return
+		}
+	}
+	threshold := config.RebalanceThreshold
+	if value := query.Get("threshold"); value != "" {
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold < 0 || threshold >= 1 {
+			respondWithError(w, http.StatusBadRequest, "threshold must be a share between 0 and 1")
+			return
+		}
+	}
+	var maxBytes int64
+	if value := query.Get("maxBytes"); value != "" {
+		maxBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			respondWithError(w, http.StatusBadRequest, "maxBytes must be a number of bytes")
+			return
+		}
+	}
+
+	plan, err := f.planRebalance(r.Context(), threshold, maxBytes)
+	if err != nil {
+		logger.Error("Failed to plan the rebalance", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to plan the rebalance")
+		return
+	}
+	plan.DryRun = dryRun
+
+	if !dryRun {
+		for _, move := range plan.Moves {
+			moved, err := f.moveReplica(r.Context(), move)
+			if err != nil {
+				plan.Failed = append(plan.Failed, BackupFailure{Name: move.Block, Error: err.Error()})
+				continue
+			}
+			if moved {
+				plan.Moved++
+				plan.MovedBytes += move.Size
+			}
+		}
+		logger.Info("Rebalance completed",
+			zap.Int("planned", plan.Blocks),
+			zap.Int("moved", plan.Moved),
+			zap.Int64("bytes", plan.MovedBytes),
+			zap.Int("failed", len(plan.Failed)),
+		)
+		var auditErr error
+		if len(plan.Failed) > 0 {
+			auditErr = fmt.Errorf("%d of %d moves failed", len(plan.Failed), len(plan.Moves))
+		}
+		recordAudit(r.Context(), AuditRebalance, "", auditErr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(plan)
+}
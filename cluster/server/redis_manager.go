@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+const filesIndexKey = "files"
+
+const corruptedBlocksKey = "corrupted_blocks"
+
+var ErrFileNotFound = errors.New("file not found")
+
+type RedisManager struct {
+	redisClient *redis.Client
+}
+
+type FileMetadata struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Blocks    int       `json:"blocks"`
+	BlockSize int       `json:"block_size,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Packed is set for small files stored in a shared container instead of
+	// blocks of their own.
+	Packed *PackedLocation `json:"packed,omitempty"`
+	// Extents are set for files whose blocks are compressed independently:
+	// block i+1 holds Extents[i] of the content, so a range is read from the
+	// blocks it spans only. Files stored as a single gzip stream have none.
+	Extents []BlockExtent `json:"extents,omitempty"`
+	// Annotations are what the upload hooks found out about the content,
+	// such as the results of a scan.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Owner is the name of the API key the file was written with, which its
+	// storage is accounted to.
+	Owner string `json:"owner,omitempty"`
+	// Rewritten maps the positions of the blocks that patches and appends
+	// stored again to the tag of the name they were stored under, see
+	// blockName. The other blocks are under the name of the file.
+	Rewritten map[int]string `json:"rewritten,omitempty"`
+	// Version goes up with every write of the file. Files not written since
+	// versions were recorded are at 0.
+	Version int64 `json:"version"`
+}
+
+func (r *RedisManager) SendBlockHashWithNumberOfBlocks(blockHashedName []byte, blockLength int) error {
+	return r.redisClient.Set(context.Background(), fmt.Sprintf("%x", blockHashedName), blockLength, 0).Err()
+}
+
+func (r *RedisManager) GetNumberOfBlocksOfAFile(fileHashedName []byte) (int, error) {
+	val, err := r.redisClient.Get(context.Background(), fmt.Sprintf("%x", fileHashedName)).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrFileNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+// filesVersionsKey counts the versions of each file name. It outlives
+// deletes, so a name never gets a version it had before.
+const filesVersionsKey = "files:versions"
+
+// saveMetadataScript records the metadata of a new version of a file, given
+// as JSON cut before the value of its version. With ARGV[3], the current version must be one
+// of those it lists, or any with "*"; it returns 0 when it is not, and the
+// new version otherwise. With KEYS[3], the number of blocks of the file, it
+// also sets that to ARGV[4].
+var saveMetadataScript = redis.NewScript(`
+if ARGV[3] ~= '' then
+	local current = redis.call('HGET', KEYS[1], ARGV[1])
+	if not current then
+		return 0
+	end
+	local version = tostring(cjson.decode(current).version or 0)
+	if ARGV[3] ~= '*' and not string.find(' ' .. ARGV[3] .. ' ', ' ' .. version .. ' ', 1, true) then
+		return 0
+	end
+end
+local version = redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2] .. version .. '}')
+if KEYS[3] then
+	redis.call('SET', KEYS[3], ARGV[4])
+end
+return version
+`)
+
+// SaveFileMetadata records metadata as a new version of the file.
+func (r *RedisManager) SaveFileMetadata(metadata FileMetadata) error {
+	_, err := r.SaveFileMetadataIf(metadata, "")
+	return err
+}
+
+// SaveFileMetadataIf records metadata as a new version of the file if its
+// current version matches ifMatch, as sent in If-Match; errPreconditionFailed
+// otherwise. It returns the new version.
+func (r *RedisManager) SaveFileMetadataIf(metadata FileMetadata, ifMatch string) (int64, error) {
+	return r.saveFileMetadata(metadata, ifMatch, -1)
+}
+
+// SaveFileBlocksIf is SaveFileMetadataIf also setting the number of blocks
+// of the file, in the same transaction, so readers never see the blocks of
+// one version with the metadata of another.
+func (r *RedisManager) SaveFileBlocksIf(metadata FileMetadata, numOfBlocks int, ifMatch string) (int64, error) {
+	return r.saveFileMetadata(metadata, ifMatch, numOfBlocks)
+}
+
+func (r *RedisManager) saveFileMetadata(metadata FileMetadata, ifMatch string, numOfBlocks int) (int64, error) {
+	metadata.Version = 0
+	jsonData, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+	// Version is the last field: the script writes its value.
+	jsonData = bytes.TrimSuffix(jsonData, []byte("0}"))
+	keys := []string{filesIndexKey, filesVersionsKey}
+	args := []any{metadata.Name, jsonData, matchedVersions(ifMatch)}
+	if numOfBlocks >= 0 {
+		keys = append(keys, fmt.Sprintf("%x", GenerateFileHash(metadata.Name)))
+		args = append(args, numOfBlocks)
+	}
+	version, err := saveMetadataScript.Run(context.Background(), r.redisClient, keys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, errPreconditionFailed
+	}
+	return version, nil
+}
+
+// UpdateFileMetadata rewrites the metadata of the current version of a file
+// in place, such as when its content moves, keeping its version.
+func (r *RedisManager) UpdateFileMetadata(metadata FileMetadata) error {
+	jsonData, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return r.redisClient.HSet(context.Background(), filesIndexKey, metadata.Name, jsonData).Err()
+}
+
+// GetFileBlocks returns the metadata of a file and its number of blocks,
+// read together. Names without metadata, such as containers and snapshots,
+// get metadata holding only their name. It fails with ErrFileNotFound when
+// the name has no blocks.
+func (r *RedisManager) GetFileBlocks(fileName string) (FileMetadata, int, error) {
+	ctx := context.Background()
+	pipe := r.redisClient.TxPipeline()
+	count := pipe.Get(ctx, fmt.Sprintf("%x", GenerateFileHash(fileName)))
+	value := pipe.HGet(ctx, filesIndexKey, fileName)
+	_, _ = pipe.Exec(ctx)
+
+	val, err := count.Result()
+	if errors.Is(err, redis.Nil) {
+		return FileMetadata{}, 0, ErrFileNotFound
+	}
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+	numOfBlocks, err := strconv.Atoi(val)
+	if err != nil {
+		return FileMetadata{}, 0, err
+	}
+
+	metadata := FileMetadata{Name: fileName}
+	if val, err := value.Result(); err == nil {
+		if metadata, err = decodeFileMetadata(val); err != nil {
+			return FileMetadata{}, 0, err
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		return FileMetadata{}, 0, err
+	}
+	return metadata, numOfBlocks, nil
+}
+
+func (r *RedisManager) GetFileMetadata(fileName string) (FileMetadata, error) {
+	var metadata FileMetadata
+
+	val, err := r.redisClient.HGet(context.Background(), filesIndexKey, fileName).Result()
+	if errors.Is(err, redis.Nil) {
+		return metadata, ErrFileNotFound
+	}
+	if err != nil {
+		return metadata, err
+	}
+
+	return decodeFileMetadata(val)
+}
+
+// legacyBlockSize is the block size of files stored before it was recorded
+// in their metadata.
+const legacyBlockSize = 128 * MB
+
+func decodeFileMetadata(val string) (FileMetadata, error) {
+	var metadata FileMetadata
+	if err := json.Unmarshal([]byte(val), &metadata); err != nil {
+		return metadata, err
+	}
+	if metadata.BlockSize == 0 && metadata.Packed == nil {
+		metadata.BlockSize = legacyBlockSize
+	}
+	return metadata, nil
+}
+
+func (r *RedisManager) ListFiles() ([]FileMetadata, error) {
+	values, err := r.redisClient.HGetAll(context.Background(), filesIndexKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileMetadata, 0, len(values))
+	for _, val := range values {
+		metadata, err := decodeFileMetadata(val)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, metadata)
+	}
+
+	return files, nil
+}
+
+func (r *RedisManager) DeleteFileMetadata(fileName string) error {
+	return r.redisClient.HDel(context.Background(), filesIndexKey, fileName).Err()
+}
+
+// BlockLocation is what Redis records about a stored block. Size is -1 for
+// blocks stored before sizes were recorded.
+type BlockLocation struct {
+	// NodeAddress is the replica reads go to first.
+	NodeAddress string
+	Replicas    []Replica
+	Hash        string
+	Size        int64
+}
+
+// GetBlockLocation returns the nodes holding the named block, the SHA-256 of
+// its content and its size.
+func (r *RedisManager) GetBlockLocation(blockName string) (BlockLocation, error) {
+	values, err := r.redisClient.HMGet(context.Background(), fmt.Sprintf("%x", GenerateFileHash(blockName)), "node_address", "block_hash", "block_size", replicasField).Result()
+	if err != nil {
+		return BlockLocation{}, err
+	}
+
+	location := BlockLocation{Size: -1}
+	nodeAddress, _ := values[0].(string)
+	location.Hash, _ = values[1].(string)
+	if size, ok := values[2].(string); ok {
+		if n, err := strconv.ParseInt(size, 10, 64); err == nil {
+			location.Size = n
+		}
+	}
+	encoded, _ := values[3].(string)
+	location.Replicas = parseReplicas(encoded, nodeAddress)
+	location.NodeAddress = primaryReplica(location.Replicas)
+
+	if location.NodeAddress == "" {
+		return BlockLocation{}, fmt.Errorf("no location recorded for block %s", blockName)
+	}
+	return location, nil
+}
+
+// MarkBlockCorrupted records a block whose content no longer matches its hash.
+func (r *RedisManager) MarkBlockCorrupted(blockName string) error {
+	return r.redisClient.SAdd(context.Background(), corruptedBlocksKey, blockName).Err()
+}
+
+// ClearBlockCorrupted forgets a block recorded as corrupted, once it has been
+// rewritten or deleted.
+func (r *RedisManager) ClearBlockCorrupted(blockName string) error {
+	return r.redisClient.SRem(context.Background(), corruptedBlocksKey, blockName).Err()
+}
+
+func (r *RedisManager) CorruptedBlocks() ([]string, error) {
+	return r.redisClient.SMembers(context.Background(), corruptedBlocksKey).Result()
+}
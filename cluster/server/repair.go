@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	blockCorruptions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "block_corruptions_total",
+			Help: "Corrupted blocks, by how they were found: read or scrub on the node, download, store, write verification or check (POST /admin/scrub) on the central server",
+		},
+		[]string{"source"},
+	)
+	blockRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "block_repairs_total",
+			Help: "Attempts to repair corrupted blocks, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+// errNoHealthyCopy is returned when a corrupted block has no good copy left
+// to repair it from.
+var errNoHealthyCopy = errors.New("no healthy copy of the block")
+
+// repairRequests wakes the repair loop up as soon as a block is found
+// corrupted, rather than at its next pass.
+var repairRequests = make(chan struct{}, 1)
+
+// CorruptionReport is what a node sends about a block that no longer matches
+// the checksum it was stored with.
+type CorruptionReport struct {
+	Url   string `json:"Url"`
+	ID    string `json:"ID,omitempty"`
+	Block string `json:"Block"`
+	// Hash is the SHA-256 the node stored the block with.
+	Hash   string `json:"Hash,omitempty"`
+	Source string `json:"Source,omitempty"`
+}
+
+// ReceiveCorruptionReport marks the replica of a block reported by its node as
+// stale and schedules its repair. Reports about a version of the block
+// that has since been replaced, or moved, are ignored.
+func (f *fileManager) ReceiveCorruptionReport(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+	if !validJoinSecret(r) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid join secret")
+		return
+	}
+
+	var report CorruptionReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	u, err := url.ParseRequestURI(report.Url)
+	if err != nil || report.Block == "" {
+		respondWithError(w, http.StatusBadRequest, "Url and Block are required")
+		return
+	}
+	address := u.String()
+	blockName := strings.TrimSuffix(report.Block, ".bin")
+
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil || !slices.Contains(location.Addresses(), address) || (report.Hash != "" && report.Hash != location.Hash) {
+		logger.Info("Ignoring corruption report for a block the node no longer holds",
+			zap.String("blockName", blockName),
+			zap.String("nodeAddress", address),
+		)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	source := report.Source
+	if source != "scrub" {
+		source = "read"
+	}
+	logger.Warn("Node reported a corrupted block",
+		zap.String("blockName", blockName),
+		zap.String("nodeAddress", address),
+		zap.String("source", source),
+	)
+	blockCorruptions.WithLabelValues(source).Inc()
+	if err := f.markReplicaCorrupted(r.Context(), blockName, address, location.Hash); err != nil {
+		logger.Error("Failed to record corrupted block", zap.String("blockName", blockName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to record the report")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// markBlockCorrupted records a corrupted block and schedules its repair.
+func (f *fileManager) markBlockCorrupted(blockName string) error {
+	if err := f.redisManager.MarkBlockCorrupted(blockName); err != nil {
+		return err
+	}
+	select {
+	case repairRequests <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RunRepairs repairs the corrupted blocks whenever one is reported, and every
+// interval for those that could not be repaired yet.
+func (f *fileManager) RunRepairs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-repairRequests:
+		}
+		// Repairs rewrite blocks, which maintenance holds off; the blocks
+		// stay marked corrupted until it is over.
+		if maintenance.Check(true) != nil {
+			continue
+		}
+		if err := f.RepairCorruptedBlocks(ctx); err != nil {
+			logger.Error("Repair pass failed", zap.Error(err))
+		}
+	}
+}
+
+// RepairCorruptedBlocks rewrites every corrupted block that still has a good
+// copy.
+func (f *fileManager) RepairCorruptedBlocks(ctx context.Context) error {
+	blocks, err := f.redisManager.CorruptedBlocks()
+	if err != nil {
+		return err
+	}
+
+	for _, blockName := range blocks {
+		err := f.repairBlock(ctx, blockName)
+		switch {
+		case err == nil:
+			blockRepairs.WithLabelValues("repaired").Inc()
+			logger.Info("Repaired corrupted block", zap.String("blockName", blockName))
+		case errors.Is(err, errNoHealthyCopy):
+			blockRepairs.WithLabelValues("unavailable").Inc()
+		default:
+			blockRepairs.WithLabelValues("failed").Inc()
+			logger.Warn("Failed to repair corrupted block", zap.String("blockName", blockName), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// repairBlock rewrites the stale replicas of a block from a healthy copy.
+func (f *fileManager) repairBlock(ctx context.Context, blockName string) error {
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil {
+		// The block is gone: nothing left to repair.
+		return f.redisManager.ClearBlockCorrupted(blockName)
+	}
+
+	var stale []string
+	for _, replica := range location.Replicas {
+		if replica.State != ReplicaHealthy && !isColdAddress(replica.Address) {
+			stale = append(stale, replica.Address)
+		}
+	}
+	if len(stale) == 0 {
+		return f.redisManager.ClearBlockCorrupted(blockName)
+	}
+
+	data, err := f.healthyCopy(ctx, location, blockName)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, address := range stale {
+		if err := f.redisManager.SetReplicaState(ctx, blockName, address, ReplicaRepairing); err != nil {
+			return err
+		}
+		err := f.streamBlock(ctx, newPhaseTimer(), address, GenerateBlockHash(data), blockName+".bin", data, func(int64) {})
+		state := ReplicaHealthy
+		if err != nil {
+			errs = append(errs, err)
+			state = ReplicaStale
+		}
+		// A block rewritten in the meantime has new replicas; the copy just
+		// written is found stale when next read.
+		if current, err := f.redisManager.GetBlockLocation(blockName); err == nil && current.Hash == location.Hash {
+			if err := f.redisManager.SetReplicaState(ctx, blockName, address, state); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return f.redisManager.ClearBlockCorrupted(blockName)
+}
+
+// healthyCopy returns the content of a block from the block cache of the
+// central server or, failing that, from a healthy replica.
+func (f *fileManager) healthyCopy(ctx context.Context, location BlockLocation, blockName string) ([]byte, error) {
+	if data, ok := blockCache.Get(blockName, location.Hash); ok && fmt.Sprintf("%x", GenerateBlockHash(data)) == location.Hash {
+		return data, nil
+	}
+	if len(location.Healthy()) == 0 {
+		return nil, errNoHealthyCopy
+	}
+	block, err := f.fetchBlockReplicas(ctx, location, blockName+".bin")
+	if errors.Is(err, errBlockCorrupted) {
+		return nil, errNoHealthyCopy
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer putBuffer(block)
+	return bytes.Clone(block.Bytes()), nil
+}
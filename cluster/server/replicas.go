@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"slices"
+	"strings"
+)
+
+// ReplicaState is how far a copy of a block can be trusted.
+type ReplicaState string
+
+const (
+	ReplicaHealthy ReplicaState = "healthy"
+	// ReplicaStale copies no longer match the block: they are corrupted, or
+	// missed a rewrite. They are not read until repaired.
+	ReplicaStale ReplicaState = "stale"
+	// ReplicaRepairing copies are being rewritten from a healthy one.
+	ReplicaRepairing ReplicaState = "repairing"
+)
+
+// Replica is one copy of a block.
+type Replica struct {
+	Address string       `json:"address"`
+	State   ReplicaState `json:"state"`
+}
+
+// replicasField holds the replicas of a block as JSON. node_address is kept
+// alongside as the address reads go to first, for the central servers that
+// predate replicas.
+const replicasField = "replicas"
+
+// replicaFields returns the fields recording replicas in a block hash.
+func replicaFields(replicas []Replica) ([]any, error) {
+	encoded, err := json.Marshal(replicas)
+	if err != nil {
+		return nil, err
+	}
+	return []any{"node_address", primaryReplica(replicas), replicasField, string(encoded)}, nil
+}
+
+// parseReplicas reads the replicas of a block hash. Blocks written before
+// replicas were recorded have a single healthy one, at node_address.
+func parseReplicas(encoded string, nodeAddress string) []Replica {
+	var replicas []Replica
+	if encoded != "" && json.Unmarshal([]byte(encoded), &replicas) == nil && len(replicas) > 0 {
+		return replicas
+	}
+	if nodeAddress == "" {
+		return nil
+	}
+	return []Replica{{Address: nodeAddress, State: ReplicaHealthy}}
+}
+
+// primaryReplica returns the first healthy replica, or the first one when
+// none is healthy.
+func primaryReplica(replicas []Replica) string {
+	for _, replica := range replicas {
+		if replica.State == ReplicaHealthy {
+			return replica.Address
+		}
+	}
+	if len(replicas) == 0 {
+		return ""
+	}
+	return replicas[0].Address
+}
+
+// Healthy returns the addresses of the healthy replicas of the block, in the
+// order they should be read.
+func (l BlockLocation) Healthy() []string {
+	var addresses []string
+	for _, replica := range l.Replicas {
+		if replica.State == ReplicaHealthy {
+			addresses = append(addresses, replica.Address)
+		}
+	}
+	return addresses
+}
+
+// Addresses returns the addresses of every replica of the block.
+func (l BlockLocation) Addresses() []string {
+	addresses := make([]string, len(l.Replicas))
+	for i, replica := range l.Replicas {
+		addresses[i] = replica.Address
+	}
+	return addresses
+}
+
+// SetBlockReplicas replaces the replicas of a block.
+func (r *RedisManager) SetBlockReplicas(ctx context.Context, blockName string, replicas []Replica) error {
+	fields, err := replicaFields(replicas)
+	if err != nil {
+		return err
+	}
+	return r.redisClient.HSet(ctx, fmt.Sprintf("%x", GenerateFileHash(blockName)), fields...).Err()
+}
+
+// SetReplicaState changes the state of the replica of a block on address. It
+// does nothing if the block has no replica there.
+func (r *RedisManager) SetReplicaState(ctx context.Context, blockName string, address string, state ReplicaState) error {
+	location, err := r.GetBlockLocation(blockName)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(location.Replicas, func(replica Replica) bool { return replica.Address == address })
+	if i < 0 || location.Replicas[i].State == state {
+		return nil
+	}
+	location.Replicas[i].State = state
+	return r.SetBlockReplicas(ctx, blockName, location.Replicas)
+}
+
+// markReplicaCorrupted records that the copy of a block with the given hash on
+// address is corrupted, and schedules its repair. Nothing is recorded if the
+// block has been rewritten since, as its content was then checked against the
+// wrong hash.
+func (f *fileManager) markReplicaCorrupted(ctx context.Context, blockName string, address string, hash string) error {
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil || location.Hash != hash {
+		return err
+	}
+	if err := f.redisManager.SetReplicaState(ctx, blockName, address, ReplicaStale); err != nil {
+		return err
+	}
+	return f.markBlockCorrupted(blockName)
+}
+
+// fetchBlockReplicas reads a block from its healthy replicas in turn, the
+// fastest first, until one returns it intact. A replica found corrupted is
+// marked stale: the one that answered, which a hedged read may have sent to
+// the next replica.
+func (f *fileManager) fetchBlockReplicas(ctx context.Context, location BlockLocation, blockFileName string) (*bytes.Buffer, error) {
+	blockName := strings.TrimSuffix(blockFileName, ".bin")
+	replicas := nodeHealthMetrics.ByLatency(location.Healthy())
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("%w: no healthy replica of %s", errBlockCorrupted, blockName)
+	}
+
+	var err error
+	for i := range replicas {
+		var block *bytes.Buffer
+		var address string
+		// Hedged reads go to the next replica.
+		block, address, err = f.fetchBlockHedged(ctx, replicas[i:], blockFileName)
+		if err == nil && fmt.Sprintf("%x", GenerateBlockHash(block.Bytes())) != location.Hash {
+			putBuffer(block)
+			blockCorruptions.WithLabelValues("download").Inc()
+			err = fmt.Errorf("%w: %s does not match its hash on %s", errBlockCorrupted, blockName, address)
+		}
+		if err == nil {
+			return block, nil
+		}
+		if errors.Is(err, errBlockCorrupted) {
+			if markErr := f.markReplicaCorrupted(ctx, blockName, address, location.Hash); markErr != nil {
+				requestLogger(ctx).Warn("Failed to record corrupted block",
+					zap.String("blockName", blockName),
+					zap.String("nodeAddress", address),
+					zap.Error(markErr),
+				)
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// deleteFormerReplicas deletes the copies of a rewritten block left on the
+// nodes in previous that no longer hold one of its replicas.
+func (f *fileManager) deleteFormerReplicas(ctx context.Context, blockName string, previous []string, location BlockLocation) {
+	for _, address := range previous {
+		if slices.Contains(location.Addresses(), address) {
+			continue
+		}
+		if err := f.DeleteBlockFromNode(ctx, address, blockName+".bin"); err != nil {
+			requestLogger(ctx).Warn("Failed to delete the previous copy of a rewritten block",
+				zap.String("blockName", blockName),
+				zap.String("nodeAddress", address),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var replicaPlacementDegraded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "replica_placement_degraded_total",
+		Help: "Replicas placed against the anti-affinity rules (shared_domain), or missing for lack of nodes (too_few_nodes)",
+	},
+	[]string{"reason"},
+)
+
+// hostDomain is the failure domain nodes without a host label take from the
+// host name of their address.
+const hostDomain = "host"
+
+// failureDomain returns the value of a failure domain of the node at
+// address, "" if it has none. The caller holds n.mutex.
+func (n *nodeManager) failureDomain(address string, domain string) string {
+	if value := n.labels[address][domain]; value != "" {
+		return value
+	}
+	if domain == hostDomain {
+		if u, err := url.Parse(address); err == nil {
+			return u.Hostname()
+		}
+	}
+	return ""
+}
+
+// sharesFailureDomain reports whether the node at address shares one of the
+// FDS_FAILURE_DOMAINS with a node at others. The caller holds n.mutex.
+func (n *nodeManager) sharesFailureDomain(address string, others []string) bool {
+	for _, domain := range config.FailureDomains {
+		value := n.failureDomain(address, domain)
+		if value == "" {
+			continue
+		}
+		for _, other := range others {
+			if n.failureDomain(other, domain) == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectReplicaNode picks a node, at random by the share of its capacity it
+// has left and among those at pinned if it is not nil, for another replica
+// of a block held on the nodes at holders: one that shares no failure domain
+// with them if there is any, and otherwise any other node, in which case it
+// reports the placement as relaxed. Nodes in skip are left out. It reports false if no node is left.
+func (n *nodeManager) selectReplicaNode(block FileBlock, pinned []string, holders []string, skip []string) (node Node, relaxed bool, ok bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.shuffleByFreeShare()
+	strict, fallback := -1, -1
+	for i, node := range n.NodeStats {
+		if pinned != nil && !slices.Contains(pinned, node.address) {
+			continue
+		}
+		if slices.Contains(holders, node.address) || slices.Contains(skip, node.address) {
+			continue
+		}
+		if breakers.Open(breakerKey(node.address)) || !n.acceptsBlock(node.address, len(block.bytes)) || !n.hasRoom(node, len(block.bytes)) {
+			continue
+		}
+		if !n.sharesFailureDomain(node.address, holders) {
+			strict = i
+			break
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+
+	selected := strict
+	if selected < 0 {
+		selected, relaxed = fallback, true
+	}
+	if selected < 0 {
+		return Node{}, false, false
+	}
+	selectedNode := n.NodeStats[selected]
+	n.NodeStats[selected].usage = selectedNode.usage + len(block.bytes)
+	return selectedNode, relaxed, true
+}
+
+// replicateBlock stores the copies of a block just written on primary that
+// FDS_REPLICATION_FACTOR asks for, each away from the failure domains of the
+// others as far as the nodes allow, and records them. Copies that cannot be
+// placed are left out: the block stays readable from those stored.
+func (f *fileManager) replicateBlock(ctx context.Context, block FileBlock, blockFileName string, blockDataHash []byte, primary string) {
+	logger := requestLogger(ctx)
+	blockName := strings.TrimSuffix(blockFileName, ".bin")
+
+	holders := []string{primary}
+	var failed []string
+	for len(holders) < config.ReplicationFactor {
+		node, relaxed, ok := f.nodeManager.selectReplicaNode(block, pinnedNodes(ctx), holders, failed)
+		if !ok {
+			replicaPlacementDegraded.WithLabelValues("too_few_nodes").Add(float64(config.ReplicationFactor - len(holders)))
+			logger.Warn("Not enough nodes for the replicas of a block",
+				zap.String("blockName", blockName),
+				zap.Int("replicas", len(holders)),
+				zap.Int("replicationFactor", config.ReplicationFactor),
+			)
+			break
+		}
+
+		err := nodeRetryPolicy().Do(ctx, "blockReplicate", func() error {
+			return f.streamBlock(ctx, newPhaseTimer(), node.address, blockDataHash, blockFileName, block.bytes, func(int64) {})
+		})
+		if err != nil {
+			logger.Warn("Failed to store a replica of a block",
+				zap.String("blockName", blockName),
+				zap.String("nodeAddress", node.address),
+				zap.Error(err),
+			)
+			failed = append(failed, node.address)
+			continue
+		}
+		if relaxed {
+			replicaPlacementDegraded.WithLabelValues("shared_domain").Inc()
+			logger.Warn("Replica placed in the failure domain of another",
+				zap.String("blockName", blockName),
+				zap.String("nodeAddress", node.address),
+				zap.Strings("replicas", holders),
+			)
+		}
+		holders = append(holders, node.address)
+	}
+	if len(holders) == 1 {
+		return
+	}
+
+	replicas := make([]Replica, len(holders))
+	for i, address := range holders {
+		replicas[i] = Replica{Address: address, State: ReplicaHealthy}
+	}
+	if err := f.redisManager.SetBlockReplicas(ctx, blockName, replicas); err != nil {
+		logger.Warn("Failed to record the replicas of a block", zap.String("blockName", blockName), zap.Error(err))
+	}
+}
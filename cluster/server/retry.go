@@ -0,0 +1,116 @@
+package server
+
+import (
+	"FDS/grpcwire"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// nodeStatusError is returned when a node answers with an unexpected HTTP
+// status.
+type nodeStatusError struct {
+	Node       string
+	StatusCode int
+}
+
+func (e *nodeStatusError) Error() string {
+	return fmt.Sprintf("unexpected response from node %s: status %d", e.Node, e.StatusCode)
+}
+
+// retryPolicy decides how often a failed node request is repeated before the
+// node is treated as failed.
+type retryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter spreads each backoff randomly by up to this fraction, so
+	// concurrent transfers do not retry in lockstep.
+	Jitter          float64
+	RetryableStatus []int
+}
+
+func nodeRetryPolicy() retryPolicy {
+	return retryPolicy{
+		Attempts:       max(1, config.NodeRetryAttempts),
+		InitialBackoff: config.NodeRetryInitialBackoff,
+		MaxBackoff:     config.NodeRetryMaxBackoff,
+		Jitter:         0.5,
+		RetryableStatus: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// Do calls op until it succeeds, fails with an error that is not worth
+// retrying, ctx is done or the attempts are used up. It returns the last
+// error.
+func (p retryPolicy) Do(ctx context.Context, operation string, op func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.Attempts || ctx.Err() != nil || !p.retryable(err) {
+			return err
+		}
+
+		delay := p.jittered(backoff)
+		requestLogger(ctx).Warn("Retrying node request",
+			zap.String("operation", operation),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", delay),
+			zap.Error(err),
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, p.MaxBackoff)
+	}
+}
+
+func (p retryPolicy) jittered(backoff time.Duration) time.Duration {
+	if p.Jitter <= 0 || backoff <= 0 {
+		return backoff
+	}
+	spread := p.Jitter * float64(backoff)
+	return time.Duration(float64(backoff) - spread + 2*spread*rand.Float64())
+}
+
+// retryable reports whether err may be transient: a network error, a
+// retryable HTTP status or a transient gRPC status. Cancellation, an open
+// circuit breaker and a corrupted block are final.
+func (p retryPolicy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, errCircuitOpen) || errors.Is(err, errBlockCorrupted) {
+		return false
+	}
+
+	var statusErr *nodeStatusError
+	if errors.As(err, &statusErr) {
+		return slices.Contains(p.RetryableStatus, statusErr.StatusCode)
+	}
+
+	var status *grpcwire.Status
+	if errors.As(err, &status) {
+		switch status.Code {
+		case grpcwire.Unavailable, grpcwire.DeadlineExceeded, grpcwire.ResourceExhausted, grpcwire.Aborted, grpcwire.DataLoss:
+			return true
+		}
+		return false
+	}
+
+	return true
+}
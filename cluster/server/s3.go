@@ -0,0 +1,13 @@
+package server
+
+import "FDS/s3"
+
+// newS3Client returns a client for bucket with the FDS_S3_* settings.
+func newS3Client(bucket string) (*s3.Client, error) {
+	return s3.New(bucket, s3.Config{
+		Endpoint:  config.S3Endpoint,
+		Region:    config.S3Region,
+		AccessKey: config.S3AccessKey,
+		SecretKey: config.S3SecretKey,
+	})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ScrubFinding is a replica a scrub found corrupted or could not read.
+type ScrubFinding struct {
+	Block   string `json:"block"`
+	Address string `json:"address"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ScrubSummary is the answer of POST /admin/scrub.
+type ScrubSummary struct {
+	File       string         `json:"file,omitempty"`
+	Blocks     int            `json:"blocks"`
+	Replicas   int            `json:"replicas"`
+	Corrupted  []ScrubFinding `json:"corrupted"`
+	Unreadable []ScrubFinding `json:"unreadable"`
+}
+
+// scrubBlock reads every healthy replica of a block on the nodes and checks
+// it against the hash recorded for the block. Replicas found corrupted are
+// marked stale and scheduled for repair, as a download would have. Replicas
+// in the cold tier are not read.
+func (f *fileManager) scrubBlock(ctx context.Context, blockName string) (int, []ScrubFinding, []ScrubFinding) {
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil {
+		return 0, nil, []ScrubFinding{{Block: blockName, Error: err.Error()}}
+	}
+
+	replicas := 0
+	var corrupted, unreadable []ScrubFinding
+	for _, address := range location.Healthy() {
+		if isColdAddress(address) {
+			continue
+		}
+		replicas++
+		block, err := f.fetchBlock(ctx, address, blockName+".bin")
+		if err != nil {
+			unreadable = append(unreadable, ScrubFinding{Block: blockName, Address: address, Error: err.Error()})
+			continue
+		}
+		stored := fmt.Sprintf("%x", GenerateBlockHash(block.Bytes()))
+		putBuffer(block)
+		if stored == location.Hash {
+			continue
+		}
+		corrupted = append(corrupted, ScrubFinding{Block: blockName, Address: address})
+		blockCorruptions.WithLabelValues("check").Inc()
+		if err := f.markReplicaCorrupted(ctx, blockName, address, location.Hash); err != nil {
+			requestLogger(ctx).Warn("Failed to record corrupted block",
+				zap.String("blockName", blockName),
+				zap.String("nodeAddress", address),
+				zap.Error(err),
+			)
+		}
+	}
+	return replicas, corrupted, unreadable
+}
+
+// scrub checks the blocks of the files named in blocks, verifyConcurrency
+// at a time.
+func (f *fileManager) scrub(ctx context.Context, blocks map[string]FileMetadata) ScrubSummary {
+	summary := ScrubSummary{Corrupted: []ScrubFinding{}, Unreadable: []ScrubFinding{}}
+	var mutex sync.Mutex
+	slots := make(chan struct{}, verifyConcurrency)
+	var wg sync.WaitGroup
+	for _, metadata := range blocks {
+		for i := 1; i <= metadata.Blocks; i++ {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(blockName string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				replicas, corrupted, unreadable := f.scrubBlock(ctx, blockName)
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				summary.Blocks++
+				summary.Replicas += replicas
+				summary.Corrupted = append(summary.Corrupted, corrupted...)
+				summary.Unreadable = append(summary.Unreadable, unreadable...)
+			}(metadata.blockName(i))
+		}
+	}
+	wg.Wait()
+
+	for _, findings := range [][]ScrubFinding{summary.Corrupted, summary.Unreadable} {
+		sort.Slice(findings, func(i, j int) bool {
+			if findings[i].Block != findings[j].Block {
+				return findings[i].Block < findings[j].Block
+			}
+			return findings[i].Address < findings[j].Address
+		})
+	}
+	return summary
+}
+
+// Scrub reads back every replica of every block, or those of the file at
+// ?file=, and checks their content. The answer lists the replicas found
+// corrupted, which are repaired, and those that could not be read.
+func (f *fileManager) Scrub(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/scrub").Inc()
+	logger := requestLogger(r.Context())
+	fileName := r.URL.Query().Get("file")
+
+	var files []FileMetadata
+	if fileName != "" {
+		metadata, err := f.redisManager.GetFileMetadata(fileName)
+		if errors.Is(err, ErrFileNotFound) {
+			respondFileNotFound(w, fileName)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to retrieve file metadata", zap.String("fileName", fileName), zap.Error(err))
+			respondWithError(w, http.StatusInternalServerError, "Failed to scrub the blocks")
+			return
+		}
+		files = []FileMetadata{metadata}
+	} else {
+		var err error
+		files, err = f.redisManager.ListFiles()
+		if err != nil {
+			logger.Error("Failed to list files", zap.Error(err))
+			respondWithError(w, http.StatusInternalServerError, "Failed to scrub the blocks")
+			return
+		}
+	}
+
+	summary := f.scrub(r.Context(), f.blockFiles(files))
+	summary.File = fileName
+	logger.Info("Scrub completed",
+		zap.String("fileName", fileName),
+		zap.Int("blocks", summary.Blocks),
+		zap.Int("replicas", summary.Replicas),
+		zap.Int("corrupted", len(summary.Corrupted)),
+		zap.Int("unreadable", len(summary.Unreadable)),
+	)
+	var auditErr error
+	if len(summary.Corrupted) > 0 {
+		auditErr = fmt.Errorf("%d corrupted replicas", len(summary.Corrupted))
+	}
+	recordAudit(r.Context(), AuditScrub, fileName, auditErr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(summary)
+}
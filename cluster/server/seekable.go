@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// BlockExtent is the part of the content of a file a block holds once
+// decompressed.
+type BlockExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// compressBlocks cuts body into pieces of blockSize bytes, each compressed as
+// a gzip member of its own: concatenated, the blocks still make up one gzip
+// stream, and each one decompresses alone. The blocks are numbered from
+// position, and their extents start at offset. They are slices of the
+// returned buffer, handed back by the caller with putBuffer once they are
+// distributed.
+func compressBlocks(ctx context.Context, body []byte, blockSize int, position int, offset int64) (*bytes.Buffer, []FileBlock, []BlockExtent, error) {
+	compressed := getBuffer()
+	var ends []int
+	var extents []BlockExtent
+	for start := 0; start == 0 || start < len(body); start += blockSize {
+		end := min(start+blockSize, len(body))
+		if err := compressInto(ctx, compressed, body[start:end]); err != nil {
+			putBuffer(compressed)
+			return nil, nil, nil, err
+		}
+		ends = append(ends, compressed.Len())
+		extents = append(extents, BlockExtent{Offset: offset + int64(start), Length: int64(end - start)})
+	}
+
+	// The buffer may have moved while it grew, so the blocks are only cut
+	// once it is complete.
+	blocks := make([]FileBlock, len(ends))
+	start := 0
+	for i, end := range ends {
+		blocks[i] = FileBlock{bytes: compressed.Bytes()[start:end], position: position + i}
+		start = end
+	}
+	return compressed, blocks, extents, nil
+}
+
+// decompressBlock returns the content of a block compressed by
+// compressBlocks, which holds length bytes of the file.
+func decompressBlock(block []byte, length int64) ([]byte, error) {
+	gz, err := getGzipReader(bytes.NewReader(block))
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	content.Grow(int(length))
+	_, err = content.ReadFrom(gz)
+	if closeErr := gz.Close(); closeErr == nil {
+		putGzipReader(gz)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(content.Len()) != length {
+		return nil, fmt.Errorf("block holds %d bytes instead of %d", content.Len(), length)
+	}
+	return content.Bytes(), nil
+}
+
+// readExtent returns the content of block i+1 of a file in the seekable
+// layout.
+func (f *fileManager) readExtent(ctx context.Context, timer *phaseTimer, metadata FileMetadata, i int) ([]byte, error) {
+	blockName := metadata.blockName(i + 1)
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	timer.Phase("metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	var decompressErr error
+	err = f.readBlock(ctx, timer, blockName, location, func(block []byte) {
+		content, decompressErr = decompressBlock(block, metadata.Extents[i].Length)
+	})
+	timer.Phase("decompress")
+	if err != nil {
+		return nil, err
+	}
+	return content, decompressErr
+}
+
+// extentReader reads a file in the seekable layout, fetching and
+// decompressing only the blocks its reads fall into, one at a time.
+type extentReader struct {
+	ctx      context.Context
+	files    *fileManager
+	timer    *phaseTimer
+	metadata FileMetadata
+	offset   int64
+	// block is the index of the extent held in content, -1 for none.
+	block   int
+	content []byte
+	read    int64
+}
+
+func newExtentReader(ctx context.Context, files *fileManager, metadata FileMetadata) *extentReader {
+	return &extentReader{ctx: ctx, files: files, timer: newPhaseTimer(), metadata: metadata, block: -1}
+}
+
+func (r *extentReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.metadata.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *extentReader) Read(p []byte) (int, error) {
+	if r.offset >= r.metadata.Size {
+		return 0, io.EOF
+	}
+
+	extents := r.metadata.Extents
+	i := sort.Search(len(extents), func(i int) bool { return extents[i].Offset+extents[i].Length > r.offset })
+	if i == len(extents) {
+		return 0, fmt.Errorf("no block holds offset %d", r.offset)
+	}
+	if i != r.block {
+		content, err := r.files.readExtent(r.ctx, r.timer, r.metadata, i)
+		if err != nil {
+			requestLogger(r.ctx).Error("Failed to read block",
+				zap.String("fileName", r.metadata.Name),
+				zap.Int("position", i+1),
+				zap.Error(err),
+			)
+			return 0, err
+		}
+		r.block, r.content = i, content
+		r.read += int64(len(content))
+	}
+
+	n := copy(p, r.content[r.offset-extents[i].Offset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// serveRange answers a Range request on a file in the seekable layout from
+// the blocks the range spans, instead of reconstructing the whole file. It
+// reports whether the request was handled.
+func (f *fileManager) serveRange(w http.ResponseWriter, r *http.Request, metadata FileMetadata) bool {
+	if r.Header.Get("Range") == "" || metadata.Packed != nil || metadata.Extents == nil {
+		return false
+	}
+
+	// The type is not sniffed, which would read the first block for nothing.
+	w.Header().Set("Content-Type", downloadContentType(metadata.Name))
+	reader := newExtentReader(r.Context(), f, metadata)
+	http.ServeContent(w, r, metadata.Name, metadata.CreatedAt, reader)
+	reader.timer.report(requestLogger(r.Context()), "download", config.SlowDownloadThreshold, int(reader.read), nil, zap.String("fileName", metadata.Name))
+	fileTransferSize.WithLabelValues("download").Observe(float64(reader.read))
+	return true
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"FDS/grpcwire"
+	"FDS/logging"
+	"FDS/version"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MB = 1024 * 1024
+
+var httpRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests received, labeled by method and path.",
+	},
+	[]string{"method", "path"},
+)
+
+type FileBlock struct {
+	bytes    []byte
+	position int
+}
+
+type NodeRegistrationRequest struct {
+	Url string `json:"Url"`
+	// ID is the persistent identity of the node, absent for older nodes.
+	ID     string            `json:"ID,omitempty"`
+	Labels map[string]string `json:"Labels,omitempty"`
+	// The capabilities of the node, absent for nodes older than the
+	// registration handshake.
+	Version      *version.Info `json:"Version,omitempty"`
+	MaxBlockSize int64         `json:"MaxBlockSize,omitempty"`
+	Codecs       []string      `json:"Codecs,omitempty"`
+	Auth         []string      `json:"Auth,omitempty"`
+	// Capacity is the space the node offers for blocks, in bytes; 0 when
+	// the node leaves it to FDS_NODE_DEFAULT_CAPACITY.
+	Capacity int64 `json:"Capacity,omitempty"`
+}
+
+type clients struct {
+	httpClient  http.Client
+	redisClient *redis.Client
+	mutex       *sync.Mutex
+	nodeManager *nodeManager
+	fileManager *fileManager
+	jobManager  *jobManager
+}
+
+// newNodeTransport returns the connection pool shared by all traffic to the
+// nodes. With NodeHTTP2 the nodes are spoken to over HTTP/2, plaintext unless
+// they serve HTTPS, so concurrent block transfers are multiplexed over one
+// connection per node. The certificates of HTTPS nodes are checked against
+// nodeTLS.
+func newNodeTransport() *http.Transport {
+	var protocols http.Protocols
+	if config.NodeHTTP2 {
+		protocols.SetUnencryptedHTTP2(true)
+		protocols.SetHTTP2(true)
+	} else {
+		protocols.SetHTTP1(true)
+	}
+
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        config.NodeMaxIdleConns,
+		MaxIdleConnsPerHost: config.NodeMaxIdleConnsPerHost,
+		MaxConnsPerHost:     config.NodeMaxConnsPerHost,
+		IdleConnTimeout:     config.NodeIdleConnTimeout,
+		TLSClientConfig:     nodeTLS,
+		Protocols:           &protocols,
+	}
+}
+
+func newHttpClient(transport *http.Transport) http.Client {
+	return http.Client{Timeout: config.NodeRequestTimeout, Transport: requestIDTransport{base: breakerTransport{base: nodeAuthTransport{base: transport}}}}
+}
+
+// newProbeClient returns the client node health checks use. /health needs
+// no cluster token, and the address checked may be any URL a registration
+// named, so the token is never sent.
+func newProbeClient(transport *http.Transport) *http.Client {
+	return &http.Client{Timeout: config.NodeRequestTimeout, Transport: requestIDTransport{base: breakerTransport{base: transport}}}
+}
+
+// newBlockClient returns the client used for gRPC block streams. It has no
+// overall timeout since each transfer is bounded by its context, and always
+// speaks HTTP/2 as gRPC requires.
+func newBlockClient(transport *http.Transport) *http.Client {
+	if !config.NodeHTTP2 {
+		transport = transport.Clone()
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		protocols.SetHTTP2(true)
+		transport.Protocols = &protocols
+	}
+
+	return &http.Client{Transport: requestIDTransport{base: breakerTransport{base: nodeAuthTransport{base: transport}}}}
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     config.RedisAddr,
+		Password: "",
+		DB:       0,
+		Protocol: 2,
+	})
+}
+
+// logger discards everything until New sets it up.
+var logger = zap.NewNop()
+
+// shutdownTimeout bounds how long a stopping Server waits for the requests
+// in flight.
+const shutdownTimeout = 30 * time.Second
+
+// registerMetrics registers the metrics of the central server, once per
+// process.
+var registerMetrics = sync.OnceFunc(func() {
+	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(blockTransmissedByNode)
+	prometheus.MustRegister(httpRequestDuration, fileTransferSize, blockTransmitDuration, redisOperationDuration)
+	prometheus.MustRegister(nodeHealthMetrics)
+	prometheus.MustRegister(nodeBreakerState)
+	prometheus.MustRegister(hedgedFetches)
+	prometheus.MustRegister(uploadsInFlight, uploadBufferedBytes, uploadsRejected)
+	prometheus.MustRegister(uploadsRefusedByType)
+	prometheus.MustRegister(uploadHookDuration)
+	prometheus.MustRegister(blockCacheRequests, blockCacheEvictions, blockCacheBytes)
+	prometheus.MustRegister(coalescedFetches)
+	prometheus.MustRegister(blockCorruptions, blockRepairs)
+	prometheus.MustRegister(nodeEvictions, nodeReadmissions)
+	prometheus.MustRegister(uploadRecoveries)
+	prometheus.MustRegister(replicaPlacementDegraded)
+	prometheus.MustRegister(writeVerifications)
+})
+
+// running is set while a Server exists.
+var running atomic.Bool
+
+// Server is a central server. It keeps its state in package variables, so a
+// process holds one Server at a time: New fails until the previous one has
+// stopped.
+type Server struct {
+	clients     *clients
+	handler     http.Handler
+	grpcHandler http.Handler
+
+	httpListener net.Listener
+	grpcListener net.Listener
+	tls          bool
+	background   sync.WaitGroup
+	done         chan struct{}
+	err          error
+}
+
+// New sets up a central server with cfg, typically from LoadConfig, and
+// connects it to its Redis. It serves nothing until Start.
+func New(cfg Config) (*Server, error) {
+	if !running.CompareAndSwap(false, true) {
+		return nil, errors.New("a central server is already running in this process")
+	}
+	s, err := newServer(cfg)
+	if err != nil {
+		running.Store(false)
+		return nil, err
+	}
+	return s, nil
+}
+
+func newServer(cfg Config) (_ *Server, err error) {
+	config = cfg
+	resetState()
+
+	configuredLogger, err := logging.New(config.Log)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up logging: %w", err)
+	}
+	logger = configuredLogger
+	ensurePresignKey()
+
+	redisClient := newRedisClient()
+	redisClient.AddHook(redisMetricsHook{})
+	defer func() {
+		if err != nil {
+			redisClient.Close()
+		}
+	}()
+
+	if err := loadNodeToken(redisClient); err != nil {
+		return nil, fmt.Errorf("failed to load the cluster token: %w", err)
+	}
+
+	if err := loadMaintenance(redisClient); err != nil {
+		return nil, fmt.Errorf("failed to load the maintenance mode: %w", err)
+	}
+
+	auditLog, err = newAuditSink(redisClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+
+	if err := loadNodeCA(); err != nil {
+		return nil, fmt.Errorf("failed to load the node CA: %w", err)
+	}
+
+	nodeTransport := newNodeTransport()
+	httpClient := newHttpClient(nodeTransport)
+	mutex := &sync.Mutex{}
+
+	registerMetrics()
+	breakers.configure(config.NodeBreakerThreshold, config.NodeBreakerCoolDown)
+	admissions.configure(config.NodeEvictAfter, config.NodeReadmitAfter, config.NodeFlapWindow, config.NodeQuarantine, config.NodeQuarantineMax)
+
+	redisManagerClient := &RedisManager{redisClient: redisClient}
+	nodeManagerClient := &nodeManager{httpClient: &httpClient, probeClient: newProbeClient(nodeTransport), mutex: mutex, redisClient: redisClient, registry: redisManagerClient}
+	fileManagerClient := &fileManager{nodeManager: nodeManagerClient, redisManager: redisManagerClient, httpClient: &httpClient, blockClient: newBlockClient(nodeTransport), mutex: mutex}
+	jobManagerClient := newJobManager(fileManagerClient)
+	fileManagerClient.jobs = jobManagerClient
+	fileManagerClient.packer = newPacker(fileManagerClient)
+	clients := &clients{httpClient: httpClient, redisClient: redisClient, mutex: mutex, nodeManager: nodeManagerClient, fileManager: fileManagerClient, jobManager: jobManagerClient}
+
+	uploadHooks, _ = newUploadHooks(config.UploadHooks)
+
+	grpcServer := clients.SetupGrpcServer()
+	return &Server{
+		clients:     clients,
+		handler:     withCORS(clients.SetupRouter()),
+		grpcHandler: withRequestID(withRequestCaller(withAccessLog(withAPIKey(withUsage(withLease(withPrecondition(grpcServer))))))),
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// resetState drops what a previous Server of the process left in the
+// package variables.
+func resetState() {
+	auditLog = nopAuditSink{}
+	blockCache = &blockLRU{entries: make(map[string]*list.Element), order: list.New()}
+	blockFetches = &fetchGroup{}
+	blockFetchLatency = &latencyTracker{}
+	breakers = &nodeBreakers{breakers: make(map[string]*circuitBreaker)}
+	admissions = &nodeAdmissions{nodes: make(map[string]*nodeAdmission)}
+	hotspots = &hotspotTracker{}
+	maintenance = &maintenanceMode{}
+	nodeToken = ""
+	nodeTLS, nodeIssuer = nil, nil
+	nodeHealthMetrics.reset()
+	rehydrating.Clear()
+	uploadHooks = nil
+	uploads = &uploadAdmission{}
+	usage = &usageMeter{pending: make(map[usageBucket]*UsageCounts)}
+	centralInstance = newCentralInstance()
+	select {
+	case <-repairRequests:
+	default:
+	}
+}
+
+// Start opens the listeners of the HTTP and gRPC APIs, then serves them and
+// runs the background work of the central server until ctx is done. Wait
+// returns once it has all stopped. A Server that fails to start releases
+// the process for another.
+func (s *Server) Start(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			s.clients.redisClient.Close()
+			running.Store(false)
+		}
+	}()
+	apiServer, err := newAPIServer(s.handler)
+	if err != nil {
+		return err
+	}
+	httpListener, err := net.Listen("tcp", config.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	grpcListener, err := net.Listen("tcp", config.GRPCAddr)
+	if err != nil {
+		httpListener.Close()
+		return err
+	}
+	s.httpListener, s.grpcListener, s.tls = httpListener, grpcListener, apiServer.TLSConfig != nil
+
+	ctx, stop := context.WithCancel(ctx)
+	nodeManagerClient, fileManagerClient := s.clients.nodeManager, s.clients.fileManager
+	if err := nodeManagerClient.ReconcileRegistry(ctx, config.NodeRegistryPruneAfter); err != nil {
+		logger.Error("Failed to reconcile the node registry", zap.Error(err))
+	}
+	s.run(func() {
+		if err := fileManagerClient.RecoverUploads(ctx); err != nil {
+			logger.Error("Failed to recover interrupted uploads", zap.Error(err))
+		}
+	})
+
+	if config.NodeHeartbeatInterval > 0 {
+		s.run(func() { nodeManagerClient.RunHeartbeats(ctx, config.NodeHeartbeatInterval) })
+	}
+
+	if config.NodeDiscovery != "" {
+		discoverer, _ := newNodeDiscoverer(config.NodeDiscovery)
+		s.run(func() { nodeManagerClient.RunDiscovery(ctx, discoverer, config.NodeDiscoveryInterval) })
+	}
+
+	if config.ColdTier != "" && config.TieringInterval > 0 {
+		s.run(func() { fileManagerClient.RunTiering(ctx, config.TieringInterval) })
+	}
+
+	if config.RepairInterval > 0 {
+		s.run(func() { fileManagerClient.RunRepairs(ctx, config.RepairInterval) })
+	}
+
+	s.run(func() { fileManagerClient.RunMultipartExpiry(ctx, multipartSweepInterval) })
+
+	if config.UsageRetention > 0 {
+		s.run(func() { usage.Run(ctx, s.clients.redisClient) })
+	}
+	if config.UsageExportSink != "" {
+		if sink, err := openUsageSink(config.UsageExportSink); err != nil {
+			logger.Error("Failed to open the usage export sink", zap.Error(err))
+		} else {
+			s.run(func() { fileManagerClient.RunUsageExports(ctx, sink) })
+		}
+	}
+
+	grpcServer := grpcwire.NewHTTPServer(s.grpcHandler)
+	stopped := make(chan error, 2)
+	go func() { stopped <- serveAPI(apiServer, httpListener) }()
+	go func() { stopped <- grpcServer.Serve(grpcListener) }()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case err := <-stopped:
+			s.err = err
+		}
+		stop()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := apiServer.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to shut the HTTP API down", zap.Error(err))
+		}
+		if err := grpcServer.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Failed to shut the gRPC API down", zap.Error(err))
+		}
+		s.background.Wait()
+		s.clients.redisClient.Close()
+		_ = logger.Sync()
+
+		running.Store(false)
+		close(s.done)
+	}()
+	return nil
+}
+
+// run runs fn in the background; the Server stops once fn has returned.
+func (s *Server) run(fn func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		fn()
+	}()
+}
+
+// Wait waits for the Server to stop, and returns the error that stopped it,
+// nil if it stopped because the context of Start was done.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// URL returns the base URL of the HTTP API of a started Server, on localhost
+// when it listens on every interface.
+func (s *Server) URL() string {
+	scheme := "http"
+	if s.tls {
+		scheme = "https"
+	}
+	return scheme + "://" + localAddr(s.httpListener.Addr())
+}
+
+// GRPCAddr returns the address of the gRPC API of a started Server, on
+// localhost when it listens on every interface.
+func (s *Server) GRPCAddr() string {
+	return localAddr(s.grpcListener.Addr())
+}
+
+func localAddr(addr net.Addr) string {
+	tcp := addr.(*net.TCPAddr)
+	if tcp.IP.IsUnspecified() {
+		return net.JoinHostPort("localhost", strconv.Itoa(tcp.Port))
+	}
+	return tcp.String()
+}
+
+// centralFeatures lists the optional capabilities advertised on /version.
+func centralFeatures() []string {
+	features := []string{"grpc", "webdav", "presigned-urls", "async-jobs", "job-events", "node-registry", "api-v1", "openapi"}
+	if config.DirectDownloads != directDownloadsOff {
+		features = append(features, "direct-downloads-"+config.DirectDownloads)
+	}
+	if config.AuditSink != auditSinkOff {
+		features = append(features, "audit-log")
+	}
+	if config.ColdTier != "" {
+		features = append(features, "cold-tier")
+	}
+	if config.TLSCertFile != "" {
+		features = append(features, "tls")
+	}
+	if nodeIssuer != nil {
+		features = append(features, "node-certificates")
+	}
+	return features
+}
+
+func (c *clients) GetVersion(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	version.Handler(centralFeatures()...)(w, r)
+}
+
+func (c *clients) SetupRouter() *mux.Router {
+	routerHttp := mux.NewRouter()
+	routerHttp.NotFoundHandler = http.HandlerFunc(respondNoRoute)
+	routerHttp.MethodNotAllowedHandler = http.HandlerFunc(respondMethodNotAllowed)
+
+	routerHttp.HandleFunc("/", func(w http.ResponseWriter, request *http.Request) {
+		httpRequestsTotal.WithLabelValues(request.Method, request.URL.Path).Inc()
+		w.Write([]byte("Hello, Prometheus!"))
+	})
+	routerHttp.Handle("/metrics", promhttp.Handler())
+	routerHttp.HandleFunc("/version", c.GetVersion).Methods("GET")
+	routerHttp.HandleFunc("/openapi.json", openAPIHandler(routerHttp)).Methods("GET")
+	routerHttp.HandleFunc("/healthz", c.Healthz).Methods("GET", "HEAD")
+	routerHttp.HandleFunc("/readyz", c.Readyz).Methods("GET", "HEAD")
+	routerHttp.PathPrefix(webdavPrefix).Handler(newWebdavHandler(c.fileManager))
+
+	c.setupAPI(routerHttp.PathPrefix(apiV1).Subrouter())
+
+	// The paths the API had before it was versioned.
+	legacy := routerHttp.NewRoute().Subrouter()
+	legacy.Use(withLegacyPath)
+	c.setupAPI(legacy)
+
+	routerHttp.Use(withRequestID, withRequestCaller, withAccessLog, withAPIKey, withUsage, withLease, withPrecondition, withMaintenance)
+
+	return routerHttp
+}
+
+// setupAPI registers the endpoints of the API on r.
+func (c *clients) setupAPI(r *mux.Router) {
+	r.HandleFunc("/sendFile", c.fileManager.UploadFileAndDistributeBlocks).Methods("POST")
+	r.HandleFunc("/fetch", c.fileManager.FetchFile).Methods("POST")
+	r.HandleFunc("/nodesUsage", c.nodeManager.GetNodeUsage).Methods("GET")
+	r.HandleFunc("/nodes", c.nodeManager.ListNodes).Methods("GET")
+	r.HandleFunc("/retrieveFile", withPresignedURL(fileNameFromQuery, c.fileManager.DownloadFile)).Methods("GET", "HEAD")
+	r.HandleFunc("/downloadArchive", c.fileManager.DownloadArchive).Methods("POST")
+	r.HandleFunc("/addNode", c.nodeManager.VerifyAndRegisterNode).Methods("POST")
+	r.HandleFunc("/nodes/report", c.nodeManager.ReceiveNodeReport).Methods("POST")
+	r.HandleFunc("/nodes/corruption", c.fileManager.ReceiveCorruptionReport).Methods("POST")
+	r.HandleFunc("/nodes/certificate", c.nodeManager.IssueNodeCertificate).Methods("POST")
+	r.HandleFunc("/files", c.fileManager.ListFiles).Methods("GET")
+	r.HandleFunc("/files/batchUpload", c.fileManager.BatchUpload).Methods("POST")
+	r.HandleFunc("/files/batchDelete", c.fileManager.BatchDelete).Methods("POST")
+	r.HandleFunc("/files/batchGet", c.fileManager.BatchGet).Methods("POST")
+	r.HandleFunc("/files/{name}", c.fileManager.GetFileInfo).Methods("GET")
+	r.HandleFunc("/files/{name}", withPresignedURL(fileNameFromPath, c.fileManager.UploadFileByName)).Methods("PUT")
+	r.HandleFunc("/files/{name}", c.fileManager.DeleteFile).Methods("DELETE")
+	r.HandleFunc("/files/{name}", c.fileManager.PatchFile).Methods("PATCH")
+	r.HandleFunc("/files/{name}/presign", c.fileManager.PresignFile).Methods("POST")
+	r.HandleFunc("/files/{name}/copy", c.fileManager.CopyFile).Methods("POST")
+	r.HandleFunc("/files/{name}/append", c.fileManager.AppendFile).Methods("POST")
+	r.HandleFunc("/files/{name}/lock", c.fileManager.GetFileLock).Methods("GET")
+	r.HandleFunc("/files/{name}/lock", c.fileManager.LockFile).Methods("POST")
+	r.HandleFunc("/files/{name}/lock", c.fileManager.UnlockFile).Methods("DELETE")
+	r.HandleFunc("/files/{name}/signature", c.fileManager.GetFileSignature).Methods("GET")
+	r.HandleFunc("/files/{name}/manifest", c.fileManager.GetFileManifest).Methods("GET")
+	r.HandleFunc("/files/{name}/delta", c.fileManager.UploadFileDelta).Methods("POST")
+	r.HandleFunc("/files/{name}/uploads", c.fileManager.InitiateMultipartUpload).Methods("POST")
+	r.HandleFunc("/files/{name}/uploads/{id}", c.fileManager.GetMultipartUpload).Methods("GET")
+	r.HandleFunc("/files/{name}/uploads/{id}", c.fileManager.AbortMultipartUpload).Methods("DELETE")
+	r.HandleFunc("/files/{name}/uploads/{id}/parts/{part}", c.fileManager.UploadPart).Methods("PUT")
+	r.HandleFunc("/files/{name}/uploads/{id}/complete", c.fileManager.CompleteMultipartUpload).Methods("POST")
+	r.HandleFunc("/snapshots", c.fileManager.GetSnapshots).Methods("GET")
+	r.HandleFunc("/snapshots", c.fileManager.CreateSnapshot).Methods("POST")
+	r.HandleFunc("/snapshots/{id}", c.fileManager.DeleteSnapshot).Methods("DELETE")
+	r.HandleFunc("/snapshots/{id}/files", c.fileManager.GetSnapshotFiles).Methods("GET")
+	r.HandleFunc("/snapshots/{id}/files/{name}", c.fileManager.DownloadSnapshotFile).Methods("GET", "HEAD")
+	r.HandleFunc("/snapshots/{id}/rollback", c.fileManager.RollbackToSnapshot).Methods("POST")
+	r.HandleFunc("/jobs/{id}", c.jobManager.GetJob).Methods("GET")
+	r.HandleFunc("/jobs/{id}/events", c.jobManager.StreamJobEvents).Methods("GET")
+
+	adminRouter := r.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(requireAdmin)
+	adminRouter.HandleFunc("/audit", GetAuditLog).Methods("GET")
+	adminRouter.HandleFunc("/files/{name}/blocks", c.fileManager.GetBlockMap).Methods("GET")
+	adminRouter.HandleFunc("/stats", c.fileManager.GetClusterStats).Methods("GET")
+	adminRouter.HandleFunc("/hotspots", GetHotspots).Methods("GET")
+	adminRouter.HandleFunc("/usage", c.fileManager.GetUsage).Methods("GET")
+	adminRouter.HandleFunc("/usage/export", c.fileManager.GetUsageExport).Methods("GET")
+	adminRouter.HandleFunc("/usage/export", c.fileManager.PostUsageExport).Methods("POST")
+	adminRouter.HandleFunc("/backups", c.fileManager.GetBackups).Methods("GET")
+	adminRouter.HandleFunc("/backups", c.fileManager.CreateBackup).Methods("POST")
+	adminRouter.HandleFunc("/backups/{id}/restore", c.fileManager.RestoreBackup).Methods("POST")
+	adminRouter.HandleFunc("/tiering/run", c.fileManager.RunTieringPass).Methods("POST")
+	adminRouter.HandleFunc("/rebalance", c.fileManager.Rebalance).Methods("POST")
+	adminRouter.HandleFunc("/scrub", c.fileManager.Scrub).Methods("POST")
+	adminRouter.HandleFunc("/gc", c.fileManager.GC).Methods("POST")
+	adminRouter.HandleFunc("/nodes/drain", c.nodeManager.DrainNode).Methods("PUT")
+	adminRouter.HandleFunc("/nodes/drain", c.nodeManager.UndrainNode).Methods("DELETE")
+	adminRouter.HandleFunc("/nodes/decommission", c.fileManager.DecommissionNode).Methods("POST")
+	adminRouter.HandleFunc("/files/{name}/offload", c.fileManager.OffloadFileNow).Methods("POST")
+	adminRouter.HandleFunc("/files/{name}/rehydrate", c.fileManager.RehydrateFileNow).Methods("POST")
+	adminRouter.HandleFunc("/files/{name}/pin", c.fileManager.GetFilePin).Methods("GET")
+	adminRouter.HandleFunc("/files/{name}/pin", c.fileManager.PinFile).Methods("PUT")
+	adminRouter.HandleFunc("/files/{name}/pin", c.fileManager.UnpinFile).Methods("DELETE")
+	adminRouter.HandleFunc("/maintenance", c.GetMaintenance).Methods("GET")
+	adminRouter.HandleFunc("/maintenance", c.EnableMaintenance).Methods("PUT")
+	adminRouter.HandleFunc("/maintenance", c.DisableMaintenance).Methods("DELETE")
+}
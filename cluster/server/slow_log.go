@@ -0,0 +1,65 @@
+package server
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"time"
+)
+
+// phaseTimer splits the duration of an upload, download or block transmit
+// into named phases, so a slow operation can be logged with where the time
+// went.
+type phaseTimer struct {
+	start     time.Time
+	mark      time.Time
+	names     []string
+	durations map[string]time.Duration
+}
+
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, mark: now, durations: make(map[string]time.Duration)}
+}
+
+// Phase charges the time since the previous call to name. Phases can be
+// entered several times, e.g. once per block.
+func (t *phaseTimer) Phase(name string) {
+	now := time.Now()
+	if _, ok := t.durations[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.durations[name] += now.Sub(t.mark)
+	t.mark = now
+}
+
+func (t *phaseTimer) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, name := range t.names {
+		enc.AddDuration(name, t.durations[name])
+	}
+	return nil
+}
+
+// report logs a warning when the operation took at least threshold or moved
+// at least FDS_LARGE_TRANSFER_THRESHOLD bytes. A zero threshold disables the
+// check.
+func (t *phaseTimer) report(logger *zap.Logger, operation string, threshold time.Duration, size int, err error, fields ...zap.Field) {
+	total := time.Since(t.start)
+	slow := threshold > 0 && total >= threshold
+	large := config.LargeTransferThreshold > 0 && size >= config.LargeTransferThreshold
+	if !slow && !large {
+		return
+	}
+
+	fields = append(fields,
+		zap.String("operation", operation),
+		zap.Int("size", size),
+		zap.Duration("duration", total),
+		zap.Object("phases", t),
+		zap.Bool("slow", slow),
+		zap.Bool("large", large),
+	)
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	logger.Warn("Slow or large transfer", fields...)
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix = ".snap-"
+	snapshotsKey   = "snapshots"
+)
+
+// snapshotFilesKey holds the metadata of the files of a snapshot.
+func snapshotFilesKey(id string) string { return "snapshot:files:" + id }
+
+// snapshotPackedKey holds the content of the packed files of a snapshot.
+func snapshotPackedKey(id string) string { return "snapshot:packed:" + id }
+
+// snapshotFileName is the name the blocks of a file are kept under in a
+// snapshot.
+func snapshotFileName(id string, fileName string) string {
+	return snapshotPrefix + id + "-" + fileName
+}
+
+func isSnapshotName(name string) bool { return strings.HasPrefix(name, snapshotPrefix) }
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+// Snapshot describes a point-in-time view of the namespace.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     int       `json:"files"`
+	Size      int64     `json:"size"`
+}
+
+// SnapshotRollback is the answer of a rollback: the files put back as they
+// were, the files created since the snapshot that were removed, and the
+// failures.
+type SnapshotRollback struct {
+	ID       string          `json:"id"`
+	Restored int             `json:"restored"`
+	Removed  int             `json:"removed"`
+	Failed   []BackupFailure `json:"failed"`
+}
+
+// snapshotFile captures one file. The blocks are hard-linked by their nodes
+// under the snapshot name, so they survive later overwrites and deletes of
+// the file without taking space until then; packed files are small and their
+// content is kept in Redis. A file overwritten while it is captured is
+// captured again.
+func (f *fileManager) snapshotFile(ctx context.Context, id string, metadata FileMetadata) (FileMetadata, error) {
+	rdb := f.redisManager.redisClient
+	for attempt := 0; ; attempt++ {
+		if metadata.Packed != nil {
+			content, err := f.packer.Read(ctx, *metadata.Packed)
+			if err != nil {
+				return metadata, err
+			}
+			if err := rdb.HSet(ctx, snapshotPackedKey(id), metadata.Name, content).Err(); err != nil {
+				return metadata, err
+			}
+		} else if _, err := f.copyBlocks(ctx, metadata.Name, snapshotFileName(id, metadata.Name)); err != nil {
+			return metadata, err
+		}
+
+		current, err := f.redisManager.GetFileMetadata(metadata.Name)
+		if err != nil || current.CreatedAt.Equal(metadata.CreatedAt) || attempt == 2 {
+			// A file deleted meanwhile is still captured as it was. The
+			// captured blocks are all under the snapshot name.
+			metadata.Rewritten = nil
+			return metadata, nil
+		}
+		if metadata.Packed == nil {
+			_ = f.removeBlocks(ctx, snapshotFileName(id, metadata.Name))
+		}
+		metadata = current
+	}
+}
+
+// TakeSnapshot captures every file of the namespace.
+func (f *fileManager) TakeSnapshot(ctx context.Context) (Snapshot, error) {
+	snapshot, err := f.createSnapshot(ctx)
+	recordAudit(ctx, AuditSnapshotCreate, snapshot.ID, err)
+	return snapshot, err
+}
+
+func (f *fileManager) createSnapshot(ctx context.Context) (Snapshot, error) {
+	logger := requestLogger(ctx)
+	rdb := f.redisManager.redisClient
+	snapshot := Snapshot{ID: newTimestampedID(), CreatedAt: time.Now().UTC()}
+
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return snapshot, err
+	}
+
+	for _, metadata := range files {
+		captured, err := f.snapshotFile(ctx, snapshot.ID, metadata)
+		if err != nil {
+			logger.Error("Failed to capture file in snapshot",
+				zap.String("snapshotID", snapshot.ID),
+				zap.String("fileName", metadata.Name),
+				zap.Error(err),
+			)
+			f.purgeSnapshot(ctx, snapshot.ID)
+			return Snapshot{}, fmt.Errorf("failed to capture %s: %w", metadata.Name, err)
+		}
+
+		data, err := json.Marshal(captured)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		if err := rdb.HSet(ctx, snapshotFilesKey(snapshot.ID), captured.Name, data).Err(); err != nil {
+			f.purgeSnapshot(ctx, snapshot.ID)
+			return Snapshot{}, err
+		}
+		snapshot.Files++
+		snapshot.Size += captured.Size
+	}
+
+	// The snapshot is only listed once it is complete.
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if err := rdb.HSet(ctx, snapshotsKey, snapshot.ID, data).Err(); err != nil {
+		f.purgeSnapshot(ctx, snapshot.ID)
+		return Snapshot{}, err
+	}
+
+	logger.Info("Snapshot created",
+		zap.String("snapshotID", snapshot.ID),
+		zap.Int("files", snapshot.Files),
+		zap.Int64("size", snapshot.Size),
+	)
+	return snapshot, nil
+}
+
+func (f *fileManager) ListSnapshots(ctx context.Context) ([]Snapshot, error) {
+	values, err := f.redisManager.redisClient.HGetAll(ctx, snapshotsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]Snapshot, 0, len(values))
+	for _, value := range values {
+		var snapshot Snapshot
+		if err := json.Unmarshal([]byte(value), &snapshot); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a, b Snapshot) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return snapshots, nil
+}
+
+// snapshotFiles returns the metadata of the files of a snapshot, by name.
+func (f *fileManager) snapshotFiles(ctx context.Context, id string) (map[string]FileMetadata, error) {
+	rdb := f.redisManager.redisClient
+	exists, err := rdb.HExists(ctx, snapshotsKey, id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errSnapshotNotFound
+	}
+
+	values, err := rdb.HGetAll(ctx, snapshotFilesKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]FileMetadata, len(values))
+	for name, value := range values {
+		metadata, err := decodeFileMetadata(value)
+		if err != nil {
+			return nil, err
+		}
+		files[name] = metadata
+	}
+	return files, nil
+}
+
+// ReadSnapshotFile returns the content of a file as it was in a snapshot.
+func (f *fileManager) ReadSnapshotFile(ctx context.Context, id string, fileName string) (FileMetadata, []byte, error) {
+	files, err := f.snapshotFiles(ctx, id)
+	if err != nil {
+		return FileMetadata{}, nil, err
+	}
+	metadata, ok := files[fileName]
+	if !ok {
+		return FileMetadata{}, nil, ErrFileNotFound
+	}
+
+	if metadata.Packed != nil {
+		content, err := f.redisManager.redisClient.HGet(ctx, snapshotPackedKey(id), fileName).Bytes()
+		return metadata, content, err
+	}
+	content, err := f.reconstructFile(ctx, newPhaseTimer(), snapshotFileName(id, fileName))
+	return metadata, content, err
+}
+
+// RollbackSnapshot puts the namespace back as it was in a snapshot: files
+// created since are removed and the others get their captured version back.
+// The snapshot itself is kept.
+func (f *fileManager) RollbackSnapshot(ctx context.Context, id string) (SnapshotRollback, error) {
+	rollback, err := f.rollbackSnapshot(ctx, id)
+	recordAudit(ctx, AuditSnapshotRollback, id, err)
+	return rollback, err
+}
+
+func (f *fileManager) rollbackSnapshot(ctx context.Context, id string) (SnapshotRollback, error) {
+	logger := requestLogger(ctx)
+	rollback := SnapshotRollback{ID: id, Failed: []BackupFailure{}}
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	files, err := f.snapshotFiles(ctx, id)
+	if err != nil {
+		return rollback, err
+	}
+	current, err := f.redisManager.ListFiles()
+	if err != nil {
+		return rollback, err
+	}
+
+	fail := func(name string, err error) {
+		logger.Error("Failed to roll back file",
+			zap.String("snapshotID", id),
+			zap.String("fileName", name),
+			zap.Error(err),
+		)
+		rollback.Failed = append(rollback.Failed, BackupFailure{Name: name, Error: err.Error()})
+	}
+
+	for _, metadata := range current {
+		captured, ok := files[metadata.Name]
+		if ok && captured.CreatedAt.Equal(metadata.CreatedAt) {
+			// Unchanged since the snapshot.
+			delete(files, metadata.Name)
+			continue
+		}
+		if err := f.removeFile(ctx, metadata.Name); err != nil {
+			fail(metadata.Name, err)
+			delete(files, metadata.Name)
+			continue
+		}
+		if !ok {
+			rollback.Removed++
+		}
+	}
+
+	for name, metadata := range files {
+		if metadata.Packed != nil {
+			content, err := f.redisManager.redisClient.HGet(ctx, snapshotPackedKey(id), name).Bytes()
+			if err == nil {
+				err = f.storeWhole(ctx, newPhaseTimer(), name, content, metadata.Annotations)
+			}
+			if err != nil {
+				fail(name, err)
+				continue
+			}
+			// Keep the captured creation time, so the file counts as
+			// unchanged in a later rollback.
+			if stored, err := f.redisManager.GetFileMetadata(name); err == nil {
+				stored.CreatedAt = metadata.CreatedAt
+				_ = f.redisManager.UpdateFileMetadata(stored)
+			}
+			rollback.Restored++
+			continue
+		}
+
+		numOfBlocks, err := f.copyBlocks(ctx, snapshotFileName(id, name), name)
+		if err == nil {
+			metadata.Blocks = numOfBlocks
+			metadata.Rewritten = nil
+			err = f.redisManager.SaveFileMetadata(metadata)
+		}
+		if err != nil {
+			fail(name, err)
+			continue
+		}
+		rollback.Restored++
+	}
+
+	logger.Info("Namespace rolled back to snapshot",
+		zap.String("snapshotID", id),
+		zap.Int("restored", rollback.Restored),
+		zap.Int("removed", rollback.Removed),
+		zap.Int("failed", len(rollback.Failed)),
+	)
+	return rollback, nil
+}
+
+// purgeSnapshot deletes the blocks and the records of a snapshot, complete
+// or not.
+func (f *fileManager) purgeSnapshot(ctx context.Context, id string) error {
+	rdb := f.redisManager.redisClient
+	names, err := rdb.HKeys(ctx, snapshotFilesKey(id)).Result()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err := f.removeBlocks(ctx, snapshotFileName(id, name))
+		if err != nil && !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
+	}
+	return rdb.Del(ctx, snapshotFilesKey(id), snapshotPackedKey(id)).Err()
+}
+
+// RemoveSnapshot frees the blocks kept for a snapshot.
+func (f *fileManager) RemoveSnapshot(ctx context.Context, id string) error {
+	err := f.deleteSnapshot(ctx, id)
+	recordAudit(ctx, AuditSnapshotDelete, id, err)
+	return err
+}
+
+func (f *fileManager) deleteSnapshot(ctx context.Context, id string) error {
+	removed, err := f.redisManager.redisClient.HDel(ctx, snapshotsKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return errSnapshotNotFound
+	}
+	requestLogger(ctx).Info("Snapshot deleted", zap.String("snapshotID", id))
+	return f.purgeSnapshot(ctx, id)
+}
+
+func (f *fileManager) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/snapshots").Inc()
+
+	snapshot, err := f.TakeSnapshot(r.Context())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create snapshot: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPath(r, "/snapshots/"+snapshot.ID))
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(snapshot)
+}
+
+func (f *fileManager) GetSnapshots(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/snapshots").Inc()
+
+	snapshots, err := f.ListSnapshots(r.Context())
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to list snapshots", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list snapshots")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(snapshots)
+}
+
+// GetSnapshotFiles lists the files of a snapshot, like GET /files.
+func (f *fileManager) GetSnapshotFiles(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/snapshots/{id}/files").Inc()
+
+	files, err := f.snapshotFiles(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, errSnapshotNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeSnapshotNotFound, "Snapshot not found", nil)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to list snapshot files", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to list snapshot files")
+		return
+	}
+
+	list := make([]FileMetadata, 0, len(files))
+	for _, metadata := range files {
+		list = append(list, metadata)
+	}
+	slices.SortFunc(list, func(a, b FileMetadata) int { return strings.Compare(a.Name, b.Name) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// DownloadSnapshotFile serves a file as it was in a snapshot.
+func (f *fileManager) DownloadSnapshotFile(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/snapshots/{id}/files/{name}").Inc()
+	vars := mux.Vars(r)
+
+	metadata, content, err := f.ReadSnapshotFile(r.Context(), vars["id"], vars["name"])
+	if errors.Is(err, errSnapshotNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeSnapshotNotFound, "Snapshot not found", nil)
+		return
+	}
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, vars["name"])
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to read snapshot file",
+			zap.String("snapshotID", vars["id"]),
+			zap.String("fileName", vars["name"]),
+			zap.Error(err),
+		)
+		respondWithError(w, http.StatusInternalServerError, "Failed to download file")
+		return
+	}
+
+	http.ServeContent(w, r, metadata.Name, metadata.CreatedAt, bytes.NewReader(content))
+}
+
+func (f *fileManager) RollbackToSnapshot(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/snapshots/{id}/rollback").Inc()
+
+	rollback, err := f.RollbackSnapshot(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, errSnapshotNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeSnapshotNotFound, "Snapshot not found", nil)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to roll back to snapshot", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to roll back: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(rollback)
+}
+
+func (f *fileManager) DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/snapshots/{id}").Inc()
+
+	err := f.RemoveSnapshot(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, errSnapshotNotFound) {
+		respondWithErrorCode(w, http.StatusNotFound, CodeSnapshotNotFound, "Snapshot not found", nil)
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Error("Failed to delete snapshot", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete snapshot")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
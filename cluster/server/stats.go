@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"sort"
+)
+
+type NodeBlockStats struct {
+	Address    string `json:"address"`
+	Registered bool   `json:"registered"`
+	Blocks     int    `json:"blocks"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// UsageDistribution summarizes how the stored bytes are spread across the
+// registered nodes.
+type UsageDistribution struct {
+	MinBytes    int64   `json:"min_bytes"`
+	MaxBytes    int64   `json:"max_bytes"`
+	MeanBytes   float64 `json:"mean_bytes"`
+	StddevBytes float64 `json:"stddev_bytes"`
+	// Imbalance is max/mean, 1 for a perfectly even spread.
+	Imbalance float64 `json:"imbalance"`
+}
+
+type ClusterStats struct {
+	Files         int   `json:"files"`
+	Blocks        int   `json:"blocks"`
+	LogicalBytes  int64 `json:"logical_bytes"`
+	PhysicalBytes int64 `json:"physical_bytes"`
+	// UnknownSizeBlocks were stored before block sizes were recorded and are
+	// missing from PhysicalBytes.
+	UnknownSizeBlocks int     `json:"unknown_size_blocks"`
+	CompressionRatio  float64 `json:"compression_ratio"`
+	// UnderReplicatedBlocks have no healthy copy on a registered node.
+	UnderReplicatedBlocks int               `json:"under_replicated_blocks"`
+	CorruptedBlocks       int               `json:"corrupted_blocks"`
+	Nodes                 []NodeBlockStats  `json:"nodes"`
+	Distribution          UsageDistribution `json:"distribution"`
+}
+
+func (f *fileManager) CollectClusterStats() (ClusterStats, error) {
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return ClusterStats{}, err
+	}
+
+	nodes := make(map[string]*NodeBlockStats)
+	f.nodeManager.mutex.Lock()
+	for _, address := range f.nodeManager.NodeAddresses {
+		nodes[address] = &NodeBlockStats{Address: address, Registered: true}
+	}
+	f.nodeManager.mutex.Unlock()
+
+	stats := ClusterStats{Files: len(files)}
+	for _, metadata := range files {
+		stats.LogicalBytes += metadata.Size
+
+		for i := 1; i <= metadata.Blocks; i++ {
+			stats.Blocks++
+
+			location, err := f.redisManager.GetBlockLocation(metadata.blockName(i))
+			if err != nil {
+				stats.UnderReplicatedBlocks++
+				continue
+			}
+
+			available := false
+			for _, replica := range location.Replicas {
+				node, ok := nodes[replica.Address]
+				if !ok {
+					node = &NodeBlockStats{Address: replica.Address, Registered: isColdAddress(replica.Address)}
+					nodes[replica.Address] = node
+				}
+				if node.Registered && replica.State == ReplicaHealthy {
+					available = true
+				}
+				node.Blocks++
+				if location.Size >= 0 {
+					node.Bytes += location.Size
+					stats.PhysicalBytes += location.Size
+				}
+			}
+			if !available {
+				stats.UnderReplicatedBlocks++
+			}
+			if location.Size < 0 {
+				stats.UnknownSizeBlocks++
+			}
+		}
+	}
+
+	if stats.PhysicalBytes > 0 {
+		stats.CompressionRatio = float64(stats.LogicalBytes) / float64(stats.PhysicalBytes)
+	}
+
+	corrupted, err := f.redisManager.CorruptedBlocks()
+	if err != nil {
+		return ClusterStats{}, err
+	}
+	stats.CorruptedBlocks = len(corrupted)
+
+	stats.Nodes = make([]NodeBlockStats, 0, len(nodes))
+	var registered []int64
+	for _, node := range nodes {
+		stats.Nodes = append(stats.Nodes, *node)
+		if node.Registered {
+			registered = append(registered, node.Bytes)
+		}
+	}
+	sort.Slice(stats.Nodes, func(i, j int) bool {
+		return stats.Nodes[i].Address < stats.Nodes[j].Address
+	})
+	stats.Distribution = usageDistribution(registered)
+
+	return stats, nil
+}
+
+func usageDistribution(bytes []int64) UsageDistribution {
+	if len(bytes) == 0 {
+		return UsageDistribution{}
+	}
+
+	distribution := UsageDistribution{MinBytes: bytes[0], MaxBytes: bytes[0]}
+	var sum float64
+	for _, b := range bytes {
+		distribution.MinBytes = min(distribution.MinBytes, b)
+		distribution.MaxBytes = max(distribution.MaxBytes, b)
+		sum += float64(b)
+	}
+	distribution.MeanBytes = sum / float64(len(bytes))
+
+	var variance float64
+	for _, b := range bytes {
+		variance += math.Pow(float64(b)-distribution.MeanBytes, 2)
+	}
+	distribution.StddevBytes = math.Sqrt(variance / float64(len(bytes)))
+
+	if distribution.MeanBytes > 0 {
+		distribution.Imbalance = float64(distribution.MaxBytes) / distribution.MeanBytes
+	}
+	return distribution
+}
+
+func (f *fileManager) GetClusterStats(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	stats, err := f.CollectClusterStats()
+	if err != nil {
+		logger.Error("Failed to collect cluster statistics", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to collect cluster statistics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(stats)
+}
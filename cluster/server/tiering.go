@@ -0,0 +1,458 @@
+package server
+
+import (
+	"FDS/s3"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// errColdFile is returned for block plans of files with blocks in the
+	// cold tier, which only the central server can read.
+	errColdFile         = errors.New("file has blocks in the cold tier")
+	errColdTierDisabled = errors.New("FDS_COLD_TIER is not set")
+)
+
+// A block moved to the cold tier keeps its Redis entry; its only replica
+// becomes the s3://bucket/prefix of the tier, so every path that reads,
+// copies or deletes a block by its address reaches the bucket instead of a
+// node.
+func isColdAddress(address string) bool { return strings.HasPrefix(address, "s3://") }
+
+// coldTier is the bucket and prefix blocks are offloaded to.
+type coldTier struct {
+	address string
+	client  *s3.Client
+	prefix  string
+}
+
+func (t *coldTier) key(blockFileName string) string {
+	if t.prefix == "" {
+		return blockFileName
+	}
+	return t.prefix + "/" + blockFileName
+}
+
+var (
+	coldTiersMutex sync.Mutex
+	coldTiers      = make(map[string]*coldTier)
+)
+
+// openColdTier returns the tier of an s3://bucket/prefix address. Blocks keep
+// the address they were offloaded to, so they can still be read after
+// FDS_COLD_TIER changes.
+func openColdTier(address string) (*coldTier, error) {
+	coldTiersMutex.Lock()
+	defer coldTiersMutex.Unlock()
+
+	if tier, ok := coldTiers[address]; ok {
+		return tier, nil
+	}
+
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(address, "s3://"), "/")
+	client, err := newS3Client(bucket)
+	if err != nil {
+		return nil, err
+	}
+	tier := &coldTier{address: address, client: client, prefix: strings.Trim(prefix, "/")}
+	coldTiers[address] = tier
+	return tier, nil
+}
+
+func (f *fileManager) fetchColdBlock(ctx context.Context, address string, blockFileName string) (*bytes.Buffer, error) {
+	tier, err := openColdTier(address)
+	if err != nil {
+		return nil, err
+	}
+	body, err := tier.client.Get(ctx, tier.key(blockFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return readPooled(body, -1)
+}
+
+func (f *fileManager) deleteColdBlock(ctx context.Context, address string, blockFileName string) error {
+	tier, err := openColdTier(address)
+	if err != nil {
+		return err
+	}
+	return tier.client.Delete(ctx, tier.key(blockFileName))
+}
+
+func (f *fileManager) copyColdBlock(ctx context.Context, address string, from string, to string) error {
+	block, err := f.fetchColdBlock(ctx, address, from)
+	if err != nil {
+		return err
+	}
+	defer putBuffer(block)
+
+	tier, err := openColdTier(address)
+	if err != nil {
+		return err
+	}
+	return tier.client.Put(ctx, tier.key(to), bytes.NewReader(block.Bytes()), int64(block.Len()))
+}
+
+func (f *fileManager) coldBlockPresent(ctx context.Context, address string, blockFileName string) (bool, error) {
+	tier, err := openColdTier(address)
+	if err != nil {
+		return false, err
+	}
+	keys, err := tier.client.List(ctx, tier.key(blockFileName))
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(keys, tier.key(blockFileName)), nil
+}
+
+// TieringSummary is the answer of a tiering pass.
+type TieringSummary struct {
+	Files  int             `json:"files"`
+	Blocks int             `json:"blocks"`
+	Bytes  int64           `json:"bytes"`
+	Failed []BackupFailure `json:"failed"`
+}
+
+// TieredFile is the answer of an offload or a rehydration: the number of
+// blocks moved and their compressed size.
+type TieredFile struct {
+	Name   string `json:"name"`
+	Blocks int    `json:"blocks"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// isCold reports whether a file is due for the cold tier: written over
+// FDS_COLD_AFTER ago and, with FDS_COLD_MAX_HEAT, cooled down below it, or
+// otherwise not read for FDS_COLD_AFTER either.
+func isCold(metadata FileMetadata, access FileAccess, now time.Time) bool {
+	cutoff := now.Add(-config.ColdAfter)
+	if metadata.CreatedAt.After(cutoff) {
+		return false
+	}
+	if config.ColdMaxHeat > 0 {
+		return access.Heat < config.ColdMaxHeat
+	}
+	return access.LastAccessed == nil || access.LastAccessed.Before(cutoff)
+}
+
+// TierColdFiles offloads the cold files to the cold tier, see isCold. Packed files are left alone, as they share their blocks,
+// and so are pinned files, kept on their nodes.
+func (f *fileManager) TierColdFiles(ctx context.Context) (TieringSummary, error) {
+	logger := requestLogger(ctx)
+	summary := TieringSummary{Failed: []BackupFailure{}}
+
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return summary, err
+	}
+	accesses, err := f.redisManager.ListFileAccesses(ctx)
+	if err != nil {
+		return summary, err
+	}
+	pins, err := f.redisManager.redisClient.HGetAll(ctx, filePinsKey).Result()
+	if err != nil {
+		return summary, err
+	}
+
+	indexed := make(map[string]bool, len(files))
+	now := time.Now()
+	for _, metadata := range files {
+		indexed[metadata.Name] = true
+		if metadata.Packed != nil || pins[metadata.Name] != "" || !isCold(metadata, accesses[metadata.Name], now) {
+			continue
+		}
+
+		tiered, err := f.OffloadFile(ctx, metadata.Name)
+		if err != nil {
+			summary.Failed = append(summary.Failed, BackupFailure{Name: metadata.Name, Error: err.Error()})
+			continue
+		}
+		if tiered.Blocks > 0 {
+			summary.Files++
+			summary.Blocks += tiered.Blocks
+			summary.Bytes += tiered.Bytes
+		}
+	}
+
+	// Files deleted while they were read may leave their reads behind.
+	for name := range accesses {
+		if !indexed[name] {
+			_ = f.redisManager.DeleteFileAccess(ctx, name)
+		}
+	}
+
+	logger.Info("Tiering pass completed",
+		zap.Int("files", summary.Files),
+		zap.Int("blocks", summary.Blocks),
+		zap.Int64("bytes", summary.Bytes),
+		zap.Int("failed", len(summary.Failed)),
+	)
+	return summary, nil
+}
+
+// OffloadFile moves the blocks of a file from the nodes to the cold tier.
+// Each block is verified and stored in the bucket before its location is
+// switched and the node copy deleted, so a failure leaves it readable where
+// it was.
+func (f *fileManager) OffloadFile(ctx context.Context, fileName string) (TieredFile, error) {
+	tiered, err := f.offloadFile(ctx, fileName)
+	if err != nil || tiered.Blocks > 0 {
+		recordAudit(ctx, AuditTierOffload, fileName, err)
+	}
+	return tiered, err
+}
+
+func (f *fileManager) offloadFile(ctx context.Context, fileName string) (TieredFile, error) {
+	logger := requestLogger(ctx)
+	tiered := TieredFile{Name: fileName}
+	if config.ColdTier == "" {
+		return tiered, errColdTierDisabled
+	}
+	tier, err := openColdTier(strings.TrimSuffix(config.ColdTier, "/"))
+	if err != nil {
+		return tiered, err
+	}
+
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	metadata, err := f.redisManager.GetFileMetadata(fileName)
+	if err != nil {
+		return tiered, err
+	}
+	if metadata.Packed != nil {
+		return tiered, errPackedFile
+	}
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(fileName)
+	if err != nil {
+		return tiered, err
+	}
+
+	for i := 1; i <= numOfBlocks; i++ {
+		blockName := metadata.blockName(i)
+		location, err := f.redisManager.GetBlockLocation(blockName)
+		if err != nil {
+			return tiered, err
+		}
+		if isColdAddress(location.NodeAddress) {
+			continue
+		}
+
+		block, err := f.fetchBlockReplicas(ctx, location, blockName+".bin")
+		if err != nil {
+			return tiered, fmt.Errorf("failed to read block %d: %w", i, err)
+		}
+		size := int64(block.Len())
+		err = tier.client.Put(ctx, tier.key(blockName+".bin"), bytes.NewReader(block.Bytes()), size)
+		putBuffer(block)
+		if err != nil {
+			return tiered, fmt.Errorf("failed to offload block %d: %w", i, err)
+		}
+
+		if err := f.redisManager.SetBlockReplicas(ctx, blockName, []Replica{{Address: tier.address, State: ReplicaHealthy}}); err != nil {
+			return tiered, fmt.Errorf("failed to record the location of block %d: %w", i, err)
+		}
+		for _, address := range location.Addresses() {
+			if err := f.DeleteBlockFromNode(ctx, address, blockName+".bin"); err != nil {
+				logger.Warn("Failed to delete an offloaded block from its node",
+					zap.String("blockName", blockName),
+					zap.String("nodeAddress", address),
+					zap.Error(err),
+				)
+			}
+		}
+		tiered.Blocks++
+		tiered.Bytes += size
+	}
+
+	if tiered.Blocks > 0 {
+		logger.Info("File offloaded to the cold tier",
+			zap.String("fileName", fileName),
+			zap.Int("blocks", tiered.Blocks),
+			zap.Int64("bytes", tiered.Bytes),
+		)
+	}
+	return tiered, nil
+}
+
+// rehydrating holds the files being moved back to the nodes, so concurrent
+// reads of a cold file start a single rehydration.
+var rehydrating sync.Map
+
+// RehydrateFile moves the blocks of a file from the cold tier back to the
+// nodes.
+func (f *fileManager) RehydrateFile(ctx context.Context, fileName string) (TieredFile, error) {
+	if _, busy := rehydrating.LoadOrStore(fileName, true); busy {
+		return TieredFile{Name: fileName}, nil
+	}
+	defer rehydrating.Delete(fileName)
+
+	tiered, err := f.rehydrateFile(ctx, fileName)
+	if err != nil || tiered.Blocks > 0 {
+		recordAudit(ctx, AuditTierRehydrate, fileName, err)
+	}
+	return tiered, err
+}
+
+func (f *fileManager) rehydrateFile(ctx context.Context, fileName string) (TieredFile, error) {
+	logger := requestLogger(ctx)
+	tiered := TieredFile{Name: fileName}
+
+	rewriteMutex.Lock()
+	defer rewriteMutex.Unlock()
+
+	metadata, numOfBlocks, err := f.redisManager.GetFileBlocks(fileName)
+	if err != nil {
+		return tiered, err
+	}
+
+	// Blocks are distributed under the name they are stored under, which
+	// differs for those patches and appends stored again.
+	blocks := make(map[string][]FileBlock)
+	cold := make(map[int]string)
+	for i := 1; i <= numOfBlocks; i++ {
+		blockName := metadata.blockName(i)
+		location, err := f.redisManager.GetBlockLocation(blockName)
+		if err != nil {
+			return tiered, err
+		}
+		if !isColdAddress(location.NodeAddress) {
+			continue
+		}
+
+		block, err := f.fetchColdBlock(ctx, location.NodeAddress, blockName+".bin")
+		if err != nil {
+			return tiered, fmt.Errorf("failed to read block %d from the cold tier: %w", i, err)
+		}
+		data := bytes.Clone(block.Bytes())
+		putBuffer(block)
+		if fmt.Sprintf("%x", GenerateBlockHash(data)) != location.Hash {
+			return tiered, fmt.Errorf("block %d does not match its hash", i)
+		}
+		blocks[metadata.blocksOf(i)] = append(blocks[metadata.blocksOf(i)], FileBlock{bytes: data, position: i})
+		cold[i] = location.NodeAddress
+		tiered.Bytes += int64(len(data))
+	}
+	if len(cold) == 0 {
+		return tiered, nil
+	}
+
+	for blocksOf, stored := range blocks {
+		if err := f.distributeBlocks(ctx, newPhaseTimer(), blocksOf, stored, noopUploadObserver{}); err != nil {
+			return tiered, err
+		}
+	}
+	tiered.Blocks = len(cold)
+
+	for position, address := range cold {
+		blockName := metadata.blockName(position)
+		if err := f.deleteColdBlock(ctx, address, blockName+".bin"); err != nil {
+			logger.Warn("Failed to delete a rehydrated block from the cold tier",
+				zap.String("blockName", blockName),
+				zap.Error(err),
+			)
+		}
+	}
+
+	logger.Info("File rehydrated from the cold tier",
+		zap.String("fileName", fileName),
+		zap.Int("blocks", tiered.Blocks),
+		zap.Int64("bytes", tiered.Bytes),
+	)
+	return tiered, nil
+}
+
+// RunTiering offloads the cold files at each interval.
+func (f *fileManager) RunTiering(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Tiering moves blocks, which maintenance holds off.
+		if maintenance.Check(true) != nil {
+			continue
+		}
+		if _, err := f.TierColdFiles(ctx); err != nil {
+			logger.Error("Tiering pass failed", zap.Error(err))
+		}
+	}
+}
+
+// RunTieringPass runs a tiering pass now.
+func (f *fileManager) RunTieringPass(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/tiering/run").Inc()
+	logger := requestLogger(r.Context())
+
+	if config.ColdTier == "" {
+		respondWithError(w, http.StatusBadRequest, errColdTierDisabled.Error())
+		return
+	}
+
+	summary, err := f.TierColdFiles(r.Context())
+	if err != nil {
+		logger.Error("Tiering pass failed", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Tiering pass failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(summary)
+}
+
+// OffloadFileNow moves a file to the cold tier regardless of when it was last
+// read.
+func (f *fileManager) OffloadFileNow(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/files/{name}/offload").Inc()
+	f.respondTiered(w, r, "offload", f.OffloadFile)
+}
+
+// RehydrateFileNow moves a file from the cold tier back to the nodes.
+func (f *fileManager) RehydrateFileNow(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, "/admin/files/{name}/rehydrate").Inc()
+	f.respondTiered(w, r, "rehydrate", f.RehydrateFile)
+}
+
+func (f *fileManager) respondTiered(w http.ResponseWriter, r *http.Request, action string, move func(context.Context, string) (TieredFile, error)) {
+	logger := requestLogger(r.Context())
+	fileName := mux.Vars(r)["name"]
+
+	tiered, err := move(r.Context(), fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		respondFileNotFound(w, fileName)
+		return
+	}
+	if errors.Is(err, errPackedFile) {
+		respondWithError(w, http.StatusConflict, "Packed files are not tiered")
+		return
+	}
+	if errors.Is(err, errColdTierDisabled) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to "+action+" file", zap.String("fileName", fileName), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to "+action+" file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(tiered)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval bounds how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the certificate of FDS_TLS_CERT_FILE and
+// FDS_TLS_KEY_FILE, and loads it again when the files change, so a
+// certificate renewed by an ACME client such as certbot is picked up without
+// a restart. A renewal that cannot be loaded is logged and the previous
+// certificate kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// filesModTime returns the latest modification time of the two files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		latest = later(latest, info.ModTime())
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.checkedAt) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+
+	modTime, err := c.filesModTime()
+	if err == nil && modTime.After(c.modTime) {
+		err = c.load(modTime)
+		if err == nil {
+			logger.Info("TLS certificate reloaded", zap.String("certFile", c.certFile))
+		}
+	}
+	if err != nil {
+		logger.Warn("Failed to reload the TLS certificate, keeping the previous one", zap.String("certFile", c.certFile), zap.Error(err))
+	}
+	return c.cert, nil
+}
+
+// newAPIServer returns the server of the HTTP API, over HTTPS when a
+// certificate is configured.
+func newAPIServer(handler http.Handler) (*http.Server, error) {
+	server := &http.Server{Handler: handler}
+	if config.TLSCertFile == "" {
+		return server, nil
+	}
+
+	certs, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %w", err)
+	}
+	server.TLSConfig = &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tlsVersions[config.TLSMinVersion],
+	}
+	return server, nil
+}
+
+// serveAPI serves the HTTP API on listener until server is shut down. Over
+// HTTPS, FDS_HTTP_REDIRECT_PORT redirects plain HTTP requests to it.
+func serveAPI(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig == nil {
+		return server.Serve(listener)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	if config.HTTPRedirectPort > 0 {
+		redirect := &http.Server{Addr: fmt.Sprintf(":%d", config.HTTPRedirectPort), Handler: redirectToHTTPS(port)}
+		server.RegisterOnShutdown(func() { redirect.Close() })
+		go func() {
+			if err := redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("HTTP redirect listener stopped", zap.Error(err))
+			}
+		}()
+	}
+	logger.Info("Serving the API over HTTPS", zap.String("addr", listener.Addr().String()), zap.Int("redirectPort", config.HTTPRedirectPort))
+	return server.ServeTLS(listener, "", "")
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS, on
+// FDS_PUBLIC_URL if it is set and on port otherwise. Requests other than GET
+// and HEAD get a 308, so clients send their body again.
+func redirectToHTTPS(port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base := strings.TrimSuffix(config.PublicURL, "/")
+		if !strings.HasPrefix(base, "https://") {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			base = fmt.Sprintf("https://%s:%d", host, port)
+		}
+
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, base+r.URL.RequestURI(), code)
+	}
+}
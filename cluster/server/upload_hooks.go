@@ -0,0 +1,379 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errUploadRejected is returned for the uploads a hook refuses.
+	errUploadRejected = errors.New("upload rejected")
+	// errUploadHookFailed is returned when a hook cannot tell whether an
+	// upload is acceptable, unless FDS_UPLOAD_HOOKS_FAIL_OPEN is set.
+	errUploadHookFailed = errors.New("upload hook failed")
+)
+
+var uploadHookDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "upload_hook_duration_seconds",
+		Help:    "Time spent in each upload hook, by result: accepted, rejected or failed",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"hook", "result"},
+)
+
+// hookedUpload is an upload going through the hooks. A hook may replace its
+// content and add annotations, which are recorded in the file metadata.
+type hookedUpload struct {
+	FileName    string
+	ContentType string
+	Content     []byte
+	Annotations map[string]string
+}
+
+// uploadHook inspects, annotates or transforms uploads before they are split
+// into blocks. Process refuses an upload by returning an error wrapping
+// errUploadRejected; other errors mean the hook could not run.
+type uploadHook interface {
+	Name() string
+	Process(ctx context.Context, upload *hookedUpload) error
+}
+
+// uploadHooks is the chain of FDS_UPLOAD_HOOKS, run in order.
+var uploadHooks []uploadHook
+
+func rejectUpload(reason string) error {
+	return fmt.Errorf("%w: %s", errUploadRejected, reason)
+}
+
+// newUploadHook parses a hook of FDS_UPLOAD_HOOKS:
+//
+//	exec:/path/to/command    runs the command with the upload on its standard input
+//	webhook:https://host/path posts the upload to the URL
+//	pii or pii:reject         annotates, or refuses, uploads with personal data
+func newUploadHook(spec string) (uploadHook, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "exec":
+		if !filepath.IsAbs(arg) {
+			return nil, fmt.Errorf("FDS_UPLOAD_HOOKS: %q needs an absolute path", spec)
+		}
+		return execHook{path: arg}, nil
+	case "webhook":
+		u, err := url.Parse(arg)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("FDS_UPLOAD_HOOKS: %q needs an http or https URL", spec)
+		}
+		return webhookHook{url: arg, host: u.Host}, nil
+	case "pii":
+		if arg != "" && arg != "reject" {
+			return nil, fmt.Errorf("FDS_UPLOAD_HOOKS: %q is not pii or pii:reject", spec)
+		}
+		return piiHook{reject: arg == "reject"}, nil
+	}
+	return nil, fmt.Errorf("FDS_UPLOAD_HOOKS: %q is not exec:/path, webhook:URL, pii or pii:reject", spec)
+}
+
+// newUploadHooks parses the chain of FDS_UPLOAD_HOOKS.
+func newUploadHooks(specs []string) ([]uploadHook, error) {
+	var hooks []uploadHook
+	for _, spec := range specs {
+		hook, err := newUploadHook(spec)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// runUploadHooks passes an upload through the hooks, and returns its content
+// as they left it with a context carrying their annotations.
+func runUploadHooks(ctx context.Context, timer *phaseTimer, fileName string, body []byte) ([]byte, context.Context, error) {
+	if len(uploadHooks) == 0 {
+		return body, ctx, nil
+	}
+	defer timer.Phase("hooks")
+	logger := requestLogger(ctx)
+
+	upload := &hookedUpload{FileName: fileName, ContentType: declaredType(ctx), Content: body, Annotations: map[string]string{}}
+	for _, hook := range uploadHooks {
+		hookCtx, cancel := context.WithTimeout(ctx, config.UploadHookTimeout)
+		start := time.Now()
+		err := hook.Process(hookCtx, upload)
+		cancel()
+
+		result := "accepted"
+		switch {
+		case errors.Is(err, errUploadRejected):
+			result = "rejected"
+		case err != nil:
+			result = "failed"
+		}
+		uploadHookDuration.WithLabelValues(hook.Name(), result).Observe(time.Since(start).Seconds())
+
+		if errors.Is(err, errUploadRejected) {
+			logger.Info("Upload rejected by a hook", zap.String("fileName", fileName), zap.String("hook", hook.Name()), zap.Error(err))
+			return nil, ctx, err
+		}
+		if err != nil {
+			if config.UploadHooksFailOpen {
+				logger.Warn("Upload hook failed, storing the upload anyway", zap.String("fileName", fileName), zap.String("hook", hook.Name()), zap.Error(err))
+				continue
+			}
+			logger.Error("Upload hook failed", zap.String("fileName", fileName), zap.String("hook", hook.Name()), zap.Error(err))
+			return nil, ctx, fmt.Errorf("%w: %s: %w", errUploadHookFailed, hook.Name(), err)
+		}
+	}
+
+	if len(upload.Annotations) > 0 {
+		ctx = withAnnotations(ctx, upload.Annotations)
+	}
+	return upload.Content, ctx, nil
+}
+
+// refuseWhileHooked answers 409 to writes that would store content the
+// hooks have not seen, and tells whether it did. what names them, e.g.
+// "Appends".
+func refuseWhileHooked(w http.ResponseWriter, what string) bool {
+	if len(uploadHooks) == 0 {
+		return false
+	}
+	respondWithError(w, http.StatusConflict, what+" are not available while upload hooks are configured")
+	return true
+}
+
+type annotationsKey struct{}
+
+// withAnnotations records the annotations to store with a file in its
+// metadata.
+func withAnnotations(ctx context.Context, annotations map[string]string) context.Context {
+	return context.WithValue(ctx, annotationsKey{}, annotations)
+}
+
+// uploadAnnotations returns the annotations of the upload of fileName.
+// Containers sealed on the way carry none.
+func uploadAnnotations(ctx context.Context, fileName string) map[string]string {
+	if isContainerName(fileName) {
+		return nil
+	}
+	annotations, _ := ctx.Value(annotationsKey{}).(map[string]string)
+	return annotations
+}
+
+// execHook runs a command with the upload on its standard input, and the
+// file name and declared type in FDS_FILE_NAME and FDS_CONTENT_TYPE. The
+// command sees PATH and the FDS_HOOK_* variables of the central server,
+// none of its other settings and secrets. Like
+// virus scanners such as clamscan, it exits 0 to accept the upload and 1 to
+// refuse it; the lines key=value it prints are annotations, and its first
+// line of output the reason of a refusal. Any other exit is a failure.
+type execHook struct {
+	path string
+}
+
+func (h execHook) Name() string {
+	return filepath.Base(h.path)
+}
+
+func (h execHook) Process(ctx context.Context, upload *hookedUpload) error {
+	cmd := exec.CommandContext(ctx, h.path)
+	cmd.Stdin = bytes.NewReader(upload.Content)
+	cmd.Env = append(hookEnviron(), "FDS_FILE_NAME="+upload.FileName, "FDS_CONTENT_TYPE="+upload.ContentType)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		reason := firstLine(stdout.String())
+		if reason == "" {
+			reason = firstLine(stderr.String())
+		}
+		return rejectUpload(reason)
+	}
+	if err != nil {
+		if message := firstLine(stderr.String()); message != "" {
+			return fmt.Errorf("%w: %s", err, message)
+		}
+		return err
+	}
+
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(line), "="); ok && key != "" {
+			upload.Annotations[key] = value
+		}
+	}
+	return nil
+}
+
+// hookEnviron returns the variables of the environment passed on to exec
+// hooks.
+func hookEnviron() []string {
+	var env []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, "PATH=") || strings.HasPrefix(variable, "FDS_HOOK_") {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(line)
+}
+
+// webhookHook posts the upload to a URL, with its file name and declared
+// type in the X-FDS-File-Name and X-FDS-Content-Type headers. The service
+// answers 204, 200 with a JSON hookVerdict, or 200 with other content to
+// replace the upload; 403 and 422 refuse the upload, with the reason in a
+// hookVerdict or as text. Any other answer is a failure.
+type webhookHook struct {
+	url  string
+	host string
+}
+
+// hookVerdict is the JSON answer of a webhook.
+type hookVerdict struct {
+	Reason      string            `json:"reason"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (h webhookHook) Name() string {
+	return h.host
+}
+
+func (h webhookHook) Process(ctx context.Context, upload *hookedUpload) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(upload.Content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-FDS-File-Name", upload.FileName)
+	if upload.ContentType != "" {
+		req.Header.Set("X-FDS-Content-Type", upload.ContentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	var verdict hookVerdict
+	if mediaType == "application/json" {
+		if err := json.Unmarshal(body, &verdict); err != nil {
+			return fmt.Errorf("invalid verdict: %w", err)
+		}
+	}
+
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+		if mediaType != "application/json" {
+			upload.Content = body
+			return nil
+		}
+		maps.Copy(upload.Annotations, verdict.Annotations)
+		return nil
+	case http.StatusForbidden, http.StatusUnprocessableEntity:
+		if verdict.Reason == "" && mediaType != "application/json" {
+			verdict.Reason = firstLine(string(body))
+		}
+		return rejectUpload(verdict.Reason)
+	}
+	return fmt.Errorf("%s answered %s", h.host, res.Status)
+}
+
+// piiPatterns find personal data in text uploads.
+var piiPatterns = map[string]*regexp.Regexp{
+	"email": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	"ssn":   regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+	"card":  regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`),
+}
+
+// piiHook annotates text uploads holding e-mail addresses, US social
+// security numbers or payment card numbers with pii, the kinds found, and
+// refuses them when reject is set.
+type piiHook struct {
+	reject bool
+}
+
+func (h piiHook) Name() string {
+	return "pii"
+}
+
+func (h piiHook) Process(_ context.Context, upload *hookedUpload) error {
+	if !strings.HasPrefix(sniffContentType(upload.Content), "text/") {
+		return nil
+	}
+
+	var found []string
+	for kind, pattern := range piiPatterns {
+		matches := pattern.FindAll(upload.Content, -1)
+		if kind == "card" {
+			matches = slices.DeleteFunc(matches, func(match []byte) bool { return !luhnValid(match) })
+		}
+		if len(matches) > 0 {
+			found = append(found, kind)
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	slices.Sort(found)
+
+	if h.reject {
+		return rejectUpload("personal data found: " + strings.Join(found, ", "))
+	}
+	upload.Annotations["pii"] = strings.Join(found, ",")
+	return nil
+}
+
+// luhnValid tells whether the digits of number pass the Luhn check of card
+// numbers.
+func luhnValid(number []byte) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		digit, err := strconv.Atoi(string(number[i]))
+		if err != nil {
+			continue
+		}
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
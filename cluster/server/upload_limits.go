@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// multipartOverhead is allowed on top of FDS_MAX_UPLOAD_SIZE for the framing
+// and form fields of a multipart upload.
+const multipartOverhead = 1 * MB
+
+// limitUploadBody answers 413 to an upload whose declared length exceeds
+// FDS_MAX_UPLOAD_SIZE plus overhead, before any of it is read, and caps the
+// body so that an upload without or with a wrong Content-Length fails as soon
+// as it crosses the limit. It reports whether the request may go on.
+func limitUploadBody(w http.ResponseWriter, r *http.Request, overhead int64) bool {
+	if config.MaxUploadSize <= 0 {
+		return true
+	}
+
+	limit := int64(config.MaxUploadSize) + overhead
+	if r.ContentLength > limit {
+		respondUploadTooLarge(w)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// uploadTooLarge reports whether an upload of size bytes exceeds
+// FDS_MAX_UPLOAD_SIZE.
+func uploadTooLarge(size int64) bool {
+	return config.MaxUploadSize > 0 && size > int64(config.MaxUploadSize)
+}
+
+// isBodyTooLarge reports whether err comes from reading past the limit set
+// by limitUploadBody.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+func respondUploadTooLarge(w http.ResponseWriter) {
+	respondWithErrorCode(w, http.StatusRequestEntityTooLarge, CodeUploadTooLarge, fmt.Sprintf("File exceeds the maximum upload size of %d bytes", config.MaxUploadSize), map[string]any{"maxSize": config.MaxUploadSize})
+}
+
+var errUploadsSaturated = errors.New("too many uploads in progress")
+
+var (
+	uploadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "uploads_in_flight",
+		Help: "Uploads admitted and not finished yet, asynchronous ones included",
+	})
+	uploadBufferedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "upload_buffered_bytes",
+		Help: "Bytes reserved by the uploads in flight",
+	})
+	uploadsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "uploads_rejected_total",
+		Help: "Uploads turned away because FDS_MAX_CONCURRENT_UPLOADS or FDS_MAX_BUFFERED_UPLOAD_BYTES was reached",
+	})
+)
+
+// uploadAdmission bounds the uploads the central server holds in memory at
+// once, by count and by bytes, so a burst is turned away with 503 instead of
+// exhausting memory and node bandwidth.
+type uploadAdmission struct {
+	mutex    sync.Mutex
+	inFlight int
+	buffered int64
+}
+
+var uploads = &uploadAdmission{}
+
+// uploadTicket is an admitted upload holding its reserved bytes until it is
+// released.
+type uploadTicket struct {
+	admission *uploadAdmission
+	reserved  int64
+	released  bool
+}
+
+// Admit reserves a slot and size bytes for an upload.
+func (a *uploadAdmission) Admit(size int64) (*uploadTicket, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if config.MaxConcurrentUploads > 0 && a.inFlight >= config.MaxConcurrentUploads {
+		uploadsRejected.Inc()
+		return nil, errUploadsSaturated
+	}
+	if !a.fitsLocked(size) {
+		uploadsRejected.Inc()
+		return nil, errUploadsSaturated
+	}
+
+	a.inFlight++
+	a.buffered += size
+	a.updateMetricsLocked()
+	return &uploadTicket{admission: a, reserved: size}, nil
+}
+
+func (a *uploadAdmission) fitsLocked(size int64) bool {
+	return config.MaxBufferedUploadBytes <= 0 || a.buffered+size <= int64(config.MaxBufferedUploadBytes)
+}
+
+func (a *uploadAdmission) updateMetricsLocked() {
+	uploadsInFlight.Set(float64(a.inFlight))
+	uploadBufferedBytes.Set(float64(a.buffered))
+}
+
+// Grow reserves n more bytes for an upload whose size was not known when it
+// was admitted.
+func (t *uploadTicket) Grow(n int64) error {
+	a := t.admission
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if t.released {
+		return nil
+	}
+	if !a.fitsLocked(n) {
+		uploadsRejected.Inc()
+		return errUploadsSaturated
+	}
+	t.reserved += n
+	a.buffered += n
+	a.updateMetricsLocked()
+	return nil
+}
+
+// Release gives back the slot and the bytes. Releasing twice is harmless.
+func (t *uploadTicket) Release() {
+	a := t.admission
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if t.released {
+		return
+	}
+	t.released = true
+	a.inFlight--
+	a.buffered -= t.reserved
+	a.updateMetricsLocked()
+}
+
+// admittedBody reserves the bytes of an upload without Content-Length as
+// they are read.
+type admittedBody struct {
+	io.ReadCloser
+	ticket *uploadTicket
+}
+
+func (b *admittedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if growErr := b.ticket.Grow(int64(n)); growErr != nil {
+			return n, growErr
+		}
+	}
+	return n, err
+}
+
+// admitUpload admits an HTTP upload, reserving its Content-Length, or answers
+// 503 with Retry-After. It reports whether the request may go on.
+func admitUpload(w http.ResponseWriter, r *http.Request) (*uploadTicket, bool) {
+	ticket, err := uploads.Admit(max(r.ContentLength, 0))
+	if err != nil {
+		respondUploadsSaturated(w)
+		return nil, false
+	}
+	if r.ContentLength < 0 {
+		r.Body = &admittedBody{ReadCloser: r.Body, ticket: ticket}
+	}
+	return ticket, true
+}
+
+func respondUploadsSaturated(w http.ResponseWriter) {
+	setUploadRetryAfter(w)
+	respondWithErrorCode(w, http.StatusServiceUnavailable, CodeUploadsSaturated, "Too many uploads in progress, retry later", nil)
+}
+
+func setUploadRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(config.UploadRetryAfter.Seconds()))))
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// errNotStaged is returned when a block of an interrupted upload was not kept
+// in the staging area, so the upload cannot be resumed.
+var errNotStaged = errors.New("block not staged")
+
+// uploadStaging keeps the compressed blocks of the uploads in flight in
+// FDS_UPLOAD_STAGING_DIR until the upload is over, so the blocks a crash kept
+// from reaching the nodes can be sent again when the central server starts.
+type uploadStaging struct{ dirTarget }
+
+// staging returns the staging area, or false if FDS_UPLOAD_STAGING_DIR is not
+// set.
+func staging() (uploadStaging, bool) {
+	if config.UploadStagingDir == "" {
+		return uploadStaging{}, false
+	}
+	return uploadStaging{dirTarget{root: config.UploadStagingDir}}, true
+}
+
+func stagingDir(fileName string) string {
+	return fmt.Sprintf("%x", GenerateFileHash(fileName))
+}
+
+func (s uploadStaging) Put(ctx context.Context, fileName string, block FileBlock) error {
+	key := stagingDir(fileName) + "/" + strconv.Itoa(block.position)
+	return s.dirTarget.Put(ctx, key, bytes.NewReader(block.bytes), int64(len(block.bytes)))
+}
+
+func (s uploadStaging) Get(ctx context.Context, fileName string, position int) ([]byte, error) {
+	body, err := s.dirTarget.Get(ctx, stagingDir(fileName)+"/"+strconv.Itoa(position))
+	if errors.Is(err, errObjectNotFound) {
+		return nil, errNotStaged
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// Drop removes the blocks staged for an upload.
+func (s uploadStaging) Drop(fileName string) error {
+	return os.RemoveAll(filepath.Join(s.root, stagingDir(fileName)))
+}
+
+// stageBlocks keeps the blocks of an upload in the staging area, if there is
+// one.
+func stageBlocks(ctx context.Context, fileName string, blocks []FileBlock) error {
+	s, ok := staging()
+	if !ok {
+		return nil
+	}
+	for _, block := range blocks {
+		if err := s.Put(ctx, fileName, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redriveUpload sends the blocks of an interrupted upload that no node stored
+// again, from the staging area.
+func (f *fileManager) redriveUpload(ctx context.Context, log uploadLog) error {
+	s, ok := staging()
+	if !ok {
+		return errNotStaged
+	}
+
+	var missing []FileBlock
+	for position := 1; position <= log.intent.Blocks; position++ {
+		if _, stored := log.stored[position]; stored {
+			continue
+		}
+		data, err := s.Get(ctx, log.intent.File, position)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", position, err)
+		}
+		missing = append(missing, FileBlock{bytes: data, position: position})
+	}
+
+	observer := loggedUploadObserver{uploadObserver: noopUploadObserver{}, ctx: ctx, redis: f.redisManager, fileName: log.intent.File}
+	return f.distributeBlocks(ctx, newPhaseTimer(), log.intent.File, missing, observer)
+}
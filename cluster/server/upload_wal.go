@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadsInFlightKey is the set of the files being uploaded. Each one has an
+// upload log, uploadLogKey, recording what the upload planned and which of
+// its blocks the nodes have stored, so an upload interrupted by a crash of
+// the central server is finished or rolled back when it starts again.
+const uploadsInFlightKey = "uploads_in_flight"
+
+func uploadLogKey(fileName string) string {
+	return "upload_log:" + fileName
+}
+
+const (
+	uploadLogIntent       = "intent"
+	uploadLogDistributing = "distributing"
+	uploadLogBlockPrefix  = "block-"
+)
+
+// errUploadInterrupted is audited for the uploads rolled back at startup.
+var errUploadInterrupted = errors.New("upload interrupted by a restart of the central server")
+
+var uploadRecoveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "upload_recoveries_total",
+		Help: "Uploads interrupted by a restart of the central server, by outcome: resumed, restored or rolled_back",
+	},
+	[]string{"result"},
+)
+
+// UploadIntent is what an upload plans to write.
+type UploadIntent struct {
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	Blocks    int       `json:"blocks"`
+	BlockSize int       `json:"block_size"`
+	StartedAt time.Time `json:"started_at"`
+	// PreviousBlocks is the number of blocks of the version being
+	// overwritten, 0 for a new file.
+	PreviousBlocks int `json:"previous_blocks"`
+	// Extents are those of the blocks, stored with the file.
+	Extents []BlockExtent `json:"extents,omitempty"`
+	// Annotations are those of the upload hooks, stored with the file.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Owner is the API key the file is written with.
+	Owner string `json:"owner,omitempty"`
+}
+
+// beginUpload records the intent of an upload before any of its metadata is
+// written.
+func (r *RedisManager) beginUpload(ctx context.Context, intent UploadIntent) error {
+	encoded, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	pipe := r.redisClient.TxPipeline()
+	pipe.Del(ctx, uploadLogKey(intent.File))
+	pipe.HSet(ctx, uploadLogKey(intent.File), uploadLogIntent, encoded)
+	pipe.SAdd(ctx, uploadsInFlightKey, intent.File)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// uploadDistributing records that blocks of the upload may now have been
+// overwritten on the nodes.
+func (r *RedisManager) uploadDistributing(ctx context.Context, fileName string) error {
+	return r.redisClient.HSet(ctx, uploadLogKey(fileName), uploadLogDistributing, 1).Err()
+}
+
+func (r *RedisManager) uploadBlockStored(ctx context.Context, fileName string, position int, address string) error {
+	return r.redisClient.HSet(ctx, uploadLogKey(fileName), uploadLogBlockPrefix+strconv.Itoa(position), address).Err()
+}
+
+// endUpload drops the log of an upload that is over.
+func (r *RedisManager) endUpload(ctx context.Context, fileName string) error {
+	pipe := r.redisClient.TxPipeline()
+	pipe.Del(ctx, uploadLogKey(fileName))
+	pipe.SRem(ctx, uploadsInFlightKey, fileName)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// endUpload drops the log of an upload that is over, and its staged blocks.
+func (f *fileManager) endUpload(ctx context.Context, fileName string) error {
+	if s, ok := staging(); ok {
+		if err := s.Drop(fileName); err != nil {
+			return err
+		}
+	}
+	return f.redisManager.endUpload(ctx, fileName)
+}
+
+// uploadLog is the state of an upload as logged.
+type uploadLog struct {
+	intent       UploadIntent
+	distributing bool
+	// stored maps the position of the blocks the nodes have stored to the
+	// node holding them.
+	stored map[int]string
+}
+
+func (r *RedisManager) readUploadLog(ctx context.Context, fileName string) (uploadLog, error) {
+	var log uploadLog
+	fields, err := r.redisClient.HGetAll(ctx, uploadLogKey(fileName)).Result()
+	if err != nil {
+		return log, err
+	}
+	encoded, ok := fields[uploadLogIntent]
+	if !ok {
+		return log, fmt.Errorf("no upload intent for %s", fileName)
+	}
+	if err := json.Unmarshal([]byte(encoded), &log.intent); err != nil {
+		return log, err
+	}
+	_, log.distributing = fields[uploadLogDistributing]
+	log.stored = make(map[int]string)
+	for field, address := range fields {
+		if position, ok := strings.CutPrefix(field, uploadLogBlockPrefix); ok {
+			if i, err := strconv.Atoi(position); err == nil {
+				log.stored[i] = address
+			}
+		}
+	}
+	return log, nil
+}
+
+// loggedUploadObserver logs the blocks the nodes have stored.
+type loggedUploadObserver struct {
+	uploadObserver
+	ctx      context.Context
+	redis    *RedisManager
+	fileName string
+}
+
+func (o loggedUploadObserver) BlockStored(position int, nodeAddress string) {
+	if err := o.redis.uploadBlockStored(o.ctx, o.fileName, position, nodeAddress); err != nil {
+		requestLogger(o.ctx).Warn("Failed to log stored block",
+			zap.String("fileName", o.fileName),
+			zap.Int("blockPosition", position),
+			zap.Error(err),
+		)
+	}
+	o.uploadObserver.BlockStored(position, nodeAddress)
+}
+
+// RecoverUploads finishes or rolls back the uploads a previous run of the
+// central server left in flight. An upload whose blocks were all stored, or
+// whose missing blocks can be sent again from the staging area, is added to
+// the metadata index; one that had not started sending blocks leaves the
+// previous version of the file as it was; any other has overwritten part of
+// the previous version, and fails: the file is removed rather than left
+// half-written.
+func (f *fileManager) RecoverUploads(ctx context.Context) error {
+	files, err := f.redisManager.redisClient.SMembers(ctx, uploadsInFlightKey).Result()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, fileName := range files {
+		log, err := f.redisManager.readUploadLog(ctx, fileName)
+		if err != nil {
+			logger.Warn("Dropping unreadable upload log", zap.String("fileName", fileName), zap.Error(err))
+			errs = append(errs, f.endUpload(ctx, fileName))
+			continue
+		}
+
+		result, err := f.recoverUpload(ctx, log)
+		if err != nil {
+			logger.Error("Failed to recover interrupted upload", zap.String("fileName", fileName), zap.Error(err))
+			errs = append(errs, err)
+			continue
+		}
+		uploadRecoveries.WithLabelValues(result).Inc()
+		logger.Warn("Recovered interrupted upload",
+			zap.String("fileName", fileName),
+			zap.String("result", result),
+			zap.Int("blocksStored", len(log.stored)),
+			zap.Int("blocks", log.intent.Blocks),
+		)
+		errs = append(errs, f.endUpload(ctx, fileName))
+	}
+	return errors.Join(errs...)
+}
+
+func (f *fileManager) recoverUpload(ctx context.Context, log uploadLog) (string, error) {
+	intent := log.intent
+	if log.distributing && len(log.stored) < intent.Blocks {
+		err := f.redriveUpload(ctx, log)
+		if err == nil {
+			log, err = f.redisManager.readUploadLog(ctx, intent.File)
+		}
+		if err != nil && !errors.Is(err, errNotStaged) {
+			logger.Warn("Failed to resume interrupted upload", zap.String("fileName", intent.File), zap.Error(err))
+		}
+	}
+
+	if log.distributing && len(log.stored) >= intent.Blocks {
+		previous, previousErr := f.redisManager.GetFileMetadata(intent.File)
+		err := f.redisManager.SaveFileMetadata(FileMetadata{
+			Name:        intent.File,
+			Size:        intent.Size,
+			Blocks:      intent.Blocks,
+			BlockSize:   intent.BlockSize,
+			CreatedAt:   intent.StartedAt,
+			Extents:     intent.Extents,
+			Annotations: intent.Annotations,
+			Owner:       intent.Owner,
+		})
+		if err != nil {
+			return "", err
+		}
+		if previousErr == nil && previous.Packed != nil {
+			f.packer.Release(ctx, intent.File, *previous.Packed)
+		}
+		if previousErr == nil {
+			f.removeRewrittenBlocks(ctx, previous)
+		}
+		return "resumed", nil
+	}
+
+	if !log.distributing {
+		fileHash := fmt.Sprintf("%x", GenerateFileHash(intent.File))
+		var err error
+		if intent.PreviousBlocks > 0 {
+			err = f.redisManager.redisClient.Set(ctx, fileHash, intent.PreviousBlocks, 0).Err()
+		} else {
+			err = f.redisManager.redisClient.Del(ctx, fileHash).Err()
+		}
+		return "restored", err
+	}
+
+	recordAudit(withCaller(ctx, systemCaller), AuditFileUpload, intent.File, errUploadInterrupted)
+	return "rolled_back", f.rollbackUpload(ctx, intent)
+}
+
+// abortUpload restores the previous version of the file, or rolls back the
+// upload, after it failed.
+func (f *fileManager) abortUpload(ctx context.Context, fileName string) {
+	ctx = context.WithoutCancel(ctx)
+	log, err := f.redisManager.readUploadLog(ctx, fileName)
+	if err == nil {
+		var result string
+		if result, err = f.recoverUpload(ctx, log); err == nil {
+			requestLogger(ctx).Info("Failed upload cleaned up", zap.String("fileName", fileName), zap.String("result", result))
+			err = f.endUpload(ctx, fileName)
+		}
+	}
+	if err != nil {
+		requestLogger(ctx).Warn("Failed to clean up after the upload, left for recovery", zap.String("fileName", fileName), zap.Error(err))
+	}
+}
+
+// rollbackUpload removes the blocks written by an upload that failed after
+// it started sending them, along with those of the version it overwrote.
+// A previous version packed into a container is untouched, and kept.
+func (f *fileManager) rollbackUpload(ctx context.Context, intent UploadIntent) error {
+	for i := 1; i <= max(intent.Blocks, intent.PreviousBlocks); i++ {
+		if err := f.removeBlock(ctx, intent.File+"-block-"+strconv.Itoa(i)); err != nil {
+			return err
+		}
+	}
+	if err := f.redisManager.redisClient.Del(ctx, fmt.Sprintf("%x", GenerateFileHash(intent.File))).Err(); err != nil {
+		return err
+	}
+
+	metadata, err := f.redisManager.GetFileMetadata(intent.File)
+	if err == nil && metadata.Packed != nil {
+		return nil
+	}
+	if err == nil {
+		f.removeRewrittenBlocks(ctx, metadata)
+	}
+	return f.redisManager.DeleteFileMetadata(intent.File)
+}
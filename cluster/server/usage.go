@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// apiKeyHeader carries the API key a request is accounted to.
+const apiKeyHeader = "X-API-Key"
+
+const (
+	// usageKeysKey is the set of the keys usage has been recorded for.
+	usageKeysKey = "usage:keys"
+	// usageFlushInterval is how often the usage counted in memory is added
+	// to Redis.
+	usageFlushInterval = 10 * time.Second
+	usageHourFormat    = "2006010215"
+)
+
+// apiKeyName returns the name FDS_API_KEYS gives to key.
+func apiKeyName(key string) (string, bool) {
+	for _, entry := range config.APIKeys {
+		name, secret, _ := strings.Cut(entry, "=")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// withAPIKey refuses requests carrying an API key that is not in
+// FDS_API_KEYS, rather than accounting them to nobody. It must run after
+// withRequestCaller, which resolves the key.
+func withAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(apiKeyHeader) != "" && callerFromContext(r.Context()).APIKey == "" {
+			respondWithErrorCode(w, http.StatusUnauthorized, CodeInvalidAPIKey, "Unknown API key", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fileOwner returns the owner of the files written under ctx: the name of
+// the API key of the request, "" without one.
+func fileOwner(ctx context.Context) string {
+	return callerFromContext(ctx).APIKey
+}
+
+// usageKey is what the usage of a request is accounted to: the name of its
+// API key, or its caller (anonymous or presigned) without one.
+func usageKey(c caller) string {
+	if c.APIKey != "" {
+		return c.APIKey
+	}
+	return c.Identity
+}
+
+// UsageCounts is the traffic of an API key: the requests it made, the bytes
+// of their bodies and of the responses.
+type UsageCounts struct {
+	Requests        int64 `json:"requests"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+}
+
+func (u *UsageCounts) add(other UsageCounts) {
+	u.Requests += other.Requests
+	u.BytesUploaded += other.BytesUploaded
+	u.BytesDownloaded += other.BytesDownloaded
+}
+
+type usageBucket struct {
+	key  string
+	hour string
+}
+
+// usageMeter counts the traffic of every API key by hour in memory, and adds
+// it to Redis every usageFlushInterval so requests do not wait for Redis. A
+// crash loses the last interval.
+type usageMeter struct {
+	mutex   sync.Mutex
+	pending map[usageBucket]*UsageCounts
+}
+
+var usage = &usageMeter{pending: make(map[usageBucket]*UsageCounts)}
+
+func (m *usageMeter) Record(key string, at time.Time, counts UsageCounts) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	bucket := usageBucket{key: key, hour: at.UTC().Format(usageHourFormat)}
+	pending, ok := m.pending[bucket]
+	if !ok {
+		pending = &UsageCounts{}
+		m.pending[bucket] = pending
+	}
+	pending.add(counts)
+}
+
+func usageHourKey(key string, hour string) string {
+	return "usage:" + key + ":" + hour
+}
+
+// Flush adds the usage counted since the last flush to Redis. Usage that
+// could not be written is kept for the next flush.
+func (m *usageMeter) Flush(ctx context.Context, client *redis.Client) error {
+	m.mutex.Lock()
+	pending := m.pending
+	m.pending = make(map[usageBucket]*UsageCounts)
+	m.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	pipe := client.Pipeline()
+	for bucket, counts := range pending {
+		hourKey := usageHourKey(bucket.key, bucket.hour)
+		pipe.HIncrBy(ctx, hourKey, "requests", counts.Requests)
+		pipe.HIncrBy(ctx, hourKey, "bytes_uploaded", counts.BytesUploaded)
+		pipe.HIncrBy(ctx, hourKey, "bytes_downloaded", counts.BytesDownloaded)
+		pipe.Expire(ctx, hourKey, config.UsageRetention+time.Hour)
+		pipe.SAdd(ctx, usageKeysKey, bucket.key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		m.mutex.Lock()
+		for bucket, counts := range pending {
+			if current, ok := m.pending[bucket]; ok {
+				counts.add(*current)
+			}
+			m.pending[bucket] = counts
+		}
+		m.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes the usage every usageFlushInterval until ctx is done, and
+// once more then.
+func (m *usageMeter) Run(ctx context.Context, client *redis.Client) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Record what was counted since the last flush.
+			ctx = context.WithoutCancel(ctx)
+			if err := m.Flush(ctx, client); err != nil {
+				logger.Warn("Failed to record API usage", zap.Error(err))
+			}
+			return
+		case <-ticker.C:
+		}
+		if err := m.Flush(ctx, client); err != nil {
+			logger.Warn("Failed to record API usage", zap.Error(err))
+		}
+	}
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
+
+// withUsage accounts every request, with the bytes of its body and of its
+// response, to its usage key. It must run after withAPIKey.
+func withUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.UsageRetention <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		next.ServeHTTP(recorder, r)
+
+		counts := UsageCounts{Requests: 1, BytesDownloaded: recorder.bytes}
+		if body != nil {
+			counts.BytesUploaded = body.n.Load()
+		}
+		usage.Record(usageKey(callerFromContext(r.Context())), start, counts)
+	})
+}
+
+// UsageHour is the usage of an API key during the hour starting at Hour.
+type UsageHour struct {
+	Hour time.Time `json:"hour"`
+	UsageCounts
+}
+
+// KeyUsage is the usage of an API key over the period asked for, in total
+// and by hour. Hours without traffic are left out.
+type KeyUsage struct {
+	Key string `json:"key"`
+	UsageCounts
+	Hours []UsageHour `json:"hours"`
+}
+
+// GetUsage returns the usage of the keys, all of them unless one is given,
+// by hour from from to to.
+func (r *RedisManager) GetUsage(ctx context.Context, key string, from time.Time, to time.Time) ([]KeyUsage, error) {
+	keys := []string{key}
+	if key == "" {
+		var err error
+		if keys, err = r.redisClient.SMembers(ctx, usageKeysKey).Result(); err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+	}
+
+	var hours []time.Time
+	for hour := from.UTC().Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+		hours = append(hours, hour)
+	}
+
+	pipe := r.redisClient.Pipeline()
+	results := make([][]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		for _, hour := range hours {
+			results[i] = append(results[i], pipe.HGetAll(ctx, usageHourKey(key, hour.Format(usageHourFormat))))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	usages := make([]KeyUsage, 0, len(keys))
+	for i, key := range keys {
+		keyUsage := KeyUsage{Key: key, Hours: []UsageHour{}}
+		for j, result := range results[i] {
+			values := result.Val()
+			if len(values) == 0 {
+				continue
+			}
+			hour := UsageHour{Hour: hours[j]}
+			hour.Requests, _ = strconv.ParseInt(values["requests"], 10, 64)
+			hour.BytesUploaded, _ = strconv.ParseInt(values["bytes_uploaded"], 10, 64)
+			hour.BytesDownloaded, _ = strconv.ParseInt(values["bytes_downloaded"], 10, 64)
+			keyUsage.add(hour.UsageCounts)
+			keyUsage.Hours = append(keyUsage.Hours, hour)
+		}
+		usages = append(usages, keyUsage)
+	}
+	return usages, nil
+}
+
+// GetUsage returns the usage of the API keys, or of the one given as key,
+// from from to to (RFC 3339, the last 24 hours by default), by hour.
+func (f *fileManager) GetUsage(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+	params := r.URL.Query()
+
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s must be an RFC 3339 timestamp", name))
+				return
+			}
+			*dst = t
+		}
+	}
+	if !from.Before(to) {
+		respondWithError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	// Older usage has expired.
+	if oldest := time.Now().Add(-config.UsageRetention); from.Before(oldest) {
+		from = oldest
+	}
+
+	usages, err := f.redisManager.GetUsage(r.Context(), params.Get("key"), from, to)
+	if err != nil {
+		logger.Error("Failed to retrieve API usage", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve API usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(usages)
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	usageFormatCSV    = "csv"
+	usageFormatNDJSON = "ndjson"
+
+	usageDayFormat = "2006-01-02"
+	// usageExportedKey holds the last day exported by the scheduled exports.
+	usageExportedKey = "usage:exported"
+	// usageSampleInterval is how often the storage of the keys is sampled.
+	usageSampleInterval = time.Hour
+)
+
+// usageStorageKey holds the storage of every key on a day, as of the last
+// sample taken that day.
+func usageStorageKey(day string) string {
+	return "usage:storage:" + day
+}
+
+// UsageRecord is a line of a usage export: what a key stored on a day, as of
+// the last sample of that day, and its traffic during the day.
+type UsageRecord struct {
+	Date        string `json:"date"`
+	Key         string `json:"key"`
+	Files       int64  `json:"files"`
+	StoredBytes int64  `json:"stored_bytes"`
+	UsageCounts
+}
+
+var usageCSVHeader = []string{"date", "key", "files", "stored_bytes", "requests", "bytes_uploaded", "bytes_downloaded"}
+
+// keyStorage is what a key stores.
+type keyStorage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// SampleStorage records what every key stores now as the storage of today.
+// Files written without a key are accounted to anonymous.
+func (f *fileManager) SampleStorage(ctx context.Context) error {
+	files, err := f.redisManager.ListFiles()
+	if err != nil {
+		return err
+	}
+
+	storage := make(map[string]*keyStorage)
+	for _, metadata := range files {
+		owner := metadata.Owner
+		if owner == "" {
+			owner = "anonymous"
+		}
+		if storage[owner] == nil {
+			storage[owner] = &keyStorage{}
+		}
+		storage[owner].Files++
+		storage[owner].Bytes += metadata.Size
+	}
+
+	day := usageStorageKey(time.Now().UTC().Format(usageDayFormat))
+	pipe := f.redisManager.redisClient.TxPipeline()
+	pipe.Del(ctx, day)
+	for owner, stored := range storage {
+		value, _ := json.Marshal(stored)
+		pipe.HSet(ctx, day, owner, value)
+	}
+	pipe.Expire(ctx, day, config.UsageRetention+24*time.Hour)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// UsageRecords returns the usage of every key on day, by key. Today's
+// storage is sampled first; days never sampled have no storage.
+func (f *fileManager) UsageRecords(ctx context.Context, day time.Time) ([]UsageRecord, error) {
+	date := day.Format(usageDayFormat)
+	if date == time.Now().UTC().Format(usageDayFormat) {
+		if err := f.SampleStorage(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	storage, err := f.redisManager.redisClient.HGetAll(ctx, usageStorageKey(date)).Result()
+	if err != nil {
+		return nil, err
+	}
+	traffic, err := f.redisManager.GetUsage(ctx, "", day, day.Add(24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]*UsageRecord)
+	record := func(key string) *UsageRecord {
+		if records[key] == nil {
+			records[key] = &UsageRecord{Date: date, Key: key}
+		}
+		return records[key]
+	}
+	for key, value := range storage {
+		var stored keyStorage
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			return nil, fmt.Errorf("invalid storage of %s on %s: %w", key, date, err)
+		}
+		record(key).Files = stored.Files
+		record(key).StoredBytes = stored.Bytes
+	}
+	for _, keyUsage := range traffic {
+		if keyUsage.Requests > 0 {
+			record(keyUsage.Key).UsageCounts = keyUsage.UsageCounts
+		}
+	}
+
+	sorted := make([]UsageRecord, 0, len(records))
+	for _, r := range records {
+		sorted = append(sorted, *r)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted, nil
+}
+
+// encodeUsage writes records as CSV, with a header line, or as NDJSON.
+func encodeUsage(records []UsageRecord, format string) ([]byte, string) {
+	var buf bytes.Buffer
+	if format == usageFormatNDJSON {
+		encoder := json.NewEncoder(&buf)
+		for _, record := range records {
+			_ = encoder.Encode(record)
+		}
+		return buf.Bytes(), "application/x-ndjson"
+	}
+
+	writer := csv.NewWriter(&buf)
+	_ = writer.Write(usageCSVHeader)
+	for _, r := range records {
+		_ = writer.Write([]string{
+			r.Date,
+			r.Key,
+			strconv.FormatInt(r.Files, 10),
+			strconv.FormatInt(r.StoredBytes, 10),
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.BytesUploaded, 10),
+			strconv.FormatInt(r.BytesDownloaded, 10),
+		})
+	}
+	writer.Flush()
+	return buf.Bytes(), "text/csv"
+}
+
+// usageSink is where usage exports are written.
+type usageSink interface {
+	Write(ctx context.Context, date string, format string, contentType string, body []byte) error
+}
+
+// openUsageSink parses a sink: webhook:URL, s3://bucket/prefix, or a local
+// directory, optionally as a file:// URL.
+func openUsageSink(spec string) (usageSink, error) {
+	if spec == "" {
+		return nil, errors.New("no sink given and FDS_USAGE_EXPORT_SINK is not set")
+	}
+	if rawURL, ok := strings.CutPrefix(spec, "webhook:"); ok {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q is not webhook:http(s)://host/path", spec)
+		}
+		return webhookSink{url: rawURL, host: u.Host}, nil
+	}
+	target, err := openBackupTarget(spec)
+	if err != nil {
+		return nil, err
+	}
+	return targetSink{target: target}, nil
+}
+
+// targetSink writes every export as usage-<date>.<format> under a backup
+// target, replacing an earlier export of the same day.
+type targetSink struct {
+	target backupTarget
+}
+
+func (s targetSink) Write(ctx context.Context, date string, format string, _ string, body []byte) error {
+	return s.target.Put(ctx, "usage-"+date+"."+format, bytes.NewReader(body), int64(len(body)))
+}
+
+// webhookSink posts every export to a URL, with its day in the
+// X-FDS-Usage-Date header. Any 2xx answer is a success.
+type webhookSink struct {
+	url  string
+	host string
+}
+
+func (s webhookSink) Write(ctx context.Context, date string, _ string, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-FDS-Usage-Date", date)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", s.host, res.Status)
+	}
+	return nil
+}
+
+// UsageExport is the answer of an export to a sink.
+type UsageExport struct {
+	Date    string `json:"date"`
+	Format  string `json:"format"`
+	Records int    `json:"records"`
+}
+
+// ExportUsage writes the usage of day to sink.
+func (f *fileManager) ExportUsage(ctx context.Context, sink usageSink, day time.Time, format string) (UsageExport, error) {
+	export := UsageExport{Date: day.Format(usageDayFormat), Format: format}
+	records, err := f.UsageRecords(ctx, day)
+	if err != nil {
+		return export, err
+	}
+	body, contentType := encodeUsage(records, format)
+	if err := sink.Write(ctx, export.Date, format, contentType, body); err != nil {
+		return export, err
+	}
+	export.Records = len(records)
+	return export, nil
+}
+
+// RunUsageExports samples the storage of the keys every
+// usageSampleInterval and, once a day is over, exports it to sink. Days
+// missed while the central server was down are exported when it is back, as
+// far back as FDS_USAGE_RETENTION.
+func (f *fileManager) RunUsageExports(ctx context.Context, sink usageSink) {
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := f.SampleStorage(ctx); err != nil {
+			logger.Warn("Failed to sample the storage of the API keys", zap.Error(err))
+		}
+		if err := f.exportPastDays(ctx, sink); err != nil {
+			logger.Error("Failed to export usage", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *fileManager) exportPastDays(ctx context.Context, sink usageSink) error {
+	rdb := f.redisManager.redisClient
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	// The first run only exports yesterday.
+	day := today.AddDate(0, 0, -1)
+	last, err := rdb.Get(ctx, usageExportedKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if exported, err := time.Parse(usageDayFormat, last); err == nil {
+		day = exported.AddDate(0, 0, 1)
+	}
+	if oldest := today.Add(-config.UsageRetention); day.Before(oldest) {
+		day = oldest.Truncate(24 * time.Hour)
+	}
+
+	for ; day.Before(today); day = day.AddDate(0, 0, 1) {
+		export, err := f.ExportUsage(ctx, sink, day, config.UsageExportFormat)
+		if err != nil {
+			return fmt.Errorf("usage of %s: %w", day.Format(usageDayFormat), err)
+		}
+		if err := rdb.Set(ctx, usageExportedKey, export.Date, 0).Err(); err != nil {
+			return err
+		}
+		logger.Info("Usage exported", zap.String("date", export.Date), zap.Int("records", export.Records))
+	}
+	return nil
+}
+
+// usageExportRequest reads the date (YYYY-MM-DD, yesterday by default) and
+// format of an export from the query.
+func usageExportRequest(w http.ResponseWriter, r *http.Request) (time.Time, string, bool) {
+	params := r.URL.Query()
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	if value := params.Get("date"); value != "" {
+		d, err := time.Parse(usageDayFormat, value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "date must be YYYY-MM-DD")
+			return time.Time{}, "", false
+		}
+		day = d
+	}
+	format := config.UsageExportFormat
+	if value := params.Get("format"); value != "" {
+		if value != usageFormatCSV && value != usageFormatNDJSON {
+			respondWithError(w, http.StatusBadRequest, "format must be csv or ndjson")
+			return time.Time{}, "", false
+		}
+		format = value
+	}
+	return day, format, true
+}
+
+// GetUsageExport answers with the usage export of a day.
+func (f *fileManager) GetUsageExport(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	day, format, ok := usageExportRequest(w, r)
+	if !ok {
+		return
+	}
+	records, err := f.UsageRecords(r.Context(), day)
+	if err != nil {
+		logger.Error("Failed to collect usage", zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to collect usage")
+		return
+	}
+
+	body, contentType := encodeUsage(records, format)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// PostUsageExport writes the usage export of a day to the sink given in the
+// query, or FDS_USAGE_EXPORT_SINK.
+func (f *fileManager) PostUsageExport(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, r.URL.Path).Inc()
+	logger := requestLogger(r.Context())
+
+	day, format, ok := usageExportRequest(w, r)
+	if !ok {
+		return
+	}
+	spec := r.URL.Query().Get("sink")
+	if spec == "" {
+		spec = config.UsageExportSink
+	}
+	sink, err := openUsageSink(spec)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	export, err := f.ExportUsage(r.Context(), sink, day, format)
+	if err != nil {
+		logger.Error("Failed to export usage", zap.String("date", export.Date), zap.Error(err))
+		respondWithError(w, http.StatusInternalServerError, "Failed to export usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(export)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/sha256"
+	"hash"
+	"log"
+	"net/http"
+)
+
+// Bounds of the block size, whether configured or requested for an upload.
+const (
+	minBlockSize = 64 * 1024
+	maxBlockSize = 1024 * MB
+)
+
+// chooseBlockSize returns the block size for a file of size bytes.
+// With adaptive sizing the data is cut into about FDS_BLOCK_TARGET_COUNT
+// blocks, rounded up to whole MB and kept between FDS_MIN_BLOCK_SIZE and
+// FDS_MAX_BLOCK_SIZE: small files end up in a single block, huge ones in
+// blocks large enough to keep the metadata small.
+func chooseBlockSize(size int) int {
+	if !config.AdaptiveBlockSize {
+		return config.BlockSize
+	}
+
+	target := (size + config.BlockTargetCount - 1) / config.BlockTargetCount
+	target = (target + MB - 1) / MB * MB
+	return min(max(target, config.MinBlockSize), config.MaxBlockSize)
+}
+
+func GenerateFileHash(fileName string) []byte {
+	h := sha256.New()
+
+	return generateHash([]byte(fileName), h)
+}
+
+func GenerateBlockHash(blockData []byte) []byte {
+	h := sha256.New()
+
+	return generateHash(blockData, h)
+}
+
+func generateHash(data []byte, h hash.Hash) []byte {
+	h.Write(data)
+
+	bs := h.Sum(nil)
+	return bs
+}
+
+func logAndRespondError(w http.ResponseWriter, code int, message string, err error) {
+	if err != nil {
+		log.Printf("[ERROR] %s: %v", message, err)
+	} else {
+		log.Printf("[ERROR] %s", message)
+	}
+	respondWithError(w, code, message)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+)
+
+// verifyConcurrency bounds the blocks read back at once.
+const verifyConcurrency = 8
+
+// errWriteUnverified fails writes whose blocks could not all be read back
+// intact with FDS_VERIFY_WRITES.
+var errWriteUnverified = errors.New("the blocks written could not be verified")
+
+var writeVerifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "write_verifications_total",
+		Help: "Block replicas read back after a write with FDS_VERIFY_WRITES, by result (ok, mismatch, unreadable)",
+	},
+	[]string{"result"},
+)
+
+// verifyBlocks reads every replica of the blocks just written back from its
+// node and checks it against the content sent. A replica that differs is
+// marked stale and scheduled for repair, as a download would have; either
+// way the write fails, so that it only succeeds once every block can be read.
+func (f *fileManager) verifyBlocks(ctx context.Context, fileName string, blocks []FileBlock) error {
+	slots := make(chan struct{}, verifyConcurrency)
+	errs := make(chan error, len(blocks))
+	var wg sync.WaitGroup
+	for _, block := range blocks {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(block FileBlock) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs <- f.verifyBlock(ctx, fileName+"-block-"+strconv.Itoa(block.position), block.bytes)
+		}(block)
+	}
+	wg.Wait()
+	close(errs)
+
+	var failed []error
+	for err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+func (f *fileManager) verifyBlock(ctx context.Context, blockName string, data []byte) error {
+	hash := fmt.Sprintf("%x", GenerateBlockHash(data))
+	location, err := f.redisManager.GetBlockLocation(blockName)
+	if err != nil {
+		return fmt.Errorf("%w: failed to read the location of %s: %w", errWriteUnverified, blockName, err)
+	}
+	if location.Hash != hash {
+		return fmt.Errorf("%w: %s was rewritten in the meantime", errWriteUnverified, blockName)
+	}
+
+	for _, address := range location.Healthy() {
+		block, err := f.fetchBlock(ctx, address, blockName+".bin")
+		if err != nil {
+			writeVerifications.WithLabelValues("unreadable").Inc()
+			return fmt.Errorf("%w: %s cannot be read from %s: %w", errWriteUnverified, blockName, address, err)
+		}
+		stored := fmt.Sprintf("%x", GenerateBlockHash(block.Bytes()))
+		putBuffer(block)
+		if stored != hash {
+			writeVerifications.WithLabelValues("mismatch").Inc()
+			blockCorruptions.WithLabelValues("verify").Inc()
+			if err := f.markReplicaCorrupted(ctx, blockName, address, hash); err != nil {
+				requestLogger(ctx).Warn("Failed to record corrupted block",
+					zap.String("blockName", blockName),
+					zap.String("nodeAddress", address),
+					zap.Error(err),
+				)
+			}
+			return fmt.Errorf("%w: %s does not match what was sent to %s", errWriteUnverified, blockName, address)
+		}
+		writeVerifications.WithLabelValues("ok").Inc()
+	}
+	return nil
+}
@@ -0,0 +1,645 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const webdavPrefix = "/webdav"
+
+// lockTokenScheme prefixes the lease IDs handed out as WebDAV lock tokens.
+const lockTokenScheme = "opaquelocktoken:"
+
+// webdavHandler serves the flat file namespace over WebDAV (RFC 4918) so the
+// cluster can be mounted from Finder/Explorer. The protocol is left to
+// golang.org/x/net/webdav: each request is served by a webdav.Handler over a
+// davSession, whose FileSystem is the fileManager and whose LockSystem is the
+// leases of lock.go. Lock tokens are lease IDs, so writes to a locked file go
+// through only with its token in the If header.
+type webdavHandler struct {
+	prefix      string
+	fileManager *fileManager
+}
+
+func newWebdavHandler(fileManager *fileManager) *webdavHandler {
+	return &webdavHandler{prefix: webdavPrefix, fileManager: fileManager}
+}
+
+func (h *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httpRequestsTotal.WithLabelValues(r.Method, h.prefix).Inc()
+
+	if !strings.HasPrefix(r.URL.Path, h.prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := davFileName(strings.TrimPrefix(r.URL.Path, h.prefix))
+
+	if name == "" {
+		switch r.Method {
+		case http.MethodPut, "LOCK":
+			// The root is the only collection, and locking it would lock
+			// the whole namespace.
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		case http.MethodDelete, "COPY", "MOVE":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodPut:
+		if !limitUploadBody(w, r, 0) {
+			return
+		}
+		ticket, ok := admitUpload(w, r)
+		if !ok {
+			return
+		}
+		defer ticket.Release()
+		ctx = withDeclaredType(ctx, r.Header.Get("Content-Type"))
+	case "LOCK":
+		// x/net/webdav takes a LOCK without Timeout as infinite.
+		if r.Header.Get("Timeout") == "" {
+			r.Header.Set("Timeout", "Second-"+strconv.Itoa(int(config.LockDefaultTTL/time.Second)))
+		}
+	}
+
+	session := &davSession{
+		ctx:    ctx,
+		files:  h.fileManager,
+		name:   name,
+		method: r.Method,
+		header: w.Header(),
+		tokens: make(map[string]string),
+		held:   make(map[string]string),
+	}
+	handler := &webdav.Handler{
+		Prefix:     h.prefix,
+		FileSystem: davFileSystem{session},
+		LockSystem: davLockSystem{session},
+	}
+	handler.ServeHTTP(&davResponseWriter{ResponseWriter: w, session: session}, r)
+}
+
+// davFileName maps the path of a WebDAV resource to a file name; the empty
+// name is the root collection.
+func davFileName(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// davSession is what x/net/webdav sees of the cluster for one request. Its
+// locks are taken for the request target unless named otherwise, since
+// LockSystem calls carry no context and refreshes and unlocks only a token.
+type davSession struct {
+	ctx    context.Context
+	files  *fileManager
+	name   string
+	method string
+	header http.Header
+	// tokens are the locks created during the request, by token, with the
+	// file they lease ("" for none).
+	tokens map[string]string
+	// held are the leases the request holds, by file, which its writes to
+	// those files go through with.
+	held map[string]string
+	// err is the failure of the fileManager the request is answered with.
+	err error
+}
+
+// fileContext returns the context of an operation of the request on name:
+// holding the lease of name if the request holds it, and without If-Match
+// unless name is the target, which If-Match is about.
+func (s *davSession) fileContext(name string) context.Context {
+	ctx := s.ctx
+	if name != s.name {
+		ctx = context.WithValue(ctx, ifMatchKey{}, "")
+	}
+	if leaseID, ok := s.held[name]; ok {
+		ctx = context.WithValue(ctx, leaseKey{}, leaseID)
+	}
+	return ctx
+}
+
+// fail records err to answer the request with, and returns it for
+// x/net/webdav, which answers its own status instead.
+func (s *davSession) fail(err error) error {
+	s.err = err
+	return err
+}
+
+// davResponseWriter answers the failures of the fileManager as the rest of
+// the API does, instead of with the status x/net/webdav gives any error of
+// its FileSystem.
+type davResponseWriter struct {
+	http.ResponseWriter
+	session  *davSession
+	answered bool
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	err := w.session.err
+	if status < http.StatusBadRequest || err == nil {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.answered = true
+	w.Header().Del("Content-Type")
+	switch {
+	case isBodyTooLarge(err):
+		respondUploadTooLarge(w.ResponseWriter)
+	case errors.Is(err, errUploadsSaturated):
+		respondUploadsSaturated(w.ResponseWriter)
+	default:
+		requestLogger(w.session.ctx).Error("WebDAV request failed",
+			zap.String("method", w.session.method),
+			zap.String("fileName", w.session.name),
+			zap.Error(err),
+		)
+		respondUploadError(w.ResponseWriter, w.session.name, "WebDAV request failed", err)
+	}
+}
+
+func (w *davResponseWriter) Write(p []byte) (int, error) {
+	if w.answered {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// davFileSystem is the namespace as a webdav.FileSystem: the root holds every
+// file whose name has no slash. Names with slashes are read, but nothing is
+// written under them, for want of the collections they would be in.
+type davFileSystem struct {
+	*davSession
+}
+
+func (fs davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (fs davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fileName := davFileName(name)
+	if fileName == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+		}
+		return &davRoot{fs: fs}, nil
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if strings.Contains(fileName, "/") {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if flag&os.O_CREATE == 0 {
+			if _, err := fs.Stat(ctx, name); err != nil {
+				return nil, err
+			}
+		}
+		// The content is only stored once complete, on Close.
+		return &davWriter{fs: fs, info: &davFileInfo{metadata: FileMetadata{Name: fileName}}, content: getBuffer()}, nil
+	}
+
+	metadata, err := fs.metadata(fileName)
+	if err != nil {
+		return nil, err
+	}
+	fileCtx := fs.fileContext(fileName)
+	if fileName == fs.name {
+		switch fs.method {
+		case "COPY":
+			if err := fs.files.checkPrecondition(fileCtx, fileName); err != nil {
+				return nil, fs.fail(err)
+			}
+		case http.MethodGet:
+			fileCtx = fs.files.noteFileRead(fileCtx, fileName)
+			fallthrough
+		case http.MethodHead:
+			// The type is not sniffed, which would read the first block
+			// for nothing.
+			fs.header.Set("Content-Type", downloadContentType(fileName))
+		}
+	}
+	return &davReader{fs: fs, ctx: fileCtx, info: &davFileInfo{metadata: metadata}}, nil
+}
+
+func (fs davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fileName := davFileName(name)
+	if fileName == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	err := fs.files.RemoveFile(fs.fileContext(fileName), fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return fs.fail(err)
+	}
+	return nil
+}
+
+// Rename copies the file through the central server, since blocks are
+// addressed by file name and cannot be renamed in place on the nodes.
+func (fs davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	source, dest := davFileName(oldName), davFileName(newName)
+	if source == "" || dest == "" || strings.Contains(dest, "/") {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrPermission}
+	}
+
+	// A leased source is not copied only to fail to be removed.
+	sourceCtx := fs.fileContext(source)
+	if err := fs.files.checkWrite(sourceCtx, source); err != nil {
+		return fs.fail(err)
+	}
+	data, err := fs.files.ReconstructFileFromBlocks(sourceCtx, source)
+	if err != nil {
+		return fs.fail(err)
+	}
+	if err := fs.files.StoreFile(fs.fileContext(dest), dest, data); err != nil {
+		return fs.fail(err)
+	}
+	if err := fs.files.RemoveFile(sourceCtx, source); err != nil {
+		return fs.fail(err)
+	}
+	return nil
+}
+
+func (fs davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fileName := davFileName(name)
+	if fileName == "" {
+		return davRootInfo{}, nil
+	}
+	metadata, err := fs.metadata(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &davFileInfo{metadata: metadata}, nil
+}
+
+// metadata returns the metadata of fileName, os.ErrNotExist if there is no
+// such file.
+func (s *davSession) metadata(fileName string) (FileMetadata, error) {
+	metadata, err := s.files.redisManager.GetFileMetadata(fileName)
+	if errors.Is(err, ErrFileNotFound) {
+		return FileMetadata{}, &os.PathError{Op: "stat", Path: fileName, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return FileMetadata{}, s.fail(err)
+	}
+	return metadata, nil
+}
+
+// davFileInfo describes a file. Its ETag is the version of the file, as
+// everywhere else in the API.
+type davFileInfo struct {
+	metadata FileMetadata
+}
+
+func (fi *davFileInfo) Name() string       { return fi.metadata.Name }
+func (fi *davFileInfo) Size() int64        { return fi.metadata.Size }
+func (fi *davFileInfo) Mode() os.FileMode  { return 0o644 }
+func (fi *davFileInfo) ModTime() time.Time { return fi.metadata.CreatedAt }
+func (fi *davFileInfo) IsDir() bool        { return false }
+func (fi *davFileInfo) Sys() any           { return nil }
+
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	return fileETag(fi.metadata.Version), nil
+}
+
+func (fi *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	return downloadContentType(fi.metadata.Name), nil
+}
+
+type davRootInfo struct{}
+
+func (davRootInfo) Name() string       { return "/" }
+func (davRootInfo) Size() int64        { return 0 }
+func (davRootInfo) Mode() os.FileMode  { return os.ModeDir | 0o755 }
+func (davRootInfo) ModTime() time.Time { return time.Time{} }
+func (davRootInfo) IsDir() bool        { return true }
+func (davRootInfo) Sys() any           { return nil }
+
+// davRoot is the root collection opened, listing the files.
+type davRoot struct {
+	fs    davFileSystem
+	files []os.FileInfo
+	// listed is whether files holds the listing, which Readdir hands out
+	// count entries at a time.
+	listed bool
+}
+
+func (d *davRoot) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		files, err := d.fs.files.redisManager.ListFiles()
+		if err != nil {
+			return nil, d.fs.fail(err)
+		}
+		for _, metadata := range files {
+			if !strings.Contains(metadata.Name, "/") {
+				d.files = append(d.files, &davFileInfo{metadata: metadata})
+			}
+		}
+		d.listed = true
+	}
+
+	if count <= 0 {
+		files := d.files
+		d.files = nil
+		return files, nil
+	}
+	if len(d.files) == 0 {
+		return nil, io.EOF
+	}
+	files := d.files[:min(count, len(d.files))]
+	d.files = d.files[len(files):]
+	return files, nil
+}
+
+func (d *davRoot) Stat() (os.FileInfo, error)                   { return davRootInfo{}, nil }
+func (d *davRoot) Read(p []byte) (int, error)                   { return 0, errors.New("is a collection") }
+func (d *davRoot) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (d *davRoot) Write(p []byte) (int, error)                  { return 0, errors.New("is a collection") }
+func (d *davRoot) Close() error                                 { return nil }
+
+// davReader is a file opened for reading. Nothing is fetched before the first
+// read, so seeking to learn the size costs nothing; files in the seekable
+// layout are then read from the blocks the reads fall into, others whole.
+type davReader struct {
+	fs      davFileSystem
+	ctx     context.Context
+	info    *davFileInfo
+	offset  int64
+	content io.ReadSeeker
+}
+
+func (f *davReader) Read(p []byte) (int, error) {
+	if f.content == nil {
+		metadata := f.info.metadata
+		if metadata.Packed == nil && metadata.Extents != nil {
+			f.content = newExtentReader(f.ctx, f.fs.files, metadata)
+		} else {
+			data, err := f.fs.files.ReconstructFileFromBlocks(f.ctx, metadata.Name)
+			if err != nil {
+				return 0, f.fs.fail(err)
+			}
+			f.content = bytes.NewReader(data)
+		}
+	}
+	if _, err := f.content.Seek(f.offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := f.content.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *davReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.metadata.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the file")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davReader) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *davReader) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a collection")
+}
+func (f *davReader) Write(p []byte) (int, error) { return 0, errors.New("opened for reading") }
+func (f *davReader) Close() error                { return nil }
+
+// davWriter is a file opened for writing: its content is buffered and stored
+// as the new version of the file on Close, after which Stat describes it.
+type davWriter struct {
+	fs      davFileSystem
+	info    *davFileInfo
+	content *bytes.Buffer
+	stored  bool
+}
+
+func (f *davWriter) Write(p []byte) (int, error) {
+	return f.content.Write(p)
+}
+
+// ReadFrom reads the body of a PUT, whose errors, such as crossing the upload
+// limit, are then answered as such.
+func (f *davWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := f.content.ReadFrom(r)
+	if err != nil {
+		return n, f.fs.fail(err)
+	}
+	return n, nil
+}
+
+func (f *davWriter) Close() error {
+	defer putBuffer(f.content)
+	name := f.info.metadata.Name
+	if err := f.fs.files.StoreFile(f.fs.fileContext(name), name, f.content.Bytes()); err != nil {
+		return f.fs.fail(err)
+	}
+	metadata, err := f.fs.metadata(name)
+	if err != nil {
+		return err
+	}
+	f.info.metadata, f.stored = metadata, true
+	return nil
+}
+
+func (f *davWriter) Stat() (os.FileInfo, error) {
+	if !f.stored {
+		f.info.metadata.Size = int64(f.content.Len())
+	}
+	return f.info, nil
+}
+
+func (f *davWriter) Read(p []byte) (int, error) { return 0, errors.New("opened for writing") }
+func (f *davWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("opened for writing")
+}
+func (f *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a collection")
+}
+
+// davLockSystem is the leases as a webdav.LockSystem. A lock is a lease on
+// one file, whatever its depth. The locks x/net/webdav takes for the length
+// of a request made without If header are leases too, so that the writes of
+// the request hold one and no lease is taken meanwhile.
+type davLockSystem struct {
+	*davSession
+}
+
+// Confirm holds the leases of name0 and name1 for the request if conditions,
+// the conditions of one list of an If header, hold: the lease of each of them
+// that is leased is named, the other tokens named lease one of them, and the
+// ETags are those of the first of them.
+func (ls davLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	leases := make(map[string]string)
+	etag := ""
+	for _, name := range []string{davFileName(name0), davFileName(name1)} {
+		if name == "" {
+			continue
+		}
+		lease, err := ls.files.redisManager.GetFileLease(ls.ctx, name)
+		if err == nil {
+			leases[name] = lease.LeaseID
+		} else if !errors.Is(err, errNotLocked) {
+			return nil, err
+		}
+		if etag == "" {
+			if metadata, err := ls.files.redisManager.GetFileMetadata(name); err == nil {
+				etag = fileETag(metadata.Version)
+			}
+		}
+	}
+
+	named := make(map[string]bool)
+	for _, condition := range conditions {
+		holds := false
+		if condition.Token != "" {
+			leaseID := strings.TrimPrefix(condition.Token, lockTokenScheme)
+			for _, held := range leases {
+				holds = holds || held == leaseID
+			}
+			if !condition.Not {
+				named[leaseID] = true
+			}
+		} else {
+			holds = etag != "" && condition.ETag == etag
+		}
+		if holds == condition.Not {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	for _, leaseID := range leases {
+		if !named[leaseID] {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+
+	for name, leaseID := range leases {
+		ls.held[name] = leaseID
+	}
+	return func() {
+		for name := range leases {
+			delete(ls.held, name)
+		}
+	}, nil
+}
+
+// Create leases the file at the root of details for its Duration, or for
+// FDS_LOCK_DEFAULT_TTL when the lock only lasts the request.
+func (ls davLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	name := davFileName(details.Root)
+	leaseID := newLockToken()
+	token := lockTokenScheme + leaseID
+	if name == "" || strings.Contains(name, "/") {
+		// Nothing is written there to be held back.
+		ls.tokens[token] = ""
+		return token, nil
+	}
+
+	ttl := config.LockDefaultTTL
+	if ls.method == "LOCK" {
+		ttl = lockTTL(details.Duration)
+	}
+	_, err := ls.files.redisManager.LockFile(ls.ctx, name, leaseID, callerFromContext(ls.ctx).Identity, ttl)
+	if errors.Is(err, errFileLocked) {
+		return "", webdav.ErrLocked
+	}
+	if err != nil {
+		return "", err
+	}
+	ls.tokens[token] = name
+	ls.held[name] = leaseID
+	return token, nil
+}
+
+// Refresh extends the lease of the request target named by token. A lock
+// that has expired is not granted again.
+func (ls davLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	leaseID := strings.TrimPrefix(token, lockTokenScheme)
+	lease, err := ls.files.redisManager.GetFileLease(ls.ctx, ls.name)
+	if errors.Is(err, errNotLocked) || err == nil && lease.LeaseID != leaseID {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	lease, err = ls.files.redisManager.LockFile(ls.ctx, ls.name, leaseID, callerFromContext(ls.ctx).Identity, lockTTL(duration))
+	if errors.Is(err, errFileLocked) {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return webdav.LockDetails{
+		Root:      "/" + ls.name,
+		Duration:  time.Until(lease.ExpiresAt).Round(time.Second),
+		ZeroDepth: true,
+	}, nil
+}
+
+// Unlock drops the lease of token: one created during the request, or else
+// one on the request target (RFC 4918, 9.11.1).
+func (ls davLockSystem) Unlock(now time.Time, token string) error {
+	name, created := ls.tokens[token]
+	if created {
+		delete(ls.tokens, token)
+		delete(ls.held, name)
+		if name == "" {
+			return nil
+		}
+	} else {
+		name = ls.name
+	}
+
+	// The locks of a request are dropped even when its client went away.
+	err := ls.files.redisManager.UnlockFile(context.WithoutCancel(ls.ctx), name, strings.TrimPrefix(token, lockTokenScheme))
+	if errors.Is(err, errNotLocked) || errors.Is(err, errFileLocked) {
+		return webdav.ErrNoSuchLock
+	}
+	return err
+}
+
+// newLockToken returns the ID of a new lock, a UUID as opaquelocktoken URIs
+// hold.
+func newLockToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// lockTTL returns how long to lock for the Timeout of a LOCK, at most
+// FDS_LOCK_MAX_TTL, which "Infinite" (negative) locks for.
+func lockTTL(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		if timeout == 0 {
+			return config.LockDefaultTTL
+		}
+		return config.LockMaxTTL
+	}
+	return min(timeout, config.LockMaxTTL)
+}
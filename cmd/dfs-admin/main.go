@@ -0,0 +1,315 @@
+// Command dfs-admin runs the operations of the cluster through the admin
+// endpoints of the central server.
+//
+//	dfs-admin [-server http://localhost:8000] [-token TOKEN] <command> [arguments]
+//
+// The token defaults to FDS_ADMIN_TOKEN; without one the central server only
+// takes admin requests from localhost.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// apiVersion is the version of the central server API the tool speaks.
+const apiVersion = "/v1"
+
+type command struct {
+	usage   string
+	summary string
+	run     func(a *admin, args []string) error
+}
+
+var commands = map[string]command{
+	"nodes":        {"nodes", "list the nodes and their usage", listNodes},
+	"drain":        {"drain <address>", "stop placing blocks on a node", drainNode},
+	"undrain":      {"undrain <address>", "place blocks on a drained node again", undrainNode},
+	"decommission": {"decommission <address>", "move every block off a node and remove it", decommissionNode},
+	"rebalance":    {"rebalance [-dry-run] [-threshold share] [-max-bytes n]", "even out the usage of the nodes", rebalance},
+	"scrub":        {"scrub", "read back every replica and repair the corrupted ones", scrub},
+	"verify-file":  {"verify-file <name>", "read back every replica of a file's blocks", verifyFile},
+	"gc":           {"gc", "drop expired multipart uploads and stale corruption records", gc},
+	"backup":       {"backup [-target spec]", "back the metadata and blocks of the files up", backup},
+	"backups":      {"backups [-target spec]", "list the backups of a target", listBackups},
+}
+
+var commandOrder = []string{"nodes", "drain", "undrain", "decommission", "rebalance", "scrub", "verify-file", "gc", "backup", "backups"}
+
+func main() {
+	server := flag.String("server", "http://localhost:8000", "URL of the central server")
+	token := flag.String("token", os.Getenv("FDS_ADMIN_TOKEN"), "admin token, FDS_ADMIN_TOKEN by default")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s [flags] <command> [arguments]\n\ncommands:\n", os.Args[0])
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		for _, name := range commandOrder {
+			fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].summary)
+		}
+		w.Flush()
+		fmt.Fprintln(out, "\nflags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	a := &admin{
+		baseURL:    strings.TrimSuffix(*server, "/") + apiVersion,
+		token:      *token,
+		httpClient: &http.Client{},
+	}
+	if err := cmd.run(a, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// admin sends the requests of the commands to the central server.
+type admin struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// do sends a request and decodes its JSON answer into out, unless out is
+// nil.
+func (a *admin) do(method string, path string, query url.Values, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	target := a.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	res, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return responseError(res)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func responseError(res *http.Response) error {
+	var body struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err == nil && body.Message != "" {
+		return fmt.Errorf("server responded %d (%s): %s", res.StatusCode, body.Code, body.Message)
+	}
+	return fmt.Errorf("server responded %d", res.StatusCode)
+}
+
+// printJSON writes an answer as indented JSON.
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// oneArgument returns the single argument of a command.
+func oneArgument(args []string, name string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", fmt.Errorf("expected one argument, the %s", name)
+	}
+	return args[0], nil
+}
+
+// nodeStatus is the part of a registry entry the tool shows.
+type nodeStatus struct {
+	Address       string    `json:"address"`
+	ID            string    `json:"id"`
+	Status        string    `json:"status"`
+	Usage         int64     `json:"usage"`
+	Capacity      int64     `json:"capacity"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+func listNodes(a *admin, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
+	var nodes []nodeStatus
+	if err := a.do(http.MethodGet, "/nodes", nil, nil, &nodes); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tID\tSTATUS\tUSED\tCAPACITY\tLAST HEARTBEAT")
+	for _, node := range nodes {
+		used := "-"
+		if node.Capacity > 0 {
+			used = fmt.Sprintf("%d (%.0f%%)", node.Usage, 100*float64(node.Usage)/float64(node.Capacity))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", node.Address, node.ID, node.Status, used, node.Capacity, node.LastHeartbeat.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func drainNode(a *admin, args []string) error {
+	return a.nodeCommand(http.MethodPut, "/admin/nodes/drain", args)
+}
+
+func undrainNode(a *admin, args []string) error {
+	return a.nodeCommand(http.MethodDelete, "/admin/nodes/drain", args)
+}
+
+func decommissionNode(a *admin, args []string) error {
+	return a.nodeCommand(http.MethodPost, "/admin/nodes/decommission", args)
+}
+
+func (a *admin) nodeCommand(method string, path string, args []string) error {
+	address, err := oneArgument(args, "address of the node")
+	if err != nil {
+		return err
+	}
+	var result json.RawMessage
+	if err := a.do(method, path, url.Values{"address": {address}}, nil, &result); err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func rebalance(a *admin, args []string) error {
+	flags := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only plan the moves")
+	threshold := flags.Float64("threshold", -1, "share of their capacity the nodes may use above that of the cluster, FDS_REBALANCE_THRESHOLD by default")
+	maxBytes := flags.Int64("max-bytes", 0, "most bytes to move, no limit if 0")
+	_ = flags.Parse(args)
+
+	query := url.Values{"dryRun": {strconv.FormatBool(*dryRun)}}
+	if *threshold >= 0 {
+		query.Set("threshold", strconv.FormatFloat(*threshold, 'f', -1, 64))
+	}
+	if *maxBytes > 0 {
+		query.Set("maxBytes", strconv.FormatInt(*maxBytes, 10))
+	}
+	var plan json.RawMessage
+	if err := a.do(http.MethodPost, "/admin/rebalance", query, nil, &plan); err != nil {
+		return err
+	}
+	return printJSON(plan)
+}
+
+// scrubSummary is the answer of a scrub, checked for the exit status.
+type scrubSummary struct {
+	Corrupted  []json.RawMessage `json:"corrupted"`
+	Unreadable []json.RawMessage `json:"unreadable"`
+}
+
+func scrub(a *admin, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
+	return a.scrub(nil)
+}
+
+func verifyFile(a *admin, args []string) error {
+	name, err := oneArgument(args, "name of the file")
+	if err != nil {
+		return err
+	}
+	return a.scrub(url.Values{"file": {name}})
+}
+
+// scrub prints the answer of a scrub and fails when it found a replica
+// corrupted or unreadable.
+func (a *admin) scrub(query url.Values) error {
+	var raw json.RawMessage
+	if err := a.do(http.MethodPost, "/admin/scrub", query, nil, &raw); err != nil {
+		return err
+	}
+	if err := printJSON(raw); err != nil {
+		return err
+	}
+	var summary scrubSummary
+	if err := json.Unmarshal(raw, &summary); err != nil {
+		return err
+	}
+	if len(summary.Corrupted) > 0 || len(summary.Unreadable) > 0 {
+		return fmt.Errorf("%d replicas corrupted, %d unreadable", len(summary.Corrupted), len(summary.Unreadable))
+	}
+	return nil
+}
+
+func gc(a *admin, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no argument")
+	}
+	var summary json.RawMessage
+	if err := a.do(http.MethodPost, "/admin/gc", nil, nil, &summary); err != nil {
+		return err
+	}
+	return printJSON(summary)
+}
+
+func backup(a *admin, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	target := flags.String("target", "", "s3://bucket/prefix or a directory of the central server, FDS_BACKUP_TARGET by default")
+	_ = flags.Parse(args)
+
+	var summary json.RawMessage
+	if err := a.do(http.MethodPost, "/admin/backups", nil, map[string]string{"target": *target}, &summary); err != nil {
+		return err
+	}
+	return printJSON(summary)
+}
+
+func listBackups(a *admin, args []string) error {
+	flags := flag.NewFlagSet("backups", flag.ExitOnError)
+	target := flags.String("target", "", "s3://bucket/prefix or a directory of the central server, FDS_BACKUP_TARGET by default")
+	_ = flags.Parse(args)
+
+	query := url.Values{}
+	if *target != "" {
+		query.Set("target", *target)
+	}
+	var backups json.RawMessage
+	if err := a.do(http.MethodGet, "/admin/backups", query, nil, &backups); err != nil {
+		return err
+	}
+	return printJSON(backups)
+}
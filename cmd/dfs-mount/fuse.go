@@ -0,0 +1,399 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Minimal implementation of the Linux FUSE kernel protocol (7.31), covering
+// the operations needed for a flat read/write namespace.
+
+const (
+	fuseKernelVersion      = 7
+	fuseKernelMinorVersion = 31
+	fuseRootID             = 1
+	fuseMaxWrite           = 128 * 1024
+	fuseReadBufferSize     = fuseMaxWrite + 4096
+
+	fuseAtomicOTrunc = 1 << 3
+	fuseBigWrites    = 1 << 5
+
+	fattrSize = 1 << 3
+	fattrFh   = 1 << 6
+)
+
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opMkdir       = 9
+	opUnlink      = 10
+	opRmdir       = 11
+	opRename      = 12
+	opOpen        = 14
+	opRead        = 15
+	opWrite       = 16
+	opStatfs      = 17
+	opRelease     = 18
+	opFsync       = 20
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opAccess      = 34
+	opCreate      = 35
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+	opRename2     = 45
+)
+
+type fuseInHeader struct {
+	Len     uint32
+	Opcode  uint32
+	Unique  uint64
+	Nodeid  uint64
+	Uid     uint32
+	Gid     uint32
+	Pid     uint32
+	Padding uint32
+}
+
+type fuseOutHeader struct {
+	Len    uint32
+	Error  int32
+	Unique uint64
+}
+
+type fuseInitIn struct {
+	Major        uint32
+	Minor        uint32
+	MaxReadahead uint32
+	Flags        uint32
+}
+
+type fuseInitOut struct {
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+	TimeGran            uint32
+	MaxPages            uint16
+	MapAlignment        uint16
+	Flags2              uint32
+	Unused              [7]uint32
+}
+
+type fuseAttr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	Uid       uint32
+	Gid       uint32
+	Rdev      uint32
+	Blksize   uint32
+	Flags     uint32
+}
+
+type fuseEntryOut struct {
+	Nodeid         uint64
+	Generation     uint64
+	EntryValid     uint64
+	AttrValid      uint64
+	EntryValidNsec uint32
+	AttrValidNsec  uint32
+	Attr           fuseAttr
+}
+
+type fuseAttrOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Dummy         uint32
+	Attr          fuseAttr
+}
+
+type fuseOpenIn struct {
+	Flags     uint32
+	OpenFlags uint32
+}
+
+type fuseOpenOut struct {
+	Fh        uint64
+	OpenFlags uint32
+	Padding   uint32
+}
+
+type fuseCreateIn struct {
+	Flags     uint32
+	Mode      uint32
+	Umask     uint32
+	OpenFlags uint32
+}
+
+type fuseCreateOut struct {
+	Entry fuseEntryOut
+	Open  fuseOpenOut
+}
+
+// fuseReadIn is shared by READ, WRITE and READDIR requests.
+type fuseReadIn struct {
+	Fh        uint64
+	Offset    uint64
+	Size      uint32
+	ReadFlags uint32
+	LockOwner uint64
+	Flags     uint32
+	Padding   uint32
+}
+
+type fuseWriteOut struct {
+	Size    uint32
+	Padding uint32
+}
+
+type fuseReleaseIn struct {
+	Fh           uint64
+	Flags        uint32
+	ReleaseFlags uint32
+	LockOwner    uint64
+}
+
+type fuseFhIn struct {
+	Fh uint64
+}
+
+type fuseSetattrIn struct {
+	Valid     uint32
+	Padding   uint32
+	Fh        uint64
+	Size      uint64
+	LockOwner uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Unused4   uint32
+	Uid       uint32
+	Gid       uint32
+	Unused5   uint32
+}
+
+type fuseRenameIn struct {
+	Newdir uint64
+}
+
+type fuseRename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+}
+
+type fuseKstatfs struct {
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Bsize   uint32
+	Namelen uint32
+	Frsize  uint32
+	Padding uint32
+	Spare   [6]uint32
+}
+
+type fuseDirentHeader struct {
+	Ino     uint64
+	Off     uint64
+	Namelen uint32
+	Type    uint32
+}
+
+// fuseRequest is a decoded kernel request; body holds the opcode-specific
+// arguments that follow the header.
+type fuseRequest struct {
+	header fuseInHeader
+	body   []byte
+}
+
+func (r *fuseRequest) decode(v any) error {
+	return binary.Read(bytes.NewReader(r.body), binary.NativeEndian, v)
+}
+
+// names returns the NUL-terminated strings found in the body after skip bytes.
+func (r *fuseRequest) names(skip int) []string {
+	if skip > len(r.body) {
+		return nil
+	}
+	var names []string
+	for _, part := range bytes.Split(r.body[skip:], []byte{0}) {
+		if len(part) > 0 {
+			names = append(names, string(part))
+		}
+	}
+	return names
+}
+
+type fuseConn struct {
+	dev *os.File
+}
+
+func (c *fuseConn) readRequest(buf []byte) (*fuseRequest, error) {
+	for {
+		n, err := c.dev.Read(buf)
+		if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EAGAIN) {
+			continue
+		}
+		if errors.Is(err, syscall.ENODEV) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		req := &fuseRequest{}
+		headerSize := binary.Size(req.header)
+		if n < headerSize {
+			return nil, fmt.Errorf("short FUSE request: %d bytes", n)
+		}
+		if err := binary.Read(bytes.NewReader(buf[:headerSize]), binary.NativeEndian, &req.header); err != nil {
+			return nil, err
+		}
+		req.body = append([]byte(nil), buf[headerSize:n]...)
+		return req, nil
+	}
+}
+
+// reply sends a successful response whose payload is the binary encoding of
+// out followed by data.
+func (c *fuseConn) reply(req *fuseRequest, out any, data []byte) error {
+	var payload bytes.Buffer
+	if out != nil {
+		if err := binary.Write(&payload, binary.NativeEndian, out); err != nil {
+			return err
+		}
+	}
+	payload.Write(data)
+	return c.write(req.header.Unique, 0, payload.Bytes())
+}
+
+func (c *fuseConn) replyError(req *fuseRequest, errno syscall.Errno) error {
+	return c.write(req.header.Unique, -int32(errno), nil)
+}
+
+func (c *fuseConn) write(unique uint64, errno int32, payload []byte) error {
+	header := fuseOutHeader{Error: errno, Unique: unique}
+	header.Len = uint32(binary.Size(header) + len(payload))
+
+	var msg bytes.Buffer
+	_ = binary.Write(&msg, binary.NativeEndian, header)
+	msg.Write(payload)
+
+	_, err := c.dev.Write(msg.Bytes())
+	if errors.Is(err, syscall.ENOENT) {
+		// The request was interrupted and the kernel no longer waits for it.
+		return nil
+	}
+	return err
+}
+
+// mount attaches a FUSE filesystem at mountpoint, using fusermount when
+// available so unprivileged users can mount.
+func mount(mountpoint string) (*fuseConn, error) {
+	for _, helper := range []string{"fusermount3", "fusermount"} {
+		if bin, err := exec.LookPath(helper); err == nil {
+			return mountWithHelper(bin, mountpoint)
+		}
+	}
+	return mountDirect(mountpoint)
+}
+
+func mountDirect(mountpoint string) (*fuseConn, error) {
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /dev/fuse: %w", err)
+	}
+
+	options := fmt.Sprintf("fd=%d,rootmode=40000,user_id=%d,group_id=%d", fd, os.Getuid(), os.Getgid())
+	if err := unix.Mount("dfs", mountpoint, "fuse.dfs", unix.MS_NOSUID|unix.MS_NODEV, options); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to mount %s: %w", mountpoint, err)
+	}
+
+	return &fuseConn{dev: os.NewFile(uintptr(fd), "/dev/fuse")}, nil
+}
+
+func mountWithHelper(bin string, mountpoint string) (*fuseConn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fds[0])
+
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	cmd := exec.Command(bin, "-o", "fsname=dfs,subtype=dfs", "--", mountpoint)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	remote.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", bin, err)
+	}
+
+	buf := make([]byte, 4)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(fds[0], buf, oob, 0)
+	waitErr := cmd.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive FUSE descriptor: %w", err)
+	}
+	if waitErr != nil {
+		return nil, fmt.Errorf("%s failed: %w", bin, waitErr)
+	}
+
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return nil, errors.New("fusermount did not send a FUSE descriptor")
+	}
+	rights, err := unix.ParseUnixRights(&messages[0])
+	if err != nil || len(rights) == 0 {
+		return nil, errors.New("fusermount did not send a FUSE descriptor")
+	}
+
+	return &fuseConn{dev: os.NewFile(uintptr(rights[0]), "/dev/fuse")}, nil
+}
+
+func unmount(mountpoint string) error {
+	for _, helper := range []string{"fusermount3", "fusermount"} {
+		if bin, err := exec.LookPath(helper); err == nil {
+			return exec.Command(bin, "-u", mountpoint).Run()
+		}
+	}
+	return unix.Unmount(mountpoint, 0)
+}
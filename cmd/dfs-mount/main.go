@@ -0,0 +1,51 @@
+//go:build linux
+
+// Command dfs-mount mounts the DFS namespace as a local read/write directory
+// using FUSE.
+//
+//	dfs-mount [-server http://localhost:8000] <mountpoint>
+package main
+
+import (
+	"FDS/client"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	server := flag.String("server", "http://localhost:8000", "URL of the central server")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <mountpoint>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	mountpoint := flag.Arg(0)
+
+	conn, err := mount(mountpoint)
+	if err != nil {
+		log.Fatalf("failed to mount %s: %v", mountpoint, err)
+	}
+	log.Printf("mounted %s at %s", *server, mountpoint)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := unmount(mountpoint); err != nil {
+			log.Printf("failed to unmount %s: %v", mountpoint, err)
+		}
+	}()
+
+	if err := newDfsFS(client.New(*server), conn).serve(); err != nil {
+		log.Fatalf("FUSE session failed: %v", err)
+	}
+}
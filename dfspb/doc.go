@@ -0,0 +1,7 @@
+// Package dfspb holds the protobuf messages and service bindings of the DFS
+// gRPC API. The messages (*.pb.go) are generated by protoc-gen-go; the
+// service bindings (*_grpc.go) run on grpcwire and are maintained by hand,
+// along with the services of the .proto files.
+package dfspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative dfs.proto node.proto
@@ -0,0 +1,92 @@
+// Service bindings for node.proto on top of grpcwire, in the shape
+// protoc-gen-go-grpc generates for grpc-go.
+//
+// This file is written and maintained by hand, not generated: grpcwire is not
+// grpc-go, so protoc-gen-go-grpc cannot produce it, and go generate only
+// regenerates the messages in node.pb.go. A change to the services of
+// node.proto has to be made here too.
+
+package dfspb
+
+import (
+	"FDS/grpcwire"
+	"context"
+)
+
+const (
+	BlockService_StoreBlock_FullMethodName = "/dfs.v1.BlockService/StoreBlock"
+)
+
+type BlockServiceClient interface {
+	StoreBlock(ctx context.Context) (BlockService_StoreBlockClient, error)
+}
+
+type blockServiceClient struct {
+	cc *grpcwire.ClientConn
+}
+
+func NewBlockServiceClient(cc *grpcwire.ClientConn) BlockServiceClient {
+	return &blockServiceClient{cc: cc}
+}
+
+func (c *blockServiceClient) StoreBlock(ctx context.Context) (BlockService_StoreBlockClient, error) {
+	stream, err := c.cc.NewStream(ctx, BlockService_StoreBlock_FullMethodName)
+	if err != nil {
+		return nil, err
+	}
+	return &blockServiceStoreBlockClient{stream}, nil
+}
+
+type BlockService_StoreBlockClient interface {
+	Send(*StoreBlockRequest) error
+	Recv() (*StoreBlockResponse, error)
+	CloseSend() error
+}
+
+type blockServiceStoreBlockClient struct {
+	*grpcwire.ClientStream
+}
+
+func (x *blockServiceStoreBlockClient) Send(m *StoreBlockRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *blockServiceStoreBlockClient) Recv() (*StoreBlockResponse, error) {
+	m := new(StoreBlockResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type BlockServiceServer interface {
+	StoreBlock(BlockService_StoreBlockServer) error
+}
+
+func RegisterBlockServiceServer(s *grpcwire.Server, srv BlockServiceServer) {
+	s.Handle(BlockService_StoreBlock_FullMethodName, func(stream *grpcwire.ServerStream) error {
+		return srv.StoreBlock(&blockServiceStoreBlockServer{stream})
+	})
+}
+
+type BlockService_StoreBlockServer interface {
+	Send(*StoreBlockResponse) error
+	Recv() (*StoreBlockRequest, error)
+	Context() context.Context
+}
+
+type blockServiceStoreBlockServer struct {
+	*grpcwire.ServerStream
+}
+
+func (x *blockServiceStoreBlockServer) Send(m *StoreBlockResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *blockServiceStoreBlockServer) Recv() (*StoreBlockRequest, error) {
+	m := new(StoreBlockRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,252 @@
+package grpcwire
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientConn issues calls to one server. Calls are multiplexed over a shared
+// HTTP/2 connection.
+type ClientConn struct {
+	target     string
+	httpClient *http.Client
+}
+
+// sharedClient is used by every ClientConn, so dialing the same target
+// repeatedly reuses one HTTP/2 connection.
+var sharedClient = newH2CClient()
+
+func newH2CClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+}
+
+// DialOption configures a ClientConn.
+type DialOption func(*ClientConn)
+
+// WithHTTPClient makes the connection issue its calls through client instead
+// of the package's shared one. The client's transport must speak HTTP/2 to
+// the target and the client must not set a Timeout, since calls are bounded
+// by their context.
+func WithHTTPClient(client *http.Client) DialOption {
+	return func(c *ClientConn) {
+		c.httpClient = client
+	}
+}
+
+// Dial returns a connection to target, given as "host:port" or as an
+// "http://host:port" or "https://host:port" URL. No network activity happens
+// until the first call.
+func Dial(target string, opts ...DialOption) *ClientConn {
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+
+	c := &ClientConn{
+		target:     strings.TrimSuffix(target, "/"),
+		httpClient: sharedClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ClientStream is the client side of a call.
+type ClientStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	pw     *io.PipeWriter
+	done   chan struct{}
+	res    *http.Response
+	err    error
+	status error
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a context whose calls send header as request
+// metadata, on top of the metadata of ctx.
+func WithMetadata(ctx context.Context, header http.Header) context.Context {
+	merged := http.Header{}
+	if parent, ok := ctx.Value(metadataKey{}).(http.Header); ok {
+		for key, values := range parent {
+			merged[key] = values
+		}
+	}
+	for key, values := range header {
+		merged[key] = values
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// NewStream starts a call. The context bounds the whole call and its
+// deadline is propagated to the server.
+func (c *ClientConn) NewStream(ctx context.Context, fullMethod string) (*ClientStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.target+fullMethod, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if metadata, ok := ctx.Value(metadataKey{}).(http.Header); ok {
+		for key, values := range metadata {
+			req.Header[key] = values
+		}
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Te", "trailers")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", formatTimeout(time.Until(deadline)))
+	}
+
+	s := &ClientStream{ctx: ctx, cancel: cancel, pw: pw, done: make(chan struct{})}
+	go func() {
+		s.res, s.err = c.httpClient.Do(req)
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// SendMsg sends a request message. It returns io.EOF when the server has
+// already ended the call; RecvMsg then reports the status.
+func (s *ClientStream) SendMsg(m proto.Message) error {
+	if err := writeFrame(s.pw, m); err != nil {
+		var status *Status
+		if errors.As(err, &status) {
+			return err
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+// CloseSend signals that no more request messages will be sent.
+func (s *ClientStream) CloseSend() error {
+	return s.pw.Close()
+}
+
+// RecvMsg reads the next response message. It returns io.EOF when the call
+// completed successfully and a *Status error otherwise.
+func (s *ClientStream) RecvMsg(m proto.Message) error {
+	if s.status != nil {
+		return s.status
+	}
+
+	err := s.recv(m)
+	if err != nil {
+		s.status = err
+		s.finish()
+	}
+	return err
+}
+
+func (s *ClientStream) recv(m proto.Message) error {
+	select {
+	case <-s.done:
+	case <-s.ctx.Done():
+		return contextStatus(s.ctx.Err())
+	}
+
+	if s.err != nil {
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			return contextStatus(ctxErr)
+		}
+		return Errorf(Unavailable, "%v", s.err)
+	}
+
+	if s.res.StatusCode != http.StatusOK {
+		return Errorf(Unknown, "unexpected HTTP status %d", s.res.StatusCode)
+	}
+
+	// A trailers-only response carries the status in the headers.
+	if status, ok := statusFromHeader(s.res.Header); ok {
+		return status
+	}
+
+	err := readFrame(s.res.Body, m)
+	if errors.Is(err, io.EOF) {
+		if status, ok := statusFromHeader(s.res.Trailer); ok {
+			return status
+		}
+		return Errorf(Internal, "stream ended without a status")
+	}
+	if err != nil {
+		var status *Status
+		if errors.As(err, &status) {
+			return err
+		}
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			return contextStatus(ctxErr)
+		}
+		return Errorf(Unavailable, "%v", err)
+	}
+	return nil
+}
+
+func (s *ClientStream) finish() {
+	s.pw.Close()
+	if s.res != nil {
+		s.res.Body.Close()
+	}
+	s.cancel()
+}
+
+// statusFromHeader returns io.EOF for an OK status, the *Status otherwise,
+// and false when the header carries no status.
+func statusFromHeader(header http.Header) (error, bool) {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		return nil, false
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return Errorf(Internal, "malformed grpc-status %q", value), true
+	}
+	if Code(code) == OK {
+		return io.EOF, true
+	}
+	return &Status{Code: Code(code), Message: decodeMessage(header.Get("Grpc-Message"))}, true
+}
+
+// Invoke performs a unary call.
+func (c *ClientConn) Invoke(ctx context.Context, fullMethod string, req proto.Message, resp proto.Message) error {
+	stream, err := c.NewStream(ctx, fullMethod)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.SendMsg(req); err != nil && !errors.Is(err, io.EOF) {
+		stream.finish()
+		return err
+	}
+	_ = stream.CloseSend()
+
+	if err := stream.RecvMsg(resp); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Errorf(Internal, "server sent no response message")
+		}
+		return err
+	}
+
+	extra := resp.ProtoReflect().New().Interface()
+	if err := stream.RecvMsg(extra); !errors.Is(err, io.EOF) {
+		if err == nil {
+			stream.finish()
+			return Errorf(Internal, "server sent more than one response message")
+		}
+		return err
+	}
+	return nil
+}
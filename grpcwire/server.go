@@ -0,0 +1,192 @@
+package grpcwire
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Handler serves one call. Returning a *Status sets the call status; any
+// other non-nil error is reported as Unknown.
+type Handler func(stream *ServerStream) error
+
+// ServerStream is the server side of a call.
+type ServerStream struct {
+	ctx         context.Context
+	r           *http.Request
+	w           http.ResponseWriter
+	mutex       sync.Mutex
+	wroteHeader bool
+}
+
+func (s *ServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// Header returns the request metadata.
+func (s *ServerStream) Header() http.Header {
+	return s.r.Header
+}
+
+// RecvMsg reads the next request message, returning io.EOF once the client
+// has closed its side of the stream.
+func (s *ServerStream) RecvMsg(m proto.Message) error {
+	if err := s.ctx.Err(); err != nil {
+		return contextStatus(err)
+	}
+	return readFrame(s.r.Body, m)
+}
+
+func (s *ServerStream) SendMsg(m proto.Message) error {
+	if err := s.ctx.Err(); err != nil {
+		return contextStatus(err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.writeHeaderLocked()
+	if err := writeFrame(s.w, m); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (s *ServerStream) writeHeaderLocked() {
+	if !s.wroteHeader {
+		s.w.WriteHeader(http.StatusOK)
+		s.wroteHeader = true
+	}
+}
+
+// Server routes calls to handlers by their full method name, e.g.
+// "/dfs.v1.FileService/Upload".
+type Server struct {
+	handlers map[string]Handler
+}
+
+func NewServer() *Server {
+	return &Server{handlers: make(map[string]Handler)}
+}
+
+func (s *Server) Handle(fullMethod string, handler Handler) {
+	s.handlers[fullMethod] = handler
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), contentType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := r.Context()
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		if timeout, err := parseTimeout(value); err == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	stream := &ServerStream{ctx: ctx, r: r, w: w}
+
+	var err error
+	if handler, ok := s.handlers[r.URL.Path]; ok {
+		err = handler(stream)
+	} else {
+		err = Errorf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil && CodeOf(err) == Unknown {
+		err = contextStatus(ctxErr)
+	}
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.writeHeaderLocked()
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(CodeOf(err))))
+	if err != nil {
+		message := err.Error()
+		var status *Status
+		if errors.As(err, &status) {
+			message = status.Message
+		}
+		w.Header().Set("Grpc-Message", encodeMessage(message))
+	}
+}
+
+// WithFallback returns a handler that serves gRPC calls and passes every
+// other request to fallback, so both can share one listener.
+func (s *Server) WithFallback(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), contentType) {
+			s.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe serves calls over plaintext HTTP/2 on addr.
+func (s *Server) ListenAndServe(addr string) error {
+	return ListenAndServe(addr, s)
+}
+
+// ListenAndServe serves handler, typically a Server wrapped in middleware,
+// over plaintext HTTP/2 on addr.
+func ListenAndServe(addr string, handler http.Handler) error {
+	server := NewHTTPServer(handler)
+	server.Addr = addr
+	return server.ListenAndServe()
+}
+
+// NewHTTPServer returns a server of handler over plaintext HTTP/2, for
+// callers that bring their own listener or shut the server down.
+func NewHTTPServer(handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{Handler: handler, Protocols: &protocols}
+}
+
+func contextStatus(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Errorf(DeadlineExceeded, "deadline exceeded")
+	}
+	return Errorf(Canceled, "call canceled")
+}
+
+// Unary adapts a unary method to a Handler.
+func Unary[Req proto.Message, Resp proto.Message](newReq func() Req, method func(context.Context, Req) (Resp, error)) Handler {
+	return func(stream *ServerStream) error {
+		req := newReq()
+		if err := stream.RecvMsg(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return Errorf(Internal, "missing request message")
+			}
+			return err
+		}
+
+		resp, err := method(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		return stream.SendMsg(resp)
+	}
+}
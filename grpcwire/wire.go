@@ -0,0 +1,104 @@
+// Package grpcwire implements the subset of the gRPC-over-HTTP/2 protocol
+// used by the DFS services (unary and streaming calls, deadlines, status
+// trailers) on top of net/http, so typed protobuf services can be served
+// without the grpc-go runtime. It interoperates with standard gRPC clients
+// using plaintext HTTP/2 with prior knowledge.
+package grpcwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	contentType    = "application/grpc"
+	maxMessageSize = 64 * 1024 * 1024
+)
+
+// writeFrame writes one length-prefixed, uncompressed message.
+func writeFrame(w io.Writer, m proto.Message) error {
+	data, err := proto.Marshal(m)
+	if err != nil {
+		return Errorf(Internal, "failed to marshal message: %v", err)
+	}
+
+	frame := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrame reads one message, returning io.EOF at a clean end of stream.
+func readFrame(r io.Reader, m proto.Message) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return Errorf(Internal, "truncated message prefix")
+		}
+		return err
+	}
+
+	if prefix[0] != 0 {
+		return Errorf(Unimplemented, "compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxMessageSize {
+		return Errorf(ResourceExhausted, "message of %d bytes exceeds the %d bytes limit", length, maxMessageSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Errorf(Internal, "truncated message: %v", err)
+	}
+
+	if err := proto.Unmarshal(data, m); err != nil {
+		return Errorf(Internal, "failed to unmarshal message: %v", err)
+	}
+	return nil
+}
+
+// parseTimeout decodes a grpc-timeout header value such as "250m" or "5S".
+func parseTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit in %q", value)
+	}
+	return time.Duration(amount) * unit, nil
+}
+
+func formatTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "1n"
+	}
+	// The value is limited to 8 digits, so pick the finest unit that fits.
+	for _, u := range []struct {
+		unit  time.Duration
+		label string
+	}{{time.Nanosecond, "n"}, {time.Microsecond, "u"}, {time.Millisecond, "m"}, {time.Second, "S"}, {time.Minute, "M"}} {
+		if v := d / u.unit; v < 1e8 {
+			return strconv.FormatInt(int64(v), 10) + u.label
+		}
+	}
+	return strconv.FormatInt(int64(d/time.Hour), 10) + "H"
+}
@@ -0,0 +1,318 @@
+// Package kvlog is an embedded key-value store kept in a single append-only
+// file, in the manner of Bitcask. Every write appends a record and the index
+// of the live records is kept in memory, so a read is one positioned read of
+// the file. Overwritten and deleted records are reclaimed by compaction,
+// which rewrites the live records to a new file.
+//
+// Each record is a header of three little-endian uint32 (the CRC-32C of the
+// rest of the record, the key length and the value length, all ones for a
+// deletion) followed by the key and the value. A record torn by a crash fails
+// its checksum and is truncated when the file is opened.
+package kvlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	headerSize = 12
+	tombstone  = ^uint32(0)
+
+	// MaxKeySize and MaxValueSize bound what a record can hold.
+	MaxKeySize   = 64 * 1024
+	MaxValueSize = 1 << 30
+
+	// compactMinGarbage is how many bytes of overwritten and deleted records
+	// must pile up before compaction starts on its own; it also has to exceed
+	// the size of the live records.
+	compactMinGarbage = 64 * 1024 * 1024
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrClosed   = errors.New("database closed")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// entry locates the value of a live record.
+type entry struct {
+	offset int64
+	length int
+	record int64
+}
+
+// DB is an open store. It is safe for concurrent use.
+type DB struct {
+	mutex      sync.RWMutex
+	path       string
+	file       *os.File
+	index      map[string]entry
+	size       int64
+	live       int64
+	compacting bool
+	closed     bool
+}
+
+// Open opens the store at path, creating it if needed.
+func Open(path string) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{path: path, file: file, index: make(map[string]entry)}
+	if err := db.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// load rebuilds the index from the records and drops a torn tail.
+func (db *DB) load() error {
+	reader := bufio.NewReaderSize(io.NewSectionReader(db.file, 0, 1<<62), 1<<20)
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		sum := binary.LittleEndian.Uint32(header[0:])
+		keyLength := binary.LittleEndian.Uint32(header[4:])
+		valueLength := binary.LittleEndian.Uint32(header[8:])
+		if keyLength > MaxKeySize || (valueLength != tombstone && valueLength > MaxValueSize) {
+			break
+		}
+
+		bodyLength := int(keyLength)
+		if valueLength != tombstone {
+			bodyLength += int(valueLength)
+		}
+		body := make([]byte, bodyLength)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			break
+		}
+		checksum := crc32.New(castagnoli)
+		checksum.Write(header[4:])
+		checksum.Write(body)
+		if checksum.Sum32() != sum {
+			break
+		}
+
+		key := string(body[:keyLength])
+		recordSize := int64(headerSize + bodyLength)
+		if previous, ok := db.index[key]; ok {
+			db.live -= previous.record
+			delete(db.index, key)
+		}
+		if valueLength != tombstone {
+			db.index[key] = entry{offset: offset + headerSize + int64(keyLength), length: int(valueLength), record: recordSize}
+			db.live += recordSize
+		}
+		offset += recordSize
+	}
+
+	db.size = offset
+	return db.file.Truncate(offset)
+}
+
+func encodeRecord(key string, value []byte, deleted bool) []byte {
+	valueLength := uint32(len(value))
+	if deleted {
+		valueLength = tombstone
+	}
+	record := make([]byte, headerSize+len(key)+len(value))
+	binary.LittleEndian.PutUint32(record[4:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(record[8:], valueLength)
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], value)
+	binary.LittleEndian.PutUint32(record[0:], crc32.Checksum(record[4:], castagnoli))
+	return record
+}
+
+// Get returns a copy of the value of key.
+func (db *DB) Get(key string) ([]byte, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	e, ok := db.index[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	value := make([]byte, e.length)
+	if _, err := db.file.ReadAt(value, e.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Has reports whether key is stored.
+func (db *DB) Has(key string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	_, ok := db.index[key]
+	return ok
+}
+
+// Keys returns the keys of the live records, in no particular order.
+func (db *DB) Keys() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Put stores value under key, replacing the previous value.
+func (db *DB) Put(key string, value []byte) error {
+	if len(key) > MaxKeySize || len(value) > MaxValueSize {
+		return fmt.Errorf("record too large: %d byte key, %d byte value", len(key), len(value))
+	}
+	return db.append(key, value, false)
+}
+
+// Delete removes key. Deleting a missing key returns ErrNotFound.
+func (db *DB) Delete(key string) error {
+	return db.append(key, nil, true)
+}
+
+func (db *DB) append(key string, value []byte, deleted bool) error {
+	record := encodeRecord(key, value, deleted)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	previous, existed := db.index[key]
+	if deleted && !existed {
+		return ErrNotFound
+	}
+	if _, err := db.file.WriteAt(record, db.size); err != nil {
+		// Whatever part of the record made it to the file is overwritten by
+		// the next write, or dropped on the next open.
+		return err
+	}
+
+	if existed {
+		db.live -= previous.record
+		delete(db.index, key)
+	}
+	if !deleted {
+		db.index[key] = entry{offset: db.size + headerSize + int64(len(key)), length: len(value), record: int64(len(record))}
+		db.live += int64(len(record))
+	}
+	db.size += int64(len(record))
+
+	if garbage := db.size - db.live; garbage > compactMinGarbage && garbage > db.live && !db.compacting {
+		db.compacting = true
+		go db.Compact()
+	}
+	return nil
+}
+
+// Sync flushes the file to stable storage.
+func (db *DB) Sync() error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.file.Sync()
+}
+
+// Size returns the size of the file, including the records compaction would
+// reclaim.
+func (db *DB) Size() int64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.size
+}
+
+// Live returns the size of the live records.
+func (db *DB) Live() int64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.live
+}
+
+// Compact rewrites the live records to a new file, which replaces the current
+// one. Reads and writes wait until it is done.
+func (db *DB) Compact() error {
+	db.mutex.Lock()
+	defer func() {
+		db.compacting = false
+		db.mutex.Unlock()
+	}()
+	if db.closed {
+		return ErrClosed
+	}
+
+	tmpPath := db.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	writer := bufio.NewWriterSize(tmp, 1<<20)
+	index := make(map[string]entry, len(db.index))
+	var offset int64
+	for key, e := range db.index {
+		value := make([]byte, e.length)
+		if _, err := db.file.ReadAt(value, e.offset); err != nil {
+			return fail(err)
+		}
+		record := encodeRecord(key, value, false)
+		if _, err := writer.Write(record); err != nil {
+			return fail(err)
+		}
+		index[key] = entry{offset: offset + headerSize + int64(len(key)), length: e.length, record: int64(len(record))}
+		offset += int64(len(record))
+	}
+	if err := writer.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmpPath, db.path); err != nil {
+		return fail(err)
+	}
+
+	db.file.Close()
+	db.file = tmp
+	db.index = index
+	db.size = offset
+	db.live = offset
+	return nil
+}
+
+// Close closes the file.
+func (db *DB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return db.file.Close()
+}
@@ -0,0 +1,122 @@
+// Package logging builds the zap logger shared by the central server and the
+// nodes from the FDS_LOG_* settings: level, JSON or console output, sampling
+// and an optional log file rotated by size.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+type Options struct {
+	Level      string // FDS_LOG_LEVEL: debug, info, warn or error
+	Format     string // FDS_LOG_FORMAT: json or console
+	Sampling   bool   // FDS_LOG_SAMPLING, drops repeated lines under load
+	File       string // FDS_LOG_FILE, stderr if empty
+	MaxSizeMB  int    // FDS_LOG_MAX_SIZE_MB, 0 never rotates the file
+	MaxBackups int    // FDS_LOG_MAX_BACKUPS, rotated files kept, 0 keeps all
+}
+
+func Defaults() Options {
+	return Options{
+		Level:      "info",
+		Format:     FormatJSON,
+		Sampling:   true,
+		MaxSizeMB:  100,
+		MaxBackups: 5,
+	}
+}
+
+// LoadEnv overrides opts with the FDS_LOG_* environment variables that are
+// set, reporting every invalid value.
+func LoadEnv(opts *Options) error {
+	var errs []error
+
+	if value, ok := os.LookupEnv("FDS_LOG_LEVEL"); ok {
+		if _, err := zapcore.ParseLevel(value); err != nil {
+			errs = append(errs, fmt.Errorf("FDS_LOG_LEVEL: invalid level %q", value))
+		} else {
+			opts.Level = value
+		}
+	}
+	if value, ok := os.LookupEnv("FDS_LOG_FORMAT"); ok {
+		if value != FormatJSON && value != FormatConsole {
+			errs = append(errs, fmt.Errorf("FDS_LOG_FORMAT: %q is not one of %s, %s", value, FormatJSON, FormatConsole))
+		} else {
+			opts.Format = value
+		}
+	}
+	if value, ok := os.LookupEnv("FDS_LOG_SAMPLING"); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("FDS_LOG_SAMPLING: invalid boolean %q", value))
+		} else {
+			opts.Sampling = b
+		}
+	}
+	if value, ok := os.LookupEnv("FDS_LOG_FILE"); ok {
+		opts.File = value
+	}
+	intEnv := func(key string, dst *int) {
+		if value, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				errs = append(errs, fmt.Errorf("%s: invalid non-negative integer %q", key, value))
+				return
+			}
+			*dst = n
+		}
+	}
+	intEnv("FDS_LOG_MAX_SIZE_MB", &opts.MaxSizeMB)
+	intEnv("FDS_LOG_MAX_BACKUPS", &opts.MaxBackups)
+
+	return errors.Join(errs...)
+}
+
+// New builds a logger from opts.
+func New(opts Options) (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch opts.Format {
+	case FormatJSON:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case FormatConsole:
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+
+	var output zapcore.WriteSyncer = zapcore.Lock(os.Stderr)
+	if opts.File != "" {
+		file, err := openRotatingFile(opts.File, int64(opts.MaxSizeMB)*1024*1024, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+
+	core := zapcore.NewCore(encoder, output, level)
+	if opts.Sampling {
+		// The same settings as zap.NewProduction.
+		core = zapcore.NewSamplerWithOptions(core, time.Second, 100, 100)
+	}
+
+	return zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel), zap.ErrorOutput(zapcore.Lock(os.Stderr))), nil
+}
@@ -0,0 +1,43 @@
+// Package rollsum implements the weak rolling checksum of rsync. The checksum
+// of a window can be updated in constant time as the window slides one byte,
+// so a client can look for the chunks of a file at every offset of its new
+// version.
+package rollsum
+
+const modulus = 1 << 16
+
+// Rolling is the checksum of a sliding window of bytes.
+type Rolling struct {
+	a, b uint32
+	size uint32
+}
+
+// New returns the checksum of window, which sets the window size.
+func New(window []byte) *Rolling {
+	r := &Rolling{size: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	r.a %= modulus
+	r.b %= modulus
+	return r
+}
+
+// Roll slides the window one byte: out leaves it at the front and in enters it
+// at the back.
+func (r *Rolling) Roll(out, in byte) {
+	// uint32 arithmetic wraps modulo 2^32, a multiple of the modulus, so
+	// neither the subtractions nor the products need guarding.
+	r.a = (r.a - uint32(out) + uint32(in)) % modulus
+	r.b = (r.b - r.size*uint32(out) + r.a) % modulus
+}
+
+func (r *Rolling) Sum() uint32 {
+	return r.b<<16 | r.a
+}
+
+// Sum returns the checksum of data.
+func Sum(data []byte) uint32 {
+	return New(data).Sum()
+}
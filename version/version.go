@@ -0,0 +1,88 @@
+// Package version describes the build of the DFS binaries. Version and
+// Commit can be set at link time:
+//
+//	go build -ldflags "-X FDS/version.Version=1.2.0 -X FDS/version.Commit=$(git rev-parse HEAD)"
+//
+// Without them the commit is taken from the VCS information Go embeds in the
+// binary.
+package version
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+var (
+	Version = "0.1.0"
+	Commit  = ""
+)
+
+// APIVersion is bumped on incompatible changes to the central/node protocol.
+const APIVersion = 1
+
+// MinAPIVersion is the oldest protocol version of a peer this build still
+// works with.
+const MinAPIVersion = 1
+
+type Info struct {
+	Version       string   `json:"version"`
+	Commit        string   `json:"commit"`
+	Modified      bool     `json:"modified,omitempty"`
+	GoVersion     string   `json:"go_version"`
+	APIVersion    int      `json:"api_version"`
+	MinAPIVersion int      `json:"min_api_version,omitempty"`
+	Features      []string `json:"features"`
+}
+
+// Get returns the build information together with the given feature flags.
+func Get(features ...string) Info {
+	info := Info{
+		Version:       strings.TrimPrefix(Version, "v"),
+		Commit:        Commit,
+		GoVersion:     runtime.Version(),
+		APIVersion:    APIVersion,
+		MinAPIVersion: MinAPIVersion,
+		Features:      append([]string{}, features...),
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+
+	return info
+}
+
+// Handler serves the build information as JSON.
+func Handler(features ...string) http.HandlerFunc {
+	info := Get(features...)
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(info)
+	}
+}
+
+// Has reports whether info advertises feature.
+func (i Info) Has(feature string) bool {
+	for _, f := range i.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}